@@ -1,59 +1,19 @@
 package examples
 
 import (
-	"encoding/base64"
-	"encoding/binary"
 	"fmt"
-	"net"
 
 	"github.com/amarnathcjd/gogram/telegram"
+	"github.com/amarnathcjd/gogram/telegram/sessions"
 )
 
-// This function decodes the Telethon Session String to gogram's Session Format
 // Make sure the Schema Layer of Telethon Session matches with telegram.ApiVersion value
-func decodeTelethonSessionString(sessionString string) (*telegram.Session, error) {
-	data, err := base64.URLEncoding.DecodeString(sessionString[1:])
-	if err != nil {
-		return nil, fmt.Errorf("failed to decode base64: %v", err)
-	}
-
-	ipLen := 4
-	if len(data) == 352 {
-		ipLen = 16
-	}
-
-	expectedLen := 1 + ipLen + 2 + 256
-	if len(data) != expectedLen {
-		return nil, fmt.Errorf("invalid session string length")
-	}
-
-	// ">B{}sH256s"
-	offset := 1
-
-	// IP Address (4 or 16 bytes based on IPv4 or IPv6)
-	ipData := data[offset : offset+ipLen]
-	ip := net.IP(ipData)
-	ipAddress := ip.String()
-	offset += ipLen
-
-	// Port (2 bytes, Big Endian)
-	port := binary.BigEndian.Uint16(data[offset : offset+2])
-	offset += 2
-
-	// Auth Key (256 bytes)
-	var authKey [256]byte
-	copy(authKey[:], data[offset:offset+256])
-
-	return &telegram.Session{
-		Hostname: ipAddress + ":" + fmt.Sprint(port),
-		Key:      authKey[:],
-	}, nil
-}
-
 func main() {
 	sessionString := "<TELETHON_STRING_SESSION>"
 
-	sess, err := decodeTelethonSessionString(sessionString)
+	sess, err := sessions.ImportTelethonString(sessionString)
+	// or, for a telethon .session file:
+	// sess, err := sessions.ImportTelethonFile("telethon.session")
 	if err != nil {
 		panic(err)
 	}
@@ -74,4 +34,8 @@ func main() {
 	}
 
 	fmt.Println(client.JSON(me, true))
+
+	// gogram sessions can be exported back to telethon as well
+	telethonString, _ := sessions.ExportTelethonString(client.ExportRawSession())
+	fmt.Println("Telethon StringSession:", telethonString)
 }
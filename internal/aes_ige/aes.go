@@ -110,6 +110,24 @@ func doAES256IGEdecrypt(data, out, key, iv []byte) error {
 	return c.doAES256IGEdecrypt(data, out)
 }
 
+// EncryptIGE encrypts data with AES-256 in IGE mode, data must be a multiple of the block size.
+func EncryptIGE(data, key, iv []byte) ([]byte, error) {
+	out := make([]byte, len(data))
+	if err := doAES256IGEencrypt(data, out, key, iv); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// DecryptIGE decrypts data encrypted with AES-256 in IGE mode.
+func DecryptIGE(data, key, iv []byte) ([]byte, error) {
+	out := make([]byte, len(data))
+	if err := doAES256IGEdecrypt(data, out, key, iv); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // DecryptMessageWithTempKeys decrypts a message using temporary keys obtained during the Diffie-Hellman key exchange.
 func DecryptMessageWithTempKeys(msg []byte, nonceSecond, nonceServer *big.Int) ([]byte, error) {
 	key, iv, errTemp := generateTempKeys(nonceSecond, nonceServer)
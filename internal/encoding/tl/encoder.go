@@ -103,7 +103,7 @@ func (c *Encoder) encodeStruct(v reflect.Value) {
 	}
 
 	var hasFlagsField bool
-	var flag uint32
+	var flag, flag2 uint32
 	var flagIndex int
 	g, ok := v.Interface().(FlagIndexGetter)
 	if ok {
@@ -123,10 +123,23 @@ func (c *Encoder) encodeStruct(v reflect.Value) {
 
 	vtyp := v.Type()
 
+	// positions of the flags fields in tmpObjects, mirroring the decoder: flags2 directly
+	// follows flags when its first field comes before it (or always, for UserFull)
+	flagPos, flag2Pos := -1, -1
+	hasFlags2 := vtyp.Name() == "UserFull"
+	placeFlags := func() {
+		flagPos = len(tmpObjects)
+		tmpObjects = append(tmpObjects, reflect.ValueOf(0))
+		if hasFlags2 && flag2Pos < 0 {
+			flag2Pos = len(tmpObjects)
+			tmpObjects = append(tmpObjects, reflect.ValueOf(0))
+		}
+	}
+
 	for i := 0; i < v.NumField(); i++ {
 		// THIS PART is appending to object meta value, that actually don't writing in real encodeValue
 		if hasFlagsField && flagIndex == i {
-			tmpObjects = append(tmpObjects, reflect.ValueOf(0))
+			placeFlags()
 		}
 
 		info, err := parseTag(vtyp.Field(i).Tag)
@@ -150,10 +163,22 @@ func (c *Encoder) encodeStruct(v reflect.Value) {
 			return
 		}
 
+		if info.version == 2 && flag2Pos < 0 {
+			hasFlags2 = true
+			if flagPos >= 0 {
+				flag2Pos = len(tmpObjects)
+				tmpObjects = append(tmpObjects, reflect.ValueOf(0))
+			}
+		}
+
 		fieldVal := v.Field(i)
 		if !fieldVal.IsZero() {
 			// Tag is there, this is 100% optional field
-			flag |= 1 << info.index
+			if info.version == 2 {
+				flag2 |= 1 << info.index
+			} else {
+				flag |= 1 << info.index
+			}
 			if info.encodedInBitflag {
 				continue
 			}
@@ -163,14 +188,21 @@ func (c *Encoder) encodeStruct(v reflect.Value) {
 			continue
 		}
 	}
+	if hasFlagsField && flagPos < 0 {
+		placeFlags()
+	}
 
 	for i, elem := range tmpObjects {
 		// if you asking, wtf is here: continuing, cause we injected int value (native int, not int32), so we
 		// CAN skip this iter
-		if hasFlagsField && flagIndex == i {
+		if i == flagPos {
 			c.PutUint(flag)
 			continue
 		}
+		if i == flag2Pos {
+			c.PutUint(flag2)
+			continue
+		}
 
 		c.encodeValue(elem)
 		if c.err != nil {
@@ -124,7 +124,14 @@ func SetClientDHParams(m requester, nonce, serverNonce *tl.Int128, encryptedData
 }
 
 // rpc_drop_answer
-// get_future_salts
+
+type GetFutureSaltsParams struct {
+	Num int32
+}
+
+func (*GetFutureSaltsParams) CRC() uint32 {
+	return 0xb921bd04
+}
 
 type PingParams struct {
 	PingID int64
@@ -0,0 +1,219 @@
+// Copyright (c) 2024 RoseLoverX
+
+package session
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"sync"
+
+	"github.com/amarnathcjd/gogram/internal/utils"
+	"github.com/pkg/errors"
+)
+
+// Files encrypted at rest are laid out as
+//
+//	magic | kdf | key id (raw key) or salt + rounds (passphrase) | nonce | AES-256-GCM sealed data
+//
+// with everything before the nonce authenticated as additional data.
+const (
+	encryptedMagic = "GGENC\x01"
+
+	kdfRawKey     byte = 0
+	kdfPassphrase byte = 1
+
+	CipherKeySize     = 32
+	keyIDSize         = 8
+	passphraseSaltLen = 16
+	passphraseRounds  = 600000
+)
+
+var ErrEncryptedFile = errors.New("file is encrypted, but no encryption key is configured")
+
+// Cipher encrypts session and cache files at rest, with a key given directly or derived
+// from a passphrase (PBKDF2-SHA256). Files written with a previous key are still read,
+// and reported as stale so they get rewritten with the current one (key rotation).
+type Cipher struct {
+	current  *cipherKey
+	previous []*cipherKey
+}
+
+type cipherKey struct {
+	raw        []byte
+	passphrase []byte
+
+	mu      sync.Mutex
+	salt    []byte            // salt used for writing, reused to avoid deriving again
+	derived map[string][]byte // derived keys by salt and rounds
+}
+
+// NewKeyCipher creates a cipher with a 32 byte key.
+func NewKeyCipher(key []byte) (*Cipher, error) {
+	if len(key) != CipherKeySize {
+		return nil, errors.Errorf("encryption key must be %d bytes, got %d", CipherKeySize, len(key))
+	}
+	return &Cipher{current: &cipherKey{raw: bytes.Clone(key)}}, nil
+}
+
+// NewPassphraseCipher creates a cipher with a key derived from a passphrase.
+func NewPassphraseCipher(passphrase string) (*Cipher, error) {
+	if passphrase == "" {
+		return nil, errors.New("encryption passphrase is empty")
+	}
+	return &Cipher{current: &cipherKey{passphrase: []byte(passphrase), derived: make(map[string][]byte)}}, nil
+}
+
+// WithPrevious adds the keys of old ciphers as previous keys, only used for decryption.
+func (c *Cipher) WithPrevious(old ...*Cipher) *Cipher {
+	for _, o := range old {
+		if o == nil {
+			continue
+		}
+		c.previous = append(c.previous, o.current)
+		c.previous = append(c.previous, o.previous...)
+	}
+	return c
+}
+
+// IsEncrypted reports whether data was written by Cipher.Encrypt.
+func IsEncrypted(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(encryptedMagic))
+}
+
+// Encrypt seals data with the current key.
+func (c *Cipher) Encrypt(data []byte) ([]byte, error) {
+	k := c.current
+	header := []byte(encryptedMagic)
+
+	var key []byte
+	if k.raw != nil {
+		header = append(header, kdfRawKey)
+		header = append(header, k.id()...)
+		key = k.raw
+	} else {
+		k.mu.Lock()
+		if k.salt == nil {
+			k.salt = utils.RandomBytes(passphraseSaltLen)
+		}
+		salt := k.salt
+		k.mu.Unlock()
+
+		header = append(header, kdfPassphrase)
+		header = append(header, salt...)
+		header = binary.BigEndian.AppendUint32(header, passphraseRounds)
+		key = k.derive(salt, passphraseRounds)
+	}
+
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	out := append(header, nonce...)
+	return aead.Seal(out, nonce, data, header), nil
+}
+
+// Decrypt opens data sealed by Encrypt with the current or a previous key;
+// stale is set when it was not sealed with the current key.
+func (c *Cipher) Decrypt(data []byte) (plain []byte, stale bool, err error) {
+	if !IsEncrypted(data) || len(data) < len(encryptedMagic)+1 {
+		return nil, false, errors.New("not an encrypted file")
+	}
+
+	pos := len(encryptedMagic) + 1
+	var (
+		salt   []byte
+		rounds int
+		keyID  []byte
+	)
+	switch data[pos-1] {
+	case kdfRawKey:
+		if len(data) < pos+keyIDSize {
+			return nil, false, errors.New("truncated encrypted file")
+		}
+		keyID = data[pos : pos+keyIDSize]
+		pos += keyIDSize
+	case kdfPassphrase:
+		if len(data) < pos+passphraseSaltLen+4 {
+			return nil, false, errors.New("truncated encrypted file")
+		}
+		salt = data[pos : pos+passphraseSaltLen]
+		rounds = int(binary.BigEndian.Uint32(data[pos+passphraseSaltLen:]))
+		if rounds <= 0 || rounds > 10*passphraseRounds {
+			return nil, false, errors.New("invalid key derivation rounds of encrypted file")
+		}
+		pos += passphraseSaltLen + 4
+	default:
+		return nil, false, errors.New("unknown key derivation of encrypted file")
+	}
+	header := data[:pos]
+
+	for i, k := range append([]*cipherKey{c.current}, c.previous...) {
+		var key []byte
+		switch {
+		case keyID != nil && k.raw != nil && bytes.Equal(k.id(), keyID):
+			key = k.raw
+		case salt != nil && k.passphrase != nil:
+			key = k.derive(salt, rounds)
+		default:
+			continue
+		}
+
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, false, err
+		}
+		if len(data) < pos+aead.NonceSize() {
+			return nil, false, errors.New("truncated encrypted file")
+		}
+		nonce := data[pos : pos+aead.NonceSize()]
+		plain, err := aead.Open(nil, nonce, data[pos+aead.NonceSize():], header)
+		if err != nil {
+			continue
+		}
+
+		if i == 0 && salt != nil { // keep writing with the same salt
+			k.mu.Lock()
+			if k.salt == nil {
+				k.salt = bytes.Clone(salt)
+			}
+			k.mu.Unlock()
+		}
+		return plain, i != 0, nil
+	}
+	return nil, false, errors.New("decrypting file: wrong key or passphrase, or corrupted file")
+}
+
+func (k *cipherKey) id() []byte {
+	sum := sha256.Sum256(k.raw)
+	return sum[:keyIDSize]
+}
+
+func (k *cipherKey) derive(salt []byte, rounds int) []byte {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	id := string(binary.BigEndian.AppendUint32(bytes.Clone(salt), uint32(rounds)))
+	if key, ok := k.derived[id]; ok {
+		return key
+	}
+	key := utils.PBKDF2(sha256.New, k.passphrase, salt, rounds, CipherKeySize)
+	k.derived[id] = key
+	return key
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
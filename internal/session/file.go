@@ -14,11 +14,13 @@ import (
 
 	aes "github.com/amarnathcjd/gogram/internal/aes_ige"
 	"github.com/amarnathcjd/gogram/internal/encoding/tl"
+	"github.com/amarnathcjd/gogram/internal/utils"
 	"github.com/pkg/errors"
 )
 
 type genericFileSessionLoader struct {
 	path       string
+	cipher     *Cipher
 	lastEdited time.Time
 	cached     *Session
 }
@@ -29,6 +31,13 @@ func NewFromFile(path string) SessionLoader {
 	return &genericFileSessionLoader{path: path}
 }
 
+// NewEncryptedFromFile is like NewFromFile, but the session is encrypted at rest with the cipher.
+// Unencrypted files, and files encrypted with a previous key of the cipher, are rewritten
+// with its current key when loaded.
+func NewEncryptedFromFile(path string, cipher *Cipher) SessionLoader {
+	return &genericFileSessionLoader{path: path, cipher: cipher}
+}
+
 func (l *genericFileSessionLoader) Path() string {
 	return l.path
 }
@@ -48,11 +57,23 @@ func (l *genericFileSessionLoader) Load() (*Session, error) {
 	}
 
 	data, err := os.ReadFile(l.path)
-	data = decodeBytes(data)
 	if err != nil {
 		return nil, errors.Wrap(err, "reading file")
 	}
 
+	var stale bool
+	switch {
+	case IsEncrypted(data) && l.cipher == nil:
+		return nil, ErrEncryptedFile
+	case IsEncrypted(data):
+		if data, stale, err = l.cipher.Decrypt(data); err != nil {
+			return nil, err
+		}
+	default:
+		data = decodeBytes(data)
+		stale = l.cipher != nil // migrate to an encrypted file
+	}
+
 	file := new(tokenStorageFormat)
 	err = json.Unmarshal(data, file)
 	if err != nil {
@@ -64,6 +85,16 @@ func (l *genericFileSessionLoader) Load() (*Session, error) {
 		return nil, err
 	}
 
+	if file.Version < sessionFormatVersion || stale {
+		// migrate older files to the current format and key
+		if err := l.Store(s); err != nil {
+			return nil, errors.Wrap(err, "migrating session file")
+		}
+		if info, err = os.Stat(l.path); err != nil {
+			return nil, err
+		}
+	}
+
 	l.cached = s
 	l.lastEdited = info.ModTime()
 
@@ -81,6 +112,13 @@ func (l *genericFileSessionLoader) Store(s *Session) error {
 	file.writeSession(s)
 	data, _ := json.Marshal(file)
 
+	if l.cipher != nil {
+		encrypted, err := l.cipher.Encrypt(data)
+		if err != nil {
+			return errors.Wrap(err, "encrypting session")
+		}
+		return os.WriteFile(l.path, encrypted, 0600)
+	}
 	return os.WriteFile(l.path, encodeBytes(data), 0600)
 }
 
@@ -88,20 +126,64 @@ func (l *genericFileSessionLoader) Delete() error {
 	return os.Remove(l.path)
 }
 
+// sessionFormatVersion is the version of the on-disk session format written by Store.
+// Version 1 files (without a version field) only hold the home dc key, hash, salt,
+// hostname and app id; they are read as-is and rewritten in the current format.
+const sessionFormatVersion = 2
+
 type tokenStorageFormat struct {
+	Version  int                 `json:"version,omitempty"`
+	Key      string              `json:"key"`
+	Hash     string              `json:"hash"`
+	Salt     string              `json:"salt"`
+	Hostname string              `json:"hostname"`
+	AppID    int32               `json:"app_id"`
+	DC       int                 `json:"dc,omitempty"`
+	UserID   int64               `json:"user_id,omitempty"`
+	Bot      bool                `json:"bot,omitempty"`
+	TestMode bool                `json:"test_mode,omitempty"`
+	IPv6     bool                `json:"ipv6,omitempty"`
+	DCKeys   map[int]*tokenDCKey `json:"dc_keys,omitempty"`
+	CDNKeys  map[int]*tokenDCKey `json:"cdn_keys,omitempty"`
+	Salts    []*tokenSalt        `json:"salts,omitempty"`
+}
+
+type tokenDCKey struct {
 	Key      string `json:"key"`
 	Hash     string `json:"hash"`
 	Salt     string `json:"salt"`
 	Hostname string `json:"hostname"`
-	AppID    int32  `json:"app_id"`
+}
+
+type tokenSalt struct {
+	Salt       string `json:"salt"`
+	ValidSince int32  `json:"valid_since"`
+	ValidUntil int32  `json:"valid_until"`
 }
 
 func (t *tokenStorageFormat) writeSession(s *Session) {
+	t.Version = sessionFormatVersion
 	t.Key = base64.StdEncoding.EncodeToString(s.Key)
 	t.Hash = base64.StdEncoding.EncodeToString(s.Hash)
 	t.Salt = encodeInt64ToBase64(s.Salt)
 	t.Hostname = s.Hostname
 	t.AppID = s.AppID
+	t.DC = s.DC
+	t.UserID = s.UserID
+	t.Bot = s.Bot
+	t.TestMode = s.TestMode
+	t.IPv6 = s.IPv6
+	t.DCKeys = writeDCKeys(s.DCKeys)
+	t.CDNKeys = writeDCKeys(s.CDNKeys)
+
+	t.Salts = nil
+	for _, salt := range s.Salts {
+		t.Salts = append(t.Salts, &tokenSalt{
+			Salt:       encodeInt64ToBase64(salt.Salt),
+			ValidSince: salt.ValidSince,
+			ValidUntil: salt.ValidUntil,
+		})
+	}
 }
 
 func (t *tokenStorageFormat) readSession() (*Session, error) {
@@ -122,9 +204,72 @@ func (t *tokenStorageFormat) readSession() (*Session, error) {
 	}
 	s.Hostname = t.Hostname
 	s.AppID = t.AppID
+	s.DC = t.DC
+	if s.DC == 0 && s.Hostname != "" { // version 1 did not store the dc
+		s.DC = utils.SearchAddr(s.Hostname)
+	}
+	s.UserID = t.UserID
+	s.Bot = t.Bot
+	s.TestMode = t.TestMode
+	s.IPv6 = t.IPv6
+
+	if s.DCKeys, err = readDCKeys(t.DCKeys); err != nil {
+		return nil, err
+	}
+	if s.CDNKeys, err = readDCKeys(t.CDNKeys); err != nil {
+		return nil, err
+	}
+
+	for _, ts := range t.Salts {
+		salt, err := decodeInt64ToBase64(ts.Salt)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid binary data of future 'salt'")
+		}
+		s.Salts = append(s.Salts, &Salt{Salt: salt, ValidSince: ts.ValidSince, ValidUntil: ts.ValidUntil})
+	}
 	return s, nil
 }
 
+func writeDCKeys(keys map[int]*DCKey) map[int]*tokenDCKey {
+	if len(keys) == 0 {
+		return nil
+	}
+
+	out := make(map[int]*tokenDCKey, len(keys))
+	for dc, key := range keys {
+		out[dc] = &tokenDCKey{
+			Key:      base64.StdEncoding.EncodeToString(key.Key),
+			Hash:     base64.StdEncoding.EncodeToString(key.Hash),
+			Salt:     encodeInt64ToBase64(key.Salt),
+			Hostname: key.Hostname,
+		}
+	}
+	return out
+}
+
+func readDCKeys(keys map[int]*tokenDCKey) (map[int]*DCKey, error) {
+	if len(keys) == 0 {
+		return nil, nil
+	}
+
+	out := make(map[int]*DCKey, len(keys))
+	for dc, k := range keys {
+		var err error
+		key := &DCKey{Hostname: k.Hostname}
+		if key.Key, err = base64.StdEncoding.DecodeString(k.Key); err != nil {
+			return nil, errors.Wrapf(err, "invalid binary data of 'key' for dc %d", dc)
+		}
+		if key.Hash, err = base64.StdEncoding.DecodeString(k.Hash); err != nil {
+			return nil, errors.Wrapf(err, "invalid binary data of 'hash' for dc %d", dc)
+		}
+		if key.Salt, err = decodeInt64ToBase64(k.Salt); err != nil {
+			return nil, errors.Wrapf(err, "invalid binary data of 'salt' for dc %d", dc)
+		}
+		out[dc] = key
+	}
+	return out, nil
+}
+
 func encodeInt64ToBase64(i int64) string {
 	buf := make([]byte, tl.LongLen)
 	binary.LittleEndian.PutUint64(buf, uint64(i))
@@ -15,12 +15,76 @@ type SessionLoader interface {
 
 // Session is a basic data of specific session. Typically, session stores default hostname of mtproto server
 // (cause all accounts ties to specific server after sign in), session key, server hash and salt.
+// Besides the home datacenter, it keeps the keys of every other datacenter the account talks to,
+// who the account is and how it connects.
 type Session struct {
 	Key      []byte
 	Hash     []byte
 	Salt     int64
 	Hostname string
 	AppID    int32
+	DC       int            // home datacenter id
+	UserID   int64          // authorized account, 0 before sign in
+	Bot      bool           // whether the account is a bot
+	TestMode bool           // whether the keys belong to the test servers
+	IPv6     bool           // whether the hostnames are IPv6
+	DCKeys   map[int]*DCKey // keys authorized on other datacenters, by dc id
+	CDNKeys  map[int]*DCKey // keys of CDN datacenters, by dc id
+	Salts    []*Salt        // future server salts of the home datacenter
+}
+
+// DCKey is an auth key of a datacenter other than the home one, authorized
+// with auth.importAuthorization; keeping it avoids exporting the authorization again.
+type DCKey struct {
+	Key      []byte
+	Hash     []byte
+	Salt     int64
+	Hostname string
+}
+
+// KeyKind tells which kind of datacenter a DCKey belongs to.
+type KeyKind int
+
+const (
+	KeyRegular KeyKind = iota // regular datacenter, authorized with auth.importAuthorization
+	KeyCDN                    // CDN datacenter, not bound to the account
+)
+
+// Keys returns the keys of the given kind.
+func (s *Session) Keys(kind KeyKind) map[int]*DCKey {
+	switch kind {
+	case KeyCDN:
+		return s.CDNKeys
+	default:
+		return s.DCKeys
+	}
+}
+
+// SetKeys replaces the keys of the given kind.
+func (s *Session) SetKeys(kind KeyKind, keys map[int]*DCKey) {
+	switch kind {
+	case KeyCDN:
+		s.CDNKeys = keys
+	default:
+		s.DCKeys = keys
+	}
+}
+
+// Salt is a server salt along with its validity period, as returned by get_future_salts.
+type Salt struct {
+	Salt       int64
+	ValidSince int32
+	ValidUntil int32
+}
+
+// CurrentSalt returns a saved salt valid at the given unix time, 0 if there is none.
+func (s *Session) CurrentSalt(now int32) int64 {
+	for _, salt := range s.Salts {
+		if salt.ValidSince <= now && now < salt.ValidUntil {
+			return salt.Salt
+		}
+	}
+	return 0
 }
 
 var (
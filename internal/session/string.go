@@ -4,6 +4,7 @@ package session
 
 import (
 	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"strconv"
 	"strings"
@@ -56,7 +57,6 @@ func (s StringSession) AppID() int32 {
 }
 
 func (s *StringSession) Encode() string {
-	stringPrefix := "1BvX"
 	sessionContents := []string{
 		string(s.authKey),
 		string(s.authKeyHash),
@@ -64,11 +64,14 @@ func (s *StringSession) Encode() string {
 		strconv.Itoa(s.dcID),
 		strconv.FormatInt(int64(s.appID), 10),
 	}
-	return stringPrefix + base64.RawURLEncoding.EncodeToString([]byte(strings.Join(sessionContents, "::")))
+	return legacyStringPrefix + base64.RawURLEncoding.EncodeToString([]byte(strings.Join(sessionContents, "::")))
 }
 
 func (s *StringSession) Decode(encoded string) error {
-	decoded, err := base64.RawURLEncoding.DecodeString(encoded[len("1BvX"):])
+	if len(encoded) < len(legacyStringPrefix) {
+		return ErrInvalidSession
+	}
+	decoded, err := base64.RawURLEncoding.DecodeString(encoded[len(legacyStringPrefix):])
 	if err != nil {
 		return err
 	}
@@ -103,3 +106,47 @@ func (s *StringSession) Decode(encoded string) error {
 	}
 	return nil
 }
+
+const (
+	legacyStringPrefix = "1BvX" // key, hash, hostname, dc and app id only
+	stringPrefix       = "2BvX" // the versioned session format, see tokenStorageFormat
+)
+
+// EncodeSession encodes a full session, including the keys of other datacenters, to a string.
+func EncodeSession(s *Session) string {
+	file := new(tokenStorageFormat)
+	file.writeSession(s)
+	data, _ := json.Marshal(file)
+	return stringPrefix + base64.RawURLEncoding.EncodeToString(data)
+}
+
+// DecodeSession decodes a string session, either produced by EncodeSession or in the older StringSession format.
+func DecodeSession(encoded string) (*Session, error) {
+	switch {
+	case strings.HasPrefix(encoded, stringPrefix):
+		data, err := base64.RawURLEncoding.DecodeString(encoded[len(stringPrefix):])
+		if err != nil {
+			return nil, err
+		}
+
+		file := new(tokenStorageFormat)
+		if err := json.Unmarshal(data, file); err != nil {
+			return nil, ErrInvalidSession
+		}
+		return file.readSession()
+	case strings.HasPrefix(encoded, legacyStringPrefix):
+		legacy := NewEmptyStringSession()
+		if err := legacy.Decode(encoded); err != nil {
+			return nil, err
+		}
+
+		return &Session{
+			Key:      legacy.AuthKey(),
+			Hash:     legacy.AuthKeyHash(),
+			Hostname: legacy.IpAddr(),
+			AppID:    legacy.AppID(),
+			DC:       legacy.DcID(),
+		}, nil
+	}
+	return nil, ErrInvalidSession
+}
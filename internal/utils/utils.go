@@ -3,9 +3,12 @@
 package utils
 
 import (
+	"crypto/hmac"
 	cr "crypto/rand"
 	"crypto/sha1"
+	"encoding/binary"
 	"fmt"
+	"hash"
 	"math/rand"
 	"os"
 	"runtime"
@@ -235,6 +238,29 @@ func Sha1(input string) []byte {
 	return r[:]
 }
 
+// PBKDF2 derives a key of keyLen bytes from a password (RFC 8018).
+func PBKDF2(h func() hash.Hash, password, salt []byte, rounds, keyLen int) []byte {
+	prf := hmac.New(h, password)
+	out := make([]byte, 0, keyLen)
+
+	for block := uint32(1); len(out) < keyLen; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		prf.Write(binary.BigEndian.AppendUint32(nil, block))
+		u := prf.Sum(nil)
+
+		t := append([]byte(nil), u...)
+		for i := 1; i < rounds; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			Xor(t, u)
+		}
+		out = append(out, t...)
+	}
+	return out[:keyLen]
+}
+
 func RandomBytes(size int) []byte {
 	b := make([]byte, size)
 	_, _ = cr.Read(b)
@@ -33,6 +33,9 @@ import (
 const (
 	defaultTimeout = 60 * time.Second // after 60 sec without any read/write, lib will try to reconnect
 	acksThreshold  = 10
+
+	futureSaltsCount  = 32   // salts asked for at once, each valid for about an hour
+	futureSaltsMargin = 3600 // seconds of saved salts left before asking for more
 )
 
 type MTProto struct {
@@ -52,6 +55,15 @@ type MTProto struct {
 
 	authKeyHash []byte
 
+	dcKeys   map[session.KeyKind]map[int]*session.DCKey // auth keys of other datacenters
+	dcKeysMu sync.RWMutex
+
+	userID      int64
+	bot         bool
+	testMode    bool
+	futureSalts []*session.Salt // replaced, never changed in place; guarded by saltsMu
+	saltsMu     sync.Mutex
+
 	noRedirect bool
 
 	serverSalt int64
@@ -91,6 +103,7 @@ type Config struct {
 	StringSession  string
 	SessionStorage session.SessionLoader
 	MemorySession  bool
+	Encryption     *session.Cipher // encrypts the session file at rest
 	AppID          int32
 
 	FloodHandler func(err error) bool
@@ -103,6 +116,7 @@ type Config struct {
 	Proxy      *url.URL
 	Mode       string
 	Ipv6       bool
+	TestMode   bool
 	CustomHost bool
 }
 
@@ -110,6 +124,8 @@ func NewMTProto(c Config) (*MTProto, error) {
 	if c.SessionStorage == nil {
 		if c.MemorySession {
 			c.SessionStorage = session.NewInMemory()
+		} else if c.Encryption != nil {
+			c.SessionStorage = session.NewEncryptedFromFile(c.AuthKeyFile, c.Encryption)
 		} else {
 			c.SessionStorage = session.NewFromFile(c.AuthKeyFile)
 		}
@@ -150,6 +166,7 @@ func NewMTProto(c Config) (*MTProto, error) {
 		errorHandler:          func(err error) {},
 		mode:                  parseTransportMode(c.Mode),
 		IpV6:                  c.Ipv6,
+		testMode:              c.TestMode,
 	}
 
 	mtproto.Logger.Debug("initializing mtproto...")
@@ -191,7 +208,7 @@ func parseTransportMode(sMode string) mode.Variant {
 }
 
 func (m *MTProto) LoadSession(sess *session.Session) error {
-	m.authKey, m.authKeyHash, m.Addr, m.appID = sess.Key, sess.Hash, sess.Hostname, sess.AppID
+	m._loadSession(sess)
 	m.Logger.Debug("importing auth from session...")
 	if err := m.SaveSession(m.memorySession); err != nil {
 		return errors.Wrap(err, "saving session")
@@ -212,17 +229,126 @@ func (m *MTProto) loadAuth(stringSession string, sess *session.Session) error {
 }
 
 func (m *MTProto) ExportAuth() (*session.Session, int) {
-	return &session.Session{
+	return m.currentSession(), m.GetDC()
+}
+
+// currentSession returns everything that is persisted in the session storage.
+func (m *MTProto) currentSession() *session.Session {
+	sess := &session.Session{
 		Key:      m.authKey,
 		Hash:     m.authKeyHash,
 		Salt:     m.serverSalt,
 		Hostname: m.Addr,
-		AppID:    m.AppID(),
-	}, m.GetDC()
+		AppID:    m.appID,
+		DC:       m.GetDC(),
+		UserID:   m.userID,
+		Bot:      m.bot,
+		TestMode: m.testMode,
+		IPv6:     m.IpV6,
+		Salts:    m.FutureSalts(),
+	}
+
+	m.dcKeysMu.RLock()
+	for kind, keys := range m.dcKeys {
+		if len(keys) == 0 {
+			continue
+		}
+		copied := make(map[int]*session.DCKey, len(keys))
+		for dc, key := range keys {
+			copied[dc] = key
+		}
+		sess.SetKeys(kind, copied)
+	}
+	m.dcKeysMu.RUnlock()
+
+	return sess
+}
+
+// DCKey returns the stored auth key of the given datacenter, of a regular datacenter unless kind is given.
+func (m *MTProto) DCKey(dcID int, kind ...session.KeyKind) (*session.DCKey, bool) {
+	m.dcKeysMu.RLock()
+	defer m.dcKeysMu.RUnlock()
+	key, ok := m.dcKeys[getKeyKind(kind)][dcID]
+	return key, ok
+}
+
+// resetDCKeys replaces the stored datacenter keys, which belong to the previous authorization.
+func (m *MTProto) resetDCKeys(sess *session.Session) {
+	m.dcKeysMu.Lock()
+	defer m.dcKeysMu.Unlock()
+
+	m.dcKeys = make(map[session.KeyKind]map[int]*session.DCKey)
+	if sess == nil {
+		return
+	}
+	for _, kind := range []session.KeyKind{session.KeyRegular, session.KeyCDN} {
+		if keys := sess.Keys(kind); len(keys) > 0 {
+			m.dcKeys[kind] = keys
+		}
+	}
+}
+
+// StoreDCKey keeps an auth key of the given datacenter, saving it with the session;
+// a nil key forgets the stored one.
+func (m *MTProto) StoreDCKey(dcID int, key *session.DCKey, kind ...session.KeyKind) error {
+	k := getKeyKind(kind)
+
+	m.dcKeysMu.Lock()
+	if m.dcKeys == nil {
+		m.dcKeys = make(map[session.KeyKind]map[int]*session.DCKey)
+	}
+	if key == nil {
+		delete(m.dcKeys[k], dcID)
+	} else {
+		if m.dcKeys[k] == nil {
+			m.dcKeys[k] = make(map[int]*session.DCKey)
+		}
+		m.dcKeys[k][dcID] = key
+	}
+	m.dcKeysMu.Unlock()
+
+	return m.SaveSession(m.memorySession)
+}
+
+func getKeyKind(kind []session.KeyKind) session.KeyKind {
+	if len(kind) > 0 {
+		return kind[0]
+	}
+	return session.KeyRegular
+}
+
+// SetUser records the authorized account in the session.
+func (m *MTProto) SetUser(userID int64, bot bool) {
+	if m.userID == userID && m.bot == bot {
+		return
+	}
+
+	m.userID, m.bot = userID, bot
+	if err := m.SaveSession(m.memorySession); err != nil {
+		m.Logger.Debug(errors.Wrap(err, "saving session"))
+	}
+}
+
+// UserID returns the id of the authorized account, as recorded in the session.
+func (m *MTProto) UserID() int64 {
+	return m.userID
+}
+
+// IsBot reports whether the authorized account is a bot, as recorded in the session.
+func (m *MTProto) IsBot() bool {
+	return m.bot
+}
+
+// TestMode reports whether the session belongs to the test servers.
+func (m *MTProto) TestMode() bool {
+	return m.testMode
 }
 
 func (m *MTProto) ImportRawAuth(authKey, authKeyHash []byte, addr string, appID int32) (bool, error) {
 	m.authKey, m.authKeyHash, m.Addr, m.appID = authKey, authKeyHash, addr, appID
+	m.userID, m.bot = 0, false
+	m.setFutureSalts(nil)
+	m.resetDCKeys(nil)
 	m.Logger.Debug("imported authKey, authKeyHash, addr, appId")
 	if err := m.SaveSession(m.memorySession); err != nil {
 		return false, errors.Wrap(err, "saving session")
@@ -234,13 +360,14 @@ func (m *MTProto) ImportRawAuth(authKey, authKeyHash []byte, addr string, appID
 }
 
 func (m *MTProto) ImportAuth(stringSession string) (bool, error) {
-	sessionString := session.NewEmptyStringSession()
-	if err := sessionString.Decode(stringSession); err != nil {
+	sess, err := session.DecodeSession(stringSession)
+	if err != nil {
 		return false, err
 	}
-	m.authKey, m.authKeyHash, m.Addr = sessionString.AuthKey(), sessionString.AuthKeyHash(), sessionString.IpAddr()
-	if m.appID == 0 {
-		m.appID = sessionString.AppID()
+	appID := m.appID
+	m._loadSession(sess)
+	if appID != 0 {
+		m.appID = appID
 	}
 	m.Logger.Debug("importing - auth from stringSession...")
 	if err := m.SaveSession(m.memorySession); err != nil {
@@ -336,6 +463,11 @@ func (m *MTProto) ExportNewSender(dcID int, mem bool, cdn ...bool) (*MTProto, er
 		cfg.StringSession = session.NewStringSession(
 			m.authKey, m.authKeyHash, dcID, newAddr, m.appID,
 		).Encode()
+	} else if key, ok := m.DCKey(dcID, exportedKeyKind(cdn)); ok {
+		// reuse the key already created for this dc
+		cfg.StringSession = session.NewStringSession(
+			key.Key, key.Hash, dcID, newAddr, m.appID,
+		).Encode()
 	}
 
 	sender, err := NewMTProto(cfg)
@@ -356,6 +488,13 @@ func (m *MTProto) ExportNewSender(dcID int, mem bool, cdn ...bool) (*MTProto, er
 	return sender, nil
 }
 
+func exportedKeyKind(cdn []bool) session.KeyKind {
+	if len(cdn) > 0 && cdn[0] {
+		return session.KeyCDN
+	}
+	return session.KeyRegular
+}
+
 func (m *MTProto) CreateConnection(withLog bool) error {
 	m.stopRoutines()
 
@@ -576,10 +715,40 @@ func (m *MTProto) longPing(ctx context.Context) {
 
 			time.Sleep(30 * time.Second)
 			m.Ping()
+			m.refreshFutureSalts()
 		}
 	}
 }
 
+// FutureSalts returns the saved future server salts of the home datacenter.
+func (m *MTProto) FutureSalts() []*session.Salt {
+	m.saltsMu.Lock()
+	defer m.saltsMu.Unlock()
+	return append([]*session.Salt(nil), m.futureSalts...)
+}
+
+func (m *MTProto) setFutureSalts(salts []*session.Salt) {
+	m.saltsMu.Lock()
+	m.futureSalts = append([]*session.Salt(nil), salts...)
+	m.saltsMu.Unlock()
+}
+
+// refreshFutureSalts asks for future server salts when the saved ones run out within the
+// hour, so that a restored session starts with a valid salt; the answer is saved by
+// processResponse.
+func (m *MTProto) refreshFutureSalts() {
+	var until int32
+	for _, salt := range m.FutureSalts() {
+		until = max(until, salt.ValidUntil)
+	}
+	if int64(until) > time.Now().Unix()+futureSaltsMargin {
+		return
+	}
+	if err := m.InvokeRequestWithoutUpdate(&objects.GetFutureSaltsParams{Num: futureSaltsCount}); err != nil {
+		m.Logger.Debug(errors.Wrap(err, "requesting future salts"))
+	}
+}
+
 func (m *MTProto) Ping() time.Duration {
 	start := time.Now()
 	m.InvokeRequestWithoutUpdate(&utils.PingParams{
@@ -764,6 +933,19 @@ messageTypeSwitching:
 			}
 		}
 
+	case *objects.FutureSalts:
+		salts := make([]*session.Salt, 0, len(message.Salts))
+		for _, salt := range message.Salts {
+			salts = append(salts, &session.Salt{Salt: salt.Salt, ValidSince: salt.ValidSince, ValidUntil: salt.ValidUntil})
+		}
+		m.setFutureSalts(salts)
+		if err := m.SaveSession(m.memorySession); err != nil {
+			m.Logger.Error(errors.Wrap(err, "saving session"))
+		}
+		if err := m.writeRPCResponse(int(message.ReqMsgID), message); err != nil {
+			m.Logger.Debug(errors.Wrap(err, "writing future salts response"))
+		}
+
 	case *objects.NewSessionCreated:
 		m.serverSalt = message.ServerSalt
 		if err := m.SaveSession(m.memorySession); err != nil {
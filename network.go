@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"path/filepath"
 	"reflect"
+	"time"
 
 	"github.com/amarnathcjd/gogram/internal/encoding/tl"
 	"github.com/amarnathcjd/gogram/internal/mtproto/messages"
@@ -178,17 +179,9 @@ func (m *MTProto) AddCustomServerRequestHandler(handler func(i any) bool) {
 }
 
 func (m *MTProto) SaveSession(mem bool) (err error) {
-	sess := &session.Session{
-		Key:      m.authKey,
-		Hash:     m.authKeyHash,
-		Salt:     m.serverSalt,
-		Hostname: m.Addr,
-		AppID:    m.appID,
-	}
-
 	if !mem {
 		m.Logger.Debug("saving session to `", filepath.Base(m.sessionStorage.Path()), "`")
-		return m.sessionStorage.Store(sess)
+		return m.sessionStorage.Store(m.currentSession())
 	}
 
 	return nil
@@ -204,6 +197,15 @@ func (m *MTProto) _loadSession(s *session.Session) {
 	m.serverSalt = s.Salt
 	m.Addr = s.Hostname
 	m.appID = s.AppID
+	m.userID = s.UserID
+	m.bot = s.Bot
+	m.testMode = m.testMode || s.TestMode
+	m.IpV6 = m.IpV6 || s.IPv6
+	m.setFutureSalts(s.Salts)
+	if salt := s.CurrentSalt(int32(time.Now().Unix())); salt != 0 {
+		m.serverSalt = salt
+	}
+	m.resetDCKeys(s)
 }
 
 func (m *MTProto) reqPQ(nonce *tl.Int128) (*objects.ResPQ, error) {
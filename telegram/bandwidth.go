@@ -0,0 +1,79 @@
+// Copyright (c) 2024 RoseLoverX
+
+package telegram
+
+import (
+	"sync"
+	"time"
+)
+
+// BandwidthLimiter caps the transfer rate of file operations, in bytes per second.
+// It is safe for concurrent use by many workers, and its rate can be changed at runtime.
+type BandwidthLimiter struct {
+	mu   sync.Mutex
+	rate int64     // bytes per second, 0 means unlimited
+	next time.Time // when the next transfer may start
+}
+
+// NewBandwidthLimiter creates a limiter allowing bytesPerSec; 0 disables the limit.
+func NewBandwidthLimiter(bytesPerSec int64) *BandwidthLimiter {
+	return &BandwidthLimiter{rate: bytesPerSec}
+}
+
+// SetRate changes the limit, taking effect for the next transfer; 0 disables the limit.
+func (l *BandwidthLimiter) SetRate(bytesPerSec int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rate = bytesPerSec
+	if bytesPerSec <= 0 {
+		l.next = time.Time{}
+	}
+}
+
+// Rate returns the current limit in bytes per second.
+func (l *BandwidthLimiter) Rate() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rate
+}
+
+// Wait blocks until n bytes may be transferred without exceeding the rate.
+func (l *BandwidthLimiter) Wait(n int) {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	if l.rate <= 0 {
+		l.mu.Unlock()
+		return
+	}
+
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	wait := l.next.Sub(now)
+	l.next = l.next.Add(time.Duration(float64(n) / float64(l.rate) * float64(time.Second)))
+	l.mu.Unlock()
+
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+// SetBandwidthLimit sets the client-wide transfer cap for uploads and downloads, in bytes per second.
+func (c *Client) SetBandwidthLimit(bytesPerSec int64) {
+	c.bandwidth.SetRate(bytesPerSec)
+}
+
+// BandwidthLimit returns the client-wide transfer cap, 0 if unlimited.
+func (c *Client) BandwidthLimit() int64 {
+	return c.bandwidth.Rate()
+}
+
+// throttle waits for both the client-wide and the per-call limiter to allow n bytes.
+func (c *Client) throttle(limiter *BandwidthLimiter, n int) {
+	c.bandwidth.Wait(n)
+	limiter.Wait(n)
+}
@@ -3,11 +3,9 @@
 package telegram
 
 import (
-	"encoding/gob"
 	"encoding/json"
 
 	"fmt"
-	"os"
 	"strconv"
 	"strings"
 	"sync"
@@ -19,15 +17,18 @@ import (
 
 type CACHE struct {
 	*sync.RWMutex
-	fileName    string
-	chats       map[int64]*ChatObj
-	users       map[int64]*UserObj
-	channels    map[int64]*Channel
-	usernameMap map[string]int64
-	memory      bool
-	disabled    bool
-	InputPeers  *InputPeerCache `json:"input_peers,omitempty"`
-	logger      *utils.Logger
+	fileName string
+	store    CacheStore
+	// Deprecated: a snapshot of the access hashes in the store, taken when the cache is
+	// loaded, imported or written; changes to it are not stored. Use Store().InputPeers().
+	InputPeers *InputPeerCache `json:"input_peers,omitempty"`
+	// messages min peers were seen in, by peer
+	minContexts map[peerKey]minPeerContext
+	// when the recovery of a peer last failed, see RecoverPeer
+	recoverFailures map[peerKey]time.Time
+	memory          bool
+	disabled        bool
+	logger          *utils.Logger
 
 	wipeScheduled atomic.Bool
 }
@@ -42,41 +43,55 @@ func (c *CACHE) SetWriteFile(write bool) *CACHE {
 	return c
 }
 
+// Store returns the storage backend of the cache.
+func (c *CACHE) Store() CacheStore {
+	return c.store
+}
+
 func (c *CACHE) Clear() {
 	c.Lock()
 	defer c.Unlock()
 
-	c.chats = make(map[int64]*ChatObj)
-	c.users = make(map[int64]*UserObj)
-	c.channels = make(map[int64]*Channel)
-	c.usernameMap = make(map[string]int64)
-	c.InputPeers = &InputPeerCache{
-		InputChannels: make(map[int64]int64),
-		InputUsers:    make(map[int64]int64),
+	if err := c.store.Clear(); err != nil {
+		c.logger.Error("error clearing cache: ", err)
 	}
+	c.InputPeers = c.store.InputPeers()
+	c.minContexts = make(map[peerKey]minPeerContext)
 }
 
 func (c *CACHE) ExportJSON() ([]byte, error) {
-	c.RLock()
-	defer c.RUnlock()
-
-	return json.Marshal(c.InputPeers)
+	return json.Marshal(c.store.InputPeers())
 }
 
 func (c *CACHE) ImportJSON(data []byte) error {
+	peers := new(InputPeerCache)
+	if err := json.Unmarshal(data, peers); err != nil {
+		return err
+	}
+
 	c.Lock()
 	defer c.Unlock()
 
-	return json.Unmarshal(data, c.InputPeers)
+	if err := c.store.PutInputUsers(peers.InputUsers); err != nil {
+		return err
+	}
+	if err := c.store.PutInputChannels(peers.InputChannels); err != nil {
+		return err
+	}
+	c.InputPeers = c.store.InputPeers()
+	return nil
 }
 
 type CacheConfig struct {
-	MaxSize    int // Max size of cache: TODO
+	MaxSize    int           // Max number of cached users, channels and chats, least recently used are evicted (0: unbounded)
+	TTL        time.Duration // Age after which cached users, channels and chats are fetched again (0: never)
 	LogLevel   utils.LogLevel
 	LogNoColor bool
 	LogName    string
 	Memory     bool
 	Disabled   bool
+	Encryption *StorageEncryption // Encrypt the cache file at rest
+	Store      CacheStore         // Storage backend (default: the cache file, or memory if Memory is set, both bounded by MaxSize and TTL)
 }
 
 func NewCache(fileName string, opts ...*CacheConfig) *CACHE {
@@ -87,30 +102,29 @@ func NewCache(fileName string, opts ...*CacheConfig) *CACHE {
 	c := &CACHE{
 		RWMutex:     &sync.RWMutex{},
 		fileName:    fileName,
-		chats:       make(map[int64]*ChatObj),
-		users:       make(map[int64]*UserObj),
-		channels:    make(map[int64]*Channel),
-		usernameMap: make(map[string]int64),
-		InputPeers: &InputPeerCache{
-			InputChannels: make(map[int64]int64),
-			InputUsers:    make(map[int64]int64),
-		},
-		memory:   opt.Memory,
-		disabled: opt.Disabled,
+		store:       opt.Store,
+		minContexts: make(map[peerKey]minPeerContext),
+		memory:      opt.Memory,
+		disabled:    opt.Disabled,
 		logger: utils.NewLogger("gogram " + getLogPrefix("cache", opt.LogName)).
 			SetLevel(opt.LogLevel).
 			NoColor(opt.LogNoColor),
 	}
 
-	if !opt.Memory && !opt.Disabled {
-		c.logger.Debug("initialized cache (" + c.fileName + ") successfully")
-	}
-
-	if !opt.Disabled {
-		if _, err := os.Stat(c.fileName); err == nil && !c.memory {
-			c.ReadFile()
+	if c.store == nil {
+		if opt.Memory || opt.Disabled {
+			c.store = NewMemoryCacheStore().SetLimits(opt.MaxSize, opt.TTL)
+		} else if store, err := NewFileCacheStore(fileName, opt.Encryption); err != nil {
+			c.logger.Error("error opening cache file: ", err, ", not writing the cache file")
+			c.store = NewMemoryCacheStore().SetLimits(opt.MaxSize, opt.TTL)
+			c.memory = true
+		} else {
+			store.SetLimits(opt.MaxSize, opt.TTL)
+			c.store = store
+			c.logger.Debug("initialized cache (" + c.fileName + ") successfully")
 		}
 	}
+	c.InputPeers = c.store.InputPeers()
 
 	return c
 }
@@ -121,81 +135,90 @@ func (c *CACHE) Disable() *CACHE {
 }
 
 // --------- Cache file Functions ---------
+
+// WriteFile persists pending changes of the cache store.
 func (c *CACHE) WriteFile() {
 	if c.disabled || c.memory {
 		return
 	}
-	file, err := os.OpenFile(c.fileName, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
-	if err != nil {
-		c.logger.Error("error opening cache file: ", err)
-		return
+	if err := c.store.Flush(); err != nil {
+		c.logger.Error("error writing cache: ", err)
 	}
-	defer file.Close()
-	enc := gob.NewEncoder(file)
+	c.refreshInputPeers()
+}
+
+// refreshInputPeers takes a new snapshot of the access hashes for the deprecated InputPeers.
+func (c *CACHE) refreshInputPeers() {
+	peers := c.store.InputPeers()
 	c.Lock()
-	defer c.Unlock()
-	if err := enc.Encode(c.InputPeers); err != nil {
-		c.logger.Error("error encoding cache file: ", err)
-	}
+	c.InputPeers = peers
+	c.Unlock()
 }
 
+// ReadFile reloads the cache file, for the default file store.
 func (c *CACHE) ReadFile() {
-	file, err := os.Open(c.fileName)
-	if err != nil && !os.IsNotExist(err) {
-		c.logger.Error("error opening cache file: ", err)
+	store, ok := c.store.(*FileCacheStore)
+	if !ok {
 		return
 	}
-
-	if os.IsNotExist(err) {
+	if err := store.Load(); err != nil {
+		c.logger.Error("error reading cache file: ", err)
 		return
 	}
 
-	defer file.Close()
-	dec := gob.NewDecoder(file)
-	c.Lock()
-	dec.Decode(&c.InputPeers)
-	c.Unlock()
+	c.refreshInputPeers()
+	peers := c.InputPeers
+	c.logger.Debug(fmt.Sprintf("loaded %d users, %d channels from cache", len(peers.InputUsers), len(peers.InputChannels)))
+}
 
-	if !c.memory {
-		c.logger.Debug(fmt.Sprintf("loaded %d users, %d channels from cache", len(c.InputPeers.InputUsers), len(c.InputPeers.InputChannels)))
-	}
+// Close flushes and closes the cache store.
+func (c *CACHE) Close() error {
+	c.WriteFile()
+	return c.store.Close()
 }
 
 func (c *CACHE) getUserPeer(userID int64) (InputUser, error) {
-	c.RLock()
-	defer c.RUnlock()
-
-	if userHash, ok := c.InputPeers.InputUsers[userID]; ok {
+	if userHash, ok := c.store.GetInputUser(userID); ok {
 		return &InputUserObj{UserID: userID, AccessHash: userHash}, nil
 	}
+	if peer, ok := c.inputPeerFromMessage(peerKey{cachedUser, userID}); ok {
+		peer := peer.(*InputPeerUserFromMessage)
+		return &InputUserFromMessage{Peer: peer.Peer, MsgID: peer.MsgID, UserID: userID}, nil
+	}
 
 	return nil, fmt.Errorf("no user with id '%d' or missing from cache", userID)
 }
 
 func (c *CACHE) getChannelPeer(channelID int64) (InputChannel, error) {
-	c.RLock()
-	defer c.RUnlock()
-
-	if channelHash, ok := c.InputPeers.InputChannels[channelID]; ok {
+	if channelHash, ok := c.store.GetInputChannel(channelID); ok {
 		return &InputChannelObj{ChannelID: channelID, AccessHash: channelHash}, nil
 	}
+	if peer, ok := c.inputPeerFromMessage(peerKey{cachedChannel, channelID}); ok {
+		peer := peer.(*InputPeerChannelFromMessage)
+		return &InputChannelFromMessage{Peer: peer.Peer, MsgID: peer.MsgID, ChannelID: channelID}, nil
+	}
 
 	return nil, fmt.Errorf("no channel with id '%d' or missing from cache", channelID)
 }
 
 func (c *Client) GetInputPeer(peerID int64) (InputPeer, error) {
 	if strings.HasPrefix(strconv.Itoa(int(peerID)), "-100") {
-		c.Cache.Lock()
-		if channelHash, ok := c.Cache.InputPeers.InputChannels[trimSuffixHundred(peerID)]; ok {
-			c.Cache.Unlock()
+		if channelHash, ok := c.Cache.store.GetInputChannel(trimSuffixHundred(peerID)); ok {
 			return &InputPeerChannel{trimSuffixHundred(peerID), channelHash}, nil
 		}
-		c.Cache.Unlock()
+
+		if peer, ok := c.Cache.inputPeerFromMessage(peerKey{cachedChannel, trimSuffixHundred(peerID)}); ok {
+			return peer, nil
+		}
 
 		if channel, err := c.getChannelFromCache(trimSuffixHundred(peerID)); err == nil {
 			return &InputPeerChannel{trimSuffixHundred(peerID), channel.AccessHash}, nil
 		}
 
+		if peer, err := c.RecoverPeer(peerID); err == nil {
+			return peer, nil
+		}
+
 		return nil, fmt.Errorf("there is no channel with id '%d' or missing from cache", peerID)
 	} else if peerID < 0 {
 		if _, err := c.getChatFromCache(peerID * -1); err == nil {
@@ -205,18 +228,19 @@ func (c *Client) GetInputPeer(peerID int64) (InputPeer, error) {
 		return nil, fmt.Errorf("there is no chat with id '%d' or missing from cache", peerID)
 	}
 
-	c.Cache.RLock()
-	if userHash, ok := c.Cache.InputPeers.InputUsers[peerID]; ok {
-		c.Cache.RUnlock()
+	if userHash, ok := c.Cache.store.GetInputUser(peerID); ok {
 		return &InputPeerUser{peerID, userHash}, nil
 	}
-	c.Cache.RUnlock()
+
+	if peer, ok := c.Cache.inputPeerFromMessage(peerKey{cachedUser, peerID}); ok {
+		return peer, nil
+	}
 
 	if user, err := c.getUserFromCache(peerID); err == nil {
 		return &InputPeerUser{peerID, user.AccessHash}, nil
 	}
 
-	if channelHash, ok := c.Cache.InputPeers.InputChannels[peerID]; ok {
+	if channelHash, ok := c.Cache.store.GetInputChannel(peerID); ok {
 		return &InputPeerChannel{peerID, channelHash}, nil
 	}
 
@@ -224,20 +248,26 @@ func (c *Client) GetInputPeer(peerID int64) (InputPeer, error) {
 		return &InputPeerChat{chat.ID}, nil
 	}
 
+	if peer, err := c.RecoverPeer(peerID); err == nil {
+		return peer, nil
+	}
+
 	return nil, fmt.Errorf("there is no peer with id '%d' or missing from cache", peerID)
 }
 
 // ------------------ Get Chat/Channel/User From Cache/Telgram ------------------
 
 func (c *Client) getUserFromCache(userID int64) (*UserObj, error) {
-	c.Cache.RLock()
-	if user, found := c.Cache.users[userID]; found {
-		c.Cache.RUnlock()
+	if user, found := c.Cache.store.GetUser(userID); found {
 		return user, nil
 	}
-	c.Cache.RUnlock()
 
 	userPeer, err := c.Cache.getUserPeer(userID)
+	if err != nil {
+		if hash, ok := c.newPeerRecovery().recoverAccessHash(peerKey{cachedUser, userID}, 0); ok {
+			userPeer, err = &InputUserObj{UserID: userID, AccessHash: hash}, nil
+		}
+	}
 
 	// if user is not in cache and if the bot is participant in the user, try with access hash = 0
 	var inputPeerUser InputUser = &InputUserObj{UserID: userID, AccessHash: 0}
@@ -264,14 +294,16 @@ func (c *Client) getUserFromCache(userID int64) (*UserObj, error) {
 }
 
 func (c *Client) getChannelFromCache(channelID int64) (*Channel, error) {
-	c.Cache.RLock()
-	if channel, found := c.Cache.channels[channelID]; found {
-		c.Cache.RUnlock()
+	if channel, found := c.Cache.store.GetChannel(channelID); found {
 		return channel, nil
 	}
-	c.Cache.RUnlock()
 
 	channelPeer, err := c.Cache.getChannelPeer(channelID)
+	if err != nil {
+		if hash, ok := c.newPeerRecovery().recoverAccessHash(peerKey{cachedChannel, channelID}, 0); ok {
+			channelPeer, err = &InputChannelObj{ChannelID: channelID, AccessHash: hash}, nil
+		}
+	}
 
 	// if channel is not in cache and if the bot is participant in the channel, try with access hash = 0
 	var inputChannel InputChannel = &InputChannelObj{ChannelID: channelID, AccessHash: 0}
@@ -303,12 +335,9 @@ func (c *Client) getChannelFromCache(channelID int64) (*Channel, error) {
 }
 
 func (c *Client) getChatFromCache(chatID int64) (*ChatObj, error) {
-	c.Cache.RLock()
-	if chat, found := c.Cache.chats[chatID]; found {
-		c.Cache.RUnlock()
+	if chat, found := c.Cache.store.GetChat(chatID); found {
 		return chat, nil
 	}
-	c.Cache.RUnlock()
 
 	chat, err := c.MessagesGetChats([]int64{chatID})
 	if err != nil {
@@ -335,6 +364,7 @@ func (c *Client) getChatFromCache(chatID int64) (*ChatObj, error) {
 
 // ----------------- Get User/Channel/Chat from cache -----------------
 
+// GetUser returns a user from the cache, fetching it when missing or stale (see CacheConfig.TTL).
 func (c *Client) GetUser(userID int64) (*UserObj, error) {
 	user, err := c.getUserFromCache(userID)
 	if err != nil {
@@ -343,6 +373,7 @@ func (c *Client) GetUser(userID int64) (*UserObj, error) {
 	return user, nil
 }
 
+// GetChannel returns a channel from the cache, fetching it when missing or stale (see CacheConfig.TTL).
 func (c *Client) GetChannel(channelID int64) (*Channel, error) {
 	channel, err := c.getChannelFromCache(channelID)
 	if err != nil {
@@ -374,38 +405,121 @@ func (c *Client) GetPeer(peerID int64) (any, error) {
 
 // ----------------- Update User/Channel/Chat in cache -----------------
 
+// cacheBatch collects the changes of a batch of peers, written to the store at once.
+type cacheBatch struct {
+	users         map[int64]*UserObj
+	channels      map[int64]*Channel
+	chats         map[int64]*ChatObj
+	inputUsers    map[int64]int64
+	inputChannels map[int64]int64
+	usernames     map[string]int64
+}
+
+func newCacheBatch() *cacheBatch {
+	return &cacheBatch{
+		users:         make(map[int64]*UserObj),
+		channels:      make(map[int64]*Channel),
+		chats:         make(map[int64]*ChatObj),
+		inputUsers:    make(map[int64]int64),
+		inputChannels: make(map[int64]int64),
+		usernames:     make(map[string]int64),
+	}
+}
+
+func (c *CACHE) batchUser(b *cacheBatch, id int64) (*UserObj, bool) {
+	if user, ok := b.users[id]; ok {
+		return user, true
+	}
+	return c.store.GetUser(id)
+}
+
+func (c *CACHE) batchChannel(b *cacheBatch, id int64) (*Channel, bool) {
+	if channel, ok := b.channels[id]; ok {
+		return channel, true
+	}
+	return c.store.GetChannel(id)
+}
+
+func (c *CACHE) batchInputUser(b *cacheBatch, id int64) (int64, bool) {
+	if hash, ok := b.inputUsers[id]; ok {
+		return hash, true
+	}
+	return c.store.GetInputUser(id)
+}
+
+func (c *CACHE) batchInputChannel(b *cacheBatch, id int64) (int64, bool) {
+	if hash, ok := b.inputChannels[id]; ok {
+		return hash, true
+	}
+	return c.store.GetInputChannel(id)
+}
+
+// commit writes a batch to the store, the cache lock must be held.
+func (c *CACHE) commit(b *cacheBatch) {
+	users := make([]*UserObj, 0, len(b.users))
+	for _, user := range b.users {
+		users = append(users, user)
+	}
+	channels := make([]*Channel, 0, len(b.channels))
+	for _, channel := range b.channels {
+		channels = append(channels, channel)
+	}
+	chats := make([]*ChatObj, 0, len(b.chats))
+	for _, chat := range b.chats {
+		chats = append(chats, chat)
+	}
+
+	for _, err := range []error{
+		c.store.PutUsers(users...),
+		c.store.PutChannels(channels...),
+		c.store.PutChats(chats...),
+		c.store.PutInputUsers(b.inputUsers),
+		c.store.PutInputChannels(b.inputChannels),
+		c.store.PutUsernames(b.usernames),
+	} {
+		if err != nil {
+			c.logger.Error("error updating cache: ", err)
+		}
+	}
+}
+
 func (c *CACHE) UpdateUser(user *UserObj) bool {
 	c.Lock()
 	defer c.Unlock()
 
+	b := newCacheBatch()
+	updated := c.updateUser(b, user)
+	c.commit(b)
+	return updated
+}
+
+func (c *CACHE) updateUser(b *cacheBatch, user *UserObj) bool {
 	if user.Username != "" {
-		c.usernameMap[user.Username] = user.ID
+		b.usernames[user.Username] = user.ID
 	}
-	if _, ok := c.users[user.ID]; !ok {
-		c.users[user.ID] = user
+	cached, ok := c.batchUser(b, user.ID)
+	if !ok {
+		b.users[user.ID] = user
+		cached = user
 	}
 
 	if user.Min {
-		if userFromCache, ok := c.users[user.ID]; ok {
-			if userFromCache.Min {
-				c.users[user.ID] = user
-			}
-			return false
+		if cached.Min {
+			b.users[user.ID] = user
 		}
-		c.users[user.ID] = user
 		return false
 	}
 
-	if currAccessHash, ok := c.InputPeers.InputUsers[user.ID]; ok {
+	if currAccessHash, ok := c.batchInputUser(b, user.ID); ok {
 		if currAccessHash != user.AccessHash {
-			c.InputPeers.InputUsers[user.ID] = user.AccessHash
-			c.users[user.ID] = user
+			b.inputUsers[user.ID] = user.AccessHash
+			b.users[user.ID] = user
 			return true
 		}
 		return false
 	}
 
-	c.InputPeers.InputUsers[user.ID] = user.AccessHash
+	b.inputUsers[user.ID] = user.AccessHash
 	return true
 }
 
@@ -413,44 +527,54 @@ func (c *CACHE) UpdateChannel(channel *Channel) bool {
 	c.Lock()
 	defer c.Unlock()
 
+	b := newCacheBatch()
+	updated := c.updateChannel(b, channel)
+	c.commit(b)
+	return updated
+}
+
+func (c *CACHE) updateChannel(b *cacheBatch, channel *Channel) bool {
 	if channel.Username != "" {
-		c.usernameMap[channel.Username] = channel.ID
+		b.usernames[channel.Username] = channel.ID
 	}
 
-	if _, ok := c.channels[channel.ID]; !ok {
-		c.channels[channel.ID] = channel
+	activeCh, ok := c.batchChannel(b, channel.ID)
+	if !ok {
+		b.channels[channel.ID] = channel
+		activeCh = channel
 	}
-	if currAccessHash, ok := c.InputPeers.InputChannels[channel.ID]; ok {
-		if activeCh, ok := c.channels[channel.ID]; ok {
-			if activeCh.Min {
-				c.InputPeers.InputChannels[channel.ID] = channel.AccessHash
-				c.channels[channel.ID] = channel
-				return true
-			}
 
-			if !activeCh.Min && channel.Min {
-				return false
-			}
+	if currAccessHash, ok := c.batchInputChannel(b, channel.ID); ok {
+		if activeCh.Min {
+			b.inputChannels[channel.ID] = channel.AccessHash
+			b.channels[channel.ID] = channel
+			return true
+		}
+
+		if !activeCh.Min && channel.Min {
+			return false
 		}
 
 		if currAccessHash != channel.AccessHash && !channel.Min {
-			c.InputPeers.InputChannels[channel.ID] = channel.AccessHash
-			c.channels[channel.ID] = channel
+			b.inputChannels[channel.ID] = channel.AccessHash
+			b.channels[channel.ID] = channel
 			return true
 		}
 
 		return false
 	}
 
-	c.InputPeers.InputChannels[channel.ID] = channel.AccessHash
+	b.inputChannels[channel.ID] = channel.AccessHash
 	return true
 }
 
 func (c *CACHE) UpdateChat(chat *ChatObj) bool {
 	c.Lock()
 	defer c.Unlock()
-	c.chats[chat.ID] = chat
 
+	if err := c.store.PutChats(chat); err != nil {
+		c.logger.Error("error updating cache: ", err)
+	}
 	return true
 }
 
@@ -467,10 +591,12 @@ func (cache *CACHE) UpdatePeersToCache(users []User, chats []Chat) {
 
 	totalUpdates := [2]int{0, 0}
 
+	cache.Lock()
+	b := newCacheBatch()
 	for _, user := range users {
 		switch us := user.(type) {
 		case *UserObj:
-			if updated := cache.UpdateUser(us); updated {
+			if updated := cache.updateUser(b, us); updated {
 				totalUpdates[0]++
 			}
 		case *UserEmpty:
@@ -480,81 +606,76 @@ func (cache *CACHE) UpdatePeersToCache(users []User, chats []Chat) {
 	for _, chat := range chats {
 		switch ch := chat.(type) {
 		case *ChatObj:
-			if updated := cache.UpdateChat(ch); updated {
-				totalUpdates[1]++
-			}
+			b.chats[ch.ID] = ch
+			totalUpdates[1]++
 		case *Channel:
-			if updated := cache.UpdateChannel(ch); updated {
+			if updated := cache.updateChannel(b, ch); updated {
 				totalUpdates[1]++
 			}
 		case *ChatForbidden:
-			cache.Lock()
-			if _, ok := cache.chats[ch.ID]; !ok {
-				cache.chats[ch.ID] = &ChatObj{
-					ID: ch.ID,
+			if _, ok := b.chats[ch.ID]; !ok {
+				if _, ok := cache.store.GetChat(ch.ID); !ok {
+					b.chats[ch.ID] = &ChatObj{
+						ID: ch.ID,
+					}
 				}
 			}
-			cache.Unlock()
 		case *ChannelForbidden:
-			cache.Lock()
-			if _, ok := cache.InputPeers.InputChannels[ch.ID]; !ok {
-				cache.channels[ch.ID] = &Channel{
+			if _, ok := cache.batchInputChannel(b, ch.ID); !ok {
+				b.channels[ch.ID] = &Channel{
 					ID:         ch.ID,
 					Broadcast:  ch.Broadcast,
 					Megagroup:  ch.Megagroup,
 					AccessHash: ch.AccessHash,
 					Title:      ch.Title,
 				}
-				cache.InputPeers.InputChannels[ch.ID] = ch.AccessHash
+				b.inputChannels[ch.ID] = ch.AccessHash
 			}
-			cache.Unlock()
 		case *ChatEmpty:
 		}
 	}
+	cache.commit(b)
+	cache.Unlock()
 
 	if totalUpdates[0] > 0 || totalUpdates[1] > 0 {
 		if !cache.memory && !cache.disabled {
 			go cache.WriteFile() // write to file asynchronously
 		}
 		cache.logger.Debug(
-			fmt.Sprintf("updated %d users %d chats and %d channels in cache (u: %d, c: %d ut: %d, ct: %d, cc: %d)",
-				totalUpdates[0], totalUpdates[1], totalUpdates[1], len(users), len(chats),
-				len(cache.InputPeers.InputUsers), len(cache.chats), len(cache.InputPeers.InputChannels),
+			fmt.Sprintf("updated %d users and %d chats in cache (u: %d, c: %d)",
+				totalUpdates[0], totalUpdates[1], len(users), len(chats),
 			),
 		)
 	}
 }
 
 func (c *Client) GetPeerUser(userID int64) (*InputPeerUser, error) {
-	c.Cache.RLock()
-	defer c.Cache.RUnlock()
-
-	if peer, ok := c.Cache.InputPeers.InputUsers[userID]; ok {
+	if peer, ok := c.Cache.store.GetInputUser(userID); ok {
 		return &InputPeerUser{UserID: userID, AccessHash: peer}, nil
 	}
+	if hash, ok := c.newPeerRecovery().recoverAccessHash(peerKey{cachedUser, userID}, 0); ok {
+		return &InputPeerUser{UserID: userID, AccessHash: hash}, nil
+	}
 	return nil, fmt.Errorf("no user with id '%d' or missing from cache", userID)
 }
 
 func (c *Client) GetPeerChannel(channelID int64) (*InputPeerChannel, error) {
-	c.Cache.RLock()
-	defer c.Cache.RUnlock()
-
 	channelID = trimSuffixHundred(channelID)
 
-	if peer, ok := c.Cache.InputPeers.InputChannels[channelID]; ok {
+	if peer, ok := c.Cache.store.GetInputChannel(channelID); ok {
 		return &InputPeerChannel{ChannelID: channelID, AccessHash: peer}, nil
 	}
+	if hash, ok := c.newPeerRecovery().recoverAccessHash(peerKey{cachedChannel, channelID}, 0); ok {
+		return &InputPeerChannel{ChannelID: channelID, AccessHash: hash}, nil
+	}
 	return nil, fmt.Errorf("no channel with id '%d' or missing from cache", channelID)
 }
 
 func (c *Client) IdInCache(id int64) bool {
-	c.Cache.RLock()
-	defer c.Cache.RUnlock()
-
-	if _, ok := c.Cache.InputPeers.InputUsers[id]; ok {
+	if _, ok := c.Cache.store.GetInputUser(id); ok {
 		return true
 	}
-	if _, ok := c.Cache.InputPeers.InputChannels[id]; ok {
+	if _, ok := c.Cache.store.GetInputChannel(id); ok {
 		return true
 	}
 
@@ -0,0 +1,989 @@
+// Copyright (c) 2024 RoseLoverX
+
+package telegram
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/amarnathcjd/gogram/internal/encoding/tl"
+	"github.com/amarnathcjd/gogram/internal/session"
+	"github.com/pkg/errors"
+)
+
+// CacheStore is the storage backend of the peer cache. Implementations must be safe for
+// concurrent use; the batch Put methods let backends persist many changes at once.
+type CacheStore interface {
+	GetUser(id int64) (*UserObj, bool)
+	GetChannel(id int64) (*Channel, bool)
+	GetChat(id int64) (*ChatObj, bool)
+	PutUsers(users ...*UserObj) error
+	PutChannels(channels ...*Channel) error
+	PutChats(chats ...*ChatObj) error
+
+	// access hashes of users and channels, by id
+	GetInputUser(id int64) (int64, bool)
+	GetInputChannel(id int64) (int64, bool)
+	PutInputUsers(hashes map[int64]int64) error
+	PutInputChannels(hashes map[int64]int64) error
+	InputPeers() *InputPeerCache // snapshot of every access hash
+
+	GetUsername(username string) (int64, bool)
+	PutUsernames(usernames map[string]int64) error
+
+	GetMedia(key string) (*CachedMedia, bool)
+	PutMedia(key string, media *CachedMedia) error
+	DeleteMedia(keys ...string) error
+	RangeMedia(fn func(key string, media *CachedMedia) bool)
+
+	Flush() error // persist pending changes
+	Clear() error
+	Close() error
+}
+
+// ------------------ Memory Store ------------------
+
+// MemoryCacheStore keeps the cache in maps, nothing is persisted. Full peer objects can be
+// bounded in number (least recently used are evicted) and age, see SetLimits; access hashes,
+// usernames and media are kept separately and never evicted.
+type MemoryCacheStore struct {
+	mu            sync.RWMutex
+	maxSize       int
+	ttl           time.Duration
+	peers         map[peerKey]*list.Element
+	lru           *list.List // of *cachedPeer, most recently used first
+	inputUsers    map[int64]int64
+	inputChannels map[int64]int64
+	usernames     map[string]int64
+	media         map[string]*CachedMedia
+}
+
+var _ CacheStore = (*MemoryCacheStore)(nil)
+
+const (
+	cachedUser byte = iota
+	cachedChannel
+	cachedChat
+)
+
+type peerKey struct {
+	kind byte
+	id   int64
+}
+
+type cachedPeer struct {
+	key   peerKey
+	value any
+	added time.Time
+}
+
+func NewMemoryCacheStore() *MemoryCacheStore {
+	s := &MemoryCacheStore{}
+	s.reset()
+	return s
+}
+
+// SetLimits bounds the number of cached users, channels and chats to maxSize, and treats
+// entries older than ttl as missing, so they are fetched again; zero means no limit.
+func (s *MemoryCacheStore) SetLimits(maxSize int, ttl time.Duration) *MemoryCacheStore {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.maxSize, s.ttl = maxSize, ttl
+	s.evict()
+	return s
+}
+
+func (s *MemoryCacheStore) reset() {
+	s.peers = make(map[peerKey]*list.Element)
+	s.lru = list.New()
+	s.inputUsers = make(map[int64]int64)
+	s.inputChannels = make(map[int64]int64)
+	s.usernames = make(map[string]int64)
+	s.media = make(map[string]*CachedMedia)
+}
+
+func (s *MemoryCacheStore) get(key peerKey) (any, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	elem, ok := s.peers[key]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*cachedPeer)
+	if s.ttl > 0 && time.Since(entry.added) > s.ttl {
+		return nil, false // stale, replaced by the next put
+	}
+	s.lru.MoveToFront(elem)
+	return entry.value, true
+}
+
+// put stores a peer object, the lock must be held.
+func (s *MemoryCacheStore) put(key peerKey, value any) {
+	if elem, ok := s.peers[key]; ok {
+		entry := elem.Value.(*cachedPeer)
+		entry.value, entry.added = value, time.Now()
+		s.lru.MoveToFront(elem)
+		return
+	}
+	s.peers[key] = s.lru.PushFront(&cachedPeer{key: key, value: value, added: time.Now()})
+	s.evict()
+}
+
+func (s *MemoryCacheStore) evict() {
+	for s.maxSize > 0 && s.lru.Len() > s.maxSize {
+		oldest := s.lru.Back()
+		s.lru.Remove(oldest)
+		delete(s.peers, oldest.Value.(*cachedPeer).key)
+	}
+}
+
+func (s *MemoryCacheStore) GetUser(id int64) (*UserObj, bool) {
+	if user, ok := s.get(peerKey{cachedUser, id}); ok {
+		return user.(*UserObj), true
+	}
+	return nil, false
+}
+
+func (s *MemoryCacheStore) GetChannel(id int64) (*Channel, bool) {
+	if channel, ok := s.get(peerKey{cachedChannel, id}); ok {
+		return channel.(*Channel), true
+	}
+	return nil, false
+}
+
+func (s *MemoryCacheStore) GetChat(id int64) (*ChatObj, bool) {
+	if chat, ok := s.get(peerKey{cachedChat, id}); ok {
+		return chat.(*ChatObj), true
+	}
+	return nil, false
+}
+
+func (s *MemoryCacheStore) PutUsers(users ...*UserObj) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, user := range users {
+		s.put(peerKey{cachedUser, user.ID}, user)
+	}
+	return nil
+}
+
+func (s *MemoryCacheStore) PutChannels(channels ...*Channel) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, channel := range channels {
+		s.put(peerKey{cachedChannel, channel.ID}, channel)
+	}
+	return nil
+}
+
+func (s *MemoryCacheStore) PutChats(chats ...*ChatObj) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, chat := range chats {
+		s.put(peerKey{cachedChat, chat.ID}, chat)
+	}
+	return nil
+}
+
+func (s *MemoryCacheStore) GetInputUser(id int64) (int64, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	hash, ok := s.inputUsers[id]
+	return hash, ok
+}
+
+func (s *MemoryCacheStore) GetInputChannel(id int64) (int64, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	hash, ok := s.inputChannels[id]
+	return hash, ok
+}
+
+func (s *MemoryCacheStore) PutInputUsers(hashes map[int64]int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, hash := range hashes {
+		s.inputUsers[id] = hash
+	}
+	return nil
+}
+
+func (s *MemoryCacheStore) PutInputChannels(hashes map[int64]int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, hash := range hashes {
+		s.inputChannels[id] = hash
+	}
+	return nil
+}
+
+func (s *MemoryCacheStore) InputPeers() *InputPeerCache {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	peers := &InputPeerCache{
+		InputUsers:    make(map[int64]int64, len(s.inputUsers)),
+		InputChannels: make(map[int64]int64, len(s.inputChannels)),
+	}
+	for id, hash := range s.inputUsers {
+		peers.InputUsers[id] = hash
+	}
+	for id, hash := range s.inputChannels {
+		peers.InputChannels[id] = hash
+	}
+	return peers
+}
+
+func (s *MemoryCacheStore) GetUsername(username string) (int64, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	id, ok := s.usernames[username]
+	return id, ok
+}
+
+func (s *MemoryCacheStore) PutUsernames(usernames map[string]int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for username, id := range usernames {
+		s.usernames[username] = id
+	}
+	return nil
+}
+
+func (s *MemoryCacheStore) GetMedia(key string) (*CachedMedia, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	media, ok := s.media[key]
+	return media, ok
+}
+
+func (s *MemoryCacheStore) PutMedia(key string, media *CachedMedia) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.media[key] = media
+	return nil
+}
+
+func (s *MemoryCacheStore) DeleteMedia(keys ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, key := range keys {
+		delete(s.media, key)
+	}
+	return nil
+}
+
+func (s *MemoryCacheStore) RangeMedia(fn func(key string, media *CachedMedia) bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for key, media := range s.media {
+		if !fn(key, media) {
+			return
+		}
+	}
+}
+
+func (s *MemoryCacheStore) Flush() error { return nil }
+
+func (s *MemoryCacheStore) Clear() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reset()
+	return nil
+}
+
+func (s *MemoryCacheStore) Close() error { return nil }
+
+// ------------------ File Store ------------------
+
+// FileCacheStore keeps the cache in memory and writes the access hashes and cached media
+// to a single file on Flush, rewriting it as a whole; this is the classic cache file format.
+type FileCacheStore struct {
+	*MemoryCacheStore
+	path    string
+	cipher  *session.Cipher
+	writeMu sync.Mutex
+}
+
+var _ CacheStore = (*FileCacheStore)(nil)
+
+// NewFileCacheStore opens the cache file at path, optionally encrypted at rest.
+func NewFileCacheStore(path string, encryption ...*StorageEncryption) (*FileCacheStore, error) {
+	cipher, err := getVariadic(encryption, nil).getCipher()
+	if err != nil {
+		return nil, errors.Wrap(err, "cache encryption")
+	}
+
+	s := &FileCacheStore{MemoryCacheStore: NewMemoryCacheStore(), path: path, cipher: cipher}
+	if err := s.Load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Load reads the cache file, files written unencrypted or with a previous key are rewritten.
+func (s *FileCacheStore) Load() error {
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return errors.Wrap(err, "reading cache file")
+	}
+
+	data, stale, err := decryptStored(data, s.cipher)
+	if err != nil {
+		return errors.Wrap(err, "reading cache file")
+	}
+
+	var peers *InputPeerCache
+	media := make(map[string]*CachedMedia)
+	dec := gob.NewDecoder(bytes.NewReader(data))
+	dec.Decode(&peers)
+	dec.Decode(&media) // absent in cache files written by older versions
+
+	s.mu.Lock()
+	if peers != nil {
+		for id, hash := range peers.InputUsers {
+			s.inputUsers[id] = hash
+		}
+		for id, hash := range peers.InputChannels {
+			s.inputChannels[id] = hash
+		}
+	}
+	for key, m := range media {
+		s.media[key] = m
+	}
+	s.mu.Unlock()
+
+	if stale {
+		return s.Flush()
+	}
+	return nil
+}
+
+func (s *FileCacheStore) Flush() error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	var buf bytes.Buffer
+	enc := gob.NewEncoder(&buf)
+	s.mu.RLock()
+	peers := &InputPeerCache{InputUsers: s.inputUsers, InputChannels: s.inputChannels}
+	err := enc.Encode(peers)
+	if err == nil {
+		// uploaded media is appended after the peers, older readers simply stop before it
+		err = enc.Encode(s.media)
+	}
+	s.mu.RUnlock()
+	if err != nil {
+		return errors.Wrap(err, "encoding cache file")
+	}
+
+	data := buf.Bytes()
+	if s.cipher != nil {
+		if data, err = s.cipher.Encrypt(data); err != nil {
+			return errors.Wrap(err, "encrypting cache file")
+		}
+	}
+	return os.WriteFile(s.path, data, 0600)
+}
+
+func (s *FileCacheStore) Clear() error {
+	s.MemoryCacheStore.Clear()
+	return s.Flush()
+}
+
+// decryptStored opens data written with the cipher; unencrypted data is returned as-is,
+// stale if it should be rewritten with the current key.
+func decryptStored(data []byte, cipher *session.Cipher) ([]byte, bool, error) {
+	switch {
+	case session.IsEncrypted(data) && cipher == nil:
+		return nil, false, session.ErrEncryptedFile
+	case session.IsEncrypted(data):
+		return cipher.Decrypt(data)
+	default:
+		return data, cipher != nil, nil
+	}
+}
+
+// ------------------ Log Store ------------------
+
+const (
+	logStoreMagic = "GGLOG\x01"
+
+	// compaction is considered once the log is larger than this, with more dead than live records
+	logStoreCompactSize = 4 << 20
+)
+
+// log record kinds
+const (
+	logPutUser byte = iota + 1
+	logPutChannel
+	logPutChat
+	logPutInputUser
+	logPutInputChannel
+	logPutUsername
+	logPutMedia
+	logDeleteMedia
+)
+
+// LogCacheStore is an append-only, log-structured cache file: every change is appended
+// as a record instead of rewriting the file. Only access hashes, usernames and media are
+// kept in memory, users, channels and chats are indexed by their offset and read from disk
+// on demand. The log is compacted on Flush once most of it is overwritten records.
+type LogCacheStore struct {
+	mu     sync.RWMutex
+	file   *os.File
+	path   string
+	cipher *session.Cipher
+	size   int64 // end of the last complete record
+	dead   int64 // bytes of overwritten records
+
+	objects       map[byte]map[int64]logRecordRef
+	inputUsers    map[int64]int64
+	inputChannels map[int64]int64
+	usernames     map[string]int64
+	media         map[string]*CachedMedia
+}
+
+type logRecordRef struct {
+	offset int64
+	size   int
+}
+
+var _ CacheStore = (*LogCacheStore)(nil)
+
+// NewLogCacheStore opens or creates the log at path, optionally encrypting every record at rest.
+func NewLogCacheStore(path string, encryption ...*StorageEncryption) (*LogCacheStore, error) {
+	cipher, err := getVariadic(encryption, nil).getCipher()
+	if err != nil {
+		return nil, errors.Wrap(err, "cache encryption")
+	}
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, errors.Wrap(err, "opening cache log")
+	}
+
+	s := &LogCacheStore{file: file, path: path, cipher: cipher}
+	s.reset()
+	if err := s.load(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *LogCacheStore) reset() {
+	s.objects = map[byte]map[int64]logRecordRef{
+		logPutUser:    make(map[int64]logRecordRef),
+		logPutChannel: make(map[int64]logRecordRef),
+		logPutChat:    make(map[int64]logRecordRef),
+	}
+	s.inputUsers = make(map[int64]int64)
+	s.inputChannels = make(map[int64]int64)
+	s.usernames = make(map[string]int64)
+	s.media = make(map[string]*CachedMedia)
+	s.size, s.dead = 0, 0
+}
+
+// load replays the log into the index, dropping a partially written last record; records
+// that can't be applied, like those of a newer version, are skipped.
+func (s *LogCacheStore) load() error {
+	info, err := s.file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() == 0 {
+		return s.writeHeader()
+	}
+
+	r := bufio.NewReader(io.NewSectionReader(s.file, 0, info.Size()))
+	magic := make([]byte, len(logStoreMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != logStoreMagic {
+		return errors.New("not a cache log: " + s.path)
+	}
+
+	offset := int64(len(logStoreMagic))
+	var stale bool
+	for {
+		size, err := binary.ReadUvarint(r)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break // the end, or a torn length prefix
+		} else if err != nil {
+			return errors.Wrap(err, "reading cache log")
+		}
+		head := int64(uvarintLen(size))
+		if size > uint64(info.Size()-offset-head) {
+			break // a torn record
+		}
+		body := make([]byte, size)
+		if _, err := io.ReadFull(r, body); err != nil {
+			break
+		}
+
+		plain, recStale, err := decryptStored(body, s.cipher)
+		if err != nil {
+			return errors.Wrap(err, "reading cache log")
+		}
+		stale = stale || recStale
+
+		if err := s.apply(plain, logRecordRef{offset: offset + head, size: int(size)}); err != nil {
+			s.dead += head + int64(size) // complete but not understood, skipped
+		}
+		offset += head + int64(size)
+	}
+
+	s.size = offset
+	if offset < info.Size() {
+		if err := s.file.Truncate(offset); err != nil {
+			return errors.Wrap(err, "truncating cache log")
+		}
+	}
+	if stale { // rewrite with the current key, or encrypt a plain log
+		return s.compact()
+	}
+	return nil
+}
+
+func (s *LogCacheStore) writeHeader() error {
+	if _, err := s.file.WriteAt([]byte(logStoreMagic), 0); err != nil {
+		return err
+	}
+	s.size = int64(len(logStoreMagic))
+	return nil
+}
+
+// apply indexes a record: kind, key length, key, value.
+func (s *LogCacheStore) apply(record []byte, ref logRecordRef) error {
+	kind, key, value, err := parseLogRecord(record)
+	if err != nil {
+		return err
+	}
+
+	switch kind {
+	case logPutUser, logPutChannel, logPutChat:
+		id := int64(binary.BigEndian.Uint64(key))
+		if old, ok := s.objects[kind][id]; ok {
+			s.dead += int64(old.size)
+		}
+		s.objects[kind][id] = ref
+	case logPutInputUser:
+		id := int64(binary.BigEndian.Uint64(key))
+		if _, ok := s.inputUsers[id]; ok {
+			s.dead += int64(ref.size)
+		}
+		s.inputUsers[id] = int64(binary.BigEndian.Uint64(value))
+	case logPutInputChannel:
+		id := int64(binary.BigEndian.Uint64(key))
+		if _, ok := s.inputChannels[id]; ok {
+			s.dead += int64(ref.size)
+		}
+		s.inputChannels[id] = int64(binary.BigEndian.Uint64(value))
+	case logPutUsername:
+		if _, ok := s.usernames[string(key)]; ok {
+			s.dead += int64(ref.size)
+		}
+		s.usernames[string(key)] = int64(binary.BigEndian.Uint64(value))
+	case logPutMedia:
+		media := new(CachedMedia)
+		if err := json.Unmarshal(value, media); err != nil {
+			return err
+		}
+		if _, ok := s.media[string(key)]; ok {
+			s.dead += int64(ref.size) // roughly the size of the overwritten record
+		}
+		s.media[string(key)] = media
+	case logDeleteMedia:
+		delete(s.media, string(key))
+		s.dead += 2 * int64(ref.size) // the deleted record and this one
+	default:
+		return errors.Errorf("unknown cache log record %d", kind)
+	}
+	return nil
+}
+
+func parseLogRecord(record []byte) (kind byte, key, value []byte, err error) {
+	if len(record) < 2 {
+		return 0, nil, nil, io.ErrUnexpectedEOF
+	}
+	keyLen, n := binary.Uvarint(record[1:])
+	if n <= 0 || 1+n+int(keyLen) > len(record) {
+		return 0, nil, nil, io.ErrUnexpectedEOF
+	}
+	key = record[1+n : 1+n+int(keyLen)]
+	value = record[1+n+int(keyLen):]
+	if (record[0] <= logPutChat || record[0] == logPutInputUser || record[0] == logPutInputChannel) && len(key) != 8 {
+		return 0, nil, nil, errors.New("bad cache log record key")
+	}
+	return record[0], key, value, nil
+}
+
+func encodeLogRecord(kind byte, key, value []byte) []byte {
+	record := []byte{kind}
+	record = binary.AppendUvarint(record, uint64(len(key)))
+	record = append(record, key...)
+	return append(record, value...)
+}
+
+func idKey(id int64) []byte {
+	return binary.BigEndian.AppendUint64(nil, uint64(id))
+}
+
+// appendRecords writes records at the end of the log in a single write, indexing them.
+func (s *LogCacheStore) appendRecords(records [][]byte) error {
+	if len(records) == 0 {
+		return nil
+	}
+
+	var (
+		buf  bytes.Buffer
+		refs = make([]logRecordRef, len(records))
+	)
+	for i, record := range records {
+		body := record
+		if s.cipher != nil {
+			var err error
+			if body, err = s.cipher.Encrypt(record); err != nil {
+				return errors.Wrap(err, "encrypting cache log")
+			}
+		}
+		buf.Write(binary.AppendUvarint(nil, uint64(len(body))))
+		refs[i] = logRecordRef{offset: s.size + int64(buf.Len()), size: len(body)}
+		buf.Write(body)
+	}
+
+	if _, err := s.file.WriteAt(buf.Bytes(), s.size); err != nil {
+		return errors.Wrap(err, "writing cache log")
+	}
+	s.size += int64(buf.Len())
+
+	for i, record := range records {
+		s.apply(record, refs[i])
+	}
+	return nil
+}
+
+// readObject reads the record of a user, channel or chat.
+func (s *LogCacheStore) readObject(kind byte, id int64) (tl.Object, bool) {
+	s.mu.RLock()
+	ref, ok := s.objects[kind][id]
+	if !ok {
+		s.mu.RUnlock()
+		return nil, false
+	}
+
+	body := make([]byte, ref.size)
+	_, err := s.file.ReadAt(body, ref.offset)
+	s.mu.RUnlock()
+	if err != nil {
+		return nil, false
+	}
+	record, _, err := decryptStored(body, s.cipher)
+	if err != nil {
+		return nil, false
+	}
+	_, _, value, err := parseLogRecord(record)
+	if err != nil {
+		return nil, false
+	}
+
+	obj, err := tl.DecodeUnknownObject(value)
+	if err != nil {
+		return nil, false
+	}
+	return obj, true
+}
+
+func (s *LogCacheStore) GetUser(id int64) (*UserObj, bool) {
+	obj, ok := s.readObject(logPutUser, id)
+	user, isUser := obj.(*UserObj)
+	return user, ok && isUser
+}
+
+func (s *LogCacheStore) GetChannel(id int64) (*Channel, bool) {
+	obj, ok := s.readObject(logPutChannel, id)
+	channel, isChannel := obj.(*Channel)
+	return channel, ok && isChannel
+}
+
+func (s *LogCacheStore) GetChat(id int64) (*ChatObj, bool) {
+	obj, ok := s.readObject(logPutChat, id)
+	chat, isChat := obj.(*ChatObj)
+	return chat, ok && isChat
+}
+
+func (s *LogCacheStore) putObjects(kind byte, ids []int64, objects []tl.Object) error {
+	records := make([][]byte, 0, len(objects))
+	for i, obj := range objects {
+		value, err := tl.Marshal(obj)
+		if err != nil {
+			return errors.Wrap(err, "encoding cache object")
+		}
+		records = append(records, encodeLogRecord(kind, idKey(ids[i]), value))
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.appendRecords(records)
+}
+
+func (s *LogCacheStore) PutUsers(users ...*UserObj) error {
+	ids, objects := make([]int64, len(users)), make([]tl.Object, len(users))
+	for i, user := range users {
+		ids[i], objects[i] = user.ID, user
+	}
+	return s.putObjects(logPutUser, ids, objects)
+}
+
+func (s *LogCacheStore) PutChannels(channels ...*Channel) error {
+	ids, objects := make([]int64, len(channels)), make([]tl.Object, len(channels))
+	for i, channel := range channels {
+		ids[i], objects[i] = channel.ID, channel
+	}
+	return s.putObjects(logPutChannel, ids, objects)
+}
+
+func (s *LogCacheStore) PutChats(chats ...*ChatObj) error {
+	ids, objects := make([]int64, len(chats)), make([]tl.Object, len(chats))
+	for i, chat := range chats {
+		ids[i], objects[i] = chat.ID, chat
+	}
+	return s.putObjects(logPutChat, ids, objects)
+}
+
+func (s *LogCacheStore) GetInputUser(id int64) (int64, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	hash, ok := s.inputUsers[id]
+	return hash, ok
+}
+
+func (s *LogCacheStore) GetInputChannel(id int64) (int64, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	hash, ok := s.inputChannels[id]
+	return hash, ok
+}
+
+func (s *LogCacheStore) putHashes(kind byte, current map[int64]int64, hashes map[int64]int64) error {
+	var records [][]byte
+	for id, hash := range hashes {
+		if old, ok := current[id]; ok && old == hash {
+			continue
+		}
+		records = append(records, encodeLogRecord(kind, idKey(id), idKey(hash)))
+	}
+	return s.appendRecords(records)
+}
+
+func (s *LogCacheStore) PutInputUsers(hashes map[int64]int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.putHashes(logPutInputUser, s.inputUsers, hashes)
+}
+
+func (s *LogCacheStore) PutInputChannels(hashes map[int64]int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.putHashes(logPutInputChannel, s.inputChannels, hashes)
+}
+
+func (s *LogCacheStore) InputPeers() *InputPeerCache {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	peers := &InputPeerCache{
+		InputUsers:    make(map[int64]int64, len(s.inputUsers)),
+		InputChannels: make(map[int64]int64, len(s.inputChannels)),
+	}
+	for id, hash := range s.inputUsers {
+		peers.InputUsers[id] = hash
+	}
+	for id, hash := range s.inputChannels {
+		peers.InputChannels[id] = hash
+	}
+	return peers
+}
+
+func (s *LogCacheStore) GetUsername(username string) (int64, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	id, ok := s.usernames[username]
+	return id, ok
+}
+
+func (s *LogCacheStore) PutUsernames(usernames map[string]int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var records [][]byte
+	for username, id := range usernames {
+		if old, ok := s.usernames[username]; ok && old == id {
+			continue
+		}
+		records = append(records, encodeLogRecord(logPutUsername, []byte(username), idKey(id)))
+	}
+	return s.appendRecords(records)
+}
+
+func (s *LogCacheStore) GetMedia(key string) (*CachedMedia, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	media, ok := s.media[key]
+	return media, ok
+}
+
+func (s *LogCacheStore) PutMedia(key string, media *CachedMedia) error {
+	value, err := json.Marshal(media)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.appendRecords([][]byte{encodeLogRecord(logPutMedia, []byte(key), value)})
+}
+
+func (s *LogCacheStore) DeleteMedia(keys ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var records [][]byte
+	for _, key := range keys {
+		if _, ok := s.media[key]; ok {
+			records = append(records, encodeLogRecord(logDeleteMedia, []byte(key), nil))
+		}
+	}
+	return s.appendRecords(records)
+}
+
+func (s *LogCacheStore) RangeMedia(fn func(key string, media *CachedMedia) bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for key, media := range s.media {
+		if !fn(key, media) {
+			return
+		}
+	}
+}
+
+// Flush syncs the log to disk, compacting it first when mostly made of overwritten records.
+func (s *LogCacheStore) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.size > logStoreCompactSize && s.dead > s.size/2 {
+		return s.compact()
+	}
+	return s.file.Sync()
+}
+
+// Compact rewrites the log with only the live records.
+func (s *LogCacheStore) Compact() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.compact()
+}
+
+func (s *LogCacheStore) compact() error {
+	tmpPath := s.path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return errors.Wrap(err, "compacting cache log")
+	}
+
+	next := &LogCacheStore{file: tmp, path: s.path, cipher: s.cipher}
+	next.reset()
+	if err := next.writeHeader(); err != nil {
+		tmp.Close()
+		return errors.Wrap(err, "compacting cache log")
+	}
+
+	var records [][]byte
+	for kind, refs := range s.objects {
+		for _, ref := range refs {
+			body := make([]byte, ref.size)
+			if _, err := s.file.ReadAt(body, ref.offset); err != nil {
+				tmp.Close()
+				return errors.Wrap(err, "compacting cache log")
+			}
+			record, _, err := decryptStored(body, s.cipher)
+			if err != nil {
+				tmp.Close()
+				return errors.Wrap(err, "compacting cache log")
+			}
+			if record[0] == kind {
+				records = append(records, record)
+			}
+		}
+	}
+	for id, hash := range s.inputUsers {
+		records = append(records, encodeLogRecord(logPutInputUser, idKey(id), idKey(hash)))
+	}
+	for id, hash := range s.inputChannels {
+		records = append(records, encodeLogRecord(logPutInputChannel, idKey(id), idKey(hash)))
+	}
+	for username, id := range s.usernames {
+		records = append(records, encodeLogRecord(logPutUsername, []byte(username), idKey(id)))
+	}
+	for key, media := range s.media {
+		value, _ := json.Marshal(media)
+		records = append(records, encodeLogRecord(logPutMedia, []byte(key), value))
+	}
+
+	if err := next.appendRecords(records); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return errors.Wrap(err, "compacting cache log")
+	}
+	if err := os.Rename(tmpPath, s.path); err != nil {
+		tmp.Close()
+		return errors.Wrap(err, "compacting cache log")
+	}
+
+	s.file.Close()
+	s.file = tmp
+	s.objects, s.size = next.objects, next.size
+	s.dead = 0
+	return nil
+}
+
+func (s *LogCacheStore) Clear() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.file.Truncate(0); err != nil {
+		return err
+	}
+	s.reset()
+	return s.writeHeader()
+}
+
+func (s *LogCacheStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.file.Sync(); err != nil {
+		s.file.Close()
+		return err
+	}
+	return s.file.Close()
+}
+
+func uvarintLen(v uint64) int {
+	return len(binary.AppendUvarint(nil, v))
+}
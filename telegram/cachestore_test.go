@@ -0,0 +1,58 @@
+// Copyright (c) 2024 RoseLoverX
+
+package telegram
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLogCacheStoreLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.log")
+	store, err := NewLogCacheStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.PutInputUsers(map[int64]int64{1: 10}); err != nil {
+		t.Fatal(err)
+	}
+	// a record of a newer version, then a valid one
+	if err := store.appendRecords([][]byte{encodeLogRecord(0xfe, []byte("key"), []byte("value"))}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.PutInputUsers(map[int64]int64{2: 20}); err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	complete := info.Size()
+
+	// a torn last record: its length prefix promises more than was written
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write(append(binary.AppendUvarint(nil, 100), 1, 2, 3))
+	f.Close()
+
+	store, err = NewLogCacheStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	for id, want := range map[int64]int64{1: 10, 2: 20} {
+		if hash, ok := store.GetInputUser(id); !ok || hash != want {
+			t.Errorf("user %d: hash %d, %v, want %d", id, hash, ok, want)
+		}
+	}
+	if info, err := os.Stat(path); err != nil || info.Size() != complete {
+		t.Errorf("log is %d bytes, want the torn record dropped to %d", info.Size(), complete)
+	}
+}
@@ -3,6 +3,7 @@
 package telegram
 
 import (
+	"context"
 	"fmt"
 )
 
@@ -19,6 +20,7 @@ type (
 		Channel        *Channel
 		Peer           Peer
 		Client         *Client
+		ctx            context.Context
 	}
 )
 
@@ -199,6 +201,7 @@ type InlineCallbackQuery struct {
 	ChatInstance   int64
 	Client         *Client
 	GameShortName  string
+	ctx            context.Context
 }
 
 func (b *InlineCallbackQuery) Answer(Text string, options ...*CallbackOptions) (bool, error) {
@@ -40,32 +40,32 @@ type clientData struct {
 	appVersion       string
 	langCode         string
 	parseMode        string
-	cacheSenders     bool
+	dedupMedia       bool
 	logLevel         utils.LogLevel
 	sleepThresholdMs int
 	botAcc           bool
 	me               *UserObj
 }
 
-type exSenders struct {
-	senders map[int][]*mtproto.MTProto
-	idleTTL time.Time
-}
-
-func (e *exSenders) setTTL() {
-	e.idleTTL = time.Now().Add(CleanExportedSendersDelay)
-}
-
 // Client is the main struct of the library
 type Client struct {
 	*mtproto.MTProto
-	Cache      *CACHE
-	clientData clientData
-	dispatcher *UpdateDispatcher
-	wg         sync.WaitGroup
-	stopCh     chan struct{}
-	exSenders  *exSenders
-	Log        *utils.Logger
+	Cache         *CACHE
+	fullCache     *FullCache
+	updates       *updateManager
+	clientData    clientData
+	dispatcher    *UpdateDispatcher
+	wg            sync.WaitGroup
+	stopCh        chan struct{}
+	senders       *SenderPool
+	uploads       sync.Map // file id -> *trackedUpload, for re-sending missing parts
+	bandwidth     *BandwidthLimiter
+	transfers     *TransferManager
+	transfersOnce sync.Once
+	commands      *CommandRouter
+	commandsOnce  sync.Once
+	adminFilters  adminFilterCache // admin checks of FilterAdmin
+	Log           *utils.Logger
 }
 
 type DeviceConfig struct {
@@ -95,21 +95,112 @@ type ClientConfig struct {
 	Proxy            *url.URL             // The proxy to use (SOCKS5, HTTP)
 	ForceIPv6        bool                 // Force to use IPv6
 	Cache            *CACHE               // The cache to use
-	CacheSenders     bool                 // cache the exported file op sender (TODO: Stabilize this)
+	CacheSenders     bool                 // Deprecated: exported senders are always pooled, see MaxSendersPerDC
+	MaxSendersPerDC  int                  // Max pooled senders for file operations per data center (default: 12)
+	SenderIdleTime   time.Duration        // Idle time after which a pooled sender is closed (default: 5 minutes)
+	DedupMedia       bool                 // Reuse already uploaded files with identical content (kept in the cache file)
+	BandwidthLimit   int64                // Cap on upload and download speed in bytes per second (0 for unlimited)
 	TransportMode    string               // The transport mode to use (Abridged, Intermediate, Full)
 	SleepThresholdMs int                  // The threshold in milliseconds to sleep before flood
 	FloodHandler     func(err error) bool // The flood handler to use
 	ErrorHandler     func(err error)      // The error handler to use
+	Encryption       *StorageEncryption   // Encrypt the session and cache files at rest
+	FullUserCacheTTL time.Duration        // How long GetFullUser results are cached (default: 5 minutes, negative to disable)
+	FullChatCacheTTL time.Duration        // How long GetFullChat results are cached (default: 5 minutes, negative to disable)
+	UpdateStateStore UpdateStateStore     // Where the update state (pts, qts, seq) is kept (default: a file, none with MemorySession)
+	CatchUp          bool                 // Handle the updates missed while offline, from the saved update state
+	CatchUpMaxAge    time.Duration        // Skip missed messages older than this when catching up (0 for no limit)
+	DispatchMode     DispatchMode         // How updates are passed to handlers (default: DispatchConcurrent)
+	DispatchWorkers  int                  // Workers handling updates (DispatchOrdered default: 4 per CPU; DispatchConcurrent default: 0, a goroutine per update)
+	DispatchBacklog  int                  // Updates queued per worker before the overflow policy applies (default: 1000)
+	DispatchOverflow OverflowPolicy       // What happens to updates when the queue is full (default: OverflowBlock)
+	OnDispatchDrop   func(dropped Update) // Called with each update dropped by the overflow policy
+	HandlerTimeout   time.Duration        // Max run time of a handler, its context is cancelled after it (default: no limit)
+}
+
+// StorageEncryption configures encryption at rest (AES-256-GCM) of the session and cache files.
+// Unencrypted files are encrypted when first loaded; to rotate keys, set the new key and move the
+// old one to OldKeys (or OldPassphrases), files are re-encrypted with the new key when loaded.
+type StorageEncryption struct {
+	Key            []byte   // 32 byte key
+	Passphrase     string   // Passphrase to derive the key from (PBKDF2-SHA256), if Key is not set
+	OldKeys        [][]byte // Previous keys, only used to read files written with them
+	OldPassphrases []string // Previous passphrases, only used to read files written with them
+
+	once   sync.Once
+	cipher *session.Cipher
+	err    error
+}
+
+// getCipher builds the cipher once, so the session and cache share derived keys.
+func (e *StorageEncryption) getCipher() (*session.Cipher, error) {
+	if e == nil {
+		return nil, nil
+	}
+
+	e.once.Do(func() {
+		newCipher := func(key []byte, passphrase string) (*session.Cipher, error) {
+			if len(key) > 0 {
+				return session.NewKeyCipher(key)
+			}
+			return session.NewPassphraseCipher(passphrase)
+		}
+
+		if e.cipher, e.err = newCipher(e.Key, e.Passphrase); e.err != nil {
+			return
+		}
+		for _, key := range e.OldKeys {
+			old, err := session.NewKeyCipher(key)
+			if err != nil {
+				e.err = errors.Wrap(err, "old key")
+				return
+			}
+			e.cipher.WithPrevious(old)
+		}
+		for _, passphrase := range e.OldPassphrases {
+			old, err := session.NewPassphraseCipher(passphrase)
+			if err != nil {
+				e.err = errors.Wrap(err, "old passphrase")
+				return
+			}
+			e.cipher.WithPrevious(old)
+		}
+	})
+	return e.cipher, e.err
 }
 
 type Session struct {
+	Key      []byte         `json:"key,omitempty"`       // AUTH_KEY
+	Hash     []byte         `json:"hash,omitempty"`      // AUTH_KEY_HASH (SHA1 of AUTH_KEY)
+	Salt     int64          `json:"salt,omitempty"`      // SERVER_SALT
+	Hostname string         `json:"hostname,omitempty"`  // HOSTNAME (IP address of the DC)
+	AppID    int32          `json:"app_id,omitempty"`    // APP_ID
+	DC       int            `json:"dc,omitempty"`        // DC_ID of the home data center
+	UserID   int64          `json:"user_id,omitempty"`   // USER_ID of the authorized account
+	Bot      bool           `json:"bot,omitempty"`       // IS_BOT
+	TestMode bool           `json:"test_mode,omitempty"` // TEST_MODE (test data centers)
+	IPv6     bool           `json:"ipv6,omitempty"`      // IPV6 (hostnames are IPv6 addresses)
+	DCKeys   map[int]*DCKey `json:"dc_keys,omitempty"`   // AUTH_KEYs authorized on other data centers
+	CDNKeys  map[int]*DCKey `json:"cdn_keys,omitempty"`  // AUTH_KEYs of CDN data centers
+	Salts    []*SessionSalt `json:"salts,omitempty"`     // future SERVER_SALTs of the home data center
+}
+
+// DCKey is an auth key of a data center other than the home one.
+type DCKey struct {
 	Key      []byte `json:"key,omitempty"`      // AUTH_KEY
-	Hash     []byte `json:"hash,omitempty"`     // AUTH_KEY_HASH (SHA1 of AUTH_KEY)
 	Salt     int64  `json:"salt,omitempty"`     // SERVER_SALT
-	Hostname string `json:"hostname,omitempty"` // HOSTNAME (IP address of the DC)
-	AppID    int32  `json:"app_id,omitempty"`   // APP_ID
+	Hostname string `json:"hostname,omitempty"` // HOSTNAME, resolved from the DC_ID when empty
+}
+
+// SessionSalt is a server salt along with its validity period (unix times).
+type SessionSalt struct {
+	Salt       int64 `json:"salt"`
+	ValidSince int32 `json:"valid_since"`
+	ValidUntil int32 `json:"valid_until"`
 }
 
+// Encode encodes the home data center key of the session to a string session, usable as
+// ClientConfig.StringSession; use EncodeFull to keep the rest of the session.
 func (s *Session) Encode() string {
 	if len(s.Hash) == 0 {
 		s.Hash = utils.Sha1Byte(s.Key)[12:20]
@@ -117,6 +208,107 @@ func (s *Session) Encode() string {
 	return session.NewStringSession(s.Key, s.Hash, 0, s.Hostname, s.AppID).Encode()
 }
 
+// EncodeFull encodes the whole session, including the keys of other data centers, the account
+// and the future salts, to a string session in the format of Client.ExportSession.
+func (s *Session) EncodeFull() string {
+	return session.EncodeSession(s.internal())
+}
+
+// DecodeSession decodes a string session, as returned by Client.ExportSession, Session.Encode
+// or Session.EncodeFull.
+func DecodeSession(encoded string) (*Session, error) {
+	sess, err := session.DecodeSession(encoded)
+	if err != nil {
+		return nil, err
+	}
+	return sessionFromInternal(sess), nil
+}
+
+func (s *Session) internal() *session.Session {
+	if len(s.Hash) == 0 {
+		s.Hash = utils.Sha1Byte(s.Key)[12:20]
+	}
+
+	sess := &session.Session{
+		Key:      s.Key,
+		Hash:     s.Hash,
+		Salt:     s.Salt,
+		Hostname: s.Hostname,
+		AppID:    s.AppID,
+		DC:       s.DC,
+		UserID:   s.UserID,
+		Bot:      s.Bot,
+		TestMode: s.TestMode,
+		IPv6:     s.IPv6,
+	}
+	if sess.DC == 0 {
+		sess.DC = utils.SearchAddr(s.Hostname)
+	}
+
+	internalKeys := func(keys map[int]*DCKey, home int) map[int]*session.DCKey {
+		var converted map[int]*session.DCKey
+		for dc, key := range keys {
+			if key == nil || len(key.Key) == 0 || dc == home {
+				continue
+			}
+			if converted == nil {
+				converted = make(map[int]*session.DCKey, len(keys))
+			}
+			hostname := key.Hostname
+			if hostname == "" {
+				hostname = utils.GetHostIp(dc, s.TestMode, s.IPv6)
+			}
+			converted[dc] = &session.DCKey{
+				Key:      key.Key,
+				Hash:     utils.Sha1Byte(key.Key)[12:20],
+				Salt:     key.Salt,
+				Hostname: hostname,
+			}
+		}
+		return converted
+	}
+	sess.DCKeys = internalKeys(s.DCKeys, sess.DC)
+	sess.CDNKeys = internalKeys(s.CDNKeys, 0)
+
+	for _, salt := range s.Salts {
+		sess.Salts = append(sess.Salts, &session.Salt{Salt: salt.Salt, ValidSince: salt.ValidSince, ValidUntil: salt.ValidUntil})
+	}
+	return sess
+}
+
+func sessionFromInternal(sess *session.Session) *Session {
+	s := &Session{
+		Key:      sess.Key,
+		Hash:     sess.Hash,
+		Salt:     sess.Salt,
+		Hostname: sess.Hostname,
+		AppID:    sess.AppID,
+		DC:       sess.DC,
+		UserID:   sess.UserID,
+		Bot:      sess.Bot,
+		TestMode: sess.TestMode,
+		IPv6:     sess.IPv6,
+	}
+
+	publicKeys := func(keys map[int]*session.DCKey) map[int]*DCKey {
+		var converted map[int]*DCKey
+		for dc, key := range keys {
+			if converted == nil {
+				converted = make(map[int]*DCKey, len(keys))
+			}
+			converted[dc] = &DCKey{Key: key.Key, Salt: key.Salt, Hostname: key.Hostname}
+		}
+		return converted
+	}
+	s.DCKeys = publicKeys(sess.DCKeys)
+	s.CDNKeys = publicKeys(sess.CDNKeys)
+
+	for _, salt := range sess.Salts {
+		s.Salts = append(s.Salts, &SessionSalt{Salt: salt.Salt, ValidSince: salt.ValidSince, ValidUntil: salt.ValidUntil})
+	}
+	return s
+}
+
 func NewClient(config ClientConfig) (*Client, error) {
 	client := &Client{
 		wg:     sync.WaitGroup{},
@@ -136,8 +328,13 @@ func NewClient(config ClientConfig) (*Client, error) {
 	config = client.cleanClientConfig(config)
 	client.setupClientData(config)
 
+	if _, err := config.Encryption.getCipher(); err != nil {
+		return nil, errors.Wrap(err, "setting up storage encryption")
+	}
+
 	if config.Cache == nil {
 		client.Cache = NewCache(fmt.Sprintf("cache%s.db", config.SessionName), &CacheConfig{
+			Encryption: config.Encryption,
 			Disabled:   config.DisableCache,
 			LogLevel:   config.LogLevel,
 			LogName:    config.SessionName,
@@ -154,8 +351,8 @@ func NewClient(config ClientConfig) (*Client, error) {
 	}
 	if config.NoUpdates {
 		client.Log.Debug("client is running in no updates mode, no updates will be handled")
-	} else {
-		client.setupDispatcher()
+	} else if err := client.setupDispatcher(config); err != nil {
+		return nil, err
 	}
 	if err := client.clientWarnings(config); err != nil {
 		return nil, err
@@ -175,6 +372,8 @@ func (c *Client) setupMTProto(config ClientConfig) error {
 		}
 	}
 
+	encryption, _ := config.Encryption.getCipher() // validated in NewClient
+
 	mtproto, err := mtproto.NewMTProto(mtproto.Config{
 		AppID:       config.AppID,
 		AuthKeyFile: config.Session,
@@ -188,6 +387,8 @@ func (c *Client) setupMTProto(config ClientConfig) error {
 		Proxy:         config.Proxy,
 		MemorySession: config.MemorySession,
 		Ipv6:          config.ForceIPv6,
+		TestMode:      config.TestMode,
+		Encryption:    encryption,
 		CustomHost:    customHost,
 		FloodHandler:  config.FloodHandler,
 		ErrorHandler:  config.ErrorHandler,
@@ -233,13 +434,30 @@ func (c *Client) clientWarnings(config ClientConfig) error {
 	return nil
 }
 
-func (c *Client) setupDispatcher() {
+func (c *Client) setupDispatcher(config ClientConfig) error {
 	c.NewUpdateDispatcher()
+	c.dispatcher.handlerTimeout = config.HandlerTimeout
+	if config.DispatchMode == DispatchOrdered || config.DispatchWorkers > 0 {
+		c.dispatcher.queue = newDispatchQueue(config.DispatchMode == DispatchOrdered, config.DispatchWorkers, config.DispatchBacklog,
+			config.DispatchOverflow, config.OnDispatchDrop, &c.dispatcher.stats)
+	}
+
+	store := config.UpdateStateStore
+	if store == nil && !config.MemorySession {
+		fileStore, err := NewFileUpdateStateStore(fmt.Sprintf("updates%s.state", config.SessionName), config.Encryption)
+		if err != nil {
+			return errors.Wrap(err, "setting up update state store")
+		}
+		store = fileStore
+	}
+	c.updates = newUpdateManager(c, store, config.CatchUp, config.CatchUpMaxAge)
+
 	handleUpdaterWrapper := func(u any) bool {
 		return HandleIncomingUpdates(u, c)
 	}
 
 	c.AddCustomServerRequestHandler(handleUpdaterWrapper)
+	return nil
 }
 
 func (c *Client) cleanClientConfig(config ClientConfig) ClientConfig {
@@ -265,6 +483,8 @@ func (c *Client) setupClientData(cnf ClientConfig) {
 	c.clientData.logLevel = getValue(cnf.LogLevel, LogInfo)
 	c.clientData.parseMode = getValue(cnf.ParseMode, "HTML")
 	c.clientData.sleepThresholdMs = getValue(cnf.SleepThresholdMs, 0)
+	c.clientData.dedupMedia = cnf.DedupMedia
+	c.bandwidth = NewBandwidthLimiter(cnf.BandwidthLimit)
 
 	if cnf.LogLevel == LogDebug {
 		c.Log.SetLevel(LogDebug)
@@ -272,24 +492,8 @@ func (c *Client) setupClientData(cnf ClientConfig) {
 		c.Log.SetLevel(c.clientData.logLevel)
 	}
 
-	if cnf.CacheSenders {
-		c.clientData.cacheSenders = true
-		c.exSenders = &exSenders{
-			senders: make(map[int][]*mtproto.MTProto),
-			idleTTL: time.Now().Add(CleanExportedSendersDelay),
-		}
-		go func() {
-
-			for {
-				select {
-				case <-c.stopCh:
-					return
-				case <-time.After(CleanExportedSendersDelay):
-					c.cleanExportedSenders()
-				}
-			}
-		}()
-	}
+	c.senders = NewSenderPool(c, cnf.MaxSendersPerDC, cnf.SenderIdleTime)
+	c.fullCache = NewFullCache(getValue(cnf.FullUserCacheTTL, defaultFullCacheTTL), getValue(cnf.FullChatCacheTTL, defaultFullCacheTTL))
 }
 
 // initialRequest sends the initial initConnection request
@@ -384,10 +588,11 @@ func (c *Client) Start() error {
 // Returns true if the client is authorized as a user or a bot
 func (c *Client) IsAuthorized() (bool, error) {
 	c.Log.Debug("sending updates.getState request")
-	_, err := c.UpdatesGetState()
+	state, err := c.UpdatesGetState()
 	if err != nil {
 		return false, err
 	}
+	c.updates.start(state)
 	return true, nil
 }
 
@@ -399,6 +604,7 @@ func (c *Client) Disconnect() error {
 // switchDC permanently switches the data center
 func (c *Client) SwitchDc(dcID int) error {
 	c.Log.Debug("switching data center to (" + strconv.Itoa(dcID) + ")")
+	c.senders.Reset() // senders of the old home dc share its auth key
 	newDcSender, err := c.MTProto.SwitchDc(dcID)
 	if err != nil {
 		return errors.Wrap(err, "reconnecting to new dc")
@@ -433,23 +639,9 @@ type ExportedAuthParams struct {
 	Bytes []byte
 }
 
-func (c *Client) cleanExportedSenders() {
-	if time.Now().Before(c.exSenders.idleTTL) {
-		return
-	}
-
-	c.Log.Debug("cleaning exported senders, idle time reached")
-	for dcID, sender := range c.exSenders.senders {
-		for _, s := range sender {
-			if s != nil {
-				s.Terminate() // Terminate each sender
-			}
-		}
-		delete(c.exSenders.senders, dcID) // Remove the sender from the map
-	}
-}
-
-// CreateExportedSender creates a new exported sender for the given DC
+// CreateExportedSender creates a new exported sender for the given DC,
+// reusing the auth key stored for that DC in the session, if any.
+// File operations should use the pooled senders (see SenderPool) instead.
 func (c *Client) CreateExportedSender(dcID int, cdn bool, authParams ...ExportedAuthParams) (*mtproto.MTProto, error) {
 	const retryLimit = 1 // Retry only once
 	var lastError error
@@ -473,6 +665,14 @@ func (c *Client) CreateExportedSender(dcID int, cdn bool, authParams ...Exported
 			}
 		}
 
+		keyKind := session.KeyRegular
+		if cdn {
+			keyKind = session.KeyCDN
+		}
+		persistKey := cdn || dcID != c.MTProto.GetDC()
+		_, storedKey := c.MTProto.DCKey(dcID, keyKind)
+		storedKey = storedKey && persistKey
+
 		exported, err := c.MTProto.ExportNewSender(dcID, true, cdn)
 		if err != nil {
 			lastError = errors.Wrap(err, "exporting new sender")
@@ -490,7 +690,9 @@ func (c *Client) CreateExportedSender(dcID int, cdn bool, authParams ...Exported
 			Query:          &HelpGetConfigParams{},
 		}
 
-		if c.MTProto.GetDC() != exported.GetDC() {
+		if storedKey {
+			c.Log.Debug(fmt.Sprintf("reusing stored auth key for data-center %d", dcID))
+		} else if c.MTProto.GetDC() != exported.GetDC() {
 			c.Log.Info(fmt.Sprintf("exporting auth for data-center %d", exported.GetDC()))
 			var auth *AuthExportedAuthorization
 			if len(authParams) > 0 && authParams[0].ID != 0 && len(authParams[0].Bytes) > 0 {
@@ -520,7 +722,13 @@ func (c *Client) CreateExportedSender(dcID int, cdn bool, authParams ...Exported
 		})
 
 		if err != nil {
+			exported.Terminate()
 			lastError = errors.Wrap(err, "making initial request")
+			if storedKey {
+				// the stored key may have been revoked, export the authorization again
+				c.Log.Debug(errors.Wrap(err, fmt.Sprintf("stored auth key for data-center %d rejected", dcID)))
+				c.MTProto.StoreDCKey(dcID, nil, keyKind)
+			}
 			if retry < retryLimit {
 				c.Log.Debug(fmt.Sprintf("error making initial request, retrying (%d/%d)", retry+1, retryLimit))
 			} else {
@@ -529,6 +737,18 @@ func (c *Client) CreateExportedSender(dcID int, cdn bool, authParams ...Exported
 			continue
 		}
 
+		if !storedKey && persistKey {
+			key, _ := exported.ExportAuth()
+			if err := c.MTProto.StoreDCKey(dcID, &session.DCKey{
+				Key:      key.Key,
+				Hash:     key.Hash,
+				Salt:     key.Salt,
+				Hostname: key.Hostname,
+			}, keyKind); err != nil {
+				c.Log.Debug(errors.Wrap(err, "saving auth key of data-center "+strconv.Itoa(dcID)))
+			}
+		}
+
 		return exported, nil
 	}
 
@@ -585,6 +805,14 @@ func (c *Client) ExportSession() string {
 	return session.NewStringSession(authSession.Key, authSession.Hash, dcId, authSession.Hostname, authSession.AppID).Encode()
 }
 
+// ExportSessionFull exports the current session to a string in the full format, including the
+// keys of other datacenters and the saved salts; older versions can't import it, see ExportSession.
+func (c *Client) ExportSessionFull() string {
+	authSession, _ := c.MTProto.ExportAuth()
+	c.Log.Debug("exporting auth to full string session...")
+	return session.EncodeSession(authSession)
+}
+
 // ImportSession imports a session from a string
 //
 //	Params:
@@ -616,13 +844,7 @@ func (c *Client) ImportRawSession(authKey, authKeyHash []byte, IpAddr string, Ap
 //	  AppID: The App ID to use
 func (c *Client) ExportRawSession() *Session {
 	mtSession, _ := c.MTProto.ExportAuth()
-	return &Session{
-		Key:      mtSession.Key,
-		Hash:     mtSession.Hash,
-		Salt:     mtSession.Salt,
-		Hostname: mtSession.Hostname,
-		AppID:    mtSession.AppID,
-	}
+	return sessionFromInternal(mtSession)
 }
 
 // LoadSession loads a session from a file, database, etc.
@@ -630,13 +852,7 @@ func (c *Client) ExportRawSession() *Session {
 //	Params:
 //	  Session: The session to load
 func (c *Client) LoadSession(sess *Session) error {
-	return c.MTProto.LoadSession(&session.Session{
-		Key:      sess.Key,
-		Hash:     sess.Hash,
-		Salt:     sess.Salt,
-		Hostname: sess.Hostname,
-		AppID:    sess.AppID,
-	})
+	return c.MTProto.LoadSession(sess.internal())
 }
 
 // returns the AppID (api_id) of the client
@@ -656,7 +872,7 @@ func (c *Client) ParseMode() string {
 
 // Terminate client and disconnect from telegram server
 func (c *Client) Terminate() error {
-	//go c.cleanExportedSenders()
+	c.senders.Reset()
 	return c.MTProto.Terminate()
 }
 
@@ -682,6 +898,8 @@ func (c *Client) Stop() error {
 		close(c.stopCh)
 	}
 
+	c.updates.save()
+	c.senders.Reset()
 	return c.MTProto.Terminate()
 }
 
@@ -0,0 +1,646 @@
+// Copyright (c) 2024 RoseLoverX
+
+package telegram
+
+import (
+	"fmt"
+	"html"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/pkg/errors"
+)
+
+// CommandScope selects where a command is accepted, and offered in the bot menu.
+type CommandScope int
+
+const (
+	ScopeAll     CommandScope = iota // everywhere
+	ScopePrivate                     // private chats
+	ScopeGroup                       // groups and supergroups
+	ScopeAdmin                       // groups and supergroups, to their admins
+)
+
+// ArgType is the type an argument of a command is parsed to.
+type ArgType int
+
+const (
+	ArgString   ArgType = iota // a word, or a quoted text
+	ArgInt                     // int64
+	ArgFloat                   // float64
+	ArgBool                    // true/false, yes/no, on/off, 1/0
+	ArgDuration                // time.Duration: "90s", "1h30m", "2d", or seconds
+	ArgRest                    // the rest of the text, as is; must be the last argument
+)
+
+// CommandArg declares an argument of a command.
+type CommandArg struct {
+	Name     string
+	Type     ArgType
+	Optional bool
+	Default  any      // the value of an optional argument left out
+	Choices  []string // the values allowed, if any
+}
+
+// Command is a command of the command router.
+type Command struct {
+	Name         string
+	Aliases      []string
+	Description  string
+	Descriptions map[string]string // by language code, for the bot menu
+	Args         []CommandArg
+	Scope        CommandScope
+	Hidden       bool // left out of /help and the bot menu
+	Filters      []Filter
+	Handler      func(m *NewMessage, args *CommandArgs) error
+}
+
+// Usage returns how the command is used, like "/ban <user> [reason...]".
+func (cmd *Command) Usage() string {
+	usage := "/" + cmd.Name
+	for _, arg := range cmd.Args {
+		name := arg.Name
+		if len(arg.Choices) > 0 {
+			name = strings.Join(arg.Choices, "|")
+		}
+		if arg.Type == ArgRest {
+			name += "..."
+		}
+		if arg.Optional {
+			usage += " [" + name + "]"
+		} else {
+			usage += " <" + name + ">"
+		}
+	}
+	return usage
+}
+
+func (cmd *Command) description(lang string) string {
+	if desc, ok := cmd.Descriptions[lang]; ok && desc != "" {
+		return desc
+	}
+	if cmd.Description != "" {
+		return cmd.Description
+	}
+	return cmd.Name
+}
+
+// CommandArgs are the arguments a command was called with.
+type CommandArgs struct {
+	Command string   // the name or alias used
+	Raw     string   // the text after the command
+	Tokens  []string // Raw split on whitespace, quoted text kept together
+	values  map[string]any
+}
+
+// Get returns the value of an argument, nil if left out.
+func (a *CommandArgs) Get(name string) any {
+	return a.values[name]
+}
+
+// Has reports whether an argument was given, or has a default.
+func (a *CommandArgs) Has(name string) bool {
+	_, ok := a.values[name]
+	return ok
+}
+
+func (a *CommandArgs) String(name string) string {
+	s, _ := a.values[name].(string)
+	return s
+}
+
+func (a *CommandArgs) Int(name string) int64 {
+	i, _ := a.values[name].(int64)
+	return i
+}
+
+func (a *CommandArgs) Float(name string) float64 {
+	f, _ := a.values[name].(float64)
+	return f
+}
+
+func (a *CommandArgs) Bool(name string) bool {
+	b, _ := a.values[name].(bool)
+	return b
+}
+
+func (a *CommandArgs) Duration(name string) time.Duration {
+	d, _ := a.values[name].(time.Duration)
+	return d
+}
+
+// ArgError is returned when a command is called with arguments it can't parse.
+type ArgError struct {
+	Command *Command
+	Arg     string
+	Reason  string
+}
+
+func (e *ArgError) Error() string {
+	if e.Arg == "" {
+		return e.Reason
+	}
+	return e.Arg + ": " + e.Reason
+}
+
+var commandNameRe = regexp.MustCompile(`^[a-z0-9_]{1,32}$`)
+
+// CommandRouter routes commands to their handlers: it checks the scope and filters of a
+// command, parses its arguments, answers /help, and keeps the bot menu in sync.
+type CommandRouter struct {
+	c      *Client
+	handle Handle
+
+	mu       sync.RWMutex
+	commands []*Command
+	byName   map[string]*Command
+
+	// Prefixes a command may start with, "/" by default.
+	Prefixes []string
+	// AutoSync updates the bot menu (SetBotCommands) shortly after commands are added or
+	// removed; on by default.
+	AutoSync bool
+	// OnArgError answers a command called with bad arguments; by default it replies with the
+	// error and the usage of the command.
+	OnArgError func(m *NewMessage, err *ArgError) error
+
+	syncTimer *time.Timer
+}
+
+const commandSyncDelay = time.Second
+
+// Commands returns the command router of the client, creating it on first use; it handles
+// messages in the default group, see Handle to move it.
+func (c *Client) Commands() *CommandRouter {
+	c.commandsOnce.Do(func() {
+		r := &CommandRouter{c: c, byName: make(map[string]*Command), Prefixes: []string{"/"}, AutoSync: true}
+		r.OnArgError = r.replyUsage
+		r.handle = c.AddMessageHandler(OnNewMessage, r.route)
+		c.commands = r
+	})
+	return c.commands
+}
+
+// Handle returns the message handle of the router, to set its group.
+func (r *CommandRouter) Handle() Handle {
+	return r.handle
+}
+
+// Add adds commands to the router; names and aliases are 1-32 lowercase letters, digits
+// or underscores, and must be unique. Adding a "help" command replaces the built-in one.
+func (r *CommandRouter) Add(commands ...*Command) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, cmd := range commands {
+		if cmd.Handler == nil {
+			return errors.New("command " + cmd.Name + " has no handler")
+		}
+		for i, arg := range cmd.Args {
+			if arg.Type == ArgRest && i != len(cmd.Args)-1 {
+				return errors.New("command " + cmd.Name + ": rest argument " + arg.Name + " must be the last")
+			}
+		}
+		for _, name := range append([]string{cmd.Name}, cmd.Aliases...) {
+			if !commandNameRe.MatchString(name) {
+				return errors.New("invalid command name: " + name)
+			}
+			if _, ok := r.byName[name]; ok {
+				return errors.New("command already added: " + name)
+			}
+		}
+		for _, name := range append([]string{cmd.Name}, cmd.Aliases...) {
+			r.byName[name] = cmd
+		}
+		r.commands = append(r.commands, cmd)
+	}
+	r.scheduleSync()
+	return nil
+}
+
+// Remove removes a command, with its aliases, reporting whether it was added.
+func (r *CommandRouter) Remove(name string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	cmd, ok := r.byName[strings.ToLower(name)]
+	if !ok {
+		return false
+	}
+	for _, n := range append([]string{cmd.Name}, cmd.Aliases...) {
+		delete(r.byName, n)
+	}
+	for i, c := range r.commands {
+		if c == cmd {
+			r.commands = append(r.commands[:i], r.commands[i+1:]...)
+			break
+		}
+	}
+	r.scheduleSync()
+	return true
+}
+
+// Lookup returns a command by its name or an alias.
+func (r *CommandRouter) Lookup(name string) (*Command, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	cmd, ok := r.byName[strings.ToLower(name)]
+	return cmd, ok
+}
+
+// List returns the commands in the order they were added.
+func (r *CommandRouter) List() []*Command {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return append([]*Command(nil), r.commands...)
+}
+
+// splitCommand splits a message into the command name, the bot it is addressed to and the
+// rest of the text; ok is false if it is not a command.
+func (r *CommandRouter) splitCommand(text string) (name, bot, rest string, ok bool) {
+	for _, prefix := range r.Prefixes {
+		if prefix != "" && strings.HasPrefix(text, prefix) {
+			text, ok = text[len(prefix):], true
+			break
+		}
+	}
+	if !ok {
+		return "", "", "", false
+	}
+
+	head := text
+	if i := strings.IndexFunc(text, unicode.IsSpace); i >= 0 {
+		head, rest = text[:i], strings.TrimSpace(text[i:])
+	}
+	if i := strings.IndexByte(head, '@'); i >= 0 {
+		head, bot = head[:i], head[i+1:]
+	}
+	return strings.ToLower(head), bot, rest, head != ""
+}
+
+func (r *CommandRouter) route(m *NewMessage) error {
+	name, bot, rest, ok := r.splitCommand(m.Text())
+	if !ok {
+		return nil
+	}
+	if bot != "" {
+		me := r.c.Me()
+		if me == nil || !strings.EqualFold(bot, me.Username) {
+			return nil // addressed to another bot
+		}
+	}
+
+	cmd, ok := r.Lookup(name)
+	if !ok {
+		if name == "help" {
+			return r.help(m, rest)
+		}
+		return nil
+	}
+	if !runFilters(m, append(scopeFilters(cmd.Scope), cmd.Filters...)) {
+		return nil
+	}
+
+	args, err := parseCommandArgs(cmd, name, rest)
+	if err != nil {
+		var argErr *ArgError
+		if errors.As(err, &argErr) && r.OnArgError != nil {
+			return r.OnArgError(m, argErr)
+		}
+		return err
+	}
+	return cmd.Handler(m, args)
+}
+
+func scopeFilters(scope CommandScope) []Filter {
+	switch scope {
+	case ScopePrivate:
+		return []Filter{FilterPrivate}
+	case ScopeGroup:
+		return []Filter{FilterGroup}
+	case ScopeAdmin:
+		return []Filter{FilterGroup, FilterAdmin()}
+	}
+	return nil
+}
+
+func (r *CommandRouter) replyUsage(m *NewMessage, err *ArgError) error {
+	_, e := m.Reply(html.EscapeString(err.Error())+"\nUsage: <code>"+html.EscapeString(err.Command.Usage())+"</code>", SendOptions{ParseMode: HTML})
+	return e
+}
+
+// help answers /help with the commands usable in the chat, or /help <command> with its usage.
+func (r *CommandRouter) help(m *NewMessage, rest string) error {
+	if topic := strings.TrimPrefix(strings.ToLower(strings.TrimSpace(rest)), "/"); topic != "" {
+		cmd, ok := r.Lookup(topic)
+		if !ok || cmd.Hidden {
+			_, err := m.Reply("Unknown command: /"+html.EscapeString(topic), SendOptions{ParseMode: HTML})
+			return err
+		}
+		text := "<code>" + html.EscapeString(cmd.Usage()) + "</code>\n" + html.EscapeString(cmd.description(""))
+		if len(cmd.Aliases) > 0 {
+			text += "\nAliases: /" + strings.Join(cmd.Aliases, ", /")
+		}
+		_, err := m.Reply(text, SendOptions{ParseMode: HTML})
+		return err
+	}
+
+	var lines []string
+	for _, cmd := range r.List() {
+		if cmd.Hidden || !runFilters(m, scopeFilters(cmd.Scope)) {
+			continue
+		}
+		lines = append(lines, "/"+cmd.Name+" - "+html.EscapeString(cmd.description("")))
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+	_, err := m.Reply("<b>Commands</b>\n"+strings.Join(lines, "\n"), SendOptions{ParseMode: HTML})
+	return err
+}
+
+// tokenizeArgs splits text on whitespace, keeping quoted text ("..." or '...') together;
+// a backslash escapes the next character.
+func tokenizeArgs(text string) ([]string, error) {
+	var (
+		tokens  []string
+		current strings.Builder
+		quote   rune
+		inToken bool
+		escaped bool
+	)
+	for _, ch := range text {
+		switch {
+		case escaped:
+			current.WriteRune(ch)
+			escaped = false
+		case ch == '\\':
+			escaped, inToken = true, true
+		case quote != 0:
+			if ch == quote {
+				quote = 0
+			} else {
+				current.WriteRune(ch)
+			}
+		case ch == '"' || ch == '\'':
+			quote, inToken = ch, true
+		case unicode.IsSpace(ch):
+			if inToken {
+				tokens = append(tokens, current.String())
+				current.Reset()
+				inToken = false
+			}
+		default:
+			current.WriteRune(ch)
+			inToken = true
+		}
+	}
+	if quote != 0 {
+		return nil, errors.New("unclosed quote")
+	}
+	if inToken {
+		tokens = append(tokens, current.String())
+	}
+	return tokens, nil
+}
+
+// parseCommandArgs parses the text after a command into its declared arguments; commands
+// without declared arguments take any text.
+func parseCommandArgs(cmd *Command, used, rest string) (*CommandArgs, error) {
+	args := &CommandArgs{Command: used, Raw: rest, Tokens: strings.Fields(rest), values: make(map[string]any)}
+	if len(cmd.Args) == 0 {
+		return args, nil
+	}
+
+	tokens, err := tokenizeArgs(rest)
+	if err != nil {
+		return nil, &ArgError{Command: cmd, Reason: err.Error()}
+	}
+	args.Tokens = tokens
+
+	consumed := 0
+	for _, arg := range cmd.Args {
+		if arg.Type == ArgRest {
+			if remaining := skipTokens(rest, consumed); remaining != "" {
+				args.values[arg.Name] = remaining
+			}
+			consumed = len(tokens)
+			break
+		}
+		if consumed == len(tokens) {
+			break
+		}
+		value, err := parseArg(arg, tokens[consumed])
+		if err != nil {
+			return nil, &ArgError{Command: cmd, Arg: arg.Name, Reason: err.Error()}
+		}
+		args.values[arg.Name] = value
+		consumed++
+	}
+
+	for _, arg := range cmd.Args {
+		if _, ok := args.values[arg.Name]; ok {
+			continue
+		}
+		if !arg.Optional {
+			return nil, &ArgError{Command: cmd, Arg: arg.Name, Reason: "missing"}
+		}
+		if arg.Default != nil {
+			args.values[arg.Name] = arg.Default
+		}
+	}
+	if consumed < len(tokens) {
+		return nil, &ArgError{Command: cmd, Reason: fmt.Sprintf("too many arguments: %q", strings.Join(tokens[consumed:], " "))}
+	}
+	return args, nil
+}
+
+// skipTokens returns text after its first n tokens, as typed.
+func skipTokens(text string, n int) string {
+	for ; n > 0; n-- {
+		text = strings.TrimLeftFunc(text, unicode.IsSpace)
+		var quote rune
+		escaped := false
+		end := len(text)
+		for i, ch := range text {
+			if escaped {
+				escaped = false
+				continue
+			}
+			if ch == '\\' {
+				escaped = true
+			} else if quote != 0 {
+				if ch == quote {
+					quote = 0
+				}
+			} else if ch == '"' || ch == '\'' {
+				quote = ch
+			} else if unicode.IsSpace(ch) {
+				end = i
+				break
+			}
+		}
+		text = text[end:]
+	}
+	return strings.TrimSpace(text)
+}
+
+func parseArg(arg CommandArg, token string) (any, error) {
+	if len(arg.Choices) > 0 {
+		for _, choice := range arg.Choices {
+			if strings.EqualFold(choice, token) {
+				token = choice
+				break
+			}
+		}
+	}
+
+	var value any
+	switch arg.Type {
+	case ArgInt:
+		i, err := strconv.ParseInt(token, 10, 64)
+		if err != nil {
+			return nil, errors.New("not a whole number: " + token)
+		}
+		value = i
+	case ArgFloat:
+		f, err := strconv.ParseFloat(token, 64)
+		if err != nil {
+			return nil, errors.New("not a number: " + token)
+		}
+		value = f
+	case ArgBool:
+		switch strings.ToLower(token) {
+		case "true", "yes", "on", "1", "y":
+			value = true
+		case "false", "no", "off", "0", "n":
+			value = false
+		default:
+			return nil, errors.New("not yes or no: " + token)
+		}
+	case ArgDuration:
+		d, err := parseArgDuration(token)
+		if err != nil {
+			return nil, err
+		}
+		value = d
+	default:
+		value = token
+	}
+
+	if len(arg.Choices) > 0 {
+		for _, choice := range arg.Choices {
+			if choice == fmt.Sprint(value) {
+				return value, nil
+			}
+		}
+		return nil, errors.New("must be one of: " + strings.Join(arg.Choices, ", "))
+	}
+	return value, nil
+}
+
+func parseArgDuration(token string) (time.Duration, error) {
+	if seconds, err := strconv.ParseInt(token, 10, 64); err == nil {
+		return time.Duration(seconds) * time.Second, nil
+	}
+	if days, ok := strings.CutSuffix(token, "d"); ok {
+		if n, err := strconv.ParseFloat(days, 64); err == nil {
+			return time.Duration(n * float64(24*time.Hour)), nil
+		}
+	}
+	d, err := time.ParseDuration(token)
+	if err != nil {
+		return 0, errors.New("not a duration: " + token)
+	}
+	return d, nil
+}
+
+// ------------------ Bot Menu ------------------
+
+func (r *CommandRouter) scheduleSync() {
+	if !r.AutoSync {
+		return
+	}
+	if r.syncTimer != nil {
+		r.syncTimer.Stop()
+	}
+	r.syncTimer = time.AfterFunc(commandSyncDelay, func() {
+		if err := r.Sync(); err != nil {
+			r.c.Log.Error(errors.Wrap(err, "syncing bot commands"))
+		}
+	})
+}
+
+// Sync sets the bot menu (SetBotCommands) from the commands of the router, for each scope and
+// each language of the command descriptions. Scopes without commands of their own are reset,
+// so the menu of the default scope shows there.
+func (r *CommandRouter) Sync() error {
+	if me := r.c.Me(); me == nil || !me.Bot {
+		return nil
+	}
+
+	commands := r.List()
+	langs := map[string]bool{"": true}
+	for _, cmd := range commands {
+		for lang := range cmd.Descriptions {
+			langs[lang] = true
+		}
+	}
+	languages := make([]string, 0, len(langs))
+	for lang := range langs {
+		languages = append(languages, lang)
+	}
+	sort.Strings(languages)
+
+	scopes := []struct {
+		scope    BotCommandScope
+		includes []CommandScope
+	}{
+		{&BotCommandScopeDefault{}, []CommandScope{ScopeAll}},
+		{&BotCommandScopeUsers{}, []CommandScope{ScopeAll, ScopePrivate}},
+		{&BotCommandScopeChats{}, []CommandScope{ScopeAll, ScopeGroup}},
+		{&BotCommandScopeChatAdmins{}, []CommandScope{ScopeAll, ScopeGroup, ScopeAdmin}},
+	}
+
+	_, ownHelp := r.Lookup("help")
+	for _, s := range scopes {
+		for _, lang := range languages {
+			var (
+				menu []*BotCommand
+				own  bool // commands only offered in this scope
+			)
+			if !ownHelp { // the built-in /help, in every menu that is set
+				menu = append(menu, &BotCommand{Command: "help", Description: "Show the commands"})
+				own = len(s.includes) == 1
+			}
+			for _, cmd := range commands {
+				if cmd.Hidden {
+					continue
+				}
+				for i, included := range s.includes {
+					if cmd.Scope == included {
+						menu = append(menu, &BotCommand{Command: cmd.Name, Description: cmd.description(lang)})
+						own = own || i > 0 || len(s.includes) == 1
+						break
+					}
+				}
+			}
+
+			var err error
+			if own {
+				_, err = r.c.BotsSetBotCommands(s.scope, lang, menu)
+			} else {
+				_, err = r.c.BotsResetBotCommands(s.scope, lang)
+			}
+			if err != nil {
+				return errors.Wrapf(err, "scope %T, language %q", s.scope, lang)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,349 @@
+// Copyright (c) 2024 RoseLoverX
+
+package telegram
+
+import (
+	"context"
+	"reflect"
+	"runtime"
+	"sync/atomic"
+)
+
+// DispatchMode selects how updates are passed to the handlers.
+type DispatchMode int
+
+const (
+	// DispatchConcurrent handles each update in its own goroutine as soon as it arrives, or on
+	// a pool of workers if set; handlers of the same chat may run concurrently and out of order.
+	DispatchConcurrent DispatchMode = iota
+	// DispatchOrdered handles the updates of a chat one at a time, in the order they arrived,
+	// while different chats are handled in parallel. Messages awaited by a conversation skip
+	// the queue; other waits for a later update of the same chat hold it until they time out.
+	DispatchOrdered
+)
+
+// OverflowPolicy selects what happens to an update when the dispatch queue is full.
+type OverflowPolicy int
+
+const (
+	// OverflowBlock waits for room in the queue, which holds up reading further updates.
+	OverflowBlock OverflowPolicy = iota
+	// OverflowDropOldest drops the update that has been waiting the longest.
+	OverflowDropOldest
+	// OverflowDropNewest drops the incoming update.
+	OverflowDropNewest
+)
+
+const (
+	defaultDispatchBacklog = 1000 // queued updates per worker
+
+	awaitedKey int64 = -1 << 63 // key of updates handled out of order, see awaitedByConversation
+)
+
+// DispatchStats are counters of the handling of updates.
+type DispatchStats struct {
+	Queued   int    // updates waiting in the queue
+	Capacity int    // updates the queue can hold
+	Running  int64  // updates being handled
+	Handled  uint64 // updates handled since the start
+	Dropped  uint64 // updates dropped because the queue was full
+	TimedOut uint64 // handlers that ran past the handler timeout
+	Stuck    int64  // handlers still running past the handler timeout, holding their worker
+}
+
+type dispatchTask struct {
+	update Update
+	run    func()
+}
+
+// dispatchQueue runs updates on a fixed number of workers. In ordered mode chats are spread over
+// the workers, each with its own queue handled in order; otherwise the workers share a queue.
+type dispatchQueue struct {
+	shards     []chan dispatchTask
+	overflow   OverflowPolicy
+	onOverflow func(dropped Update)
+}
+
+func newDispatchQueue(ordered bool, workers, backlog int, overflow OverflowPolicy, onOverflow func(Update), stats *dispatchCounters) *dispatchQueue {
+	if workers <= 0 {
+		workers = runtime.NumCPU() * 4
+	}
+	if backlog <= 0 {
+		backlog = defaultDispatchBacklog
+	}
+
+	q := &dispatchQueue{overflow: overflow, onOverflow: onOverflow}
+	if ordered {
+		q.shards = make([]chan dispatchTask, workers)
+		for i := range q.shards {
+			q.shards[i] = make(chan dispatchTask, backlog)
+			go q.work(q.shards[i], stats)
+		}
+		return q
+	}
+
+	q.shards = []chan dispatchTask{make(chan dispatchTask, backlog*workers)}
+	for i := 0; i < workers; i++ {
+		go q.work(q.shards[0], stats)
+	}
+	return q
+}
+
+func (q *dispatchQueue) work(tasks chan dispatchTask, stats *dispatchCounters) {
+	for task := range tasks {
+		stats.track(func() {
+			defer func() { recover() }() // handlers recover themselves, this keeps the worker alive
+			task.run()
+		})
+	}
+}
+
+// push queues a task, applying the overflow policy when the queue of its key is full.
+func (q *dispatchQueue) push(key int64, task dispatchTask, stats *dispatchCounters) {
+	shard := q.shards[uint64(key)%uint64(len(q.shards))]
+	select {
+	case shard <- task:
+		return
+	default:
+	}
+
+	switch q.overflow {
+	case OverflowDropNewest:
+		q.drop(task.update, stats)
+	case OverflowDropOldest:
+		for {
+			select {
+			case oldest := <-shard:
+				q.drop(oldest.update, stats)
+			default:
+			}
+			select {
+			case shard <- task:
+				return
+			default:
+			}
+		}
+	default:
+		shard <- task
+	}
+}
+
+func (q *dispatchQueue) drop(update Update, stats *dispatchCounters) {
+	stats.dropped.Add(1)
+	if q.onOverflow != nil {
+		q.onOverflow(update)
+	}
+}
+
+func (q *dispatchQueue) queued() (queued, capacity int) {
+	for _, shard := range q.shards {
+		queued += len(shard)
+		capacity += cap(shard)
+	}
+	return queued, capacity
+}
+
+type dispatchCounters struct {
+	running  atomic.Int64
+	handled  atomic.Uint64
+	dropped  atomic.Uint64
+	timedOut atomic.Uint64
+	stuck    atomic.Int64
+}
+
+func (s *dispatchCounters) track(run func()) {
+	s.running.Add(1)
+	defer func() {
+		s.running.Add(-1)
+		s.handled.Add(1)
+	}()
+	run()
+}
+
+// run passes the handling of an update to the handlers: in its own goroutines, or queued for
+// the workers (behind the earlier updates of the same chat in ordered mode).
+func (d *UpdateDispatcher) run(update Update, key int64, tasks ...func()) {
+	all := func() {
+		for _, task := range tasks {
+			if task != nil {
+				task()
+			}
+		}
+	}
+
+	if d.queue == nil || key == awaitedKey {
+		go d.stats.track(all)
+		return
+	}
+	d.queue.push(key, dispatchTask{update: update, run: all}, &d.stats)
+}
+
+// spawn runs a handler of an update: in a new goroutine, or right away when updates are handled
+// by workers, where the update already has a goroutine of its own.
+func (d *UpdateDispatcher) spawn(task func()) {
+	if d.queue == nil {
+		go task()
+		return
+	}
+	task()
+}
+
+// invokeHandler runs a handler of a group in its middleware, with a context ending after the
+// handler timeout, when set. A handler still running by then is only told to stop through its
+// context: it keeps its worker (and in ordered mode the queue of its chat) until it returns, so
+// the caps on concurrency and the order of updates hold; it is counted in DispatchStats.Stuck.
+func (c *Client) invokeHandler(group string, update any, handler UpdateHandler) error {
+	return c.invokeHandlerContext(group, update, func(update any, _ context.Context) error { return handler(update) })
+}
+
+// invokeHandlerContext is invokeHandler for handlers given the context apart from the update.
+func (c *Client) invokeHandlerContext(group string, update any, handler func(update any, ctx context.Context) error) error {
+	timeout := c.dispatcher.handlerTimeout
+	if timeout <= 0 {
+		defer c.NewRecovery()()
+		return c.dispatcher.chain(group, func(u any) error { return handler(u, context.Background()) })(update)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		defer c.NewRecovery()()
+		done <- c.dispatcher.chain(group, func(u any) error { return handler(u, ctx) })(updateWithContext(update, ctx))
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+	}
+
+	c.dispatcher.stats.timedOut.Add(1)
+	c.dispatcher.stats.stuck.Add(1)
+	defer c.dispatcher.stats.stuck.Add(-1)
+	c.dispatcher.logger.Warn("handler timed out after ", timeout, ", waiting for it to return")
+	return <-done
+}
+
+// DispatchStats returns the counters of the handling of updates.
+func (c *Client) DispatchStats() DispatchStats {
+	if c.dispatcher == nil {
+		return DispatchStats{}
+	}
+
+	d := c.dispatcher
+	stats := DispatchStats{
+		Running:  d.stats.running.Load(),
+		Handled:  d.stats.handled.Load(),
+		Dropped:  d.stats.dropped.Load(),
+		TimedOut: d.stats.timedOut.Load(),
+		Stuck:    d.stats.stuck.Load(),
+	}
+	if d.queue != nil {
+		stats.Queued, stats.Capacity = d.queue.queued()
+	}
+	return stats
+}
+
+// awaitedByConversation reports whether a conversation waits for a message; in ordered mode it
+// is handled right away, as the conversation may be holding the queue of its chat.
+func (c *Client) awaitedByConversation(update Update) bool {
+	var (
+		message Message
+		edit    bool
+	)
+	switch u := update.(type) {
+	case *UpdateNewMessage:
+		message = u.Message
+	case *UpdateNewChannelMessage:
+		message = u.Message
+	case *UpdateEditMessage:
+		message, edit = u.Message, true
+	case *UpdateEditChannelMessage:
+		message, edit = u.Message, true
+	}
+	msg, ok := message.(*MessageObj)
+	if !ok {
+		return false
+	}
+
+	c.dispatcher.RLock()
+	handles, editHandles := c.dispatcher.messageHandles["conversation"], c.dispatcher.messageEditHandles["conversation"]
+	c.dispatcher.RUnlock()
+	if (edit && len(editHandles) == 0) || (!edit && len(handles) == 0) {
+		return false
+	}
+
+	packed := packMessage(c, msg)
+	if edit {
+		for _, h := range editHandles {
+			if h.IsMatch(msg.Message) && h.runFilterChain(packed, h.Filters) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, h := range handles {
+		if h.IsMatch(msg.Message, c) && h.runFilterChain(packed, h.Filters) {
+			return true
+		}
+	}
+	return false
+}
+
+// dispatchKey returns the key an update is queued by in ordered mode.
+func (c *Client) dispatchKey(update Update) int64 {
+	if c.dispatcher.queue == nil {
+		return 0
+	}
+	if c.awaitedByConversation(update) {
+		return awaitedKey
+	}
+	return c.updateChatKey(update)
+}
+
+// updateChatKey returns the chat an update belongs to, for ordering; zero if unknown.
+func (c *Client) updateChatKey(update Update) int64 {
+	switch u := update.(type) {
+	case *UpdateNewMessage:
+		return c.GetPeerID(messagePeer(u.Message))
+	case *UpdateNewChannelMessage:
+		return c.GetPeerID(messagePeer(u.Message))
+	case *UpdateNewScheduledMessage:
+		return c.GetPeerID(messagePeer(u.Message))
+	case *UpdateEditMessage:
+		return c.GetPeerID(messagePeer(u.Message))
+	case *UpdateEditChannelMessage:
+		return c.GetPeerID(messagePeer(u.Message))
+	case *UpdateBotCallbackQuery:
+		return c.GetPeerID(u.Peer)
+	}
+
+	v := reflect.ValueOf(update)
+	if v.Kind() != reflect.Ptr || v.IsNil() || v.Elem().Kind() != reflect.Struct {
+		return 0
+	}
+	v = v.Elem()
+	if field := v.FieldByName("Peer"); field.IsValid() && field.CanInterface() {
+		if peer, ok := field.Interface().(Peer); ok {
+			return c.GetPeerID(peer)
+		}
+	}
+	for _, name := range []string{"ChannelID", "ChatID", "UserID"} {
+		if field := v.FieldByName(name); field.IsValid() && field.Kind() == reflect.Int64 {
+			return field.Int()
+		}
+	}
+	return 0
+}
+
+func messagePeer(message Message) Peer {
+	switch msg := message.(type) {
+	case *MessageObj:
+		return msg.PeerID
+	case *MessageService:
+		return msg.PeerID
+	}
+	return nil
+}
@@ -0,0 +1,1074 @@
+// Copyright (c) 2024 RoseLoverX
+
+package telegram
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Packed updates of the kinds that have no handle of their own in updates.go; they are
+// registered with the Add*Handler functions below, or with Client.On and the matching event
+// (OnTyping, OnReaction, ...), and take filters like message handlers do.
+
+const (
+	eventUserStatus      = "userStatus"
+	eventTyping          = "typing"
+	eventRead            = "read"
+	eventReaction        = "reaction"
+	eventPollVote        = "pollVote"
+	eventPin             = "pin"
+	eventJoinRequest     = "joinRequest"
+	eventChatParticipant = "chatParticipant"
+	eventBotMember       = "botMember"
+	eventBoost           = "boost"
+	eventStory           = "story"
+	eventBusinessMessage = "businessMessage"
+)
+
+type eventHandle struct {
+	kind        string
+	Handler     func(update any) error
+	Filters     []Filter
+	Group       string
+	sortTrigger chan any
+}
+
+func (h *eventHandle) SetGroup(group string) Handle {
+	h.Group = group
+	h.sortTrigger <- h
+	return h
+}
+
+func (h *eventHandle) GetGroup() string {
+	return h.Group
+}
+
+func (c *Client) addEventHandle(kind string, handler func(update any) error, filters []Filter) Handle {
+	c.dispatcher.Lock()
+	defer c.dispatcher.Unlock()
+	if c.dispatcher.eventHandles == nil {
+		c.dispatcher.eventHandles = make(map[string]map[string][]*eventHandle)
+	}
+	if c.dispatcher.eventHandles[kind] == nil {
+		c.dispatcher.eventHandles[kind] = make(map[string][]*eventHandle)
+	}
+
+	handle := eventHandle{kind: kind, Handler: handler, Filters: filters, sortTrigger: c.dispatcher.sortTrigger}
+	c.dispatcher.eventHandles[kind]["default"] = append(c.dispatcher.eventHandles[kind]["default"], &handle)
+	return c.dispatcher.eventHandles[kind]["default"][len(c.dispatcher.eventHandles[kind]["default"])-1]
+}
+
+// handleEvent packs an update with pack, if any handler of its kind is added, and runs them.
+func (c *Client) handleEvent(kind string, pack func() any) {
+	c.dispatcher.RLock()
+	handles := c.dispatcher.eventHandles[kind]
+	c.dispatcher.RUnlock()
+	if len(handles) == 0 {
+		return
+	}
+
+	packed := pack()
+	if packed == nil || reflect.ValueOf(packed).IsNil() {
+		return
+	}
+	runGroups(c, kind, handles, func(group string, h *eventHandle) error {
+		if !runFilters(packed, h.Filters) {
+			return nil
+		}
+		return c.invokeHandler(group, packed, h.Handler)
+	})
+}
+
+// isSelf reports whether a user is the client itself.
+func (c *Client) isSelf(userID int64) bool {
+	me := c.Me()
+	return me != nil && me.ID != 0 && me.ID == userID
+}
+
+// eventSubject returns what filters check of an update from a chat.
+func eventSubject(c *Client, peer Peer, senderID int64) filterSubject {
+	s := filterSubject{client: c, chatID: c.GetPeerID(peer), senderID: senderID}
+	switch p := peer.(type) {
+	case *PeerUser:
+		s.private = true
+	case *PeerChat:
+		s.group = true
+	case *PeerChannel:
+		if channel := c.getChannel(p); channel != nil && !channel.Broadcast {
+			s.group = true
+		} else {
+			s.channel = true
+		}
+	}
+	if senderID != 0 {
+		s.sender, _ = c.GetUser(senderID)
+	}
+	return s
+}
+
+// ------------------ User Status ------------------
+
+// UserStatusUpdate is sent when a user goes online or offline.
+type UserStatusUpdate struct {
+	Client         *Client
+	OriginalUpdate *UpdateUserStatus
+	UserID         int64
+	User           *UserObj
+	Status         UserStatus
+	ctx            context.Context
+}
+
+func packUserStatus(c *Client, update *UpdateUserStatus) *UserStatusUpdate {
+	us := &UserStatusUpdate{Client: c, OriginalUpdate: update, UserID: update.UserID, Status: update.Status}
+	us.User, _ = c.GetUser(update.UserID)
+	return us
+}
+
+func (us *UserStatusUpdate) IsOnline() bool {
+	_, ok := us.Status.(*UserStatusOnline)
+	return ok
+}
+
+// WasOnline returns when the user was last seen online; the zero time if hidden.
+func (us *UserStatusUpdate) WasOnline() time.Time {
+	switch s := us.Status.(type) {
+	case *UserStatusOnline:
+		return time.Now()
+	case *UserStatusOffline:
+		return time.Unix(int64(s.WasOnline), 0)
+	}
+	return time.Time{}
+}
+
+// StatusName returns the status as one of: online, offline, recently, last_week, last_month or hidden.
+func (us *UserStatusUpdate) StatusName() string {
+	switch us.Status.(type) {
+	case *UserStatusOnline:
+		return "online"
+	case *UserStatusOffline:
+		return "offline"
+	case *UserStatusRecently:
+		return "recently"
+	case *UserStatusLastWeek:
+		return "last_week"
+	case *UserStatusLastMonth:
+		return "last_month"
+	}
+	return "hidden"
+}
+
+func (us *UserStatusUpdate) subject() filterSubject {
+	return eventSubject(us.Client, &PeerUser{UserID: us.UserID}, us.UserID)
+}
+
+// ------------------ Typing ------------------
+
+// TypingUpdate is sent when someone types, records or uploads in a chat.
+type TypingUpdate struct {
+	Client         *Client
+	OriginalUpdate Update // *UpdateUserTyping, *UpdateChatUserTyping or *UpdateChannelUserTyping
+	Peer           Peer
+	ChatID         int64
+	SenderID       int64
+	Sender         *UserObj
+	TopicID        int32
+	Action         SendMessageAction
+	ctx            context.Context
+}
+
+func packTyping(c *Client, update Update) *TypingUpdate {
+	t := &TypingUpdate{Client: c, OriginalUpdate: update}
+	switch u := update.(type) {
+	case *UpdateUserTyping:
+		t.Peer, t.SenderID, t.Action = &PeerUser{UserID: u.UserID}, u.UserID, u.Action
+	case *UpdateChatUserTyping:
+		t.Peer, t.SenderID, t.Action = &PeerChat{ChatID: u.ChatID}, c.GetPeerID(u.FromID), u.Action
+	case *UpdateChannelUserTyping:
+		t.Peer, t.SenderID, t.Action, t.TopicID = &PeerChannel{ChannelID: u.ChannelID}, c.GetPeerID(u.FromID), u.Action, u.TopMsgID
+	default:
+		return nil
+	}
+	t.ChatID = c.GetPeerID(t.Peer)
+	if t.SenderID != 0 {
+		t.Sender, _ = c.GetUser(t.SenderID)
+	}
+	return t
+}
+
+func (t *TypingUpdate) IsTyping() bool {
+	_, ok := t.Action.(*SendMessageTypingAction)
+	return ok
+}
+
+// IsCancelled reports whether the sender stopped the action.
+func (t *TypingUpdate) IsCancelled() bool {
+	_, ok := t.Action.(*SendMessageCancelAction)
+	return ok
+}
+
+// ActionType returns the kind of action, like "Typing", "UploadPhoto" or "RecordAudio".
+func (t *TypingUpdate) ActionType() string {
+	if t.Action == nil {
+		return ""
+	}
+	name := reflect.TypeOf(t.Action).Elem().Name()
+	return strings.TrimSuffix(strings.TrimPrefix(name, "SendMessage"), "Action")
+}
+
+func (t *TypingUpdate) IsPrivate() bool {
+	_, ok := t.Peer.(*PeerUser)
+	return ok
+}
+
+func (t *TypingUpdate) subject() filterSubject {
+	return eventSubject(t.Client, t.Peer, t.SenderID)
+}
+
+// ------------------ Read Receipts ------------------
+
+// ReadUpdate is sent when the messages of a chat are read: incoming ones by the client
+// (on another device), or outgoing ones by the other side.
+type ReadUpdate struct {
+	Client         *Client
+	OriginalUpdate Update // *UpdateReadHistoryInbox, *UpdateReadHistoryOutbox, *UpdateReadChannelInbox or *UpdateReadChannelOutbox
+	Peer           Peer
+	ChatID         int64
+	MaxID          int32 // messages up to this id are read
+	StillUnread    int32 // incoming messages left unread
+	Outbox         bool
+	ctx            context.Context
+}
+
+func packRead(c *Client, update Update) *ReadUpdate {
+	r := &ReadUpdate{Client: c, OriginalUpdate: update}
+	switch u := update.(type) {
+	case *UpdateReadHistoryInbox:
+		r.Peer, r.MaxID, r.StillUnread = u.Peer, u.MaxID, u.StillUnreadCount
+	case *UpdateReadHistoryOutbox:
+		r.Peer, r.MaxID, r.Outbox = u.Peer, u.MaxID, true
+	case *UpdateReadChannelInbox:
+		r.Peer, r.MaxID, r.StillUnread = &PeerChannel{ChannelID: u.ChannelID}, u.MaxID, u.StillUnreadCount
+	case *UpdateReadChannelOutbox:
+		r.Peer, r.MaxID, r.Outbox = &PeerChannel{ChannelID: u.ChannelID}, u.MaxID, true
+	default:
+		return nil
+	}
+	r.ChatID = c.GetPeerID(r.Peer)
+	return r
+}
+
+// IsInbox reports whether incoming messages were read, by the client.
+func (r *ReadUpdate) IsInbox() bool {
+	return !r.Outbox
+}
+
+// IsOutbox reports whether outgoing messages were read, by the other side.
+func (r *ReadUpdate) IsOutbox() bool {
+	return r.Outbox
+}
+
+// IsRead reports whether a message of the chat is covered by the receipt.
+func (r *ReadUpdate) IsRead(msgID int32) bool {
+	return msgID <= r.MaxID
+}
+
+func (r *ReadUpdate) subject() filterSubject {
+	return eventSubject(r.Client, r.Peer, 0)
+}
+
+// ------------------ Reactions ------------------
+
+// ReactionUpdate is sent when the reactions to a message change. Bots get who reacted
+// (Actor, Old and New) or the anonymous counters; users get the counters of the message.
+type ReactionUpdate struct {
+	Client         *Client
+	OriginalUpdate Update // *UpdateMessageReactions, *UpdateBotMessageReaction or *UpdateBotMessageReactions
+	Peer           Peer
+	ChatID         int64
+	MsgID          int32
+	TopicID        int32
+	Date           int32
+	ActorID        int64
+	Actor          *UserObj
+	Old            []Reaction
+	New            []Reaction
+	Counts         []*ReactionCount
+	Reactions      *MessageReactions
+	ctx            context.Context
+}
+
+func packReaction(c *Client, update Update) *ReactionUpdate {
+	r := &ReactionUpdate{Client: c, OriginalUpdate: update}
+	switch u := update.(type) {
+	case *UpdateMessageReactions:
+		r.Peer, r.MsgID, r.TopicID, r.Reactions = u.Peer, u.MsgID, u.TopMsgID, u.Reactions
+		if u.Reactions != nil {
+			r.Counts = u.Reactions.Results
+		}
+	case *UpdateBotMessageReaction:
+		r.Peer, r.MsgID, r.Date, r.Old, r.New = u.Peer, u.MsgID, u.Date, u.OldReactions, u.NewReactions
+		r.ActorID = c.GetPeerID(u.Actor)
+		if _, ok := u.Actor.(*PeerUser); ok {
+			r.Actor, _ = c.GetUser(r.ActorID)
+		}
+	case *UpdateBotMessageReactions:
+		r.Peer, r.MsgID, r.Date, r.Counts = u.Peer, u.MsgID, u.Date, u.Reactions
+	default:
+		return nil
+	}
+	r.ChatID = c.GetPeerID(r.Peer)
+	return r
+}
+
+// IsAnonymous reports whether the reactor is unknown, with only the counters given.
+func (r *ReactionUpdate) IsAnonymous() bool {
+	return r.ActorID == 0
+}
+
+// Added returns the reactions the actor added.
+func (r *ReactionUpdate) Added() []Reaction {
+	return reactionsMissing(r.New, r.Old)
+}
+
+// Removed returns the reactions the actor took back.
+func (r *ReactionUpdate) Removed() []Reaction {
+	return reactionsMissing(r.Old, r.New)
+}
+
+// Emojis returns the emoji of the reactions the actor has now; custom emoji are left out.
+func (r *ReactionUpdate) Emojis() []string {
+	var emojis []string
+	for _, reaction := range r.New {
+		if emoji, ok := reaction.(*ReactionEmoji); ok {
+			emojis = append(emojis, emoji.Emoticon)
+		}
+	}
+	return emojis
+}
+
+func (r *ReactionUpdate) GetMessage() (*NewMessage, error) {
+	return r.Client.GetMessageByID(r.Peer, r.MsgID)
+}
+
+func (r *ReactionUpdate) subject() filterSubject {
+	return eventSubject(r.Client, r.Peer, r.ActorID)
+}
+
+// reactionsMissing returns the reactions of a missing from b.
+func reactionsMissing(a, b []Reaction) []Reaction {
+	var missing []Reaction
+	for _, reaction := range a {
+		found := false
+		for _, other := range b {
+			if reflect.DeepEqual(reaction, other) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, reaction)
+		}
+	}
+	return missing
+}
+
+// ------------------ Poll Votes ------------------
+
+// PollVoteUpdate is sent when a user votes in a poll of the bot (Voter and Options), or when
+// the results of a poll change (Poll and Results).
+type PollVoteUpdate struct {
+	Client         *Client
+	OriginalUpdate Update // *UpdateMessagePollVote or *UpdateMessagePoll
+	PollID         int64
+	Poll           *Poll // only if the server knows the client hasn't seen the poll yet
+	Results        *PollResults
+	VoterID        int64
+	Voter          *UserObj
+	Options        [][]byte
+	ctx            context.Context
+}
+
+func packPollVote(c *Client, update Update) *PollVoteUpdate {
+	p := &PollVoteUpdate{Client: c, OriginalUpdate: update}
+	switch u := update.(type) {
+	case *UpdateMessagePollVote:
+		p.PollID, p.VoterID, p.Options = u.PollID, c.GetPeerID(u.Peer), u.Options
+		if _, ok := u.Peer.(*PeerUser); ok {
+			p.Voter, _ = c.GetUser(p.VoterID)
+		}
+	case *UpdateMessagePoll:
+		p.PollID, p.Poll, p.Results = u.PollID, u.Poll, u.Results
+	default:
+		return nil
+	}
+	return p
+}
+
+// IsVote reports whether the update is the vote of a user, rather than new results.
+func (p *PollVoteUpdate) IsVote() bool {
+	_, ok := p.OriginalUpdate.(*UpdateMessagePollVote)
+	return ok
+}
+
+// IsRetracted reports whether the voter took back their vote.
+func (p *PollVoteUpdate) IsRetracted() bool {
+	return p.IsVote() && len(p.Options) == 0
+}
+
+// Chose reports whether the voter chose an option.
+func (p *PollVoteUpdate) Chose(option []byte) bool {
+	for _, o := range p.Options {
+		if string(o) == string(option) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *PollVoteUpdate) TotalVoters() int32 {
+	if p.Results != nil {
+		return p.Results.TotalVoters
+	}
+	return 0
+}
+
+func (p *PollVoteUpdate) subject() filterSubject {
+	if p.VoterID == 0 {
+		return filterSubject{client: p.Client}
+	}
+	return eventSubject(p.Client, &PeerUser{UserID: p.VoterID}, p.VoterID)
+}
+
+// ------------------ Pinned Messages ------------------
+
+// PinUpdate is sent when messages of a chat are pinned or unpinned.
+type PinUpdate struct {
+	Client         *Client
+	OriginalUpdate Update // *UpdatePinnedMessages or *UpdatePinnedChannelMessages
+	Peer           Peer
+	ChatID         int64
+	Messages       []int32
+	Pinned         bool
+	ctx            context.Context
+}
+
+func packPin(c *Client, update Update) *PinUpdate {
+	p := &PinUpdate{Client: c, OriginalUpdate: update}
+	switch u := update.(type) {
+	case *UpdatePinnedMessages:
+		p.Peer, p.Messages, p.Pinned = u.Peer, u.Messages, u.Pinned
+	case *UpdatePinnedChannelMessages:
+		p.Peer, p.Messages, p.Pinned = &PeerChannel{ChannelID: u.ChannelID}, u.Messages, u.Pinned
+	default:
+		return nil
+	}
+	p.ChatID = c.GetPeerID(p.Peer)
+	return p
+}
+
+func (p *PinUpdate) IsPinned() bool {
+	return p.Pinned
+}
+
+func (p *PinUpdate) IsUnpinned() bool {
+	return !p.Pinned
+}
+
+// GetMessages fetches the pinned (or unpinned) messages.
+func (p *PinUpdate) GetMessages() ([]NewMessage, error) {
+	return p.Client.GetMessages(p.Peer, &SearchOption{IDs: p.Messages})
+}
+
+func (p *PinUpdate) subject() filterSubject {
+	return eventSubject(p.Client, p.Peer, 0)
+}
+
+// ------------------ Join Requests ------------------
+
+// JoinRequestUpdate is sent when a user asks to join a chat: to bots with the user who
+// asked, to users with the number of pending requests and the recent requesters.
+type JoinRequestUpdate struct {
+	Client           *Client
+	OriginalUpdate   Update // *UpdateBotChatInviteRequester or *UpdatePendingJoinRequests
+	Peer             Peer
+	ChatID           int64
+	UserID           int64
+	User             *UserObj
+	About            string
+	Invite           ExportedChatInvite
+	Date             int32
+	Pending          int32
+	RecentRequesters []int64
+	ctx              context.Context
+}
+
+func packJoinRequest(c *Client, update Update) *JoinRequestUpdate {
+	j := &JoinRequestUpdate{Client: c, OriginalUpdate: update}
+	switch u := update.(type) {
+	case *UpdateBotChatInviteRequester:
+		j.Peer, j.UserID, j.About, j.Invite, j.Date = u.Peer, u.UserID, u.About, u.Invite, u.Date
+		j.User, _ = c.GetUser(u.UserID)
+	case *UpdatePendingJoinRequests:
+		j.Peer, j.Pending, j.RecentRequesters = u.Peer, u.RequestsPending, u.RecentRequesters
+	default:
+		return nil
+	}
+	j.ChatID = c.GetPeerID(j.Peer)
+	return j
+}
+
+// IsRequest reports whether the update is the request of a single user, rather than the
+// count of pending ones.
+func (j *JoinRequestUpdate) IsRequest() bool {
+	return j.UserID != 0
+}
+
+// Approve lets the user join the chat.
+func (j *JoinRequestUpdate) Approve() error {
+	return j.hide(true)
+}
+
+// Decline turns the request of the user down.
+func (j *JoinRequestUpdate) Decline() error {
+	return j.hide(false)
+}
+
+func (j *JoinRequestUpdate) hide(approved bool) error {
+	if j.UserID == 0 {
+		return errors.New("no user to approve or decline, use GetChatJoinRequests")
+	}
+	peer, err := j.Client.ResolvePeer(j.Peer)
+	if err != nil {
+		return err
+	}
+	user, err := j.Client.GetSendableUser(&PeerUser{UserID: j.UserID})
+	if err != nil {
+		return err
+	}
+	_, err = j.Client.MessagesHideChatJoinRequest(approved, peer, user)
+	return err
+}
+
+func (j *JoinRequestUpdate) subject() filterSubject {
+	return eventSubject(j.Client, j.Peer, j.UserID)
+}
+
+// ------------------ Basic Group Participants ------------------
+
+// ChatParticipantUpdate is sent to bots when a member of a basic group joins, leaves, or is
+// added, removed, promoted or demoted; ParticipantUpdate is its counterpart for channels.
+type ChatParticipantUpdate struct {
+	Client         *Client
+	OriginalUpdate *UpdateChatParticipant
+	Chat           *ChatObj
+	User           *UserObj
+	Actor          *UserObj
+	Old            ChatParticipant
+	New            ChatParticipant
+	Invite         ExportedChatInvite
+	Date           int32
+	ctx            context.Context
+}
+
+func packChatParticipant(c *Client, update *UpdateChatParticipant) *ChatParticipantUpdate {
+	cp := &ChatParticipantUpdate{
+		Client:         c,
+		OriginalUpdate: update,
+		Chat:           c.getChat(&PeerChat{ChatID: update.ChatID}),
+		Old:            update.PrevParticipant,
+		New:            update.NewParticipant,
+		Invite:         update.Invite,
+		Date:           update.Date,
+	}
+	cp.User, _ = c.GetUser(update.UserID)
+	cp.Actor, _ = c.GetUser(update.ActorID)
+	return cp
+}
+
+func (cp *ChatParticipantUpdate) ChatID() int64 {
+	return cp.OriginalUpdate.ChatID
+}
+
+func (cp *ChatParticipantUpdate) UserID() int64 {
+	return cp.OriginalUpdate.UserID
+}
+
+func (cp *ChatParticipantUpdate) ActorID() int64 {
+	return cp.OriginalUpdate.ActorID
+}
+
+func (cp *ChatParticipantUpdate) byUser() bool {
+	return cp.ActorID() == 0 || cp.ActorID() == cp.UserID()
+}
+
+// IsJoined reports whether the user joined the group by themselves.
+func (cp *ChatParticipantUpdate) IsJoined() bool {
+	return cp.Old == nil && cp.New != nil && cp.byUser()
+}
+
+// IsAdded reports whether the user was added to the group by someone else.
+func (cp *ChatParticipantUpdate) IsAdded() bool {
+	return cp.Old == nil && cp.New != nil && !cp.byUser()
+}
+
+// IsLeft reports whether the user left the group by themselves.
+func (cp *ChatParticipantUpdate) IsLeft() bool {
+	return cp.Old != nil && cp.New == nil && cp.byUser()
+}
+
+// IsKicked reports whether the user was removed from the group by someone else.
+func (cp *ChatParticipantUpdate) IsKicked() bool {
+	return cp.Old != nil && cp.New == nil && !cp.byUser()
+}
+
+func (cp *ChatParticipantUpdate) IsPromoted() bool {
+	_, wasAdmin := cp.Old.(*ChatParticipantAdmin)
+	_, isAdmin := cp.New.(*ChatParticipantAdmin)
+	return cp.Old != nil && !wasAdmin && isAdmin
+}
+
+func (cp *ChatParticipantUpdate) IsDemoted() bool {
+	_, wasAdmin := cp.Old.(*ChatParticipantAdmin)
+	_, isAdmin := cp.New.(*ChatParticipantAdmin)
+	return wasAdmin && cp.New != nil && !isAdmin
+}
+
+func (cp *ChatParticipantUpdate) subject() filterSubject {
+	return eventSubject(cp.Client, &PeerChat{ChatID: cp.ChatID()}, cp.ActorID())
+}
+
+// ------------------ Bot Membership ------------------
+
+// BotMemberUpdate is sent when the membership of the client itself changes: it is added to
+// or removed from a chat, promoted or demoted, or a user blocks or unblocks the bot.
+// OldStatus and NewStatus are one of Creator, Admin, Member, Restricted, Left or Kicked.
+type BotMemberUpdate struct {
+	Client         *Client
+	OriginalUpdate Update // *UpdateChannelParticipant, *UpdateChatParticipant or *UpdateBotStopped
+	Peer           Peer
+	ChatID         int64
+	ActorID        int64
+	Actor          *UserObj
+	OldStatus      string
+	NewStatus      string
+	Invite         ExportedChatInvite
+	Date           int32
+	ctx            context.Context
+}
+
+func packBotMember(c *Client, update Update) *BotMemberUpdate {
+	b := &BotMemberUpdate{Client: c, OriginalUpdate: update}
+	switch u := update.(type) {
+	case *UpdateChannelParticipant:
+		b.Peer, b.ActorID, b.Invite, b.Date = &PeerChannel{ChannelID: u.ChannelID}, u.ActorID, u.Invite, u.Date
+		b.OldStatus, b.NewStatus = channelParticipantStatus(u.PrevParticipant), channelParticipantStatus(u.NewParticipant)
+	case *UpdateChatParticipant:
+		b.Peer, b.ActorID, b.Invite, b.Date = &PeerChat{ChatID: u.ChatID}, u.ActorID, u.Invite, u.Date
+		b.OldStatus, b.NewStatus = chatParticipantStatus(u.PrevParticipant), chatParticipantStatus(u.NewParticipant)
+	case *UpdateBotStopped:
+		b.Peer, b.ActorID, b.Date = &PeerUser{UserID: u.UserID}, u.UserID, u.Date
+		b.OldStatus, b.NewStatus = Kicked, Member
+		if u.Stopped {
+			b.OldStatus, b.NewStatus = Member, Kicked
+		}
+	default:
+		return nil
+	}
+	b.ChatID = c.GetPeerID(b.Peer)
+	if b.ActorID != 0 {
+		b.Actor, _ = c.GetUser(b.ActorID)
+	}
+	return b
+}
+
+func channelParticipantStatus(participant ChannelParticipant) string {
+	switch p := participant.(type) {
+	case *ChannelParticipantCreator:
+		return Creator
+	case *ChannelParticipantAdmin:
+		return Admin
+	case *ChannelParticipantObj, *ChannelParticipantSelf:
+		return Member
+	case *ChannelParticipantBanned:
+		if p.Left || (p.BannedRights != nil && p.BannedRights.ViewMessages) {
+			return Kicked
+		}
+		return Restricted
+	}
+	return Left
+}
+
+func chatParticipantStatus(participant ChatParticipant) string {
+	switch participant.(type) {
+	case *ChatParticipantCreator:
+		return Creator
+	case *ChatParticipantAdmin:
+		return Admin
+	case *ChatParticipantObj:
+		return Member
+	}
+	return Left
+}
+
+func isMemberStatus(status string) bool {
+	return status == Creator || status == Admin || status == Member || status == Restricted
+}
+
+// IsPrivate reports whether the update is about a user blocking or unblocking the bot.
+func (b *BotMemberUpdate) IsPrivate() bool {
+	_, ok := b.OriginalUpdate.(*UpdateBotStopped)
+	return ok
+}
+
+// IsAdded reports whether the client became a member (or the bot was unblocked).
+func (b *BotMemberUpdate) IsAdded() bool {
+	return !isMemberStatus(b.OldStatus) && isMemberStatus(b.NewStatus)
+}
+
+// IsRemoved reports whether the client is no longer a member (or the bot was blocked).
+func (b *BotMemberUpdate) IsRemoved() bool {
+	return isMemberStatus(b.OldStatus) && !isMemberStatus(b.NewStatus)
+}
+
+func (b *BotMemberUpdate) IsPromoted() bool {
+	return b.OldStatus != Admin && b.OldStatus != Creator && b.NewStatus == Admin
+}
+
+func (b *BotMemberUpdate) IsDemoted() bool {
+	return b.OldStatus == Admin && b.NewStatus != Admin && b.NewStatus != Creator
+}
+
+func (b *BotMemberUpdate) subject() filterSubject {
+	return eventSubject(b.Client, b.Peer, b.ActorID)
+}
+
+// ------------------ Boosts ------------------
+
+// BoostUpdate is sent to bots when a channel they administer is boosted.
+type BoostUpdate struct {
+	Client         *Client
+	OriginalUpdate *UpdateBotChatBoost
+	Peer           Peer
+	ChannelID      int64
+	Channel        *Channel
+	Boost          *Boost
+	Booster        *UserObj
+	ctx            context.Context
+}
+
+func packBoost(c *Client, update *UpdateBotChatBoost) *BoostUpdate {
+	b := &BoostUpdate{Client: c, OriginalUpdate: update, Peer: update.Peer, ChannelID: c.GetPeerID(update.Peer), Boost: update.Boost}
+	b.Channel = c.getChannel(update.Peer)
+	if b.BoosterID() != 0 {
+		b.Booster, _ = c.GetUser(b.BoosterID())
+	}
+	return b
+}
+
+// BoosterID returns the user who boosted; zero for unclaimed giveaway boosts.
+func (b *BoostUpdate) BoosterID() int64 {
+	if b.Boost != nil {
+		return b.Boost.UserID
+	}
+	return 0
+}
+
+func (b *BoostUpdate) IsGift() bool {
+	return b.Boost != nil && b.Boost.Gift
+}
+
+func (b *BoostUpdate) IsGiveaway() bool {
+	return b.Boost != nil && b.Boost.Giveaway
+}
+
+func (b *BoostUpdate) Expires() time.Time {
+	if b.Boost != nil {
+		return time.Unix(int64(b.Boost.Expires), 0)
+	}
+	return time.Time{}
+}
+
+func (b *BoostUpdate) subject() filterSubject {
+	return eventSubject(b.Client, b.Peer, b.BoosterID())
+}
+
+// ------------------ Stories ------------------
+
+// StoryUpdate is sent when a peer posts, edits or deletes a story.
+type StoryUpdate struct {
+	Client         *Client
+	OriginalUpdate *UpdateStory
+	Peer           Peer
+	PeerID         int64
+	Story          StoryItem
+	ctx            context.Context
+}
+
+func packStory(c *Client, update *UpdateStory) *StoryUpdate {
+	return &StoryUpdate{Client: c, OriginalUpdate: update, Peer: update.Peer, PeerID: c.GetPeerID(update.Peer), Story: update.Story}
+}
+
+func (s *StoryUpdate) ID() int32 {
+	switch story := s.Story.(type) {
+	case *StoryItemObj:
+		return story.ID
+	case *StoryItemSkipped:
+		return story.ID
+	case *StoryItemDeleted:
+		return story.ID
+	}
+	return 0
+}
+
+func (s *StoryUpdate) IsDeleted() bool {
+	_, ok := s.Story.(*StoryItemDeleted)
+	return ok
+}
+
+// Item returns the story, nil if deleted or left out; GetStory fetches the latter.
+func (s *StoryUpdate) Item() *StoryItemObj {
+	story, _ := s.Story.(*StoryItemObj)
+	return story
+}
+
+// GetStory fetches the full story.
+func (s *StoryUpdate) GetStory() (*StoryItemObj, error) {
+	peer, err := s.Client.ResolvePeer(s.Peer)
+	if err != nil {
+		return nil, err
+	}
+	stories, err := s.Client.StoriesGetStoriesByID(peer, []int32{s.ID()})
+	if err != nil {
+		return nil, err
+	}
+	for _, story := range stories.Stories {
+		if story, ok := story.(*StoryItemObj); ok {
+			return story, nil
+		}
+	}
+	return nil, errors.New("story not found")
+}
+
+func (s *StoryUpdate) subject() filterSubject {
+	var sender int64
+	if _, ok := s.Peer.(*PeerUser); ok {
+		sender = s.PeerID
+	}
+	return eventSubject(s.Client, s.Peer, sender)
+}
+
+// ------------------ Business Messages ------------------
+
+// BusinessMessage is sent to bots connected to a business account when a message of its
+// chats is sent, edited or deleted.
+type BusinessMessage struct {
+	Client         *Client
+	OriginalUpdate Update // *UpdateBotNewBusinessMessage, *UpdateBotEditBusinessMessage or *UpdateBotDeleteBusinessMessage
+	ConnectionID   string
+	Message        *NewMessage // nil for deletions
+	ReplyTo        *NewMessage
+	Peer           Peer
+	ChatID         int64
+	DeletedIDs     []int32
+	ctx            context.Context
+}
+
+func packBusinessMessage(c *Client, update Update) *BusinessMessage {
+	b := &BusinessMessage{Client: c, OriginalUpdate: update}
+	var message, replyTo Message
+	switch u := update.(type) {
+	case *UpdateBotNewBusinessMessage:
+		b.ConnectionID, message, replyTo = u.ConnectionID, u.Message, u.ReplyToMessage
+	case *UpdateBotEditBusinessMessage:
+		b.ConnectionID, message, replyTo = u.ConnectionID, u.Message, u.ReplyToMessage
+	case *UpdateBotDeleteBusinessMessage:
+		b.ConnectionID, b.Peer, b.DeletedIDs = u.ConnectionID, u.Peer, u.Messages
+	default:
+		return nil
+	}
+	if msg, ok := message.(*MessageObj); ok {
+		b.Message, b.Peer = packMessage(c, msg), msg.PeerID
+	}
+	if msg, ok := replyTo.(*MessageObj); ok {
+		b.ReplyTo = packMessage(c, msg)
+	}
+	b.ChatID = c.GetPeerID(b.Peer)
+	return b
+}
+
+func (b *BusinessMessage) IsNew() bool {
+	_, ok := b.OriginalUpdate.(*UpdateBotNewBusinessMessage)
+	return ok
+}
+
+func (b *BusinessMessage) IsEdit() bool {
+	_, ok := b.OriginalUpdate.(*UpdateBotEditBusinessMessage)
+	return ok
+}
+
+func (b *BusinessMessage) IsDelete() bool {
+	_, ok := b.OriginalUpdate.(*UpdateBotDeleteBusinessMessage)
+	return ok
+}
+
+func (b *BusinessMessage) Text() string {
+	if b.Message != nil {
+		return b.Message.MessageText()
+	}
+	return ""
+}
+
+func (b *BusinessMessage) subject() filterSubject {
+	if b.Message != nil {
+		s, _ := filterSubjectOf(b.Message)
+		return s
+	}
+	return eventSubject(b.Client, b.Peer, 0)
+}
+
+// ------------------ Handlers ------------------
+
+// Handle updates categorized as "UpdateUserStatus"
+func (c *Client) AddUserStatusHandler(handler func(u *UserStatusUpdate) error, filters ...Filter) Handle {
+	return c.addEventHandle(eventUserStatus, func(u any) error { return handler(u.(*UserStatusUpdate)) }, filters)
+}
+
+// Handle updates categorized as "UpdateUserTyping"
+//
+// Included Updates:
+//   - User Typing
+//   - Chat User Typing
+//   - Channel User Typing
+func (c *Client) AddTypingHandler(handler func(t *TypingUpdate) error, filters ...Filter) Handle {
+	return c.addEventHandle(eventTyping, func(u any) error { return handler(u.(*TypingUpdate)) }, filters)
+}
+
+// Handle updates categorized as "UpdateReadHistory"
+//
+// Included Updates:
+//   - Read History Inbox
+//   - Read History Outbox
+//   - Read Channel Inbox
+//   - Read Channel Outbox
+func (c *Client) AddReadHandler(handler func(r *ReadUpdate) error, filters ...Filter) Handle {
+	return c.addEventHandle(eventRead, func(u any) error { return handler(u.(*ReadUpdate)) }, filters)
+}
+
+// Handle updates categorized as "UpdateMessageReactions"
+//
+// Included Updates:
+//   - Message Reactions
+//   - Bot Message Reaction
+//   - Bot Message Reactions
+func (c *Client) AddReactionHandler(handler func(r *ReactionUpdate) error, filters ...Filter) Handle {
+	return c.addEventHandle(eventReaction, func(u any) error { return handler(u.(*ReactionUpdate)) }, filters)
+}
+
+// Handle updates categorized as "UpdateMessagePollVote"
+//
+// Included Updates:
+//   - Message Poll Vote
+//   - Message Poll
+func (c *Client) AddPollVoteHandler(handler func(p *PollVoteUpdate) error, filters ...Filter) Handle {
+	return c.addEventHandle(eventPollVote, func(u any) error { return handler(u.(*PollVoteUpdate)) }, filters)
+}
+
+// Handle updates categorized as "UpdatePinnedMessages"
+//
+// Included Updates:
+//   - Pinned Messages
+//   - Pinned Channel Messages
+func (c *Client) AddPinHandler(handler func(p *PinUpdate) error, filters ...Filter) Handle {
+	return c.addEventHandle(eventPin, func(u any) error { return handler(u.(*PinUpdate)) }, filters)
+}
+
+// Handle updates categorized as "UpdateBotChatInviteRequester"
+//
+// Included Updates:
+//   - Bot Chat Invite Requester
+//   - Pending Join Requests
+func (c *Client) AddJoinRequestHandler(handler func(j *JoinRequestUpdate) error, filters ...Filter) Handle {
+	return c.addEventHandle(eventJoinRequest, func(u any) error { return handler(u.(*JoinRequestUpdate)) }, filters)
+}
+
+// Handle updates categorized as "UpdateChatParticipant"
+func (c *Client) AddChatParticipantHandler(handler func(p *ChatParticipantUpdate) error, filters ...Filter) Handle {
+	return c.addEventHandle(eventChatParticipant, func(u any) error { return handler(u.(*ChatParticipantUpdate)) }, filters)
+}
+
+// Handle changes of the membership of the client itself
+//
+// Included Updates:
+//   - Channel Participant (of the client)
+//   - Chat Participant (of the client)
+//   - Bot Stopped
+func (c *Client) AddBotMemberHandler(handler func(b *BotMemberUpdate) error, filters ...Filter) Handle {
+	return c.addEventHandle(eventBotMember, func(u any) error { return handler(u.(*BotMemberUpdate)) }, filters)
+}
+
+// Handle updates categorized as "UpdateBotChatBoost"
+func (c *Client) AddBoostHandler(handler func(b *BoostUpdate) error, filters ...Filter) Handle {
+	return c.addEventHandle(eventBoost, func(u any) error { return handler(u.(*BoostUpdate)) }, filters)
+}
+
+// Handle updates categorized as "UpdateStory"
+func (c *Client) AddStoryHandler(handler func(s *StoryUpdate) error, filters ...Filter) Handle {
+	return c.addEventHandle(eventStory, func(u any) error { return handler(u.(*StoryUpdate)) }, filters)
+}
+
+// Handle updates categorized as "UpdateBotBusinessMessage"
+//
+// Included Updates:
+//   - New Business Message
+//   - Edit Business Message
+//   - Delete Business Message
+func (c *Client) AddBusinessMessageHandler(handler func(b *BusinessMessage) error, filters ...Filter) Handle {
+	return c.addEventHandle(eventBusinessMessage, func(u any) error { return handler(u.(*BusinessMessage)) }, filters)
+}
+
+// dispatchEvent returns the handling of an update by the handlers of its kind, nil if it has none.
+func (c *Client) dispatchEvent(update Update) func() {
+	switch u := update.(type) {
+	case *UpdateUserStatus:
+		return func() { c.handleEvent(eventUserStatus, func() any { return packUserStatus(c, u) }) }
+	case *UpdateUserTyping, *UpdateChatUserTyping, *UpdateChannelUserTyping:
+		return func() { c.handleEvent(eventTyping, func() any { return packTyping(c, u) }) }
+	case *UpdateReadHistoryInbox, *UpdateReadHistoryOutbox, *UpdateReadChannelInbox, *UpdateReadChannelOutbox:
+		return func() { c.handleEvent(eventRead, func() any { return packRead(c, u) }) }
+	case *UpdateMessageReactions, *UpdateBotMessageReaction, *UpdateBotMessageReactions:
+		return func() { c.handleEvent(eventReaction, func() any { return packReaction(c, u) }) }
+	case *UpdateMessagePollVote, *UpdateMessagePoll:
+		return func() { c.handleEvent(eventPollVote, func() any { return packPollVote(c, u) }) }
+	case *UpdatePinnedMessages, *UpdatePinnedChannelMessages:
+		return func() { c.handleEvent(eventPin, func() any { return packPin(c, u) }) }
+	case *UpdateBotChatInviteRequester, *UpdatePendingJoinRequests:
+		return func() { c.handleEvent(eventJoinRequest, func() any { return packJoinRequest(c, u) }) }
+	case *UpdateChatParticipant:
+		return func() {
+			c.handleEvent(eventChatParticipant, func() any { return packChatParticipant(c, u) })
+			if c.isSelf(u.UserID) {
+				c.handleEvent(eventBotMember, func() any { return packBotMember(c, u) })
+			}
+		}
+	case *UpdateChannelParticipant:
+		return func() {
+			if c.isSelf(u.UserID) {
+				c.handleEvent(eventBotMember, func() any { return packBotMember(c, u) })
+			}
+		}
+	case *UpdateBotStopped:
+		return func() { c.handleEvent(eventBotMember, func() any { return packBotMember(c, u) }) }
+	case *UpdateBotChatBoost:
+		return func() { c.handleEvent(eventBoost, func() any { return packBoost(c, u) }) }
+	case *UpdateStory:
+		return func() { c.handleEvent(eventStory, func() any { return packStory(c, u) }) }
+	case *UpdateBotNewBusinessMessage, *UpdateBotEditBusinessMessage, *UpdateBotDeleteBusinessMessage:
+		return func() { c.handleEvent(eventBusinessMessage, func() any { return packBusinessMessage(c, u) }) }
+	}
+	return nil
+}
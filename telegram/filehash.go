@@ -0,0 +1,181 @@
+// Copyright (c) 2024 RoseLoverX
+
+package telegram
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// how many times a single part may fail its hash check before the download is aborted
+const maxIntegrityRetries = 5
+
+// fileHashBlock is the size of the ranges upload.getFileHashes hashes; parts of a verified
+// download must be aligned to it.
+const fileHashBlock = 128 * 1024
+
+// IntegrityError is returned by DownloadMedia in Verify mode, when a part
+// keeps failing its SHA256 check against upload.getFileHashes, or when the
+// hashes cannot be fetched (Err).
+type IntegrityError struct {
+	Part     int
+	Offset   int64
+	Attempts int
+	Err      error
+}
+
+func (e *IntegrityError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("integrity check failed for part %d (offset %d): %v", e.Part, e.Offset, e.Err)
+	}
+	return fmt.Sprintf("integrity check failed for part %d (offset %d) after %d attempts", e.Part, e.Offset, e.Attempts)
+}
+
+func (e *IntegrityError) Unwrap() error { return e.Err }
+
+// partVerifier checks downloaded parts against the hashes returned by upload.getFileHashes,
+// fetching them lazily as parts arrive.
+type partVerifier struct {
+	sync.Mutex
+	c        *Client
+	dc       int32
+	location InputFileLocation
+	hashes   []*FileHash // sorted by offset
+	failures map[int]int
+}
+
+func newPartVerifier(c *Client, dc int32, location InputFileLocation) *partVerifier {
+	return &partVerifier{
+		c:        c,
+		dc:       dc,
+		location: location,
+		failures: make(map[int]int),
+	}
+}
+
+// covering returns the known hashes covering [offset, end) from offset on, and the offset up
+// to which they reach.
+func (v *partVerifier) covering(offset, end int64) ([]*FileHash, int64) {
+	v.Lock()
+	defer v.Unlock()
+
+	var covered []*FileHash
+	next := offset
+	i := sort.Search(len(v.hashes), func(i int) bool {
+		return v.hashes[i].Offset+int64(v.hashes[i].Limit) > offset
+	})
+	for ; next < end && i < len(v.hashes) && v.hashes[i].Offset <= next; i++ {
+		covered = append(covered, v.hashes[i])
+		next = v.hashes[i].Offset + int64(v.hashes[i].Limit)
+	}
+	return covered, next
+}
+
+// add merges fetched hashes into the known ones.
+func (v *partVerifier) add(hashes []*FileHash) {
+	v.Lock()
+	defer v.Unlock()
+
+	known := make(map[int64]bool, len(v.hashes))
+	for _, h := range v.hashes {
+		known[h.Offset] = true
+	}
+	for _, h := range hashes {
+		if h.Limit > 0 && !known[h.Offset] {
+			known[h.Offset] = true
+			v.hashes = append(v.hashes, h)
+		}
+	}
+	sort.Slice(v.hashes, func(i, j int) bool { return v.hashes[i].Offset < v.hashes[j].Offset })
+}
+
+// fetch requests the hashes from offset on.
+func (v *partVerifier) fetch(offset int64) ([]*FileHash, error) {
+	for {
+		sender, err := v.c.senders.acquire(v.dc)
+		if err != nil {
+			return nil, err
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		resp, err := sender.MakeRequestCtx(ctx, &UploadGetFileHashesParams{
+			Location: v.location,
+			Offset:   offset,
+		})
+		cancel()
+		v.c.senders.Done(sender, err)
+
+		if err != nil {
+			if handleIfFlood(err, v.c) {
+				continue
+			}
+			return nil, err
+		}
+		hashes, _ := resp.([]*FileHash)
+		return hashes, nil
+	}
+}
+
+// hashesFor returns the hashes covering [offset, offset+length), fetching missing ones.
+func (v *partVerifier) hashesFor(offset int64, length int) ([]*FileHash, error) {
+	end := offset + int64(length)
+	for {
+		covered, next := v.covering(offset, end)
+		if next >= end {
+			return covered, nil
+		}
+
+		hashes, err := v.fetch(next)
+		if err != nil {
+			return nil, errors.Wrap(err, "fetching file hashes")
+		}
+		v.add(hashes)
+		if _, reached := v.covering(offset, end); reached <= next {
+			return nil, errors.New("file hashes do not cover offset " + fmt.Sprint(next))
+		}
+	}
+}
+
+// verify checks a part starting at offset, reporting whether it is intact; an error means
+// the part could not be checked.
+func (v *partVerifier) verify(offset int64, data []byte) (bool, error) {
+	if len(data) == 0 {
+		return true, nil
+	}
+
+	hashes, err := v.hashesFor(offset, len(data))
+	if err != nil {
+		return false, err
+	}
+
+	for _, h := range hashes {
+		start := h.Offset - offset
+		stop := start + int64(h.Limit)
+		if start < 0 {
+			return false, fmt.Errorf("file hash at offset %d is not aligned to the part", h.Offset)
+		}
+		if stop > int64(len(data)) {
+			stop = int64(len(data))
+		}
+
+		sum := sha256.Sum256(data[start:stop])
+		if !bytes.Equal(sum[:], h.Hash) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// fail records a failed check of a part and returns the number of failures so far.
+func (v *partVerifier) fail(part int) int {
+	v.Lock()
+	defer v.Unlock()
+	v.failures[part]++
+	return v.failures[part]
+}
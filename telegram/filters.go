@@ -0,0 +1,482 @@
+// Copyright (c) 2024 RoseLoverX
+
+package telegram
+
+import (
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Filter narrows down the updates a handler gets. The filters given to a handler must all
+// match; Users and Chats of all of them are merged, and Blacklist turns them into the users and
+// chats to ignore. Filters work for messages, edits, callback queries, inline queries and
+// participant updates; the checks that don't apply to an update are skipped.
+//
+// Filters compose with And, Or and Not, and custom checks of any update go in Predicate.
+type Filter struct {
+	Private, Group, Channel, Media, Command, Reply, Forward, FromBot, Blacklist, Mention bool
+	Users, Chats                                                                         []int64
+	Func                                                                                 func(m *NewMessage) bool
+	FuncCallback                                                                         func(c *CallbackQuery) bool
+	Predicate                                                                            func(update any) bool // gets the packed update: *NewMessage, *CallbackQuery, *InlineQuery or *ParticipantUpdate
+}
+
+var (
+	FilterPrivate   = Filter{Private: true}
+	FilterGroup     = Filter{Group: true}
+	FilterChannel   = Filter{Channel: true}
+	FilterMedia     = Filter{Media: true}
+	FilterCommand   = Filter{Command: true}
+	FilterReply     = Filter{Reply: true}
+	FilterForward   = Filter{Forward: true}
+	FilterFromBot   = Filter{FromBot: true}
+	FilterBlacklist = Filter{Blacklist: true}
+	FilterMention   = Filter{Mention: true}
+	FilterUsers     = func(users ...int64) Filter {
+		return Filter{Users: users}
+	}
+	FilterChats = func(chats ...int64) Filter {
+		return Filter{Chats: chats}
+	}
+	FilterFunc = func(f func(m *NewMessage) bool) Filter {
+		return Filter{Func: f}
+	}
+	FilterFuncCallback = func(f func(c *CallbackQuery) bool) Filter {
+		return Filter{FuncCallback: f}
+	}
+)
+
+// ------------------ Combinators ------------------
+
+// And matches when all the filters match, like giving them to a handler together.
+func And(filters ...Filter) Filter {
+	return Filter{Predicate: func(update any) bool {
+		return runFilters(update, filters)
+	}}
+}
+
+// Or matches when any of the filters matches.
+func Or(filters ...Filter) Filter {
+	return Filter{Predicate: func(update any) bool {
+		for _, filter := range filters {
+			if runFilters(update, []Filter{filter}) {
+				return true
+			}
+		}
+		return false
+	}}
+}
+
+// Not matches when the filter doesn't.
+func Not(filter Filter) Filter {
+	return Filter{Predicate: func(update any) bool {
+		return !runFilters(update, []Filter{filter})
+	}}
+}
+
+// ------------------ Built-in Filters ------------------
+
+// FilterRegex matches the text of messages, the data of callback queries and the query of
+// inline queries against a regular expression.
+func FilterRegex(pattern string) Filter {
+	re := regexp.MustCompile(pattern)
+	return Filter{Predicate: func(update any) bool {
+		switch u := update.(type) {
+		case *NewMessage:
+			return re.MatchString(u.MessageText())
+		case *CallbackQuery:
+			return re.Match(u.Data)
+		case *InlineQuery:
+			return re.MatchString(u.Query)
+		}
+		return false
+	}}
+}
+
+// FilterMediaKind matches messages with media of one of the kinds: photo, document, video, audio,
+// voice, animation, sticker, poll, or any other kind returned by NewMessage.MediaType.
+func FilterMediaKind(kinds ...string) Filter {
+	return Filter{Predicate: func(update any) bool {
+		m := filterMessage(update)
+		if m == nil || !m.IsMedia() {
+			return false
+		}
+		for _, kind := range kinds {
+			var ok bool
+			switch strings.ToLower(kind) {
+			case "photo":
+				ok = m.Photo() != nil
+			case "video":
+				ok = m.Video() != nil
+			case "audio":
+				ok = m.Audio() != nil
+			case "voice":
+				ok = m.Voice() != nil
+			case "animation", "gif":
+				ok = m.Animation() != nil
+			case "sticker":
+				ok = m.Sticker() != nil
+			case "poll":
+				ok = m.Poll() != nil
+			default:
+				ok = strings.EqualFold(m.MediaType(), kind)
+			}
+			if ok {
+				return true
+			}
+		}
+		return false
+	}}
+}
+
+// FilterChatType matches updates from chats of one of the types: private, group or channel.
+func FilterChatType(types ...string) Filter {
+	return Filter{Predicate: func(update any) bool {
+		s, ok := filterSubjectOf(update)
+		if !ok {
+			return false
+		}
+		for _, t := range types {
+			switch strings.ToLower(t) {
+			case "private", EntityUser:
+				ok = s.private
+			case "group", EntityChat:
+				ok = s.group
+			case EntityChannel:
+				ok = s.channel
+			default:
+				ok = false
+			}
+			if ok {
+				return true
+			}
+		}
+		return false
+	}}
+}
+
+// FilterHasButtons matches messages with a keyboard or inline buttons.
+func FilterHasButtons() Filter {
+	return Filter{Predicate: func(update any) bool {
+		m := filterMessage(update)
+		return m != nil && m.Message != nil && m.Message.ReplyMarkup != nil
+	}}
+}
+
+// FilterLanguage matches updates from users with one of the language codes ("en", "pt-br"),
+// a code also matching its regional variants; only known to bots.
+func FilterLanguage(codes ...string) Filter {
+	return Filter{Predicate: func(update any) bool {
+		s, ok := filterSubjectOf(update)
+		if !ok || s.sender == nil || s.sender.LangCode == "" {
+			return false
+		}
+		lang := strings.ToLower(s.sender.LangCode)
+		for _, code := range codes {
+			code = strings.ToLower(code)
+			if lang == code || strings.HasPrefix(lang, code+"-") {
+				return true
+			}
+		}
+		return false
+	}}
+}
+
+// FilterForwardedFrom matches messages forwarded from one of the users or chats; with none
+// given, any forwarded message.
+func FilterForwardedFrom(ids ...int64) Filter {
+	return Filter{Predicate: func(update any) bool {
+		m := filterMessage(update)
+		if m == nil || m.Message == nil || m.Message.FwdFrom == nil {
+			return false
+		}
+		if len(ids) == 0 {
+			return true
+		}
+		from := m.Client.GetPeerID(m.Message.FwdFrom.FromID)
+		for _, id := range ids {
+			if id == from {
+				return true
+			}
+		}
+		return false
+	}}
+}
+
+const (
+	adminFilterTTL     = time.Minute
+	maxAdminFilterKeys = 10000 // chat and user pairs remembered per client
+)
+
+// adminFilterCache holds the admin checks of FilterAdmin for a client.
+type adminFilterCache struct {
+	mu      sync.Mutex
+	entries map[[2]int64]adminFilterEntry // {chat, user}
+}
+
+type adminFilterEntry struct {
+	admin   bool
+	expires time.Time
+}
+
+func (a *adminFilterCache) get(key [2]int64) (admin, ok bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	entry, ok := a.entries[key]
+	if !ok || time.Now().After(entry.expires) {
+		return false, false
+	}
+	return entry.admin, true
+}
+
+// put remembers an admin check; when full, expired checks are dropped first, then arbitrary ones.
+func (a *adminFilterCache) put(key [2]int64, admin bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.entries == nil {
+		a.entries = make(map[[2]int64]adminFilterEntry)
+	}
+	if _, ok := a.entries[key]; !ok && len(a.entries) >= maxAdminFilterKeys {
+		now := time.Now()
+		for k, entry := range a.entries {
+			if now.After(entry.expires) {
+				delete(a.entries, k)
+			}
+		}
+		for k := range a.entries {
+			if len(a.entries) < maxAdminFilterKeys {
+				break
+			}
+			delete(a.entries, k)
+		}
+	}
+	a.entries[key] = adminFilterEntry{admin: admin, expires: time.Now().Add(adminFilterTTL)}
+}
+
+// FilterAdmin matches updates from admins (and the creator) of the chat they come from.
+// Admin checks are cached for a minute.
+func FilterAdmin() Filter {
+	return Filter{Predicate: func(update any) bool {
+		s, ok := filterSubjectOf(update)
+		if !ok || s.client == nil || s.private || s.chatID == 0 || s.senderID == 0 {
+			return false
+		}
+
+		key := [2]int64{s.chatID, s.senderID}
+		if admin, ok := s.client.adminFilters.get(key); ok {
+			return admin
+		}
+
+		admin := isChatAdmin(s.client, s.chatID, s.senderID)
+		s.client.adminFilters.put(key, admin)
+		return admin
+	}}
+}
+
+func isChatAdmin(c *Client, chatID, userID int64) bool {
+	if _, ok := c.Cache.store.GetChat(chatID); ok {
+		full, err := c.GetFullChat(&InputPeerChat{ChatID: chatID})
+		if err != nil {
+			return false
+		}
+		if chat, ok := full.(*ChatFullObj); ok {
+			if participants, ok := chat.Participants.(*ChatParticipantsObj); ok {
+				for _, participant := range participants.Participants {
+					switch p := participant.(type) {
+					case *ChatParticipantCreator:
+						if p.UserID == userID {
+							return true
+						}
+					case *ChatParticipantAdmin:
+						if p.UserID == userID {
+							return true
+						}
+					}
+				}
+			}
+		}
+		return false
+	}
+
+	member, err := c.GetChatMember(chatID, userID)
+	if err != nil {
+		return false
+	}
+	return member.Status == Admin || member.Status == Creator
+}
+
+// ------------------ Filter Evaluation ------------------
+
+// filterSubject is what filters look at, taken from a packed update.
+type filterSubject struct {
+	client                  *Client
+	message                 *NewMessage
+	callback                *CallbackQuery
+	sender                  *UserObj
+	senderID, chatID        int64
+	private, group, channel bool
+}
+
+func filterSubjectOf(update any) (filterSubject, bool) {
+	switch u := update.(type) {
+	case *NewMessage:
+		return filterSubject{
+			client:   u.Client,
+			message:  u,
+			sender:   u.Sender,
+			senderID: u.SenderID(),
+			chatID:   u.ChatID(),
+			private:  u.IsPrivate(),
+			group:    u.IsGroup(),
+			channel:  u.IsChannel(),
+		}, true
+	case *CallbackQuery:
+		return filterSubject{
+			client:   u.Client,
+			callback: u,
+			sender:   u.Sender,
+			senderID: u.SenderID,
+			chatID:   u.ChatID,
+			private:  u.IsPrivate(),
+			group:    u.IsGroup(),
+			channel:  u.IsChannel(),
+		}, true
+	case *InlineQuery:
+		s := filterSubject{client: u.Client, sender: u.Sender, senderID: u.SenderID}
+		switch u.PeerType {
+		case InlineQueryPeerTypePm, InlineQueryPeerTypeBotPm, InlineQueryPeerTypeSameBotPm:
+			s.private = true
+		case InlineQueryPeerTypeChat, InlineQueryPeerTypeMegagroup:
+			s.group = true
+		case InlineQueryPeerTypeBroadcast:
+			s.channel = true
+		}
+		return s, true
+	case *ParticipantUpdate:
+		s := filterSubject{client: u.Client, sender: u.Actor, chatID: u.ChannelID()}
+		if s.sender == nil {
+			s.sender = u.User
+		}
+		if s.sender != nil {
+			s.senderID = s.sender.ID
+		}
+		if u.Channel != nil && !u.Channel.Broadcast {
+			s.group = true
+		} else {
+			s.channel = true
+		}
+		return s, true
+	case interface{ subject() filterSubject }:
+		return u.subject(), true
+	}
+	return filterSubject{}, false
+}
+
+func filterMessage(update any) *NewMessage {
+	if m, ok := update.(*NewMessage); ok {
+		return m
+	}
+	return nil
+}
+
+// runFilters checks an update against filters given together.
+func runFilters(update any, filters []Filter) bool {
+	s, ok := filterSubjectOf(update)
+	if !ok {
+		return len(filters) == 0
+	}
+
+	var (
+		actAsBlacklist      bool
+		actUsers, actGroups []int64
+		inSlice             = func(e int64, s []int64) bool {
+			for _, a := range s {
+				if a == e {
+					return true
+				}
+			}
+			return false
+		}
+	)
+
+	for _, filter := range filters {
+		if filter.Private && !s.private || filter.Group && !s.group || filter.Channel && !s.channel {
+			return false
+		}
+		if m := s.message; m != nil {
+			if filter.Media && !m.IsMedia() || filter.Command && !m.IsCommand() || filter.Reply && !m.IsReply() || filter.Forward && !m.IsForward() {
+				return false
+			}
+			if filter.Mention && m.Message != nil && !m.Message.Mentioned {
+				return false
+			}
+			if filter.Func != nil && !filter.Func(m) {
+				return false
+			}
+		}
+		if filter.FromBot && (s.sender == nil || !s.sender.Bot) {
+			return false
+		}
+		if s.callback != nil && filter.FuncCallback != nil && !filter.FuncCallback(s.callback) {
+			return false
+		}
+		if filter.Predicate != nil && !filter.Predicate(update) {
+			return false
+		}
+
+		if len(filter.Users) > 0 {
+			actUsers = filter.Users
+		}
+		if len(filter.Chats) > 0 {
+			actGroups = filter.Chats
+		}
+		if filter.Blacklist {
+			actAsBlacklist = true
+		}
+	}
+
+	var peerCheckUserPassed bool
+	var peerCheckGroupPassed bool
+
+	if len(actUsers) > 0 && s.senderID != 0 {
+		if inSlice(s.senderID, actUsers) {
+			if actAsBlacklist {
+				return false
+			}
+			peerCheckUserPassed = true
+		}
+	} else {
+		peerCheckUserPassed = true
+	}
+
+	if len(actGroups) > 0 && s.chatID != 0 {
+		if inSlice(s.chatID, actGroups) {
+			if actAsBlacklist {
+				return false
+			}
+			peerCheckGroupPassed = true
+		}
+	} else {
+		peerCheckGroupPassed = true
+	}
+
+	if !actAsBlacklist && (len(actUsers) > 0 || len(actGroups) > 0) && !(peerCheckUserPassed && peerCheckGroupPassed) {
+		return false
+	}
+
+	return true
+}
+
+func (h *messageHandle) runFilterChain(m *NewMessage, filters []Filter) bool {
+	return runFilters(m, filters)
+}
+
+func (h *messageEditHandle) runFilterChain(m *NewMessage, filters []Filter) bool {
+	return runFilters(m, filters)
+}
+
+func (h *callbackHandle) runFilterChain(c *CallbackQuery, filters []Filter) bool {
+	return runFilters(c, filters)
+}
@@ -0,0 +1,574 @@
+// Copyright (c) 2024 RoseLoverX
+
+package telegram
+
+import (
+	"context"
+	"encoding/json"
+	"hash/fnv"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/amarnathcjd/gogram/internal/session"
+	"github.com/pkg/errors"
+)
+
+const fsmRestoreDelay = 5 * time.Second // states restored from the store time out no sooner, so their handlers can be added first
+
+// FSMKey selects whose state an update belongs to.
+type FSMKey int
+
+const (
+	FSMUserInChat FSMKey = iota // each user in each chat
+	FSMUser                     // each user, across chats
+	FSMChat                     // each chat, shared by its members
+)
+
+// FSMRecord is the state of a key: the name of the state, its data (JSON), and when it times out.
+type FSMRecord struct {
+	State   string          `json:"state"`
+	Data    json.RawMessage `json:"data,omitempty"`
+	ChatID  int64           `json:"chat_id,omitempty"`
+	UserID  int64           `json:"user_id,omitempty"`
+	Expires int64           `json:"expires,omitempty"` // unix time, 0 if the state does not time out
+}
+
+func (r *FSMRecord) expired() bool {
+	return r.Expires != 0 && time.Now().Unix() >= r.Expires
+}
+
+// FSMStore persists the states of a state machine, so dialogs survive restarts.
+type FSMStore interface {
+	Get(key string) (*FSMRecord, error) // nil if the key has no state
+	Set(key string, record *FSMRecord) error
+	Delete(key string) error
+	Range(fn func(key string, record *FSMRecord) bool) error
+}
+
+// MemoryFSMStore keeps the states in memory; they are lost on restart.
+type MemoryFSMStore struct {
+	mu      sync.RWMutex
+	records map[string]*FSMRecord
+}
+
+func NewMemoryFSMStore() *MemoryFSMStore {
+	return &MemoryFSMStore{records: make(map[string]*FSMRecord)}
+}
+
+func (s *MemoryFSMStore) Get(key string) (*FSMRecord, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if record, ok := s.records[key]; ok {
+		r := *record
+		return &r, nil
+	}
+	return nil, nil
+}
+
+func (s *MemoryFSMStore) Set(key string, record *FSMRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r := *record
+	s.records[key] = &r
+	return nil
+}
+
+func (s *MemoryFSMStore) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.records, key)
+	return nil
+}
+
+func (s *MemoryFSMStore) Range(fn func(key string, record *FSMRecord) bool) error {
+	s.mu.RLock()
+	records := make(map[string]FSMRecord, len(s.records))
+	for key, record := range s.records {
+		records[key] = *record
+	}
+	s.mu.RUnlock()
+	for key, record := range records {
+		if !fn(key, &record) {
+			break
+		}
+	}
+	return nil
+}
+
+// FileFSMStore keeps the states in a JSON file, optionally encrypted at rest; the file is
+// rewritten on every change.
+type FileFSMStore struct {
+	MemoryFSMStore
+	path   string
+	cipher *session.Cipher
+	write  sync.Mutex
+}
+
+func NewFileFSMStore(path string, encryption ...*StorageEncryption) (*FileFSMStore, error) {
+	cipher, err := getVariadic(encryption, nil).getCipher()
+	if err != nil {
+		return nil, err
+	}
+	s := &FileFSMStore{MemoryFSMStore: MemoryFSMStore{records: make(map[string]*FSMRecord)}, path: path, cipher: cipher}
+
+	data, err := os.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+		return s, nil
+	case err != nil:
+		return nil, errors.Wrap(err, "reading fsm states")
+	}
+	data, _, err = decryptStored(data, cipher) // a stale file is rewritten by the next change
+	if err != nil {
+		return nil, errors.Wrap(err, "reading fsm states")
+	}
+	if err := json.Unmarshal(data, &s.records); err != nil {
+		return nil, errors.Wrap(err, "decoding fsm states")
+	}
+	return s, nil
+}
+
+func (s *FileFSMStore) Set(key string, record *FSMRecord) error {
+	s.MemoryFSMStore.Set(key, record)
+	return s.save()
+}
+
+func (s *FileFSMStore) Delete(key string) error {
+	s.MemoryFSMStore.Delete(key)
+	return s.save()
+}
+
+func (s *FileFSMStore) save() error {
+	s.write.Lock()
+	defer s.write.Unlock()
+
+	s.mu.RLock()
+	data, err := json.Marshal(s.records)
+	s.mu.RUnlock()
+	if err != nil {
+		return errors.Wrap(err, "encoding fsm states")
+	}
+	if s.cipher != nil {
+		if data, err = s.cipher.Encrypt(data); err != nil {
+			return errors.Wrap(err, "encrypting fsm states")
+		}
+	}
+
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return errors.Wrap(err, "writing fsm states")
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// FSMOptions configures a state machine.
+type FSMOptions struct {
+	Key   FSMKey
+	Store FSMStore // defaults to a MemoryFSMStore
+}
+
+// FSM is a finite-state machine for multi-step dialogs. Unlike a Conversation, it holds no
+// goroutine while waiting for the user: the state of each user (or chat) is kept in a store,
+// and the handlers of the current state run when an update arrives.
+//
+//	fsm := client.NewFSM(&telegram.FSMOptions{Store: store})
+//	fsm.State("name").OnMessage(func(m *telegram.NewMessage, s *telegram.FSMContext) error {
+//		s.SetData(Form{Name: m.Text()})
+//		m.Reply("How old are you?")
+//		return s.Set("age")
+//	})
+//
+// The handlers run in the "fsm" group, right after conversations (FSMGroupPriority); an update
+// handled by a state does not reach the other handlers, unless its handler returns
+// ContinuePropagation.
+type FSM struct {
+	c       *Client
+	key     FSMKey
+	store   FSMStore
+	mu      sync.Mutex
+	states  map[string]*FSMState
+	timers  map[string]*time.Timer
+	locks   [64]sync.Mutex // updates of the same key are handled one at a time
+	handles []Handle
+}
+
+// FSMState is a state of a state machine, with its handlers and timeout.
+type FSMState struct {
+	fsm       *FSM
+	name      string
+	messages  []fsmMessageHandler
+	callbacks []fsmCallbackHandler
+	timeout   time.Duration
+	onTimeout func(s *FSMContext) error
+}
+
+type fsmMessageHandler struct {
+	handler func(m *NewMessage, s *FSMContext) error
+	filters []Filter
+}
+
+type fsmCallbackHandler struct {
+	handler func(q *CallbackQuery, s *FSMContext) error
+	filters []Filter
+}
+
+// NewFSM creates a state machine, picking up the timeouts of the states in its store.
+func (c *Client) NewFSM(opts ...*FSMOptions) *FSM {
+	opt := getVariadic(opts, &FSMOptions{})
+	f := &FSM{
+		c:      c,
+		key:    opt.Key,
+		store:  opt.Store,
+		states: make(map[string]*FSMState),
+		timers: make(map[string]*time.Timer),
+	}
+	if f.store == nil {
+		f.store = NewMemoryFSMStore()
+	}
+
+	if err := f.store.Range(func(key string, record *FSMRecord) bool {
+		if record.Expires != 0 {
+			f.schedule(key, record, fsmRestoreDelay)
+		}
+		return true
+	}); err != nil {
+		c.Log.Error(errors.Wrap(err, "[fsm] loading states"))
+	}
+
+	f.handles = []Handle{
+		c.AddMessageHandler(OnNewMessage, f.routeMessage).SetGroup("fsm"),
+		c.AddCallbackHandler(OnCallbackQuery, f.routeCallback).SetGroup("fsm"),
+	}
+	return f
+}
+
+// Close removes the handlers of the state machine and stops its timers; the states are kept.
+func (f *FSM) Close() {
+	for _, h := range f.handles {
+		f.c.RemoveHandle(h)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for key, timer := range f.timers {
+		timer.Stop()
+		delete(f.timers, key)
+	}
+}
+
+// State returns the state of the given name, creating it.
+func (f *FSM) State(name string) *FSMState {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if s, ok := f.states[name]; ok {
+		return s
+	}
+	s := &FSMState{fsm: f, name: name}
+	f.states[name] = s
+	return s
+}
+
+// OnMessage adds a handler of the messages sent in the state; the first handler whose filters
+// pass handles a message.
+func (s *FSMState) OnMessage(handler func(m *NewMessage, s *FSMContext) error, filters ...Filter) *FSMState {
+	s.fsm.mu.Lock()
+	defer s.fsm.mu.Unlock()
+	s.messages = append(s.messages, fsmMessageHandler{handler: handler, filters: filters})
+	return s
+}
+
+// OnCallback adds a handler of the callback queries sent in the state.
+func (s *FSMState) OnCallback(handler func(q *CallbackQuery, s *FSMContext) error, filters ...Filter) *FSMState {
+	s.fsm.mu.Lock()
+	defer s.fsm.mu.Unlock()
+	s.callbacks = append(s.callbacks, fsmCallbackHandler{handler: handler, filters: filters})
+	return s
+}
+
+// Timeout ends the state when no update moves it on within d; onTimeout, if not nil, then
+// runs with the state and its data (e.g. to tell the user the dialog expired).
+func (s *FSMState) Timeout(d time.Duration, onTimeout func(s *FSMContext) error) *FSMState {
+	s.fsm.mu.Lock()
+	defer s.fsm.mu.Unlock()
+	s.timeout, s.onTimeout = d, onTimeout
+	return s
+}
+
+func (f *FSM) lookup(name string) *FSMState {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.states[name]
+}
+
+// Key returns the key of a user in a chat, as selected by FSMOptions.Key.
+func (f *FSM) Key(chatID, userID int64) string {
+	switch f.key {
+	case FSMUser:
+		return "u" + strconv.FormatInt(userID, 10)
+	case FSMChat:
+		return "c" + strconv.FormatInt(chatID, 10)
+	}
+	return strconv.FormatInt(chatID, 10) + ":" + strconv.FormatInt(userID, 10)
+}
+
+func (f *FSM) lock(key string) *sync.Mutex {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return &f.locks[h.Sum32()%uint32(len(f.locks))]
+}
+
+// Context returns the state of a user in a chat, e.g. to start a dialog from a command.
+func (f *FSM) Context(chatID, userID int64) (*FSMContext, error) {
+	key := f.Key(chatID, userID)
+	record, err := f.load(key)
+	if err != nil {
+		return nil, err
+	}
+	if record == nil {
+		record = &FSMRecord{ChatID: chatID, UserID: userID}
+	}
+	return &FSMContext{fsm: f, Key: key, ChatID: chatID, UserID: userID, record: record}, nil
+}
+
+// load returns the record of a key, nil if it timed out; it is then ended in the background
+// under the lock of the key, as the callers may or may not hold it (locks are shared by keys).
+func (f *FSM) load(key string) (*FSMRecord, error) {
+	record, err := f.store.Get(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "loading fsm state")
+	}
+	if record != nil && record.expired() {
+		go f.expireLocked(key)
+		return nil, nil
+	}
+	return record, nil
+}
+
+func (f *FSM) routeMessage(m *NewMessage) error {
+	return f.route(m.ChatID(), m.SenderID(), func(state *FSMState, s *FSMContext) (bool, error) {
+		for _, h := range state.messages {
+			if runFilters(m, h.filters) {
+				return true, h.handler(m, s.with(m.Context()))
+			}
+		}
+		return false, nil
+	})
+}
+
+func (f *FSM) routeCallback(q *CallbackQuery) error {
+	return f.route(q.ChatID, q.SenderID, func(state *FSMState, s *FSMContext) (bool, error) {
+		for _, h := range state.callbacks {
+			if runFilters(q, h.filters) {
+				return true, h.handler(q, s.with(q.Context()))
+			}
+		}
+		return false, nil
+	})
+}
+
+// route runs the handler of the current state of a key that takes the update, if any.
+func (f *FSM) route(chatID, userID int64, run func(state *FSMState, s *FSMContext) (bool, error)) error {
+	if userID == 0 && f.key != FSMChat {
+		return nil
+	}
+	key := f.Key(chatID, userID)
+	l := f.lock(key)
+	l.Lock()
+	defer l.Unlock()
+
+	record, err := f.load(key)
+	if err != nil || record == nil {
+		return err
+	}
+	state := f.lookup(record.State)
+	if state == nil {
+		return nil
+	}
+
+	handled, err := run(state, &FSMContext{fsm: f, Key: key, ChatID: chatID, UserID: userID, record: record})
+	if !handled || errors.Is(err, ContinuePropagation) {
+		return nil
+	}
+	if err != nil && !errors.Is(err, StopPropagation) {
+		f.c.Log.Error(errors.Wrap(err, "[fsm]"))
+	}
+	return StopPropagation
+}
+
+// schedule arms the timeout of a record, no sooner than minDelay, replacing that of the previous
+// state.
+func (f *FSM) schedule(key string, record *FSMRecord, minDelay ...time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if timer, ok := f.timers[key]; ok {
+		timer.Stop()
+		delete(f.timers, key)
+	}
+	if record == nil || record.Expires == 0 {
+		return
+	}
+	expires := record.Expires
+	delay := max(time.Until(time.Unix(expires, 0)), getVariadic(minDelay, 0))
+	f.timers[key] = time.AfterFunc(delay, func() {
+		l := f.lock(key)
+		l.Lock()
+		defer l.Unlock()
+		if record, err := f.store.Get(key); err == nil && record != nil && record.Expires == expires {
+			f.expire(key)
+		}
+	})
+}
+
+// expireLocked is expire, taking the lock of the key.
+func (f *FSM) expireLocked(key string) {
+	l := f.lock(key)
+	l.Lock()
+	defer l.Unlock()
+	f.expire(key)
+}
+
+// expire ends the timed out state of a key and runs its timeout handler; the lock of the key
+// must be held, so that a state is only ended once.
+func (f *FSM) expire(key string) {
+	record, err := f.store.Get(key)
+	if err != nil || record == nil || !record.expired() {
+		return
+	}
+	if err := f.store.Delete(key); err != nil {
+		f.c.Log.Error(errors.Wrap(err, "[fsm] ending timed out state"))
+	}
+	f.mu.Lock()
+	if timer, ok := f.timers[key]; ok {
+		timer.Stop()
+		delete(f.timers, key)
+	}
+	f.mu.Unlock()
+
+	state := f.lookup(record.State)
+	if state == nil || state.onTimeout == nil {
+		return
+	}
+	s := &FSMContext{fsm: f, Key: key, ChatID: record.ChatID, UserID: record.UserID, record: record}
+	if err := state.onTimeout(s); err != nil {
+		f.c.Log.Error(errors.Wrap(err, "[fsm] timeout of "+record.State))
+	}
+}
+
+// FSMContext is the state of a key, passed to the handlers of a state machine; setting the
+// state or the data saves it to the store.
+type FSMContext struct {
+	fsm    *FSM
+	Key    string
+	ChatID int64
+	UserID int64
+	record *FSMRecord
+	ctx    context.Context
+}
+
+func (s *FSMContext) with(ctx context.Context) *FSMContext {
+	s.ctx = ctx
+	return s
+}
+
+// Client returns the client of the state machine.
+func (s *FSMContext) Client() *Client { return s.fsm.c }
+
+// Context returns the context of the handler handling the update; context.Background() for
+// timeout handlers.
+func (s *FSMContext) Context() context.Context { return handlerContext(s.ctx) }
+
+// State returns the name of the current state, empty if there is none.
+func (s *FSMContext) State() string { return s.record.State }
+
+// Set moves to a state, keeping the data, and arms the timeout of the state.
+func (s *FSMContext) Set(state string) error {
+	if state == "" {
+		return s.Finish()
+	}
+	s.record.State, s.record.Expires = state, 0
+	if st := s.fsm.lookup(state); st != nil && st.timeout > 0 {
+		s.record.Expires = time.Now().Add(st.timeout).Unix()
+	}
+	return s.save()
+}
+
+// Data decodes the data of the state into v; v is left as is when there is no data.
+func (s *FSMContext) Data(v any) error {
+	if len(s.record.Data) == 0 {
+		return nil
+	}
+	return errors.Wrap(json.Unmarshal(s.record.Data, v), "decoding fsm data")
+}
+
+// SetData replaces the data of the state with v, encoded as JSON.
+func (s *FSMContext) SetData(v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return errors.Wrap(err, "encoding fsm data")
+	}
+	s.record.Data = data
+	if s.record.State == "" {
+		return nil // saved with the first state
+	}
+	return s.save()
+}
+
+// Finish ends the dialog, dropping the state and its data.
+func (s *FSMContext) Finish() error {
+	s.record.State, s.record.Data, s.record.Expires = "", nil, 0
+	s.fsm.schedule(s.Key, nil)
+	return errors.Wrap(s.fsm.store.Delete(s.Key), "deleting fsm state")
+}
+
+func (s *FSMContext) save() error {
+	s.record.ChatID, s.record.UserID = s.ChatID, s.UserID
+	if err := s.fsm.store.Set(s.Key, s.record); err != nil {
+		return errors.Wrap(err, "saving fsm state")
+	}
+	s.fsm.schedule(s.Key, s.record)
+	return nil
+}
+
+// FSMData returns the data of the state decoded as T; the zero value of T if there is none.
+func FSMData[T any](s *FSMContext) (T, error) {
+	var v T
+	err := s.Data(&v)
+	return v, err
+}
+
+// UpdateFSMData decodes the data of the state as T, changes it with fn, and saves it.
+//
+//	telegram.UpdateFSMData(s, func(f *Form) { f.Age = age })
+func UpdateFSMData[T any](s *FSMContext, fn func(v *T)) error {
+	v, err := FSMData[T](s)
+	if err != nil {
+		return err
+	}
+	fn(&v)
+	return s.SetData(v)
+}
+
+// FilterState passes updates of users (in chats, as keyed by f) that are in one of the given
+// states; with no states, in any state.
+func FilterState(f *FSM, states ...string) Filter {
+	return Filter{Predicate: func(update any) bool {
+		subject, ok := filterSubjectOf(update)
+		if !ok {
+			return false
+		}
+		record, err := f.load(f.Key(subject.chatID, subject.senderID))
+		if err != nil || record == nil {
+			return false
+		}
+		if len(states) == 0 {
+			return true
+		}
+		for _, state := range states {
+			if record.State == state {
+				return true
+			}
+		}
+		return false
+	}}
+}
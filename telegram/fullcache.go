@@ -0,0 +1,249 @@
+// Copyright (c) 2024 RoseLoverX
+
+package telegram
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const defaultFullCacheTTL = 5 * time.Minute
+
+// FullCache keeps full user and chat info (users.getFullUser, channels.getFullChannel and
+// messages.getFullChat) for a limited time. Entries are dropped as soon as an update that
+// changes them arrives, so a handler reacting to that update fetches fresh info.
+type FullCache struct {
+	mu      sync.Mutex
+	userTTL time.Duration
+	chatTTL time.Duration
+	entries map[peerKey]*fullEntry
+}
+
+type fullEntry struct {
+	value   any // *UserFull or ChatFull
+	expires time.Time
+}
+
+// NewFullCache creates a cache keeping full users for userTTL and full chats for chatTTL;
+// a TTL of zero or below disables caching of that kind.
+func NewFullCache(userTTL, chatTTL time.Duration) *FullCache {
+	return &FullCache{
+		userTTL: userTTL,
+		chatTTL: chatTTL,
+		entries: make(map[peerKey]*fullEntry),
+	}
+}
+
+func (f *FullCache) get(key peerKey) (any, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	entry, ok := f.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(entry.expires) {
+		delete(f.entries, key)
+		return nil, false
+	}
+	return entry.value, true
+}
+
+func (f *FullCache) put(key peerKey, value any) {
+	ttl := f.chatTTL
+	if key.kind == cachedUser {
+		ttl = f.userTTL
+	}
+	if ttl <= 0 || key.id == 0 {
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	now := time.Now()
+	for k, entry := range f.entries { // drop expired entries, so the map doesn't grow forever
+		if now.After(entry.expires) {
+			delete(f.entries, k)
+		}
+	}
+	f.entries[key] = &fullEntry{value: value, expires: now.Add(ttl)}
+}
+
+func (f *FullCache) invalidate(key peerKey) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.entries, key)
+}
+
+// InvalidateUser drops the cached full info of a user.
+func (f *FullCache) InvalidateUser(userID int64) {
+	f.invalidate(peerKey{cachedUser, userID})
+}
+
+// InvalidateChat drops the cached full info of a basic group.
+func (f *FullCache) InvalidateChat(chatID int64) {
+	f.invalidate(peerKey{cachedChat, chatID})
+}
+
+// InvalidateChannel drops the cached full info of a channel or supergroup.
+func (f *FullCache) InvalidateChannel(channelID int64) {
+	f.invalidate(peerKey{cachedChannel, channelID})
+}
+
+// Clear drops every cached entry.
+func (f *FullCache) Clear() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.entries = make(map[peerKey]*fullEntry)
+}
+
+func (f *FullCache) invalidatePeer(peer Peer) {
+	switch peer := peer.(type) {
+	case *PeerUser:
+		f.InvalidateUser(peer.UserID)
+	case *PeerChat:
+		f.InvalidateChat(peer.ChatID)
+	case *PeerChannel:
+		f.InvalidateChannel(peer.ChannelID)
+	}
+}
+
+// handleUpdate drops the entries an update makes stale.
+func (f *FullCache) handleUpdate(update Update) {
+	switch update := update.(type) {
+	case *UpdateUser:
+		f.InvalidateUser(update.UserID)
+	case *UpdateUserName:
+		f.InvalidateUser(update.UserID)
+	case *UpdateUserPhone:
+		f.InvalidateUser(update.UserID)
+	case *UpdateUserEmojiStatus:
+		f.InvalidateUser(update.UserID)
+	case *UpdatePeerBlocked:
+		f.invalidatePeer(update.PeerID)
+	case *UpdatePeerSettings:
+		f.invalidatePeer(update.Peer)
+	case *UpdatePeerHistoryTtl:
+		f.invalidatePeer(update.Peer)
+	case *UpdateBotCommands:
+		f.invalidatePeer(update.Peer)
+	case *UpdatePinnedMessages:
+		f.invalidatePeer(update.Peer)
+	case *UpdateChatDefaultBannedRights:
+		f.invalidatePeer(update.Peer)
+	case *UpdateChatParticipants:
+		switch participants := update.Participants.(type) {
+		case *ChatParticipantsObj:
+			f.InvalidateChat(participants.ChatID)
+		case *ChatParticipantsForbidden:
+			f.InvalidateChat(participants.ChatID)
+		}
+	case *UpdateChatParticipant:
+		f.InvalidateChat(update.ChatID)
+	case *UpdateChatParticipantAdd:
+		f.InvalidateChat(update.ChatID)
+	case *UpdateChatParticipantDelete:
+		f.InvalidateChat(update.ChatID)
+	case *UpdateChatParticipantAdmin:
+		f.InvalidateChat(update.ChatID)
+	case *UpdateChannel:
+		f.InvalidateChannel(update.ChannelID)
+	case *UpdateChannelParticipant:
+		f.InvalidateChannel(update.ChannelID)
+	case *UpdatePinnedChannelMessages:
+		f.InvalidateChannel(update.ChannelID)
+	case *UpdateChannelAvailableMessages:
+		f.InvalidateChannel(update.ChannelID)
+	case *UpdateGroupCall:
+		f.InvalidateChat(update.ChatID)
+		f.InvalidateChannel(update.ChatID)
+	case *UpdateNewMessage:
+		if msg, ok := update.Message.(*MessageService); ok { // title, photo, members, pins...
+			f.invalidatePeer(msg.PeerID)
+		}
+	case *UpdateNewChannelMessage:
+		if msg, ok := update.Message.(*MessageService); ok {
+			f.invalidatePeer(msg.PeerID)
+		}
+	}
+}
+
+// FullCache returns the cache of full user and chat info.
+func (c *Client) FullCache() *FullCache {
+	return c.fullCache
+}
+
+// GetFullUser returns the full info of a user, from the full cache when fresh.
+func (c *Client) GetFullUser(userID any) (*UserFull, error) {
+	inputUser, err := c.GetSendableUser(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	var key peerKey
+	switch inputUser := inputUser.(type) {
+	case *InputUserObj:
+		key = peerKey{cachedUser, inputUser.UserID}
+	case *InputUserFromMessage:
+		key = peerKey{cachedUser, inputUser.UserID}
+	}
+	if full, ok := c.fullCache.get(key); ok {
+		return full.(*UserFull), nil
+	}
+
+	resp, err := c.UsersGetFullUser(inputUser)
+	if err != nil {
+		return nil, err
+	}
+	c.Cache.UpdatePeersToCache(resp.Users, resp.Chats)
+
+	c.fullCache.put(key, resp.FullUser)
+	return resp.FullUser, nil
+}
+
+// GetFullChat returns the full info of a basic group (*ChatFullObj) or a channel (*ChannelFull),
+// from the full cache when fresh.
+func (c *Client) GetFullChat(chatID any) (ChatFull, error) {
+	peer, err := c.ResolvePeer(chatID)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		key          peerKey
+		inputChannel InputChannel
+	)
+	switch peer := peer.(type) {
+	case *InputPeerChat:
+		key = peerKey{cachedChat, peer.ChatID}
+	case *InputPeerChannel:
+		key = peerKey{cachedChannel, peer.ChannelID}
+		inputChannel = &InputChannelObj{ChannelID: peer.ChannelID, AccessHash: peer.AccessHash}
+	case *InputPeerChannelFromMessage:
+		key = peerKey{cachedChannel, peer.ChannelID}
+		inputChannel = &InputChannelFromMessage{Peer: peer.Peer, MsgID: peer.MsgID, ChannelID: peer.ChannelID}
+	default:
+		return nil, errors.New("given peer is not a chat or channel")
+	}
+
+	if full, ok := c.fullCache.get(key); ok {
+		return full.(ChatFull), nil
+	}
+
+	var resp *MessagesChatFull
+	if inputChannel != nil {
+		resp, err = c.ChannelsGetFullChannel(inputChannel)
+	} else {
+		resp, err = c.MessagesGetFullChat(key.id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.Cache.UpdatePeersToCache(resp.Users, resp.Chats)
+
+	c.fullCache.put(key, resp.FullChat)
+	return resp.FullChat, nil
+}
@@ -0,0 +1,212 @@
+// Copyright (c) 2024 RoseLoverX
+
+package telegram
+
+import "context"
+
+// The context of an update is cancelled when its handler runs longer than the handler timeout
+// (see ClientConfig.HandlerTimeout); it is context.Background() when there is none.
+
+func handlerContext(ctx context.Context) context.Context {
+	if ctx == nil {
+		return context.Background()
+	}
+	return ctx
+}
+
+// updateWithContext returns a copy of a packed update with the context set.
+func updateWithContext(update any, ctx context.Context) any {
+	switch u := update.(type) {
+	case *NewMessage:
+		return u.withContext(ctx)
+	case *Album:
+		return u.withContext(ctx)
+	case *DeleteMessage:
+		return u.withContext(ctx)
+	case *CallbackQuery:
+		return u.withContext(ctx)
+	case *InlineCallbackQuery:
+		return u.withContext(ctx)
+	case *InlineQuery:
+		return u.withContext(ctx)
+	case *InlineSend:
+		return u.withContext(ctx)
+	case *ParticipantUpdate:
+		return u.withContext(ctx)
+	case *UserStatusUpdate:
+		return u.withContext(ctx)
+	case *TypingUpdate:
+		return u.withContext(ctx)
+	case *ReadUpdate:
+		return u.withContext(ctx)
+	case *ReactionUpdate:
+		return u.withContext(ctx)
+	case *PollVoteUpdate:
+		return u.withContext(ctx)
+	case *PinUpdate:
+		return u.withContext(ctx)
+	case *JoinRequestUpdate:
+		return u.withContext(ctx)
+	case *ChatParticipantUpdate:
+		return u.withContext(ctx)
+	case *BotMemberUpdate:
+		return u.withContext(ctx)
+	case *BoostUpdate:
+		return u.withContext(ctx)
+	case *StoryUpdate:
+		return u.withContext(ctx)
+	case *BusinessMessage:
+		return u.withContext(ctx)
+	}
+	return update
+}
+
+// withContext returns a copy of v with the context set, as each handler gets its own.
+func withContext[T any](v *T, ctx context.Context, set func(*T, context.Context)) *T {
+	if v == nil || ctx == context.Background() {
+		return v
+	}
+	c := *v
+	set(&c, ctx)
+	return &c
+}
+
+// Context returns the context of the handler handling the message.
+func (m *NewMessage) Context() context.Context { return handlerContext(m.ctx) }
+
+func (m *NewMessage) withContext(ctx context.Context) *NewMessage {
+	return withContext(m, ctx, func(m *NewMessage, ctx context.Context) { m.ctx = ctx })
+}
+
+// Context returns the context of the handler handling the deletion.
+func (m *DeleteMessage) Context() context.Context { return handlerContext(m.ctx) }
+
+func (m *DeleteMessage) withContext(ctx context.Context) *DeleteMessage {
+	return withContext(m, ctx, func(m *DeleteMessage, ctx context.Context) { m.ctx = ctx })
+}
+
+// Context returns the context of the handler handling the album.
+func (a *Album) Context() context.Context { return handlerContext(a.ctx) }
+
+func (a *Album) withContext(ctx context.Context) *Album {
+	return withContext(a, ctx, func(a *Album, ctx context.Context) { a.ctx = ctx })
+}
+
+// Context returns the context of the handler handling the callback query.
+func (b *CallbackQuery) Context() context.Context { return handlerContext(b.ctx) }
+
+func (b *CallbackQuery) withContext(ctx context.Context) *CallbackQuery {
+	return withContext(b, ctx, func(b *CallbackQuery, ctx context.Context) { b.ctx = ctx })
+}
+
+// Context returns the context of the handler handling the callback query.
+func (b *InlineCallbackQuery) Context() context.Context { return handlerContext(b.ctx) }
+
+func (b *InlineCallbackQuery) withContext(ctx context.Context) *InlineCallbackQuery {
+	return withContext(b, ctx, func(b *InlineCallbackQuery, ctx context.Context) { b.ctx = ctx })
+}
+
+// Context returns the context of the handler handling the inline query.
+func (i *InlineQuery) Context() context.Context { return handlerContext(i.ctx) }
+
+func (i *InlineQuery) withContext(ctx context.Context) *InlineQuery {
+	return withContext(i, ctx, func(i *InlineQuery, ctx context.Context) { i.ctx = ctx })
+}
+
+// Context returns the context of the handler handling the chosen inline result.
+func (i *InlineSend) Context() context.Context { return handlerContext(i.ctx) }
+
+func (i *InlineSend) withContext(ctx context.Context) *InlineSend {
+	return withContext(i, ctx, func(i *InlineSend, ctx context.Context) { i.ctx = ctx })
+}
+
+// Context returns the context of the handler handling the participant update.
+func (pu *ParticipantUpdate) Context() context.Context { return handlerContext(pu.ctx) }
+
+func (pu *ParticipantUpdate) withContext(ctx context.Context) *ParticipantUpdate {
+	return withContext(pu, ctx, func(pu *ParticipantUpdate, ctx context.Context) { pu.ctx = ctx })
+}
+
+// Context returns the context of the handler handling the status update.
+func (us *UserStatusUpdate) Context() context.Context { return handlerContext(us.ctx) }
+
+func (us *UserStatusUpdate) withContext(ctx context.Context) *UserStatusUpdate {
+	return withContext(us, ctx, func(us *UserStatusUpdate, ctx context.Context) { us.ctx = ctx })
+}
+
+// Context returns the context of the handler handling the typing update.
+func (t *TypingUpdate) Context() context.Context { return handlerContext(t.ctx) }
+
+func (t *TypingUpdate) withContext(ctx context.Context) *TypingUpdate {
+	return withContext(t, ctx, func(t *TypingUpdate, ctx context.Context) { t.ctx = ctx })
+}
+
+// Context returns the context of the handler handling the read receipt.
+func (r *ReadUpdate) Context() context.Context { return handlerContext(r.ctx) }
+
+func (r *ReadUpdate) withContext(ctx context.Context) *ReadUpdate {
+	return withContext(r, ctx, func(r *ReadUpdate, ctx context.Context) { r.ctx = ctx })
+}
+
+// Context returns the context of the handler handling the reaction update.
+func (r *ReactionUpdate) Context() context.Context { return handlerContext(r.ctx) }
+
+func (r *ReactionUpdate) withContext(ctx context.Context) *ReactionUpdate {
+	return withContext(r, ctx, func(r *ReactionUpdate, ctx context.Context) { r.ctx = ctx })
+}
+
+// Context returns the context of the handler handling the poll update.
+func (p *PollVoteUpdate) Context() context.Context { return handlerContext(p.ctx) }
+
+func (p *PollVoteUpdate) withContext(ctx context.Context) *PollVoteUpdate {
+	return withContext(p, ctx, func(p *PollVoteUpdate, ctx context.Context) { p.ctx = ctx })
+}
+
+// Context returns the context of the handler handling the pin update.
+func (p *PinUpdate) Context() context.Context { return handlerContext(p.ctx) }
+
+func (p *PinUpdate) withContext(ctx context.Context) *PinUpdate {
+	return withContext(p, ctx, func(p *PinUpdate, ctx context.Context) { p.ctx = ctx })
+}
+
+// Context returns the context of the handler handling the join request.
+func (j *JoinRequestUpdate) Context() context.Context { return handlerContext(j.ctx) }
+
+func (j *JoinRequestUpdate) withContext(ctx context.Context) *JoinRequestUpdate {
+	return withContext(j, ctx, func(j *JoinRequestUpdate, ctx context.Context) { j.ctx = ctx })
+}
+
+// Context returns the context of the handler handling the participant update.
+func (cp *ChatParticipantUpdate) Context() context.Context { return handlerContext(cp.ctx) }
+
+func (cp *ChatParticipantUpdate) withContext(ctx context.Context) *ChatParticipantUpdate {
+	return withContext(cp, ctx, func(cp *ChatParticipantUpdate, ctx context.Context) { cp.ctx = ctx })
+}
+
+// Context returns the context of the handler handling the membership update.
+func (b *BotMemberUpdate) Context() context.Context { return handlerContext(b.ctx) }
+
+func (b *BotMemberUpdate) withContext(ctx context.Context) *BotMemberUpdate {
+	return withContext(b, ctx, func(b *BotMemberUpdate, ctx context.Context) { b.ctx = ctx })
+}
+
+// Context returns the context of the handler handling the boost.
+func (b *BoostUpdate) Context() context.Context { return handlerContext(b.ctx) }
+
+func (b *BoostUpdate) withContext(ctx context.Context) *BoostUpdate {
+	return withContext(b, ctx, func(b *BoostUpdate, ctx context.Context) { b.ctx = ctx })
+}
+
+// Context returns the context of the handler handling the story update.
+func (s *StoryUpdate) Context() context.Context { return handlerContext(s.ctx) }
+
+func (s *StoryUpdate) withContext(ctx context.Context) *StoryUpdate {
+	return withContext(s, ctx, func(s *StoryUpdate, ctx context.Context) { s.ctx = ctx })
+}
+
+// Context returns the context of the handler handling the business message.
+func (b *BusinessMessage) Context() context.Context { return handlerContext(b.ctx) }
+
+func (b *BusinessMessage) withContext(ctx context.Context) *BusinessMessage {
+	return withContext(b, ctx, func(b *BusinessMessage, ctx context.Context) { b.ctx = ctx })
+}
@@ -288,6 +288,9 @@ PeerSwitch:
 	case *PeerUser:
 		peerEntity, err := c.GetPeerUser(Peer.UserID)
 		if err != nil {
+			if peer, ok := c.Cache.inputPeerFromMessage(peerKey{cachedUser, Peer.UserID}); ok {
+				return peer, nil
+			}
 			return nil, err
 		}
 		return &InputPeerUser{UserID: peerEntity.UserID, AccessHash: peerEntity.AccessHash}, nil
@@ -296,6 +299,9 @@ PeerSwitch:
 	case *PeerChannel:
 		peerEntity, err := c.GetPeerChannel(Peer.ChannelID)
 		if err != nil {
+			if peer, ok := c.Cache.inputPeerFromMessage(peerKey{cachedChannel, Peer.ChannelID}); ok {
+				return peer, nil
+			}
 			return nil, err
 		}
 		return &InputPeerChannel{ChannelID: peerEntity.ChannelID, AccessHash: peerEntity.AccessHash}, nil
@@ -342,11 +348,11 @@ PeerSwitch:
 			return &InputPeerSelf{}, nil
 		}
 
-		if peerMap, ok := c.Cache.usernameMap[strings.TrimPrefix(Peer, "@")]; ok {
-			if peerHash, ok := c.Cache.InputPeers.InputChannels[peerMap]; ok {
+		if peerMap, ok := c.Cache.store.GetUsername(strings.TrimPrefix(Peer, "@")); ok {
+			if peerHash, ok := c.Cache.store.GetInputChannel(peerMap); ok {
 				return &InputPeerChannel{ChannelID: peerMap, AccessHash: peerHash}, nil
 			}
-			if peerHash, ok := c.Cache.InputPeers.InputUsers[peerMap]; ok {
+			if peerHash, ok := c.Cache.store.GetInputUser(peerMap); ok {
 				return &InputPeerUser{UserID: peerMap, AccessHash: peerHash}, nil
 			}
 		}
@@ -473,18 +479,13 @@ func (c *Client) GetSendableMedia(mediaFile any, attr *MediaMetadata) (InputMedi
 }
 
 func (c *Client) getSendableMedia(mediaFile any, attributes *MediaMetadata) (InputMedia, error) {
-	attr := getValue(attributes, &MediaMetadata{})
-	var thumbnail InputFile
-
-	switch thumb := attr.Thumb.(type) {
-	case InputFile, *InputFile, nil:
-
-	default:
-		fi, err := c.UploadFile(thumb)
-		if err != nil {
-			return nil, err
+	// a copy, the metadata of the caller is left as it is
+	attr := new(MediaMetadata)
+	if attributes != nil {
+		*attr = *attributes
+		if attr.Attributes != nil {
+			attr.Attributes = append([]DocumentAttribute{}, attr.Attributes...)
 		}
-		thumbnail = fi
 	}
 
 mediaTypeSwitch:
@@ -511,6 +512,23 @@ mediaTypeSwitch:
 			return documentExt, nil
 		} else {
 			if _, err := os.Stat(media); err == nil {
+				attr.dedupKey = ""
+				if c.clientData.dedupMedia && !attr.SkipHash {
+					kind := cachedMediaDocument
+					if _, isPhoto := MimeTypes.MIME(getValue(attr.FileName, media)); isPhoto && !attr.ForceDocument {
+						kind = cachedMediaPhoto
+					}
+
+					if key, err := mediaDedupKey(media, kind, attr); err == nil {
+						if cached, ok := c.Cache.GetMedia(key); ok {
+							c.Log.Debug("media dedup: reusing uploaded ", kind, " for ", media)
+							return cached.inputMedia(attr), nil
+						}
+						attr.Inline = true // upload to self, so the resulting media can be cached
+						attr.dedupKey = key
+					}
+				}
+
 				uploadOpts := &UploadOptions{}
 				if attr.ProgressManager != nil {
 					uploadOpts.ProgressManager = attr.ProgressManager
@@ -593,7 +611,7 @@ mediaTypeSwitch:
 		uploadedPhoto := &InputMediaUploadedPhoto{File: mediaFile, TtlSeconds: getValue(attr.TTL, 0), Spoiler: getValue(attr.Spoiler, false)}
 		if IsPhoto && !attr.ForceDocument {
 			if attr.Inline {
-				return c.uploadToSelf(uploadedPhoto)
+				return c.uploadToSelfDedup(uploadedPhoto, attr)
 			}
 
 			return uploadedPhoto, nil
@@ -611,6 +629,18 @@ mediaTypeSwitch:
 				}
 			}
 
+			// the thumbnail is only uploaded here, where it is used
+			var thumbnail InputFile
+			switch thumb := attr.Thumb.(type) {
+			case InputFile, *InputFile, nil:
+			default:
+				fi, err := c.UploadFile(thumb)
+				if err != nil {
+					return nil, err
+				}
+				thumbnail = fi
+			}
+
 			if thumbnail == nil && !attr.DisableThumb {
 				thumbFile, err := c.gatherVideoThumb(getValue(attr.FileAbsPath, fileName), dur)
 				if err != nil {
@@ -626,12 +656,12 @@ mediaTypeSwitch:
 
 			uploadedDoc := &InputMediaUploadedDocument{File: mediaFile, MimeType: mimeType, Attributes: mediaAttributes, Thumb: getValueAny(thumbnail, &InputFileObj{}).(InputFile), TtlSeconds: getValue(attr.TTL, 0), Spoiler: getValue(attr.Spoiler, false), ForceFile: getValue(attr.ForceDocument, false)}
 			if attr.Inline {
-				return c.uploadToSelf(uploadedDoc)
+				return c.uploadToSelfDedup(uploadedDoc, attr)
 			}
 
 			return uploadedDoc, nil
 		}
-	case []byte, *io.Reader, *bytes.Buffer, *os.File:
+	case []byte, *io.Reader, *bytes.Buffer, *os.File, io.Reader:
 		var uopts *UploadOptions = &UploadOptions{}
 		if attr != nil {
 			uopts.ProgressManager = attr.ProgressManager
@@ -653,9 +683,13 @@ mediaTypeSwitch:
 
 func (c *Client) uploadToSelf(mediaFile InputMedia) (InputMedia, error) {
 	upl, err := c.MessagesUploadMedia("", &InputPeerSelf{}, mediaFile)
+	for retry := 0; err != nil && retry < maxMissingPartRetries && c.resendMissingPart(mediaFile, err); retry++ {
+		upl, err = c.MessagesUploadMedia("", &InputPeerSelf{}, mediaFile)
+	}
 	if err != nil {
 		return nil, err
 	}
+	c.forgetUpload(mediaFile)
 
 	switch upl := upl.(type) {
 	case *MessageMediaPhoto:
@@ -3,6 +3,7 @@
 package telegram
 
 import (
+	"context"
 	"fmt"
 	"reflect"
 	"strings"
@@ -18,6 +19,7 @@ type (
 		Offset         string
 		PeerType       InlineQueryPeerType
 		Client         *Client
+		ctx            context.Context
 	}
 
 	InlineBuilder struct {
@@ -33,6 +35,7 @@ type (
 		ID             string
 		MsgID          InputBotInlineMessageID
 		Client         *Client
+		ctx            context.Context
 	}
 )
 
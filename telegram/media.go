@@ -16,7 +16,6 @@ import (
 	"sync/atomic"
 	"time"
 
-	mtproto "github.com/amarnathcjd/gogram"
 	"github.com/pkg/errors"
 )
 
@@ -29,34 +28,14 @@ type UploadOptions struct {
 	FileName string `json:"file_name,omitempty"`
 	// Progress callback for upload file.
 	ProgressManager *ProgressManager `json:"-"`
-}
-
-type WorkerPool struct {
-	sync.Mutex
-	workers []*mtproto.MTProto
-	free    chan *mtproto.MTProto
-}
-
-func NewWorkerPool(size int) *WorkerPool {
-	return &WorkerPool{
-		workers: make([]*mtproto.MTProto, 0, size),
-		free:    make(chan *mtproto.MTProto, size),
-	}
-}
-
-func (wp *WorkerPool) AddWorker(s *mtproto.MTProto) {
-	wp.Lock()
-	defer wp.Unlock()
-	wp.workers = append(wp.workers, s)
-	wp.free <- s // Mark the worker as free immediately
-}
-
-func (wp *WorkerPool) Next() *mtproto.MTProto {
-	return <-wp.free
-}
-
-func (wp *WorkerPool) FreeWorker(s *mtproto.MTProto) {
-	wp.free <- s
+	// Upload the source as it is read, without knowing its size in advance.
+	Stream bool `json:"stream,omitempty"`
+	// Store to persist upload progress in, making the upload resumable across restarts.
+	StateStore UploadStateStore `json:"-"`
+	// Bandwidth limit for this upload, applied on top of the client-wide limit.
+	Limiter *BandwidthLimiter `json:"-"`
+
+	job *TransferJob // set by the TransferManager, to pause or cancel the upload
 }
 
 type Source struct {
@@ -77,12 +56,58 @@ func (s *Source) GetSizeAndName() (int64, string) {
 		return stat.Size(), src.Name()
 	case []byte:
 		return int64(len(src)), ""
+	case *bytes.Buffer:
+		return int64(src.Len()), ""
 	case *io.Reader:
 		return 0, ""
 	}
 	return 0, ""
 }
 
+// IsStream reports whether the source can only be read sequentially,
+// i.e. it has no known size up front (pipes, network bodies, encoders).
+func (s *Source) IsStream() bool {
+	switch src := s.Source.(type) {
+	case string, []byte, *bytes.Buffer:
+		return false
+	case *os.File:
+		stat, err := src.Stat()
+		return err != nil || !stat.Mode().IsRegular()
+	case *io.Reader, io.Reader:
+		return true
+	}
+	return false
+}
+
+// ReadPart reads size bytes at offset, for sources that support random access.
+func (s *Source) ReadPart(offset int64, size int) ([]byte, error) {
+	var r io.ReaderAt
+	switch src := s.Source.(type) {
+	case string:
+		file, err := os.Open(src)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		r = file
+	case *os.File:
+		r = src
+	case []byte:
+		r = bytes.NewReader(src)
+	case *bytes.Buffer:
+		r = bytes.NewReader(src.Bytes())
+	default:
+		return nil, errors.New("source does not support random access")
+	}
+
+	part := make([]byte, size)
+	n, err := r.ReadAt(part, offset)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	return part[:n], nil
+}
+
 func (s *Source) GetName() string {
 	switch src := s.Source.(type) {
 	case string:
@@ -113,6 +138,8 @@ func (s *Source) GetReader() io.Reader {
 		return bytes.NewReader(src.Bytes())
 	case *io.Reader:
 		return *src
+	case io.Reader:
+		return src
 	}
 	return nil
 }
@@ -131,6 +158,10 @@ func (c *Client) UploadFile(src any, Opts ...*UploadOptions) (InputFile, error)
 		return nil, errors.New("failed to convert source to io.Reader")
 	}
 
+	if opts.Stream || (size == 0 && source.IsStream()) {
+		return c.uploadStream(file, getValue(opts.FileName, fileName), opts)
+	}
+
 	partSize := 1024 * 512 // 512KB
 	if opts.ChunkSize > 0 {
 		partSize = int(opts.ChunkSize)
@@ -139,7 +170,7 @@ func (c *Client) UploadFile(src any, Opts ...*UploadOptions) (InputFile, error)
 	var hash hash.Hash
 
 	IsFsBig := false
-	if size > 10*1024*1024 { // 10MB
+	if size > bigFileThreshold {
 		IsFsBig = true
 	}
 
@@ -155,6 +186,16 @@ func (c *Client) UploadFile(src any, Opts ...*UploadOptions) (InputFile, error)
 		totalParts++
 	}
 
+	var (
+		state *UploadState
+		saver *uploadStateSaver
+	)
+	if opts.StateStore != nil {
+		state = c.loadUploadState(opts.StateStore, source, size, partSize, totalParts, IsFsBig)
+		saver = newUploadStateSaver(opts.StateStore, state, c.Log)
+		fileId = state.FileID
+	}
+
 	wg := sync.WaitGroup{}
 
 	numWorkers := countWorkers(parts)
@@ -162,17 +203,12 @@ func (c *Client) UploadFile(src any, Opts ...*UploadOptions) (InputFile, error)
 		numWorkers = opts.Threads
 	}
 
-	w := NewWorkerPool(numWorkers)
-
 	c.Log.Info(fmt.Sprintf("file - upload: (%s) - (%s) - (%d)", source.GetName(), SizetoHuman(size), parts))
 
 	doneBytes := atomic.Int64{}
 	doneArray := sync.Map{}
 
-	if c.clientData.cacheSenders {
-		c.exSenders.setTTL()
-	}
-	go initializeWorkers(numWorkers, int32(c.GetDC()), c, w)
+	dc := int32(c.GetDC())
 
 	var progressTicker = make(chan struct{}, 1)
 
@@ -198,18 +234,40 @@ func (c *Client) UploadFile(src any, Opts ...*UploadOptions) (InputFile, error)
 		}()
 	}
 
-	MAX_RETRIES := 3
 	sem := make(chan struct{}, numWorkers)
 
-	for p := int64(0); p < parts; p++ {
-		sem <- struct{}{}
-		part := make([]byte, partSize)
-		_, err := file.Read(part)
-		if err != nil {
+	for p := int64(0); p < totalParts; p++ {
+		if opts.job.checkpoint() != nil {
+			break
+		}
+
+		partLen := int64(partSize)
+		if p == totalParts-1 && partOver > 0 {
+			partLen = partOver
+		}
+
+		part := make([]byte, partLen)
+		if _, err := io.ReadFull(file, part); err != nil {
 			c.Log.Error(err)
+			if state != nil { // keep the parts uploaded so far
+				wg.Wait()
+				saver.flush()
+			}
 			return nil, err
 		}
 
+		if !IsFsBig {
+			hash.Write(part) // parts are hashed in order, as they are read
+		}
+
+		if state != nil && state.HasPart(int32(p)) {
+			c.Log.Debug(fmt.Sprintf("skipping part %d/%d, already uploaded", p, totalParts))
+			doneBytes.Add(partLen)
+			doneArray.Store(int(p), true)
+			continue
+		}
+
+		sem <- struct{}{}
 		wg.Add(1)
 		go func(p int, part []byte) {
 			defer func() {
@@ -217,125 +275,282 @@ func (c *Client) UploadFile(src any, Opts ...*UploadOptions) (InputFile, error)
 				wg.Done()
 			}()
 
-			for i := 0; i < MAX_RETRIES; i++ {
-				sender := w.Next()
-				if !IsFsBig {
-					_, err = sender.MakeRequestCtx(context.Background(), &UploadSaveFilePartParams{
-						FileID:   fileId,
-						FilePart: int32(p),
-						Bytes:    part,
-					})
-				} else {
-					_, err = sender.MakeRequestCtx(context.Background(), &UploadSaveBigFilePartParams{
-						FileID:         fileId,
-						FilePart:       int32(p),
-						FileTotalParts: int32(totalParts),
-						Bytes:          part,
-					})
-				}
-				w.FreeWorker(sender)
-
-				if err != nil {
-					if handleIfFlood(err, c) {
-						continue
-					}
-					c.Log.Debug(err)
-					continue
-				}
-
-				c.Log.Debug(fmt.Sprintf("uploaded part %d/%d in chunks of %d KB", p, totalParts, len(part)/1024))
+			if err := c.saveFilePart(dc, fileId, int32(p), int32(totalParts), IsFsBig, part, opts.job, opts.Limiter); err != nil {
+				return
+			}
 
-				doneBytes.Add(int64(len(part)))
-				if !IsFsBig {
-					hash.Write(part)
-				}
-				doneArray.Store(p, true)
-				break
+			doneBytes.Add(int64(len(part)))
+			doneArray.Store(p, true)
+			if state != nil {
+				state.AddPart(int32(p))
+				saver.partAdded()
 			}
 		}(int(p), part)
 	}
 
 	wg.Wait()
+	close(sem)
+	close(progressTicker)
 
-	if partOver > 0 {
-		part := make([]byte, partOver)
-		_, err := file.Read(part)
-		if err != nil {
-			c.Log.Error(err)
-			return nil, err
+	if opts.job.cancelled() {
+		if state != nil {
+			saver.flush()
 		}
+		return nil, ErrTransferCancelled
+	}
 
-		for i := 0; i < MAX_RETRIES; i++ {
-			sender := w.Next()
-			if !IsFsBig {
-				_, err = sender.MakeRequestCtx(context.Background(), &UploadSaveFilePartParams{
-					FileID:   fileId,
-					FilePart: int32(totalParts - 1),
-					Bytes:    part,
-				})
-			} else {
-				_, err = sender.MakeRequestCtx(context.Background(), &UploadSaveBigFilePartParams{
-					FileID:         fileId,
-					FilePart:       int32(totalParts - 1),
-					FileTotalParts: int32(totalParts),
-					Bytes:          part,
-				})
-			}
-			w.FreeWorker(sender)
-			if err != nil {
-				if handleIfFlood(err, c) {
-					continue
+	if opts.ProgressManager != nil {
+		opts.ProgressManager.editFunc(size, size)
+	}
+
+	if opts.FileName != "" {
+		fileName = opts.FileName
+	}
+
+	if state != nil {
+		if undone := getUndoneParts(&doneArray, int(totalParts)); len(undone) > 0 {
+			saver.flush()
+			return nil, fmt.Errorf("upload incomplete: %d of %d parts failed, retry to resume", len(undone), totalParts)
+		}
+
+		// the upload is complete, but the parts are kept around in case the server
+		// reports them missing when the file is used
+		if err := opts.StateStore.Delete(state.Fingerprint); err != nil {
+			c.Log.Debug(errors.Wrap(err, "deleting upload state"))
+		}
+		c.trackUpload(fileId, source, state)
+	}
+
+	if !IsFsBig {
+		return &InputFileObj{
+			ID:          fileId,
+			Md5Checksum: string(hash.Sum(nil)),
+			Name:        prettifyFileName(fileName),
+			Parts:       int32(totalParts),
+		}, nil
+	}
+
+	return &InputFileBig{
+		ID:    fileId,
+		Parts: int32(totalParts),
+		Name:  prettifyFileName(fileName),
+	}, nil
+}
+
+const (
+	// files larger than this are uploaded with upload.saveBigFilePart
+	bigFileThreshold = 10 * 1024 * 1024 // 10MB
+	// FileTotalParts sent with saveBigFilePart while the part count is unknown
+	unknownTotalParts = -1
+)
+
+// uploadStream uploads a source of unknown length, sending parts as they are read.
+// Parts are held in memory until the big-file threshold is crossed, after which
+// they are sent with saveBigFilePart, reporting the final part count once EOF is reached.
+func (c *Client) uploadStream(file io.Reader, fileName string, opts *UploadOptions) (InputFile, error) {
+	partSize := 1024 * 512 // 512KB
+	if opts.ChunkSize > 0 {
+		partSize = int(opts.ChunkSize)
+	}
+
+	fileId := GenerateRandomLong()
+	hash := md5.New()
+
+	numWorkers := getValue(opts.Threads, countWorkers(bigFileThreshold/int64(partSize)))
+
+	c.Log.Info(fmt.Sprintf("file - upload: (%s) - (stream)", fileName))
+
+	dc := int32(c.GetDC())
+
+	var (
+		wg         sync.WaitGroup
+		sem        = make(chan struct{}, numWorkers)
+		doneBytes  atomic.Int64
+		uploadErr  atomic.Value
+		isBig      bool
+		pending    [][]byte // parts held back until the upload mode is known
+		totalParts int32
+	)
+
+	var progressTicker = make(chan struct{}, 1)
+	defer close(progressTicker)
+
+	if opts.ProgressManager != nil {
+		opts.ProgressManager.SetFileName(fileName)
+		opts.ProgressManager.lastPerc = 0
+		opts.ProgressManager.IncCount()
+
+		go func() {
+			ticker := time.NewTicker(time.Duration(opts.ProgressManager.editInterval) * time.Second)
+			defer ticker.Stop()
+
+			for {
+				select {
+				case <-progressTicker:
+					return
+				case <-ticker.C:
+					opts.ProgressManager.editFunc(0, doneBytes.Load()) // total size is not known yet
 				}
-				c.Log.Debug(err)
-				continue
 			}
+		}()
+	}
 
-			doneBytes.Add(int64(len(part)))
-			if !IsFsBig {
-				hash.Write(part)
+	sendPart := func(p int32, total int32, big bool, part []byte) {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			if err := c.saveFilePart(dc, fileId, p, total, big, part, opts.job, opts.Limiter); err != nil {
+				uploadErr.CompareAndSwap(nil, errors.Wrap(err, fmt.Sprintf("uploading part %d", p)))
+				return
 			}
+			doneBytes.Add(int64(len(part)))
+		}()
+	}
 
-			doneArray.Store(int(totalParts-1), true)
-			break
+	readPart := func() ([]byte, error) {
+		part := make([]byte, partSize)
+		n, err := io.ReadFull(file, part)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = nil
 		}
+		return part[:n], err
 	}
 
-	close(sem)
-	close(progressTicker)
-
-	if opts.ProgressManager != nil {
-		opts.ProgressManager.editFunc(size, size)
+	current, err := readPart()
+	if err != nil {
+		return nil, err
+	}
+	if len(current) == 0 {
+		return nil, errors.New("stream is empty, nothing to upload")
 	}
 
-	// destroy created workers
-	if !c.clientData.cacheSenders {
-		for _, worker := range w.workers {
-			if worker != c.MTProto {
-				worker.Terminate()
+	var totalSize int64
+	for len(current) > 0 {
+		if err := opts.job.checkpoint(); err != nil {
+			wg.Wait()
+			return nil, err
+		}
+		if err, ok := uploadErr.Load().(error); ok {
+			wg.Wait()
+			return nil, err
+		}
+
+		next, err := readPart()
+		if err != nil {
+			wg.Wait()
+			return nil, errors.Wrap(err, "reading stream")
+		}
+		last := len(next) == 0
+		totalSize += int64(len(current))
+
+		if !isBig && totalSize > bigFileThreshold {
+			isBig = true
+			for p, part := range pending {
+				sendPart(int32(p), unknownTotalParts, true, part)
 			}
+			pending = nil
 		}
+
+		switch {
+		case !isBig:
+			hash.Write(current)
+			pending = append(pending, current)
+		case last:
+			// the final part carries the real part count, so it goes out after all the others
+			wg.Wait()
+			sendPart(totalParts, totalParts+1, true, current)
+		default:
+			sendPart(totalParts, unknownTotalParts, true, current)
+		}
+
+		totalParts++
+		current = next
 	}
 
-	if opts.FileName != "" {
-		fileName = opts.FileName
+	for p, part := range pending {
+		sendPart(int32(p), totalParts, false, part)
 	}
 
-	if !IsFsBig {
+	wg.Wait()
+	close(sem)
+
+	if err, ok := uploadErr.Load().(error); ok {
+		return nil, err
+	}
+
+	if opts.ProgressManager != nil {
+		opts.ProgressManager.SetTotalSize(totalSize)
+		opts.ProgressManager.editFunc(totalSize, totalSize)
+	}
+
+	c.Log.Debug(fmt.Sprintf("stream upload finished: %s in %d parts", SizetoHuman(totalSize), totalParts))
+
+	if !isBig {
 		return &InputFileObj{
 			ID:          fileId,
 			Md5Checksum: string(hash.Sum(nil)),
 			Name:        prettifyFileName(fileName),
-			Parts:       int32(totalParts),
+			Parts:       totalParts,
 		}, nil
 	}
 
 	return &InputFileBig{
 		ID:    fileId,
-		Parts: int32(totalParts),
+		Parts: totalParts,
 		Name:  prettifyFileName(fileName),
 	}, nil
 }
 
+// saveFilePart uploads a single part of a file, retrying on flood waits and transient errors.
+func (c *Client) saveFilePart(dc int32, fileId int64, part, totalParts int32, big bool, data []byte, job *TransferJob, limiter *BandwidthLimiter) error {
+	const MAX_RETRIES = 3
+	var err error
+
+	for i := 0; i < MAX_RETRIES; i++ {
+		if err := job.checkpoint(); err != nil {
+			return err
+		}
+		c.throttle(limiter, len(data))
+		sender, acquireErr := c.senders.acquire(dc)
+		if acquireErr != nil {
+			return acquireErr
+		}
+		if !big {
+			_, err = sender.MakeRequestCtx(context.Background(), &UploadSaveFilePartParams{
+				FileID:   fileId,
+				FilePart: part,
+				Bytes:    data,
+			})
+		} else {
+			_, err = sender.MakeRequestCtx(context.Background(), &UploadSaveBigFilePartParams{
+				FileID:         fileId,
+				FilePart:       part,
+				FileTotalParts: totalParts,
+				Bytes:          data,
+			})
+		}
+		c.senders.Done(sender, err)
+
+		if err != nil {
+			if handleIfFlood(err, c) {
+				continue
+			}
+			c.Log.Debug(err)
+			continue
+		}
+
+		c.Log.Debug(fmt.Sprintf("uploaded part %d/%d in chunks of %d KB", part, totalParts, len(data)/1024))
+		return nil
+	}
+
+	return err
+}
+
 // Internal flood sleep handler
 func handleIfFlood(err error, c *Client) bool {
 	if MatchError(err, "FLOOD_WAIT_") || MatchError(err, "FLOOD_PREMIUM_WAIT_") {
@@ -405,6 +620,13 @@ type DownloadOptions struct {
 	ThumbOnly bool `json:"thumb_only,omitempty"`
 	// Thumb size to download
 	ThumbSize PhotoSize `json:"thumb_size,omitempty"`
+	// Verify each part against upload.getFileHashes, re-downloading corrupted parts;
+	// the chunk size must then be a multiple of 128KB
+	Verify bool `json:"verify,omitempty"`
+	// Bandwidth limit for this download, applied on top of the client-wide limit.
+	Limiter *BandwidthLimiter `json:"-"`
+
+	job *TransferJob // set by the TransferManager, to pause or cancel the download
 }
 
 type Destination struct {
@@ -461,6 +683,9 @@ func (c *Client) DownloadMedia(file any, Opts ...*DownloadOptions) (string, erro
 		}
 		partSize = int(opts.ChunkSize)
 	}
+	if opts.Verify && partSize%fileHashBlock != 0 {
+		return "", errors.New("chunk size must be a multiple of 131072 (128KB) to verify the download")
+	}
 
 	dest = sanitizePath(dest, fileName)
 
@@ -486,8 +711,6 @@ func (c *Client) DownloadMedia(file any, Opts ...*DownloadOptions) (string, erro
 		numWorkers = opts.Threads
 	}
 
-	var w = NewWorkerPool(numWorkers)
-
 	if opts.Buffer != nil {
 		dest = ":mem-buffer:"
 		c.Log.Warn("downloading to buffer (memory) - use with caution (memory usage)")
@@ -496,11 +719,6 @@ func (c *Client) DownloadMedia(file any, Opts ...*DownloadOptions) (string, erro
 	c.Log.Info(fmt.Sprintf("file - download: (%s) - (%s) - (%d)", dest, SizetoHuman(size), parts))
 	c.Log.Info(fmt.Sprintf("exporting senders: dc(%d) - workers(%d)", dc, numWorkers))
 
-	if c.clientData.cacheSenders {
-		c.exSenders.setTTL()
-	}
-	go initializeWorkers(numWorkers, dc, c, w)
-
 	var sem = make(chan struct{}, numWorkers)
 	var wg sync.WaitGroup
 	var doneBytes atomic.Int64
@@ -532,6 +750,32 @@ func (c *Client) DownloadMedia(file any, Opts ...*DownloadOptions) (string, erro
 
 	MAX_RETRIES := 3
 	var cdnRedirect atomic.Bool
+	var integrityErr atomic.Value
+
+	var verifier *partVerifier
+	if opts.Verify {
+		verifier = newPartVerifier(c, dc, location)
+	}
+
+	// checkPart reports whether a downloaded part passed verification (always, if not verifying)
+	checkPart := func(p int, data []byte) bool {
+		if verifier == nil {
+			return true
+		}
+		intact, err := verifier.verify(int64(p)*int64(partSize), data)
+		if err != nil {
+			integrityErr.CompareAndSwap(nil, &IntegrityError{Part: p, Offset: int64(p) * int64(partSize), Err: err})
+			return false
+		}
+		if !intact {
+			c.Log.Debug(fmt.Sprintf("part - (%d) - hash mismatch, retrying...", p))
+			if attempts := verifier.fail(p); attempts >= maxIntegrityRetries {
+				integrityErr.CompareAndSwap(nil, &IntegrityError{Part: p, Offset: int64(p) * int64(partSize), Attempts: attempts})
+			}
+			return false
+		}
+		return true
+	}
 
 	for p := int64(0); p < parts; p++ {
 		wg.Add(1)
@@ -543,10 +787,15 @@ func (c *Client) DownloadMedia(file any, Opts ...*DownloadOptions) (string, erro
 			}()
 
 			for i := 0; i < MAX_RETRIES; i++ {
-				if cdnRedirect.Load() {
+				if cdnRedirect.Load() || integrityErr.Load() != nil || opts.job.checkpoint() != nil {
 					return
 				}
-				sender := w.Next()
+				c.throttle(opts.Limiter, partSize)
+				sender, err := c.senders.acquire(dc)
+				if err != nil {
+					c.Log.Debug(errors.Wrap(err, fmt.Sprintf("part - (%d) - retrying...", p)))
+					continue
+				}
 				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 				defer cancel()
 
@@ -557,7 +806,7 @@ func (c *Client) DownloadMedia(file any, Opts ...*DownloadOptions) (string, erro
 					Precise:      true,
 					CdnSupported: false,
 				})
-				w.FreeWorker(sender)
+				c.senders.Done(sender, err)
 
 				if err != nil {
 					if handleIfFlood(err, c) {
@@ -575,6 +824,9 @@ func (c *Client) DownloadMedia(file any, Opts ...*DownloadOptions) (string, erro
 
 				switch v := part.(type) {
 				case *UploadFileObj:
+					if !checkPart(p, v.Bytes) {
+						continue
+					}
 					c.Log.Debug("downloaded part ", p, "/", totalParts, " len: ", len(v.Bytes)/1024, "KB")
 					fs.WriteAt(v.Bytes, int64(p)*int64(partSize))
 					doneBytes.Add(int64(len(v.Bytes)))
@@ -606,7 +858,15 @@ retrySinglePart:
 			}()
 
 			for i := 0; i < MAX_RETRIES; i++ {
-				sender := w.Next()
+				if integrityErr.Load() != nil || opts.job.checkpoint() != nil {
+					return
+				}
+				c.throttle(opts.Limiter, partSize)
+				sender, err := c.senders.acquire(dc)
+				if err != nil {
+					c.Log.Debug(errors.Wrap(err, fmt.Sprintf("part - (%d) - retrying...", p)))
+					continue
+				}
 				ctx, cancel := context.WithTimeout(context.Background(), 6*time.Second)
 				defer cancel()
 
@@ -617,7 +877,7 @@ retrySinglePart:
 					Precise:      true,
 					CdnSupported: false,
 				})
-				w.FreeWorker(sender)
+				c.senders.Done(sender, err)
 
 				if err != nil {
 					if handleIfFlood(err, c) {
@@ -634,6 +894,9 @@ retrySinglePart:
 
 				switch v := part.(type) {
 				case *UploadFileObj:
+					if !checkPart(p, v.Bytes) {
+						continue
+					}
 					c.Log.Debug("seq-downloaded part ", p, "/", totalParts, " len: ", len(v.Bytes)/1024, "KB")
 					fs.WriteAt(v.Bytes, int64(p)*int64(partSize))
 					doneBytes.Add(int64(len(v.Bytes)))
@@ -650,7 +913,7 @@ retrySinglePart:
 		}(p)
 	}
 
-	if !cdnRedirect.Load() && len(getUndoneParts(&doneArray, int(totalParts))) > 0 { // Loop through failed parts
+	if !cdnRedirect.Load() && integrityErr.Load() == nil && !opts.job.cancelled() && len(getUndoneParts(&doneArray, int(totalParts))) > 0 { // Loop through failed parts
 		goto retrySinglePart
 	}
 
@@ -661,17 +924,16 @@ retrySinglePart:
 		return "", errors.New("cdn redirect not implemented")
 	}
 
-	if opts.ProgressManager != nil {
-		opts.ProgressManager.editFunc(size, size)
+	if err, ok := integrityErr.Load().(*IntegrityError); ok {
+		return "", err
 	}
 
-	// destroy created workers
-	if !c.clientData.cacheSenders {
-		for _, worker := range w.workers {
-			if worker != c.MTProto {
-				worker.Terminate()
-			}
-		}
+	if opts.job.cancelled() {
+		return "", ErrTransferCancelled
+	}
+
+	if opts.ProgressManager != nil {
+		opts.ProgressManager.editFunc(size, size)
 	}
 
 	return dest, nil
@@ -687,49 +949,6 @@ func getUndoneParts(doneMap *sync.Map, totalParts int) []int {
 	return undoneSet
 }
 
-func initializeWorkers(numWorkers int, dc int32, c *Client, w *WorkerPool) {
-	if numWorkers == 1 && dc == int32(c.GetDC()) {
-		w.AddWorker(c.MTProto)
-		return
-	}
-
-	var authParams = ExportedAuthParams{}
-	if dc != int32(c.GetDC()) {
-		auth, err := c.AuthExportAuthorization(dc)
-		if err != nil {
-			c.Log.Error(err)
-			return
-		}
-
-		authParams = ExportedAuthParams{
-			ID:    auth.ID,
-			Bytes: auth.Bytes,
-		}
-	}
-
-	numCreate := 0
-	if c.clientData.cacheSenders {
-		for dcId, workers := range c.exSenders.senders {
-			if int(dc) == dcId {
-				for _, worker := range workers {
-					w.AddWorker(worker)
-					numCreate++
-				}
-			}
-		}
-	}
-
-	for i := numCreate; i < numWorkers; i++ {
-		conn, err := c.CreateExportedSender(int(dc), false, authParams)
-		if conn != nil && err == nil {
-			if c.clientData.cacheSenders {
-				c.exSenders.senders[int(dc)] = append(c.exSenders.senders[int(dc)], conn)
-			}
-			w.AddWorker(conn)
-		}
-	}
-}
-
 // DownloadChunk downloads a file in chunks, useful for downloading specific parts of a file.
 //
 // start and end are the byte offsets to download.
@@ -750,30 +969,15 @@ func (c *Client) DownloadChunk(media any, start int, end int, chunkSize int) ([]
 	if end > int(size) {
 		end = int(size)
 	}
-	var sender *mtproto.MTProto
-	if c.clientData.cacheSenders {
-		for dcId, workers := range c.exSenders.senders {
-			if int(dc) == dcId {
-				for _, worker := range workers {
-					sender = worker
-					break
-				}
-			}
-		}
-	}
-
-	if sender == nil {
-		sender, err = c.CreateExportedSender(int(dc), false)
-		if err != nil {
-			return nil, "", err
-		}
-
-		if c.clientData.cacheSenders {
-			c.exSenders.senders[int(dc)] = append(c.exSenders.senders[int(dc)], sender)
-		}
+	sender, err := c.senders.acquire(dc)
+	if err != nil {
+		return nil, "", err
 	}
+	var reqErr error
+	defer func() { c.senders.Done(sender, reqErr) }()
 
 	for curr := start; curr < end; curr += chunkSize {
+		c.throttle(nil, chunkSize)
 		part, err := sender.MakeRequest(&UploadGetFileParams{
 			Location:     input,
 			Limit:        int32(chunkSize),
@@ -781,6 +985,7 @@ func (c *Client) DownloadChunk(media any, start int, end int, chunkSize int) ([]
 			CdnSupported: false,
 		})
 
+		reqErr = err
 		if err != nil {
 			c.Log.Error(err)
 		}
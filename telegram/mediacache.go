@@ -0,0 +1,172 @@
+// Copyright (c) 2024 RoseLoverX
+
+package telegram
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/amarnathcjd/gogram/internal/encoding/tl"
+	"github.com/pkg/errors"
+)
+
+const (
+	cachedMediaPhoto    = "photo"
+	cachedMediaDocument = "document"
+)
+
+// CachedMedia is an already uploaded file, reusable by its content hash.
+type CachedMedia struct {
+	Kind          string // photo or document
+	ID            int64
+	AccessHash    int64
+	FileReference []byte
+	Added         int64
+}
+
+func (m *CachedMedia) inputMedia(attr *MediaMetadata) InputMedia {
+	if m.Kind == cachedMediaPhoto {
+		return &InputMediaPhoto{ID: &InputPhotoObj{ID: m.ID, AccessHash: m.AccessHash, FileReference: m.FileReference}, TtlSeconds: getValue(attr.TTL, 0), Spoiler: getValue(attr.Spoiler, false)}
+	}
+	return &InputMediaDocument{ID: &InputDocumentObj{ID: m.ID, AccessHash: m.AccessHash, FileReference: m.FileReference}, TtlSeconds: getValue(attr.TTL, 0), Spoiler: getValue(attr.Spoiler, false)}
+}
+
+// mediaDedupKey identifies a local file by its full content hash, size, the kind of media it is
+// sent as and what is sent along with it (file name, mime type, attributes and thumbnail), as
+// media uploaded with other metadata can't be reused.
+func mediaDedupKey(localFile string, kind string, attr *MediaMetadata) (string, error) {
+	meta := sha256.New()
+	fmt.Fprintf(meta, "%s\x00%s\x00%t\x00", attr.FileName, attr.MimeType, attr.DisableThumb)
+	for _, attribute := range attr.Attributes {
+		data, err := tl.Marshal(attribute)
+		if err != nil {
+			return "", err
+		}
+		meta.Write(data)
+	}
+	switch thumb := attr.Thumb.(type) {
+	case nil:
+	case string:
+		fmt.Fprintf(meta, "\x00thumb:%s", thumb)
+	case []byte:
+		meta.Write([]byte("\x00thumb:"))
+		meta.Write(thumb)
+	default:
+		return "", errors.New("thumbnail can't be identified")
+	}
+
+	file, err := os.Open(localFile)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%x:%d:%s:%x", hash.Sum(nil), size, kind, meta.Sum(nil)[:8]), nil
+}
+
+func (c *CACHE) GetMedia(key string) (*CachedMedia, bool) {
+	return c.store.GetMedia(key)
+}
+
+func (c *CACHE) PutMedia(key string, media *CachedMedia) {
+	if err := c.store.PutMedia(key, media); err != nil {
+		c.logger.Error("error caching media: ", err)
+		return
+	}
+
+	if !c.memory && !c.disabled {
+		go c.WriteFile()
+	}
+}
+
+// ForgetMedia drops every cached entry pointing to the given photo or document id.
+func (c *CACHE) ForgetMedia(id int64) bool {
+	var keys []string
+	c.store.RangeMedia(func(key string, media *CachedMedia) bool {
+		if media.ID == id {
+			keys = append(keys, key)
+		}
+		return true
+	})
+	if len(keys) == 0 {
+		return false
+	}
+
+	if err := c.store.DeleteMedia(keys...); err != nil {
+		c.logger.Error("error forgetting cached media: ", err)
+	}
+	return true
+}
+
+// uploadToSelfDedup uploads the media to self, caching the result when it was
+// uploaded from a local file with media deduplication enabled.
+func (c *Client) uploadToSelfDedup(media InputMedia, attr *MediaMetadata) (InputMedia, error) {
+	uploaded, err := c.uploadToSelf(media)
+	if err != nil || attr.dedupKey == "" {
+		return uploaded, err
+	}
+
+	key := attr.dedupKey
+	attr.dedupKey = ""
+	if cached := c.rememberUploadedMedia(key, uploaded); cached != nil {
+		return cached.inputMedia(attr), nil
+	}
+	return uploaded, nil
+}
+
+// rememberUploadedMedia stores the media returned by uploadToSelf under the dedup key.
+func (c *Client) rememberUploadedMedia(key string, media InputMedia) *CachedMedia {
+	cached := &CachedMedia{Added: time.Now().Unix()}
+	switch m := media.(type) {
+	case *InputMediaPhoto:
+		photo, ok := m.ID.(*InputPhotoObj)
+		if !ok {
+			return nil
+		}
+		cached.Kind, cached.ID, cached.AccessHash, cached.FileReference = cachedMediaPhoto, photo.ID, photo.AccessHash, photo.FileReference
+	case *InputMediaDocument:
+		doc, ok := m.ID.(*InputDocumentObj)
+		if !ok {
+			return nil
+		}
+		cached.Kind, cached.ID, cached.AccessHash, cached.FileReference = cachedMediaDocument, doc.ID, doc.AccessHash, doc.FileReference
+	default:
+		return nil
+	}
+
+	c.Cache.PutMedia(key, cached)
+	c.Log.Debug("media dedup: cached uploaded ", cached.Kind, " (", cached.ID, ")")
+	return cached
+}
+
+// forgetDedupMedia drops the cache entries of reused media, returning true
+// if the failed request used deduplicated media and can be retried with a fresh upload.
+func (c *Client) forgetDedupMedia(medias ...InputMedia) bool {
+	if !c.clientData.dedupMedia {
+		return false
+	}
+
+	var found bool
+	for _, media := range medias {
+		switch m := media.(type) {
+		case *InputMediaPhoto:
+			if photo, ok := m.ID.(*InputPhotoObj); ok && c.Cache.ForgetMedia(photo.ID) {
+				found = true
+			}
+		case *InputMediaDocument:
+			if doc, ok := m.ID.(*InputDocumentObj); ok && c.Cache.ForgetMedia(doc.ID) {
+				found = true
+			}
+		}
+	}
+	return found
+}
@@ -212,7 +212,7 @@ func (c *Client) editMessage(Peer InputPeer, id int32, Message string, entities
 			return nil, err
 		}
 	}
-	result, err := c.MessagesEditMessage(&MessagesEditMessageParams{
+	params := &MessagesEditMessageParams{
 		Peer:         Peer,
 		ID:           id,
 		Message:      Message,
@@ -222,10 +222,15 @@ func (c *Client) editMessage(Peer InputPeer, id int32, Message string, entities
 		Entities:     entities,
 		Media:        media,
 		ScheduleDate: options.ScheduleDate,
-	})
+	}
+	result, err := c.MessagesEditMessage(params)
+	for retry := 0; err != nil && retry < maxMissingPartRetries && c.resendMissingPart(media, err); retry++ {
+		result, err = c.MessagesEditMessage(params)
+	}
 	if err != nil {
 		return nil, err
 	}
+	c.forgetUpload(media)
 	if result != nil {
 		processed := c.processUpdate(result)
 		processed.PeerID = c.getPeer(Peer)
@@ -281,11 +286,12 @@ func (c *Client) editBotInlineMessage(ID InputBotInlineMessageID, Message string
 		dcID = id.DcID
 	}
 	if dcID != int32(c.GetDC()) {
-		borrowedSender, borrowError := c.CreateExportedSender(int(dcID), false)
+		borrowedSender, borrowError := c.senders.acquire(dcID)
 		if borrowError != nil {
 			return nil, borrowError
 		}
 		editTrueAny, err := borrowedSender.MakeRequestCtx(context.Background(), editRequest)
+		c.senders.Done(borrowedSender, err)
 		if err != nil {
 			return nil, err
 		}
@@ -296,10 +302,14 @@ func (c *Client) editBotInlineMessage(ID InputBotInlineMessageID, Message string
 		}
 	} else {
 		editTrue, err = c.MessagesEditInlineBotMessage(editRequest)
+		for retry := 0; err != nil && retry < maxMissingPartRetries && c.resendMissingPart(media, err); retry++ {
+			editTrue, err = c.MessagesEditInlineBotMessage(editRequest)
+		}
 	}
 	if err != nil {
 		return nil, err
 	}
+	c.forgetUpload(media)
 	if editTrue {
 		return &NewMessage{ID: 0, Message: &MessageObj{
 			ID:          0,
@@ -354,6 +364,8 @@ type MediaMetadata struct {
 	FileAbsPath          string              // absolute path to the file
 	Inline               bool                // to force calling media.uploadMedia (for inline and albums)
 	SkipHash             bool                // to skip reusing duplicate files
+
+	dedupKey string // content key of the file being uploaded, when media dedup is enabled
 }
 
 // SendMedia sends a media message.
@@ -419,7 +431,13 @@ func (c *Client) SendMedia(peerID, Media any, opts ...*MediaOptions) (*NewMessag
 			return nil, err
 		}
 	}
-	return c.sendMedia(senderPeer, sendMedia, textMessage, entities, sendAs, opt)
+
+	sent, err := c.sendMedia(senderPeer, sendMedia, textMessage, entities, sendAs, opt)
+	if MatchError(err, "FILE_REFERENCE_EXPIRED") && c.forgetDedupMedia(sendMedia) {
+		c.Log.Debug("media dedup: file reference expired, uploading again")
+		return c.SendMedia(peerID, Media, opts...)
+	}
+	return sent, err
 }
 
 func (c *Client) sendMedia(Peer InputPeer, Media InputMedia, Caption string, entities []MessageEntity, sendAs InputPeer, opt *MediaOptions) (*NewMessage, error) {
@@ -434,7 +452,7 @@ func (c *Client) sendMedia(Peer InputPeer, Media InputMedia, Caption string, ent
 		}
 	}
 
-	result, err := c.MessagesSendMedia(&MessagesSendMediaParams{
+	params := &MessagesSendMediaParams{
 		Silent:                 opt.Silent,
 		Background:             false,
 		ClearDraft:             opt.ClearDraft,
@@ -450,10 +468,16 @@ func (c *Client) sendMedia(Peer InputPeer, Media InputMedia, Caption string, ent
 		Entities:               entities,
 		ScheduleDate:           opt.ScheduleDate,
 		SendAs:                 sendAs,
-	})
+	}
+
+	result, err := c.MessagesSendMedia(params)
+	for retry := 0; err != nil && retry < maxMissingPartRetries && c.resendMissingPart(Media, err); retry++ {
+		result, err = c.MessagesSendMedia(params)
+	}
 	if err != nil {
 		return nil, err
 	}
+	c.forgetUpload(Media)
 	if result != nil {
 		processed := c.processUpdate(result)
 		processed.PeerID = c.getPeer(Peer)
@@ -546,7 +570,19 @@ func (c *Client) SendAlbum(peerID, Album any, opts ...*MediaOptions) ([]*NewMess
 			return nil, err
 		}
 	}
-	return c.sendAlbum(senderPeer, InputAlbum, sendAs, opt)
+
+	sent, err := c.sendAlbum(senderPeer, InputAlbum, sendAs, opt)
+	if MatchError(err, "FILE_REFERENCE_EXPIRED") {
+		var medias []InputMedia
+		for _, m := range InputAlbum {
+			medias = append(medias, m.Media)
+		}
+		if c.forgetDedupMedia(medias...) {
+			c.Log.Debug("media dedup: file reference expired, uploading album again")
+			return c.SendAlbum(peerID, Album, opts...)
+		}
+	}
+	return sent, err
 }
 
 func (c *Client) sendAlbum(Peer InputPeer, Album []*InputSingleMedia, sendAs InputPeer, opt *MediaOptions) ([]*NewMessage, error) {
@@ -584,10 +620,19 @@ func (c *Client) sendAlbum(Peer InputPeer, Album []*InputSingleMedia, sendAs Inp
 		chunk = Album[i:end]
 
 		req.MultiMedia = chunk
+		media := make([]InputMedia, 0, len(chunk))
+		for _, m := range chunk {
+			media = append(media, m.Media)
+		}
+
 		result, err := c.MessagesSendMultiMedia(req)
+		for retry := 0; err != nil && retry < maxMissingPartRetries && c.resendMissingParts(err, media...); retry++ {
+			result, err = c.MessagesSendMultiMedia(req)
+		}
 		if err != nil {
 			return nil, err
 		}
+		c.forgetUpload(media...)
 
 		if result != nil {
 			updates := processUpdates(result)
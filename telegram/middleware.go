@@ -0,0 +1,57 @@
+// Copyright (c) 2024 RoseLoverX
+
+package telegram
+
+import "strings"
+
+// UpdateHandler handles a packed update: *NewMessage (messages and edits), *Album,
+// *DeleteMessage, *CallbackQuery, *InlineCallbackQuery, *InlineQuery, *InlineSend,
+// *ParticipantUpdate or one of the updates of events.go, or the Update itself for raw
+// handlers and those added with OnUpdate.
+type UpdateHandler func(update any) error
+
+// Middleware wraps the handlers of every update type, for things like logging, auth checks or
+// metrics. It may short-circuit by returning without calling next; if it calls next with
+// another update, it must be of the same type.
+type Middleware func(next UpdateHandler) UpdateHandler
+
+// Use adds middleware run around every handler, before that of the handler's group.
+// Middleware runs in the order it was added.
+func (c *Client) Use(middleware ...Middleware) {
+	c.dispatcher.Lock()
+	defer c.dispatcher.Unlock()
+	c.dispatcher.middleware = append(c.dispatcher.middleware, middleware...)
+}
+
+// UseGroup adds middleware run around the handlers of a group (see Handle.SetGroup).
+func (c *Client) UseGroup(group string, middleware ...Middleware) {
+	c.dispatcher.Lock()
+	defer c.dispatcher.Unlock()
+	if c.dispatcher.groupMiddleware == nil {
+		c.dispatcher.groupMiddleware = make(map[string][]Middleware)
+	}
+	group = middlewareGroup(group)
+	c.dispatcher.groupMiddleware[group] = append(c.dispatcher.groupMiddleware[group], middleware...)
+}
+
+func middlewareGroup(group string) string {
+	if group = strings.ToLower(strings.TrimSpace(group)); group == "" {
+		return "default"
+	}
+	return group
+}
+
+// chain wraps a handler of a group in its middleware.
+func (d *UpdateDispatcher) chain(group string, handler UpdateHandler) UpdateHandler {
+	d.RLock()
+	defer d.RUnlock()
+
+	groupMiddleware := d.groupMiddleware[middlewareGroup(group)]
+	for i := len(groupMiddleware) - 1; i >= 0; i-- {
+		handler = groupMiddleware[i](handler)
+	}
+	for i := len(d.middleware) - 1; i >= 0; i-- {
+		handler = d.middleware[i](handler)
+	}
+	return handler
+}
@@ -1,6 +1,7 @@
 package telegram
 
 import (
+	"context"
 	"encoding/json"
 	"strings"
 
@@ -19,12 +20,14 @@ type NewMessage struct {
 	Peer           InputPeer
 	Sender         *UserObj
 	SenderChat     *Channel
+	ctx            context.Context
 }
 
 type DeleteMessage struct {
 	Client    *Client
 	ChannelID int64
 	Messages  []int32
+	ctx       context.Context
 }
 
 type CustomFile struct {
@@ -693,6 +696,7 @@ type Album struct {
 	Client    *Client
 	GroupedID int64
 	Messages  []*NewMessage
+	ctx       context.Context
 }
 
 func (a *Album) Marshal(nointent ...bool) string {
@@ -2,7 +2,10 @@
 
 package telegram
 
-import "errors"
+import (
+	"context"
+	"errors"
+)
 
 type ParticipantUpdate struct {
 	Client         *Client
@@ -14,6 +17,7 @@ type ParticipantUpdate struct {
 	New            ChannelParticipant
 	Invite         ExportedChatInvite
 	Date           int32
+	ctx            context.Context
 }
 
 func (pu *ParticipantUpdate) ChannelID() int64 {
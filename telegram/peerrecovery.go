@@ -0,0 +1,441 @@
+// Copyright (c) 2024 RoseLoverX
+
+package telegram
+
+import (
+	"reflect"
+	"time"
+
+	"github.com/amarnathcjd/gogram/internal/encoding/tl"
+	"github.com/pkg/errors"
+)
+
+const (
+	maxMinContexts      = 10000 // messages remembered for min peers
+	recoverDialogsLimit = 100   // recent dialogs searched for a lost peer
+	recoverDifference   = 1000  // events of the update history searched for a lost peer
+	maxRecoverPeers     = 3     // peers tried per recovery, e.g. per retried request
+	maxRecoverFailures  = 1000  // peers remembered as not recoverable
+	recoverRetryAfter   = time.Minute
+)
+
+// minPeerContext is a message a min user or channel was seen in, which can be used to refer
+// to it without its access hash (inputPeerUserFromMessage, inputPeerChannelFromMessage).
+type minPeerContext struct {
+	peer  Peer // chat of the message
+	msgID int32
+}
+
+// trackMinPeers remembers the messages min users and channels of an update were seen in.
+func (c *CACHE) trackMinPeers(updates []Update, users []User, chats []Chat) {
+	minPeers := make(map[peerKey]bool)
+	for _, user := range users {
+		if user, ok := user.(*UserObj); ok && user.Min {
+			minPeers[peerKey{cachedUser, user.ID}] = true
+		}
+	}
+	for _, chat := range chats {
+		if channel, ok := chat.(*Channel); ok && channel.Min {
+			minPeers[peerKey{cachedChannel, channel.ID}] = true
+		}
+	}
+	if len(minPeers) == 0 {
+		return
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	track := func(from Peer, chat Peer, msgID int32) {
+		var key peerKey
+		switch from := from.(type) {
+		case *PeerUser:
+			key = peerKey{cachedUser, from.UserID}
+		case *PeerChannel:
+			key = peerKey{cachedChannel, from.ChannelID}
+		default:
+			return
+		}
+		if !minPeers[key] {
+			return
+		}
+
+		if _, ok := c.minContexts[key]; !ok && len(c.minContexts) >= maxMinContexts {
+			for k := range c.minContexts {
+				delete(c.minContexts, k)
+				break
+			}
+		}
+		c.minContexts[key] = minPeerContext{peer: chat, msgID: msgID}
+	}
+
+	for _, update := range updates {
+		var message Message
+		switch update := update.(type) {
+		case *UpdateNewMessage:
+			message = update.Message
+		case *UpdateNewChannelMessage:
+			message = update.Message
+		case *UpdateEditMessage:
+			message = update.Message
+		case *UpdateEditChannelMessage:
+			message = update.Message
+		}
+
+		switch msg := message.(type) {
+		case *MessageObj:
+			track(msg.FromID, msg.PeerID, msg.ID)
+			if msg.FwdFrom != nil {
+				track(msg.FwdFrom.FromID, msg.PeerID, msg.ID)
+			}
+		case *MessageService:
+			track(msg.FromID, msg.PeerID, msg.ID)
+		}
+	}
+}
+
+// inputPeerFromMessage refers to a min user or channel through a message it was seen in,
+// the cache lock must not be held.
+func (c *CACHE) inputPeerFromMessage(key peerKey) (InputPeer, bool) {
+	c.RLock()
+	ctx, ok := c.minContexts[key]
+	c.RUnlock()
+	if !ok {
+		return nil, false
+	}
+
+	var chat InputPeer
+	switch peer := ctx.peer.(type) {
+	case *PeerUser:
+		hash, ok := c.store.GetInputUser(peer.UserID)
+		if !ok {
+			return nil, false
+		}
+		chat = &InputPeerUser{UserID: peer.UserID, AccessHash: hash}
+	case *PeerChat:
+		chat = &InputPeerChat{ChatID: peer.ChatID}
+	case *PeerChannel:
+		hash, ok := c.store.GetInputChannel(peer.ChannelID)
+		if !ok {
+			return nil, false
+		}
+		chat = &InputPeerChannel{ChannelID: peer.ChannelID, AccessHash: hash}
+	default:
+		return nil, false
+	}
+
+	if key.kind == cachedChannel {
+		return &InputPeerChannelFromMessage{Peer: chat, MsgID: ctx.msgID, ChannelID: key.id}, true
+	}
+	return &InputPeerUserFromMessage{Peer: chat, MsgID: ctx.msgID, UserID: key.id}, true
+}
+
+// ------------------ Invalid Peer Recovery ------------------
+
+func isInvalidPeerError(err error) bool {
+	return MatchError(err, "PEER_ID_INVALID") || MatchError(err, "CHANNEL_INVALID") || MatchError(err, "USER_ID_INVALID")
+}
+
+// MakeRequest sends a request; when it fails because of an invalid peer, a user or channel
+// it refers to is resolved again (see RecoverPeer) and a copy of it with the recovered peer
+// is sent once, the request itself is not changed.
+func (c *Client) MakeRequest(msg tl.Object) (any, error) {
+	resp, err := c.MTProto.MakeRequest(msg)
+	if err == nil {
+		c.updates.observe(resp)
+		return resp, nil
+	}
+	if !isInvalidPeerError(err) {
+		return resp, err
+	}
+
+	retry, ok := c.newPeerRecovery().recoverRequestPeers(reflect.ValueOf(msg), 0)
+	if !ok {
+		return resp, err
+	}
+	c.Log.Debug("retrying ", reflect.TypeOf(msg).Elem().Name(), " with a recovered peer")
+	resp, err = c.MTProto.MakeRequest(retry.Interface().(tl.Object))
+	if err == nil {
+		c.updates.observe(resp)
+	}
+	return resp, err
+}
+
+// peerRecovery resolves lost access hashes for a single request or RecoverPeer call: the
+// dialogs and the update history are fetched at most once however many peers are tried, and
+// at most maxRecoverPeers peers are tried.
+type peerRecovery struct {
+	c                   *Client
+	tried               int
+	dialogs, difference bool // fetched already
+}
+
+func (c *Client) newPeerRecovery() *peerRecovery {
+	return &peerRecovery{c: c}
+}
+
+// recoverRequestPeers returns a copy of a request with the first user or channel reference
+// (of the request or of the one it wraps, like invokeWithLayer) that resolves to a new access
+// hash replaced; the server does not tell which one it rejected. The request itself, and the
+// structs and slices it shares with the copy, are left as they are.
+func (r *peerRecovery) recoverRequestPeers(v reflect.Value, depth int) (reflect.Value, bool) {
+	if depth > 2 || v.Kind() != reflect.Ptr || v.IsNil() || v.Elem().Kind() != reflect.Struct {
+		return v, false
+	}
+
+	copied := reflect.New(v.Elem().Type())
+	copied.Elem().Set(v.Elem())
+	s := copied.Elem()
+	for i := 0; i < s.NumField() && r.tried < maxRecoverPeers; i++ {
+		field := s.Field(i)
+		if !field.CanSet() {
+			continue
+		}
+
+		switch field.Kind() {
+		case reflect.Interface:
+			if field.IsNil() {
+				continue
+			}
+			if recovered, ok := r.recoverInputPeer(field.Interface()); ok && reflect.TypeOf(recovered).AssignableTo(field.Type()) {
+				field.Set(reflect.ValueOf(recovered))
+				return copied, true
+			} else if nested, ok := r.recoverRequestPeers(field.Elem(), depth+1); ok {
+				field.Set(nested)
+				return copied, true
+			}
+		case reflect.Slice:
+			if field.Type().Elem().Kind() != reflect.Interface {
+				continue
+			}
+			for j := 0; j < field.Len() && r.tried < maxRecoverPeers; j++ {
+				elem := field.Index(j)
+				if elem.IsNil() {
+					continue
+				}
+				if recovered, ok := r.recoverInputPeer(elem.Interface()); ok && reflect.TypeOf(recovered).AssignableTo(elem.Type()) {
+					elems := reflect.MakeSlice(field.Type(), field.Len(), field.Len())
+					reflect.Copy(elems, field)
+					elems.Index(j).Set(reflect.ValueOf(recovered))
+					field.Set(elems)
+					return copied, true
+				}
+			}
+		}
+	}
+	return v, false
+}
+
+// recoverInputPeer resolves a user or channel reference again, returning a reference of the
+// same kind (InputPeer, InputUser or InputChannel) if it was recovered with a new access hash.
+func (r *peerRecovery) recoverInputPeer(ref any) (any, bool) {
+	var (
+		key     peerKey
+		oldHash int64
+		asPeer  bool
+	)
+	switch ref := ref.(type) {
+	case *InputPeerUser:
+		key, oldHash, asPeer = peerKey{cachedUser, ref.UserID}, ref.AccessHash, true
+	case *InputPeerUserFromMessage:
+		key, asPeer = peerKey{cachedUser, ref.UserID}, true
+	case *InputPeerChannel:
+		key, oldHash, asPeer = peerKey{cachedChannel, ref.ChannelID}, ref.AccessHash, true
+	case *InputPeerChannelFromMessage:
+		key, asPeer = peerKey{cachedChannel, ref.ChannelID}, true
+	case *InputUserObj:
+		key, oldHash = peerKey{cachedUser, ref.UserID}, ref.AccessHash
+	case *InputUserFromMessage:
+		key = peerKey{cachedUser, ref.UserID}
+	case *InputChannelObj:
+		key, oldHash = peerKey{cachedChannel, ref.ChannelID}, ref.AccessHash
+	case *InputChannelFromMessage:
+		key = peerKey{cachedChannel, ref.ChannelID}
+	default:
+		return nil, false
+	}
+
+	hash, ok := r.recoverAccessHash(key, oldHash)
+	if !ok {
+		return nil, false
+	}
+
+	switch {
+	case key.kind == cachedUser && asPeer:
+		return &InputPeerUser{UserID: key.id, AccessHash: hash}, true
+	case key.kind == cachedUser:
+		return &InputUserObj{UserID: key.id, AccessHash: hash}, true
+	case asPeer:
+		return &InputPeerChannel{ChannelID: key.id, AccessHash: hash}, true
+	default:
+		return &InputChannelObj{ChannelID: key.id, AccessHash: hash}, true
+	}
+}
+
+// RecoverPeer resolves the access hash of a user or channel again, for when the cached one
+// is missing or was rejected: by its username, from the recent dialogs (not for bots), and
+// from the recent update history, in that order. A peer that could not be recovered is not
+// tried again for a minute.
+func (c *Client) RecoverPeer(peerID int64) (InputPeer, error) {
+	key := peerKey{cachedUser, peerID}
+	if id := trimSuffixHundred(peerID); id != peerID {
+		key = peerKey{cachedChannel, id}
+	} else if peerID < 0 {
+		return nil, errors.Errorf("peer %d is not a user or channel", peerID)
+	}
+
+	r := c.newPeerRecovery()
+	if hash, ok := r.recoverAccessHash(key, 0); ok {
+		if key.kind == cachedChannel {
+			return &InputPeerChannel{ChannelID: key.id, AccessHash: hash}, nil
+		}
+		return &InputPeerUser{UserID: key.id, AccessHash: hash}, nil
+	}
+	if key.kind == cachedUser { // a channel id without the -100 prefix
+		if hash, ok := r.recoverAccessHash(peerKey{cachedChannel, peerID}, 0); ok {
+			return &InputPeerChannel{ChannelID: peerID, AccessHash: hash}, nil
+		}
+	}
+	return nil, errors.Errorf("could not recover peer %d", peerID)
+}
+
+func (r *peerRecovery) recoverAccessHash(key peerKey, oldHash int64) (int64, bool) {
+	c := r.c
+	found := func() (int64, bool) {
+		var (
+			hash int64
+			ok   bool
+		)
+		if key.kind == cachedChannel {
+			hash, ok = c.Cache.store.GetInputChannel(key.id)
+		} else {
+			hash, ok = c.Cache.store.GetInputUser(key.id)
+		}
+		return hash, ok && hash != oldHash
+	}
+	if hash, ok := found(); ok && oldHash == 0 {
+		return hash, true
+	}
+	if r.tried >= maxRecoverPeers || c.Cache.recoverFailedRecently(key) {
+		return 0, false
+	}
+	r.tried++
+
+	for _, resolve := range []func(){
+		func() {
+			if username := c.cachedUsername(key); username != "" {
+				c.ResolveUsername(username)
+			}
+		},
+		func() {
+			if r.dialogs || c.Me().Bot { // bots cannot get dialogs
+				return
+			}
+			r.dialogs = true
+			dialogs, err := c.MessagesGetDialogs(&MessagesGetDialogsParams{
+				OffsetPeer: &InputPeerEmpty{},
+				Limit:      recoverDialogsLimit,
+			})
+			if err != nil {
+				return
+			}
+			switch dialogs := dialogs.(type) {
+			case *MessagesDialogsObj:
+				c.Cache.UpdatePeersToCache(dialogs.Users, dialogs.Chats)
+			case *MessagesDialogsSlice:
+				c.Cache.UpdatePeersToCache(dialogs.Users, dialogs.Chats)
+			}
+		},
+		func() {
+			if r.difference {
+				return
+			}
+			r.difference = true
+			state, err := c.UpdatesGetState()
+			if err != nil {
+				return
+			}
+			diff, err := c.UpdatesGetDifference(&UpdatesGetDifferenceParams{
+				Pts:           max(state.Pts-recoverDifference, 1),
+				PtsTotalLimit: recoverDifference,
+				Date:          state.Date,
+				Qts:           state.Qts,
+			})
+			if err != nil {
+				return
+			}
+			switch diff := diff.(type) {
+			case *UpdatesDifferenceObj:
+				c.Cache.UpdatePeersToCache(diff.Users, diff.Chats)
+			case *UpdatesDifferenceSlice:
+				c.Cache.UpdatePeersToCache(diff.Users, diff.Chats)
+			}
+		},
+	} {
+		resolve()
+		if hash, ok := found(); ok {
+			return hash, true
+		}
+	}
+
+	c.Cache.recoverFailed(key)
+	return 0, false
+}
+
+// recoverFailedRecently reports whether the recovery of a peer failed within recoverRetryAfter.
+func (c *CACHE) recoverFailedRecently(key peerKey) bool {
+	c.RLock()
+	defer c.RUnlock()
+	at, ok := c.recoverFailures[key]
+	return ok && time.Since(at) < recoverRetryAfter
+}
+
+func (c *CACHE) recoverFailed(key peerKey) {
+	c.Lock()
+	defer c.Unlock()
+	if c.recoverFailures == nil {
+		c.recoverFailures = make(map[peerKey]time.Time)
+	}
+	if _, ok := c.recoverFailures[key]; !ok && len(c.recoverFailures) >= maxRecoverFailures {
+		for k, at := range c.recoverFailures {
+			if time.Since(at) >= recoverRetryAfter {
+				delete(c.recoverFailures, k)
+			}
+		}
+		for k := range c.recoverFailures {
+			if len(c.recoverFailures) < maxRecoverFailures {
+				break
+			}
+			delete(c.recoverFailures, k)
+		}
+	}
+	c.recoverFailures[key] = time.Now()
+}
+
+func (c *Client) cachedUsername(key peerKey) string {
+	if key.kind == cachedChannel {
+		if channel, ok := c.Cache.store.GetChannel(key.id); ok {
+			if channel.Username != "" {
+				return channel.Username
+			}
+			for _, username := range channel.Usernames {
+				if username.Active {
+					return username.Username
+				}
+			}
+		}
+		return ""
+	}
+
+	if user, ok := c.Cache.store.GetUser(key.id); ok {
+		if user.Username != "" {
+			return user.Username
+		}
+		for _, username := range user.Usernames {
+			if username.Active {
+				return username.Username
+			}
+		}
+	}
+	return ""
+}
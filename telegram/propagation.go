@@ -0,0 +1,168 @@
+// Copyright (c) 2024 RoseLoverX
+
+package telegram
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+// Execution order of handlers
+//
+// The handlers of an update run group by group (see Handle.SetGroup), in ascending order of
+// group priority. The conversation group runs first (ConversationGroupPriority), then the fsm
+// group of state machines (FSMGroupPriority); the default group has priority 0, a group named
+// after a number ("1", "-5") has that number as its priority, and other groups have priority 0
+// unless set with SetGroupPriority. Groups of the same priority run in order of name, the
+// default group first.
+//
+// The handlers of the default group run concurrently. If other groups come after it, they start
+// when all of its handlers have returned, so that StopPropagation from any of them is seen:
+// a slow handler in the default group delays the later groups of that update, so move slow
+// work off the handler or put later handlers in a group of lower priority number. The handlers
+// of other groups run one by one, in the order they were added.
+//
+// A handler steers what runs next with its return value:
+//   - nil or ContinuePropagation: go on with the next handler.
+//   - EndGroup: skip the rest of the group, go on with the next group.
+//   - StopPropagation: skip the rest of the group and all later groups.
+//
+// Other errors are logged, and handling goes on as with nil.
+var (
+	EndGroup            = errors.New("end-group-trigger")
+	StopPropagation     = errors.New("stop-propagation-trigger")
+	ContinuePropagation = errors.New("continue-propagation-trigger")
+)
+
+const (
+	DefaultGroupPriority      = 0
+	ConversationGroupPriority = -1 << 31 // conversations get the first look at updates
+	FSMGroupPriority          = -1 << 30 // then state machines (see FSM)
+)
+
+// SetGroupPriority sets the priority of a handler group; groups run in ascending order of priority.
+func (c *Client) SetGroupPriority(group string, priority int) {
+	c.dispatcher.Lock()
+	defer c.dispatcher.Unlock()
+	if c.dispatcher.groupPriority == nil {
+		c.dispatcher.groupPriority = make(map[string]int)
+	}
+	c.dispatcher.groupPriority[middlewareGroup(group)] = priority
+}
+
+func (d *UpdateDispatcher) priority(group string) int {
+	group = middlewareGroup(group)
+	if priority, ok := d.groupPriority[group]; ok {
+		return priority
+	}
+	switch group {
+	case "default":
+		return DefaultGroupPriority
+	case "conversation":
+		return ConversationGroupPriority
+	case "fsm":
+		return FSMGroupPriority
+	}
+	if priority, err := strconv.Atoi(group); err == nil {
+		return priority
+	}
+	return DefaultGroupPriority
+}
+
+func isDefaultGroup(group string) bool {
+	return middlewareGroup(group) == "default"
+}
+
+type handlerGroup[H Handle] struct {
+	name     string
+	priority int
+	handles  []H
+}
+
+// sortedGroups returns the groups of a handler map in execution order.
+func sortedGroups[H Handle](d *UpdateDispatcher, handles map[string][]H) []handlerGroup[H] {
+	d.RLock()
+	groups := make([]handlerGroup[H], 0, len(handles))
+	for name, h := range handles {
+		if len(h) > 0 {
+			groups = append(groups, handlerGroup[H]{name: name, priority: d.priority(name), handles: append([]H(nil), h...)})
+		}
+	}
+	d.RUnlock()
+
+	sort.Slice(groups, func(i, j int) bool {
+		if groups[i].priority != groups[j].priority {
+			return groups[i].priority < groups[j].priority
+		}
+		if a, b := isDefaultGroup(groups[i].name), isDefaultGroup(groups[j].name); a != b {
+			return a
+		}
+		return groups[i].name < groups[j].name
+	})
+	return groups
+}
+
+// runGroups runs the handlers of an update in execution order; call runs a handler, returning
+// nil if it doesn't match the update.
+func runGroups[H Handle](c *Client, kind string, handles map[string][]H, call func(group string, h H) error) {
+	groups := sortedGroups(c.dispatcher, handles)
+	for i, group := range groups {
+		if isDefaultGroup(group.name) && i == len(groups)-1 {
+			// nothing runs after it, no need to wait
+			for _, h := range group.handles {
+				c.dispatcher.spawn(func() {
+					c.handlerResult(kind, call(group.name, h))
+				})
+			}
+			return
+		}
+		if isDefaultGroup(group.name) {
+			var (
+				wg   sync.WaitGroup
+				stop atomic.Bool
+			)
+			for _, h := range group.handles {
+				wg.Add(1)
+				c.dispatcher.spawn(func() {
+					defer wg.Done()
+					if c.handlerResult(kind, call(group.name, h)) == StopPropagation {
+						stop.Store(true)
+					}
+				})
+			}
+			wg.Wait()
+			if stop.Load() {
+				return
+			}
+			continue
+		}
+
+		for _, h := range group.handles {
+			result := c.handlerResult(kind, call(group.name, h))
+			if result == StopPropagation {
+				return
+			}
+			if result == EndGroup {
+				break
+			}
+		}
+	}
+}
+
+// handlerResult logs the error of a handler, returning the propagation sentinel it carries, if any.
+func (c *Client) handlerResult(kind string, err error) error {
+	switch {
+	case err == nil, errors.Is(err, ContinuePropagation):
+		return nil
+	case errors.Is(err, StopPropagation):
+		return StopPropagation
+	case errors.Is(err, EndGroup):
+		return EndGroup
+	}
+	c.Log.Error(errors.Wrap(err, "["+kind+"]"))
+	return nil
+}
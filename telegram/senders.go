@@ -0,0 +1,270 @@
+// Copyright (c) 2024 RoseLoverX
+
+package telegram
+
+import (
+	"context"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	mtproto "github.com/amarnathcjd/gogram"
+	"github.com/pkg/errors"
+)
+
+// DefaultMaxSendersPerDC is the default cap of pooled senders per datacenter.
+const DefaultMaxSendersPerDC = 12
+
+// how long file operations wait for a pooled sender when all of a dc are busy
+const senderWaitTimeout = time.Minute
+
+// SenderPool keeps exported senders per datacenter, shared by every file operation of a client.
+// Senders are handed out for exclusive use, created on demand up to a cap per DC,
+// checked for a live connection before reuse and closed once idle for too long.
+type SenderPool struct {
+	c           *Client
+	mu          sync.Mutex
+	cond        *sync.Cond
+	maxPerDC    int
+	idleTimeout time.Duration
+	senders     map[int32][]*pooledSender
+	creating    map[int32]int
+	reaping     bool
+}
+
+type pooledSender struct {
+	*mtproto.MTProto
+	busy     bool
+	lastUsed time.Time
+}
+
+// NewSenderPool creates a pool for the client, defaults are used for zero values.
+func NewSenderPool(c *Client, maxPerDC int, idleTimeout time.Duration) *SenderPool {
+	p := &SenderPool{
+		c:           c,
+		maxPerDC:    getValue(maxPerDC, DefaultMaxSendersPerDC),
+		idleTimeout: getValue(idleTimeout, CleanExportedSendersDelay),
+		senders:     make(map[int32][]*pooledSender),
+		creating:    make(map[int32]int),
+	}
+	p.cond = sync.NewCond(&p.mu)
+	return p
+}
+
+// Acquire returns a sender of the dc for exclusive use, creating one if all are busy
+// and the dc is below its cap, otherwise waiting for one to be released.
+// Every acquired sender must be given back with Release, Discard or Done.
+func (p *SenderPool) Acquire(dc int32) (*mtproto.MTProto, error) {
+	return p.AcquireContext(context.Background(), dc)
+}
+
+// AcquireContext is Acquire, giving up waiting for a sender once ctx is done.
+func (p *SenderPool) AcquireContext(ctx context.Context, dc int32) (*mtproto.MTProto, error) {
+	stop := context.AfterFunc(ctx, func() {
+		p.mu.Lock()
+		p.cond.Broadcast()
+		p.mu.Unlock()
+	})
+	defer stop()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, errors.Wrapf(err, "waiting for a sender of dc %d", dc)
+		}
+
+		senders := p.senders[dc]
+		for i := 0; i < len(senders); i++ {
+			s := senders[i]
+			if s.busy {
+				continue
+			}
+			if !s.TcpActive() { // health check, drop dead connections
+				p.c.Log.Debug("sender pool: dropping disconnected sender of dc ", dc)
+				go s.Terminate()
+				senders = append(senders[:i], senders[i+1:]...)
+				p.senders[dc] = senders
+				i--
+				continue
+			}
+
+			s.busy = true
+			s.lastUsed = time.Now()
+			return s.MTProto, nil
+		}
+
+		if len(senders)+p.creating[dc] < p.maxPerDC {
+			p.creating[dc]++
+			p.mu.Unlock()
+			sender, err := p.c.CreateExportedSender(int(dc), false)
+			p.mu.Lock()
+			p.creating[dc]--
+
+			if err != nil {
+				p.cond.Broadcast() // let a waiter try creating one instead
+				return nil, errors.Wrap(err, "creating pooled sender")
+			}
+
+			p.senders[dc] = append(p.senders[dc], &pooledSender{MTProto: sender, busy: true, lastUsed: time.Now()})
+			p.c.Log.Debug("sender pool: created sender for dc ", dc, " (", len(p.senders[dc]), "/", p.maxPerDC, ")")
+			if !p.reaping {
+				p.reaping = true
+				go p.reap()
+			}
+			return sender, nil
+		}
+
+		p.cond.Wait()
+	}
+}
+
+// Release gives back a sender obtained from Acquire.
+func (p *SenderPool) Release(sender *mtproto.MTProto) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if s := p.find(sender); s != nil {
+		s.busy = false
+		s.lastUsed = time.Now()
+	} else {
+		go sender.Terminate() // dropped by Reset while in use
+	}
+	p.cond.Signal()
+}
+
+// acquire is AcquireContext, waiting at most senderWaitTimeout.
+func (p *SenderPool) acquire(dc int32) (*mtproto.MTProto, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), senderWaitTimeout)
+	defer cancel()
+	return p.AcquireContext(ctx, dc)
+}
+
+// Done gives back a sender obtained from Acquire with the error of the request made on it:
+// the sender is discarded if the request failed on the connection or it is no longer
+// connected, released otherwise (also when the request timed out or was cancelled).
+func (p *SenderPool) Done(sender *mtproto.MTProto, err error) {
+	if isConnectionError(err) || err != nil && !sender.TcpActive() {
+		p.c.Log.Debug("sender pool: discarding sender after ", err)
+		p.Discard(sender)
+		return
+	}
+	p.Release(sender)
+}
+
+// isConnectionError reports whether a request failed on the transport, like a closed or
+// reset connection; errors of telegram and requests given up on by their context are not.
+func isConnectionError(err error) bool {
+	var netErr net.Error
+	switch {
+	case err == nil, errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return false // checked first, DeadlineExceeded is a net.Error too
+	case errors.As(err, &netErr), errors.Is(err, net.ErrClosed), errors.Is(err, io.EOF),
+		errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, io.ErrClosedPipe):
+		return true
+	}
+	return strings.Contains(err.Error(), "reconnecting") // the sender failed to reconnect
+}
+
+// Discard closes a broken sender obtained from Acquire, instead of giving it back.
+func (p *SenderPool) Discard(sender *mtproto.MTProto) {
+	p.mu.Lock()
+	p.remove(sender)
+	p.cond.Broadcast()
+	p.mu.Unlock()
+
+	sender.Terminate()
+}
+
+// Size returns the number of senders kept for the dc.
+func (p *SenderPool) Size(dc int32) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.senders[dc])
+}
+
+// Reset closes every idle sender and drops the busy ones, which are closed once released;
+// used when the home datacenter changes.
+func (p *SenderPool) Reset() {
+	p.mu.Lock()
+	old := p.senders
+	p.senders = make(map[int32][]*pooledSender)
+	p.cond.Broadcast()
+	p.mu.Unlock()
+
+	for _, senders := range old {
+		for _, s := range senders {
+			if !s.busy {
+				s.Terminate()
+			}
+		}
+	}
+}
+
+func (p *SenderPool) find(sender *mtproto.MTProto) *pooledSender {
+	for _, senders := range p.senders {
+		for _, s := range senders {
+			if s.MTProto == sender {
+				return s
+			}
+		}
+	}
+	return nil
+}
+
+func (p *SenderPool) remove(sender *mtproto.MTProto) {
+	for dc, senders := range p.senders {
+		for i, s := range senders {
+			if s.MTProto == sender {
+				p.senders[dc] = append(senders[:i], senders[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// reap periodically closes idle and disconnected senders, exiting once the pool is empty.
+func (p *SenderPool) reap() {
+	ticker := time.NewTicker(p.idleTimeout / 2)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		var stale []*pooledSender
+
+		p.mu.Lock()
+		for dc, senders := range p.senders {
+			kept := senders[:0]
+			for _, s := range senders {
+				if !s.busy && (time.Since(s.lastUsed) > p.idleTimeout || !s.TcpActive()) {
+					stale = append(stale, s)
+					continue
+				}
+				kept = append(kept, s)
+			}
+			if len(kept) == 0 {
+				delete(p.senders, dc)
+			} else {
+				p.senders[dc] = kept
+			}
+		}
+		empty := len(p.senders) == 0
+		if empty {
+			p.reaping = false
+		}
+		p.mu.Unlock()
+
+		if len(stale) > 0 {
+			p.c.Log.Debug("sender pool: closing ", len(stale), " idle senders")
+		}
+		for _, s := range stale {
+			s.Terminate()
+		}
+
+		if empty {
+			return
+		}
+	}
+}
@@ -0,0 +1,200 @@
+// Copyright (c) 2024 RoseLoverX
+
+package sessions
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"strconv"
+	"strings"
+
+	"github.com/amarnathcjd/gogram/telegram"
+	"github.com/pkg/errors"
+)
+
+const (
+	gramjsStringVersion = "1"
+	mtkrutoTestSuffix   = "-test"
+)
+
+// ImportGramJSString decodes a GramJS StringSession.
+func ImportGramJSString(encoded string) (*telegram.Session, error) {
+	if !strings.HasPrefix(encoded, gramjsStringVersion) {
+		return nil, errors.New("gramjs: unsupported string session version")
+	}
+
+	data, err := base64.StdEncoding.DecodeString(encoded[1:])
+	if err != nil {
+		return nil, errors.Wrap(err, "gramjs: decoding string session")
+	}
+
+	// dc uint8, address length uint16, address, port uint16, auth key
+	if len(data) < 3 {
+		return nil, errors.New("gramjs: invalid string session length")
+	}
+	addrLen := int(binary.BigEndian.Uint16(data[1:]))
+	if len(data) != 3+addrLen+2+authKeySize {
+		return nil, errors.New("gramjs: invalid string session length")
+	}
+
+	dc := int(data[0])
+	address := string(data[3 : 3+addrLen])
+	port := int(binary.BigEndian.Uint16(data[3+addrLen:]))
+	key := bytes.Clone(data[5+addrLen:])
+
+	return newSession(dc, key, joinHostname(address, port), false), nil
+}
+
+// ExportGramJSString encodes a session as a GramJS StringSession.
+func ExportGramJSString(s *telegram.Session) (string, error) {
+	if err := checkSession(s); err != nil {
+		return "", err
+	}
+	ip, port, err := splitHostname(s)
+	if err != nil {
+		return "", err
+	}
+	address := ip.String()
+
+	var buf bytes.Buffer
+	buf.WriteByte(byte(homeDC(s)))
+	binary.Write(&buf, binary.BigEndian, uint16(len(address)))
+	buf.WriteString(address)
+	binary.Write(&buf, binary.BigEndian, uint16(port))
+	buf.Write(s.Key)
+
+	return gramjsStringVersion + base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+// ImportMTKrutoString decodes an MTKruto auth string.
+func ImportMTKrutoString(encoded string) (*telegram.Session, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(encoded, "="))
+	if err != nil {
+		return nil, errors.Wrap(err, "mtkruto: decoding auth string")
+	}
+
+	// TL string dc, TL bytes auth key, int32 api id
+	r := bytes.NewReader(rleDecode(raw))
+	dcString, err := readTLBytes(r)
+	if err != nil {
+		return nil, errors.Wrap(err, "mtkruto: reading dc")
+	}
+	key, err := readTLBytes(r)
+	if err != nil {
+		return nil, errors.Wrap(err, "mtkruto: reading auth key")
+	}
+	if len(key) != authKeySize {
+		return nil, ErrInvalidSession
+	}
+
+	dcID, test := strings.CutSuffix(string(dcString), mtkrutoTestSuffix)
+	dc, err := strconv.Atoi(dcID)
+	if err != nil {
+		return nil, errors.Wrap(err, "mtkruto: parsing dc")
+	}
+
+	s := newSession(dc, key, "", test)
+	var appID int32
+	if binary.Read(r, binary.LittleEndian, &appID) == nil { // absent in older strings
+		s.AppID = appID
+	}
+	return s, nil
+}
+
+// ExportMTKrutoString encodes a session as an MTKruto auth string.
+func ExportMTKrutoString(s *telegram.Session) (string, error) {
+	if err := checkSession(s); err != nil {
+		return "", err
+	}
+
+	dc := strconv.Itoa(homeDC(s))
+	if s.TestMode {
+		dc += mtkrutoTestSuffix
+	}
+
+	var buf bytes.Buffer
+	writeTLBytes(&buf, []byte(dc))
+	writeTLBytes(&buf, s.Key)
+	binary.Write(&buf, binary.LittleEndian, s.AppID)
+
+	return base64.RawURLEncoding.EncodeToString(rleEncode(buf.Bytes())), nil
+}
+
+func readTLBytes(r *bytes.Reader) ([]byte, error) {
+	first, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	size, header := int(first), 1
+	if first == 254 {
+		var b [3]byte
+		if _, err := r.Read(b[:]); err != nil {
+			return nil, err
+		}
+		size, header = int(b[0])|int(b[1])<<8|int(b[2])<<16, 4
+	}
+	if size > r.Len() {
+		return nil, errors.New("tl bytes out of range")
+	}
+
+	data := make([]byte, size)
+	r.Read(data)
+	if pad := (4 - (header+size)%4) % 4; pad > 0 {
+		r.Seek(int64(pad), 1)
+	}
+	return data, nil
+}
+
+func writeTLBytes(w *bytes.Buffer, data []byte) {
+	header := 1
+	if len(data) < 254 {
+		w.WriteByte(byte(len(data)))
+	} else {
+		w.Write([]byte{254, byte(len(data)), byte(len(data) >> 8), byte(len(data) >> 16)})
+		header = 4
+	}
+	w.Write(data)
+	w.Write(make([]byte, (4-(header+len(data))%4)%4))
+}
+
+// rleEncode compresses runs of zero bytes, as Telegram does for file references and auth strings.
+func rleEncode(data []byte) []byte {
+	var (
+		out   []byte
+		zeros int
+	)
+	for _, b := range data {
+		if b == 0 {
+			if zeros == 255 {
+				out = append(out, 0, byte(zeros))
+				zeros = 0
+			}
+			zeros++
+			continue
+		}
+		if zeros > 0 {
+			out = append(out, 0, byte(zeros))
+			zeros = 0
+		}
+		out = append(out, b)
+	}
+	if zeros > 0 {
+		out = append(out, 0, byte(zeros))
+	}
+	return out
+}
+
+func rleDecode(data []byte) []byte {
+	var out []byte
+	for i := 0; i < len(data); i++ {
+		if data[i] == 0 && i+1 < len(data) {
+			out = append(out, make([]byte, data[i+1])...)
+			i++
+			continue
+		}
+		out = append(out, data[i])
+	}
+	return out
+}
@@ -0,0 +1,202 @@
+// Copyright (c) 2024 RoseLoverX
+
+package sessions
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"strings"
+	"time"
+
+	"github.com/amarnathcjd/gogram/telegram"
+	"github.com/pkg/errors"
+)
+
+const pyrogramSchemaVersion = 3
+
+// Pyrogram string session layouts, all big endian.
+const (
+	pyrogramStringSize      = 1 + 4 + 1 + authKeySize + 8 + 1 // >BI?256sQ?
+	pyrogramOldStringSize   = 1 + 1 + authKeySize + 4 + 1     // >B?256sI?
+	pyrogramOldStringSize64 = 1 + 1 + authKeySize + 8 + 1     // >B?256sQ?
+)
+
+// ImportPyrogramString decodes a Pyrogram string session, including the
+// legacy layouts without an api id.
+func ImportPyrogramString(encoded string) (*telegram.Session, error) {
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(encoded, "="))
+	if err != nil {
+		return nil, errors.Wrap(err, "pyrogram: decoding string session")
+	}
+
+	var (
+		dc, appID int
+		test, bot bool
+		key       []byte
+		userID    int64
+	)
+	switch len(data) {
+	case pyrogramStringSize:
+		dc = int(data[0])
+		appID = int(binary.BigEndian.Uint32(data[1:]))
+		test = data[5] != 0
+		key = data[6 : 6+authKeySize]
+		userID = int64(binary.BigEndian.Uint64(data[6+authKeySize:]))
+		bot = data[14+authKeySize] != 0
+	case pyrogramOldStringSize:
+		dc, test = int(data[0]), data[1] != 0
+		key = data[2 : 2+authKeySize]
+		userID = int64(binary.BigEndian.Uint32(data[2+authKeySize:]))
+		bot = data[6+authKeySize] != 0
+	case pyrogramOldStringSize64:
+		dc, test = int(data[0]), data[1] != 0
+		key = data[2 : 2+authKeySize]
+		userID = int64(binary.BigEndian.Uint64(data[2+authKeySize:]))
+		bot = data[10+authKeySize] != 0
+	default:
+		return nil, errors.New("pyrogram: invalid string session length")
+	}
+
+	s := newSession(dc, bytes.Clone(key), "", test)
+	s.AppID = int32(appID)
+	s.UserID = userID
+	s.Bot = bot
+	return s, nil
+}
+
+// ExportPyrogramString encodes a session as a Pyrogram string session.
+func ExportPyrogramString(s *telegram.Session) (string, error) {
+	if err := checkSession(s); err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	buf.WriteByte(byte(homeDC(s)))
+	binary.Write(&buf, binary.BigEndian, uint32(s.AppID))
+	buf.WriteByte(boolByte(s.TestMode))
+	buf.Write(s.Key)
+	binary.Write(&buf, binary.BigEndian, uint64(s.UserID))
+	buf.WriteByte(boolByte(s.Bot))
+
+	return base64.RawURLEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+// ImportPyrogramFile reads a Pyrogram SQLite .session file.
+func ImportPyrogramFile(path string) (*telegram.Session, error) {
+	db, err := openSQLite(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "pyrogram")
+	}
+
+	rows, err := db.table("sessions")
+	if err != nil {
+		return nil, errors.Wrap(err, "pyrogram")
+	}
+	if len(rows) == 0 {
+		return nil, errors.New("pyrogram: session file holds no session")
+	}
+
+	row := rows[0]
+	key, _ := row["auth_key"].([]byte)
+	if len(key) != authKeySize {
+		return nil, ErrInvalidSession
+	}
+
+	dc, _ := row["dc_id"].(int64)
+	appID, _ := row["api_id"].(int64)
+	test, _ := row["test_mode"].(int64)
+	userID, _ := row["user_id"].(int64)
+	bot, _ := row["is_bot"].(int64)
+
+	s := newSession(int(dc), key, "", test != 0)
+	s.AppID = int32(appID)
+	s.UserID = userID
+	s.Bot = bot != 0
+	return s, nil
+}
+
+// ExportPyrogramFile writes a session as a Pyrogram SQLite .session file,
+// overwriting path if it exists.
+func ExportPyrogramFile(path string, s *telegram.Session) error {
+	if err := checkSession(s); err != nil {
+		return err
+	}
+
+	var appID, userID any
+	if s.AppID != 0 {
+		appID = int64(s.AppID)
+	}
+	if s.UserID != 0 {
+		userID = s.UserID
+	}
+
+	return writeSQLite(path, []sqliteObject{
+		{
+			kind: "table", name: "sessions", table: "sessions",
+			sql: `CREATE TABLE sessions
+(
+    dc_id     INTEGER PRIMARY KEY,
+    api_id    INTEGER,
+    test_mode INTEGER,
+    auth_key  BLOB,
+    date      INTEGER NOT NULL,
+    user_id   INTEGER,
+    is_bot    INTEGER
+)`,
+			rowid:   "dc_id",
+			columns: []string{"dc_id", "api_id", "test_mode", "auth_key", "date", "user_id", "is_bot"},
+			rows: [][]any{{
+				int64(homeDC(s)), appID, boolInt(s.TestMode), s.Key,
+				time.Now().Unix(), userID, boolInt(s.Bot),
+			}},
+		},
+		{
+			kind: "table", name: "peers", table: "peers",
+			sql: `CREATE TABLE peers
+(
+    id             INTEGER PRIMARY KEY,
+    access_hash    INTEGER,
+    type           INTEGER NOT NULL,
+    username       TEXT,
+    phone_number   TEXT,
+    last_update_on INTEGER NOT NULL DEFAULT (CAST(STRFTIME('%s', 'now') AS INTEGER))
+)`,
+		},
+		{
+			kind: "table", name: "version", table: "version",
+			sql: `CREATE TABLE version
+(
+    number INTEGER PRIMARY KEY
+)`,
+			rowid:   "number",
+			columns: []string{"number"},
+			rows:    [][]any{{int64(pyrogramSchemaVersion)}},
+		},
+		{kind: "index", name: "idx_peers_id", table: "peers", sql: "CREATE INDEX idx_peers_id ON peers (id)"},
+		{kind: "index", name: "idx_peers_username", table: "peers", sql: "CREATE INDEX idx_peers_username ON peers (username)"},
+		{kind: "index", name: "idx_peers_phone_number", table: "peers", sql: "CREATE INDEX idx_peers_phone_number ON peers (phone_number)"},
+		{
+			kind: "trigger", name: "trg_peers_last_update_on", table: "peers",
+			sql: `CREATE TRIGGER trg_peers_last_update_on
+    AFTER UPDATE
+    ON peers
+BEGIN
+    UPDATE peers
+    SET last_update_on = CAST(STRFTIME('%s', 'now') AS INTEGER)
+    WHERE id = NEW.id;
+END`,
+		},
+	})
+}
+
+func boolByte(b bool) byte {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func boolInt(b bool) int64 {
+	return int64(boolByte(b))
+}
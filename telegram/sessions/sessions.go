@@ -0,0 +1,87 @@
+// Copyright (c) 2024 RoseLoverX
+
+// Package sessions converts sessions of other MTProto libraries to and from gogram sessions.
+//
+// Supported formats are Telethon string and SQLite sessions, Pyrogram string and SQLite sessions,
+// Telegram Desktop tdata folders and GramJS / MTKruto string sessions. Every Import* function
+// returns a *telegram.Session, usable with Client.LoadSession or encoded with Session.EncodeFull
+// as ClientConfig.StringSession; every Export* function takes one, e.g. from Client.ExportRawSession.
+package sessions
+
+import (
+	"net"
+	"strconv"
+
+	"github.com/amarnathcjd/gogram/internal/utils"
+	"github.com/amarnathcjd/gogram/telegram"
+	"github.com/pkg/errors"
+)
+
+const authKeySize = 256
+
+// ErrInvalidSession is returned when a session carries no valid auth key.
+var ErrInvalidSession = errors.New("invalid session: missing or malformed auth key")
+
+// homeDC returns the home datacenter of a session, derived from its hostname when unset.
+func homeDC(s *telegram.Session) int {
+	if s.DC != 0 || s.Hostname == "" {
+		return s.DC
+	}
+	return utils.SearchAddr(s.Hostname)
+}
+
+// checkSession validates a session about to be exported.
+func checkSession(s *telegram.Session) error {
+	if s == nil || len(s.Key) != authKeySize {
+		return ErrInvalidSession
+	}
+	if homeDC(s) == 0 {
+		return errors.New("invalid session: unknown home datacenter")
+	}
+	return nil
+}
+
+// splitHostname splits a session hostname into ip and port, resolving the
+// datacenter's default address when the hostname is unset.
+func splitHostname(s *telegram.Session) (net.IP, int, error) {
+	hostname := s.Hostname
+	if hostname == "" {
+		hostname = telegram.ResolveDataCenterIP(homeDC(s), s.TestMode, false)
+	}
+
+	host, port, err := net.SplitHostPort(hostname)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "parsing hostname")
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, 0, errors.New("parsing hostname: invalid ip " + host)
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "parsing hostname")
+	}
+	return ip, p, nil
+}
+
+func joinHostname(ip string, port int) string {
+	return net.JoinHostPort(ip, strconv.Itoa(port))
+}
+
+// newSession builds a session for the given home datacenter; the hostname is resolved
+// from the built-in datacenter list unless given.
+func newSession(dc int, key []byte, hostname string, test bool) *telegram.Session {
+	if hostname == "" {
+		hostname = telegram.ResolveDataCenterIP(dc, test, false)
+	}
+	if dc == 0 {
+		dc = utils.SearchAddr(hostname)
+	}
+	return &telegram.Session{
+		Key:      key,
+		Hash:     utils.Sha1Byte(key)[12:20],
+		Hostname: hostname,
+		DC:       dc,
+		TestMode: test,
+	}
+}
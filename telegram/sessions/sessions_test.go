@@ -0,0 +1,278 @@
+// Copyright (c) 2024 RoseLoverX
+
+package sessions
+
+import (
+	"bytes"
+	"encoding/base64"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/amarnathcjd/gogram/telegram"
+)
+
+// The fixtures in testdata are written by testdata/gen.py the way each library writes them,
+// except for tdata, which is written by ExportTData with -update.
+var update = flag.Bool("update", false, "rewrite the tdata fixture")
+
+func fixtureKey(t *testing.T) []byte {
+	t.Helper()
+	key, err := base64.StdEncoding.DecodeString(readFixture(t, "key.b64"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func readFixture(t *testing.T, name string) string {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// compareSession compares the fields a format carries.
+func compareSession(t *testing.T, got, want *telegram.Session) {
+	t.Helper()
+	if got == nil {
+		t.Fatal("no session")
+	}
+	if !bytes.Equal(got.Key, want.Key) {
+		t.Errorf("key differs")
+	}
+	if got.DC != want.DC {
+		t.Errorf("dc = %d, want %d", got.DC, want.DC)
+	}
+	if want.Hostname != "" && got.Hostname != want.Hostname {
+		t.Errorf("hostname = %q, want %q", got.Hostname, want.Hostname)
+	}
+	if got.AppID != want.AppID {
+		t.Errorf("app id = %d, want %d", got.AppID, want.AppID)
+	}
+	if got.UserID != want.UserID {
+		t.Errorf("user id = %d, want %d", got.UserID, want.UserID)
+	}
+	if got.Bot != want.Bot {
+		t.Errorf("bot = %v, want %v", got.Bot, want.Bot)
+	}
+	if got.TestMode != want.TestMode {
+		t.Errorf("test mode = %v, want %v", got.TestMode, want.TestMode)
+	}
+}
+
+func TestStringSessions(t *testing.T) {
+	key := fixtureKey(t)
+	tests := []struct {
+		fixture string
+		decode  func(string) (*telegram.Session, error)
+		encode  func(*telegram.Session) (string, error)
+		want    *telegram.Session
+	}{
+		{
+			fixture: "telethon.string",
+			decode:  ImportTelethonString, encode: ExportTelethonString,
+			want: &telegram.Session{Key: key, DC: 2, Hostname: "149.154.167.51:443"},
+		},
+		{
+			fixture: "telethon_ipv6.string",
+			decode:  ImportTelethonString, encode: ExportTelethonString,
+			want: &telegram.Session{Key: key, DC: 4, Hostname: "[2001:67c:4e8:f004::a]:443"},
+		},
+		{
+			fixture: "pyrogram.string",
+			decode:  ImportPyrogramString, encode: ExportPyrogramString,
+			want: &telegram.Session{Key: key, DC: 5, AppID: 123456, UserID: 777000, Bot: true},
+		},
+		{
+			fixture: "pyrogram_legacy.string",
+			decode:  ImportPyrogramString, encode: ExportPyrogramString,
+			want: &telegram.Session{Key: key, DC: 1, UserID: 5000000000},
+		},
+		{
+			fixture: "gramjs.string",
+			decode:  ImportGramJSString, encode: ExportGramJSString,
+			want: &telegram.Session{Key: key, DC: 4, Hostname: "149.154.167.91:443"},
+		},
+		{
+			fixture: "mtkruto.string",
+			decode:  ImportMTKrutoString, encode: ExportMTKrutoString,
+			want: &telegram.Session{Key: key, DC: 2, AppID: 654321, TestMode: true},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.fixture, func(t *testing.T) {
+			s, err := tt.decode(readFixture(t, tt.fixture))
+			if err != nil {
+				t.Fatal(err)
+			}
+			compareSession(t, s, tt.want)
+
+			encoded, err := tt.encode(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			again, err := tt.decode(encoded)
+			if err != nil {
+				t.Fatal(err)
+			}
+			compareSession(t, again, tt.want)
+
+			// the gogram string session keeps everything the format carried
+			full, err := telegram.DecodeSession(s.EncodeFull())
+			if err != nil {
+				t.Fatal(err)
+			}
+			compareSession(t, full, tt.want)
+		})
+	}
+}
+
+func TestSQLiteSessions(t *testing.T) {
+	key := fixtureKey(t)
+	tests := []struct {
+		fixture string
+		read    func(string) (*telegram.Session, error)
+		write   func(string, *telegram.Session) error
+		want    *telegram.Session
+	}{
+		{
+			fixture: "telethon.session",
+			read:    ImportTelethonFile, write: ExportTelethonFile,
+			want: &telegram.Session{Key: key, DC: 2, Hostname: "149.154.167.51:443"},
+		},
+		{
+			fixture: "pyrogram.session",
+			read:    ImportPyrogramFile, write: ExportPyrogramFile,
+			want: &telegram.Session{Key: key, DC: 5, AppID: 123456, UserID: 777000, Bot: true},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.fixture, func(t *testing.T) {
+			s, err := tt.read(filepath.Join("testdata", tt.fixture))
+			if err != nil {
+				t.Fatal(err)
+			}
+			compareSession(t, s, tt.want)
+
+			path := filepath.Join(t.TempDir(), tt.fixture)
+			if err := tt.write(path, s); err != nil {
+				t.Fatal(err)
+			}
+			again, err := tt.read(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			compareSession(t, again, tt.want)
+
+			// exporting over an existing file replaces it
+			if err := tt.write(path, again); err != nil {
+				t.Fatal(err)
+			}
+			if again, err = tt.read(path); err != nil {
+				t.Fatal(err)
+			}
+			compareSession(t, again, tt.want)
+		})
+	}
+}
+
+func TestSQLiteInvalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "invalid.session")
+	if err := os.WriteFile(path, []byte("not a database"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ImportTelethonFile(path); err == nil {
+		t.Fatal("expected an error for a file that is not SQLite")
+	}
+}
+
+func TestTDataFixture(t *testing.T) {
+	key := fixtureKey(t)
+	other := bytes.Repeat([]byte{0x5a}, authKeySize)
+	want := &telegram.Session{
+		Key: key, DC: 2, UserID: 123456789,
+		DCKeys: map[int]*telegram.DCKey{4: {Key: other}},
+	}
+
+	path := filepath.Join("testdata", "tdata")
+	if *update {
+		os.RemoveAll(path)
+		if err := ExportTData(path, want); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	check := func(t *testing.T, path string) []*telegram.Session {
+		t.Helper()
+		accounts, err := ImportTData(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(accounts) != 1 {
+			t.Fatalf("got %d accounts, want 1", len(accounts))
+		}
+		compareSession(t, accounts[0], want)
+		if key := accounts[0].DCKeys[4]; key == nil || !bytes.Equal(key.Key, other) {
+			t.Errorf("key of dc 4 differs")
+		}
+		return accounts
+	}
+
+	accounts := check(t, path)
+	out := filepath.Join(t.TempDir(), "tdata")
+	if err := ExportTData(out, accounts...); err != nil {
+		t.Fatal(err)
+	}
+	check(t, out)
+
+	if _, err := ImportTData(path, "wrong passcode"); err == nil {
+		t.Fatal("expected an error for a wrong passcode")
+	}
+}
+
+func TestSessionConversion(t *testing.T) {
+	key := fixtureKey(t)
+	s := &telegram.Session{
+		Key: key, DC: 2, Hostname: "149.154.167.51:443", AppID: 1, UserID: 42, Bot: true, IPv6: true,
+		DCKeys:  map[int]*telegram.DCKey{4: {Key: bytes.Repeat([]byte{1}, authKeySize), Salt: 7, Hostname: "149.154.167.91:443"}},
+		CDNKeys: map[int]*telegram.DCKey{203: {Key: bytes.Repeat([]byte{2}, authKeySize), Hostname: "91.105.192.100:443"}},
+		Salts:   []*telegram.SessionSalt{{Salt: 9, ValidSince: 100, ValidUntil: 200}},
+	}
+
+	got, err := telegram.DecodeSession(s.EncodeFull())
+	if err != nil {
+		t.Fatal(err)
+	}
+	compareSession(t, got, s)
+	if !got.IPv6 {
+		t.Error("ipv6 lost")
+	}
+	if k := got.DCKeys[4]; k == nil || !bytes.Equal(k.Key, s.DCKeys[4].Key) || k.Salt != 7 || k.Hostname != s.DCKeys[4].Hostname {
+		t.Errorf("dc key = %+v", k)
+	}
+	if k := got.CDNKeys[203]; k == nil || !bytes.Equal(k.Key, s.CDNKeys[203].Key) || k.Hostname != s.CDNKeys[203].Hostname {
+		t.Errorf("cdn key = %+v", k)
+	}
+	if len(got.Salts) != 1 || *got.Salts[0] != *s.Salts[0] {
+		t.Errorf("salts = %v", got.Salts)
+	}
+
+	// Encode stays in the legacy format, readable by older versions
+	if encoded := s.Encode(); !strings.HasPrefix(encoded, "1BvX") {
+		t.Errorf("Encode() = %q, want the 1BvX format", encoded[:4])
+	}
+	legacy, err := telegram.DecodeSession(s.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(legacy.Key, key) || legacy.Hostname != s.Hostname || legacy.AppID != s.AppID {
+		t.Errorf("legacy session = %+v", legacy)
+	}
+}
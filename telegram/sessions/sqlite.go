@@ -0,0 +1,535 @@
+// Copyright (c) 2024 RoseLoverX
+
+package sessions
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// A minimal reader and writer of the SQLite 3 file format, enough to handle the
+// small session databases of Telethon and Pyrogram without a database driver.
+// The reader walks table b-trees (with overflow pages), the writer lays out
+// each table in a single leaf page.
+
+const (
+	sqliteMagic    = "SQLite format 3\x00"
+	sqlitePageSize = 4096
+	sqliteVersion  = 3040001
+
+	pageTableInterior = 0x05
+	pageTableLeaf     = 0x0d
+	pageIndexLeaf     = 0x0a
+)
+
+type sqliteDB struct {
+	data     []byte
+	pageSize int
+	usable   int
+}
+
+// sqliteRow is a table row, keyed by lower-case column name.
+type sqliteRow map[string]any
+
+func openSQLite(path string) (*sqliteDB, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 100 || string(data[:16]) != sqliteMagic {
+		return nil, errors.New("not a sqlite database: " + path)
+	}
+
+	pageSize := int(binary.BigEndian.Uint16(data[16:18]))
+	if pageSize == 1 {
+		pageSize = 65536
+	}
+	return &sqliteDB{
+		data:     data,
+		pageSize: pageSize,
+		usable:   pageSize - int(data[20]),
+	}, nil
+}
+
+func (db *sqliteDB) page(n int) ([]byte, error) {
+	start := (n - 1) * db.pageSize
+	if n < 1 || start+db.pageSize > len(db.data) {
+		return nil, fmt.Errorf("sqlite: page %d out of range", n)
+	}
+	return db.data[start : start+db.pageSize], nil
+}
+
+// table returns every row of the named table.
+func (db *sqliteDB) table(name string) ([]sqliteRow, error) {
+	schema, err := db.walk(1)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading schema")
+	}
+
+	for _, entry := range schema {
+		if len(entry.values) < 5 {
+			continue
+		}
+		kind, _ := entry.values[0].(string)
+		tblName, _ := entry.values[1].(string)
+		if kind != "table" || !strings.EqualFold(tblName, name) {
+			continue
+		}
+
+		root, _ := entry.values[3].(int64)
+		sql, _ := entry.values[4].(string)
+		columns, rowidColumn := parseColumns(sql)
+
+		cells, err := db.walk(int(root))
+		if err != nil {
+			return nil, errors.Wrap(err, "reading table "+name)
+		}
+
+		rows := make([]sqliteRow, 0, len(cells))
+		for _, cell := range cells {
+			row := make(sqliteRow, len(columns))
+			for i, col := range columns {
+				if i < len(cell.values) {
+					row[col] = cell.values[i]
+				} else {
+					row[col] = nil
+				}
+			}
+			if rowidColumn != "" {
+				row[rowidColumn] = cell.rowid
+			}
+			rows = append(rows, row)
+		}
+		return rows, nil
+	}
+	return nil, fmt.Errorf("sqlite: table %s not found", name)
+}
+
+type sqliteCell struct {
+	rowid  int64
+	values []any
+}
+
+// walk returns the cells of a table b-tree in rowid order.
+func (db *sqliteDB) walk(pageNum int) ([]sqliteCell, error) {
+	page, err := db.page(pageNum)
+	if err != nil {
+		return nil, err
+	}
+
+	hdr := 0
+	if pageNum == 1 {
+		hdr = 100
+	}
+
+	kind := page[hdr]
+	count := int(binary.BigEndian.Uint16(page[hdr+3:]))
+	ptrs := hdr + 8
+	if kind == pageTableInterior {
+		ptrs = hdr + 12
+	}
+
+	var cells []sqliteCell
+	for i := 0; i < count; i++ {
+		off := int(binary.BigEndian.Uint16(page[ptrs+2*i:]))
+		switch kind {
+		case pageTableInterior:
+			child := int(binary.BigEndian.Uint32(page[off:]))
+			sub, err := db.walk(child)
+			if err != nil {
+				return nil, err
+			}
+			cells = append(cells, sub...)
+		case pageTableLeaf:
+			size, n := readVarint(page[off:])
+			off += n
+			rowid, n := readVarint(page[off:])
+			off += n
+
+			payload, err := db.payload(page, off, int(size))
+			if err != nil {
+				return nil, err
+			}
+			values, err := decodeRecord(payload)
+			if err != nil {
+				return nil, err
+			}
+			cells = append(cells, sqliteCell{rowid: int64(rowid), values: values})
+		default:
+			return nil, fmt.Errorf("sqlite: unexpected page type 0x%02x", kind)
+		}
+	}
+
+	if kind == pageTableInterior {
+		sub, err := db.walk(int(binary.BigEndian.Uint32(page[hdr+8:])))
+		if err != nil {
+			return nil, err
+		}
+		cells = append(cells, sub...)
+	}
+	return cells, nil
+}
+
+// payload reads a table leaf cell payload, following its overflow pages.
+func (db *sqliteDB) payload(page []byte, off, size int) ([]byte, error) {
+	local := tableLocalSize(size, db.usable)
+	if local == size {
+		return page[off : off+size], nil
+	}
+
+	out := make([]byte, 0, size)
+	out = append(out, page[off:off+local]...)
+	next := int(binary.BigEndian.Uint32(page[off+local:]))
+	for len(out) < size && next != 0 {
+		overflow, err := db.page(next)
+		if err != nil {
+			return nil, err
+		}
+		n := min(size-len(out), db.usable-4)
+		out = append(out, overflow[4:4+n]...)
+		next = int(binary.BigEndian.Uint32(overflow))
+	}
+	if len(out) != size {
+		return nil, errors.New("sqlite: truncated overflow chain")
+	}
+	return out, nil
+}
+
+// tableLocalSize is the part of a table leaf payload stored on the page itself.
+func tableLocalSize(size, usable int) int {
+	maxLocal := usable - 35
+	if size <= maxLocal {
+		return size
+	}
+	minLocal := (usable-12)*32/255 - 23
+	k := minLocal + (size-minLocal)%(usable-4)
+	if k <= maxLocal {
+		return k
+	}
+	return minLocal
+}
+
+func decodeRecord(payload []byte) ([]any, error) {
+	hdrSize, n := readVarint(payload)
+	if int(hdrSize) > len(payload) {
+		return nil, errors.New("sqlite: corrupt record header")
+	}
+
+	var types []uint64
+	for pos := n; pos < int(hdrSize); {
+		t, n := readVarint(payload[pos:])
+		types = append(types, t)
+		pos += n
+	}
+
+	values := make([]any, 0, len(types))
+	body := payload[hdrSize:]
+	for _, t := range types {
+		var size int
+		switch {
+		case t == 0 || t == 8 || t == 9:
+			size = 0
+		case t <= 4:
+			size = int(t)
+		case t == 5:
+			size = 6
+		case t == 6 || t == 7:
+			size = 8
+		case t >= 12:
+			size = int(t-12) / 2
+		default:
+			return nil, fmt.Errorf("sqlite: unsupported serial type %d", t)
+		}
+		if size > len(body) {
+			return nil, errors.New("sqlite: corrupt record body")
+		}
+
+		field := body[:size]
+		body = body[size:]
+		switch {
+		case t == 0:
+			values = append(values, nil)
+		case t == 8:
+			values = append(values, int64(0))
+		case t == 9:
+			values = append(values, int64(1))
+		case t <= 6:
+			var v int64
+			for _, b := range field {
+				v = v<<8 | int64(b)
+			}
+			shift := 64 - 8*uint(size) // sign extend
+			values = append(values, v<<shift>>shift)
+		case t == 7:
+			values = append(values, math.Float64frombits(binary.BigEndian.Uint64(field)))
+		case t%2 == 0:
+			values = append(values, bytes.Clone(field))
+		default:
+			values = append(values, string(field))
+		}
+	}
+	return values, nil
+}
+
+// parseColumns returns the lower-case column names of a CREATE TABLE statement,
+// and the INTEGER PRIMARY KEY column aliasing the rowid, if any.
+func parseColumns(sql string) (columns []string, rowidColumn string) {
+	start, end := strings.Index(sql, "("), strings.LastIndex(sql, ")")
+	if start < 0 || end <= start {
+		return nil, ""
+	}
+
+	var (
+		defs  []string
+		depth int
+		last  = start + 1
+	)
+	for i := start + 1; i < end; i++ {
+		switch sql[i] {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				defs = append(defs, sql[last:i])
+				last = i + 1
+			}
+		}
+	}
+	defs = append(defs, sql[last:end])
+
+	for _, def := range defs {
+		fields := strings.Fields(strings.ToLower(def))
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case "primary", "unique", "check", "foreign", "constraint":
+			continue
+		}
+
+		name := strings.Trim(fields[0], "\"`[]")
+		columns = append(columns, name)
+		if len(fields) >= 4 && fields[1] == "integer" && fields[2] == "primary" && fields[3] == "key" {
+			rowidColumn = name
+		}
+	}
+	return columns, rowidColumn
+}
+
+func readVarint(b []byte) (uint64, int) {
+	var v uint64
+	for i := 0; i < 9 && i < len(b); i++ {
+		if i == 8 {
+			return v<<8 | uint64(b[i]), 9
+		}
+		v = v<<7 | uint64(b[i]&0x7f)
+		if b[i]&0x80 == 0 {
+			return v, i + 1
+		}
+	}
+	return v, len(b)
+}
+
+func appendVarint(b []byte, v uint64) []byte {
+	if v > 0x00ffffffffffffff {
+		var buf [9]byte
+		buf[8] = byte(v)
+		v >>= 8
+		for i := 7; i >= 0; i-- {
+			buf[i] = byte(v&0x7f) | 0x80
+			v >>= 7
+		}
+		return append(b, buf[:]...)
+	}
+
+	var buf [8]byte
+	i := len(buf) - 1
+	buf[i] = byte(v & 0x7f)
+	for v >>= 7; v > 0; v >>= 7 {
+		i--
+		buf[i] = byte(v&0x7f) | 0x80
+	}
+	return append(b, buf[i:]...)
+}
+
+// ---------------------------- writer ----------------------------
+
+// sqliteObject is a schema entry: a table with its rows, an (empty) index or a trigger.
+type sqliteObject struct {
+	kind    string // table, index or trigger
+	name    string
+	table   string
+	sql     string // empty for automatic indexes
+	rowid   string // INTEGER PRIMARY KEY column of a table, stored as the rowid
+	columns []string
+	rows    [][]any
+}
+
+func writeSQLite(path string, objects []sqliteObject) error {
+	pages := [][]byte{nil} // page 1 is the schema, built last
+	var schema []sqliteCell
+
+	for i, obj := range objects {
+		var root int64
+		switch obj.kind {
+		case "table":
+			var cells []sqliteCell
+			for j, row := range obj.rows {
+				rowid := int64(j + 1)
+				values := make([]any, len(row))
+				copy(values, row)
+				for c, col := range obj.columns {
+					if col == obj.rowid && c < len(values) {
+						if id, ok := values[c].(int64); ok {
+							rowid = id
+						}
+						values[c] = nil
+					}
+				}
+				cells = append(cells, sqliteCell{rowid: rowid, values: values})
+			}
+
+			page, err := buildLeafPage(pageTableLeaf, cells, 0)
+			if err != nil {
+				return errors.Wrap(err, "table "+obj.name)
+			}
+			pages = append(pages, page)
+			root = int64(len(pages))
+		case "index":
+			page, _ := buildLeafPage(pageIndexLeaf, nil, 0)
+			pages = append(pages, page)
+			root = int64(len(pages))
+		}
+
+		var sql any
+		if obj.sql != "" {
+			sql = obj.sql
+		}
+		schema = append(schema, sqliteCell{
+			rowid:  int64(i + 1),
+			values: []any{obj.kind, obj.name, obj.table, root, sql},
+		})
+	}
+
+	first, err := buildLeafPage(pageTableLeaf, schema, 100)
+	if err != nil {
+		return errors.Wrap(err, "schema")
+	}
+	pages[0] = first
+
+	hdr := first[:100]
+	copy(hdr, sqliteMagic)
+	binary.BigEndian.PutUint16(hdr[16:], sqlitePageSize)
+	hdr[18], hdr[19] = 1, 1 // legacy journal mode
+	hdr[21], hdr[22], hdr[23] = 64, 32, 32
+	binary.BigEndian.PutUint32(hdr[24:], 1)                  // file change counter
+	binary.BigEndian.PutUint32(hdr[28:], uint32(len(pages))) // database size in pages
+	binary.BigEndian.PutUint32(hdr[40:], 1)                  // schema cookie
+	binary.BigEndian.PutUint32(hdr[44:], 4)                  // schema format
+	binary.BigEndian.PutUint32(hdr[56:], 1)                  // UTF-8
+	binary.BigEndian.PutUint32(hdr[92:], 1)                  // version-valid-for
+	binary.BigEndian.PutUint32(hdr[96:], sqliteVersion)
+
+	return os.WriteFile(path, bytes.Join(pages, nil), 0600)
+}
+
+// buildLeafPage lays out cells in a single leaf page, hdr is the offset of the page header.
+func buildLeafPage(kind byte, cells []sqliteCell, hdr int) ([]byte, error) {
+	page := make([]byte, sqlitePageSize)
+	page[hdr] = kind
+	binary.BigEndian.PutUint16(page[hdr+3:], uint16(len(cells)))
+
+	content := sqlitePageSize
+	ptrs := hdr + 8
+	for i, cell := range cells {
+		payload := encodeRecord(cell.values)
+		if len(payload) > tableLocalSize(len(payload), sqlitePageSize) {
+			return nil, errors.New("sqlite: row too large for a single page")
+		}
+
+		var c []byte
+		c = appendVarint(c, uint64(len(payload)))
+		c = appendVarint(c, uint64(cell.rowid))
+		c = append(c, payload...)
+
+		content -= len(c)
+		if content < ptrs+2*(i+1) {
+			return nil, errors.New("sqlite: rows do not fit a single page")
+		}
+		copy(page[content:], c)
+		binary.BigEndian.PutUint16(page[ptrs+2*i:], uint16(content))
+	}
+
+	binary.BigEndian.PutUint16(page[hdr+5:], uint16(content%65536))
+	return page, nil
+}
+
+func encodeRecord(values []any) []byte {
+	var (
+		header []byte
+		body   []byte
+	)
+	for _, v := range values {
+		switch v := v.(type) {
+		case nil:
+			header = appendVarint(header, 0)
+		case bool:
+			if v {
+				header = appendVarint(header, 9)
+			} else {
+				header = appendVarint(header, 8)
+			}
+		case int64:
+			t, size := intSerialType(v)
+			header = appendVarint(header, t)
+			for i := size - 1; i >= 0; i-- {
+				body = append(body, byte(v>>(8*uint(i))))
+			}
+		case float64:
+			header = appendVarint(header, 7)
+			body = binary.BigEndian.AppendUint64(body, math.Float64bits(v))
+		case []byte:
+			header = appendVarint(header, uint64(12+2*len(v)))
+			body = append(body, v...)
+		case string:
+			header = appendVarint(header, uint64(13+2*len(v)))
+			body = append(body, v...)
+		}
+	}
+
+	// the header size varint counts itself
+	size := len(header) + 1
+	if len(appendVarint(nil, uint64(size))) > 1 {
+		size++
+	}
+	return append(appendVarint(nil, uint64(size)), append(header, body...)...)
+}
+
+func intSerialType(v int64) (uint64, int) {
+	switch {
+	case v == 0:
+		return 8, 0
+	case v == 1:
+		return 9, 0
+	case v >= math.MinInt8 && v <= math.MaxInt8:
+		return 1, 1
+	case v >= math.MinInt16 && v <= math.MaxInt16:
+		return 2, 2
+	case v >= -1<<23 && v < 1<<23:
+		return 3, 3
+	case v >= math.MinInt32 && v <= math.MaxInt32:
+		return 4, 4
+	case v >= -1<<47 && v < 1<<47:
+		return 5, 6
+	default:
+		return 6, 8
+	}
+}
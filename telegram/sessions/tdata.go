@@ -0,0 +1,425 @@
+// Copyright (c) 2024 RoseLoverX
+
+package sessions
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha512"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	ige "github.com/amarnathcjd/gogram/internal/aes_ige"
+	"github.com/amarnathcjd/gogram/internal/utils"
+	"github.com/amarnathcjd/gogram/telegram"
+	"github.com/pkg/errors"
+)
+
+const (
+	tdfMagic   = "TDF$"
+	tdfVersion = 4016008 // app version written into exported files
+
+	tdataSaltSize          = 32
+	tdataLocalKeySize      = 256
+	tdataPasscodeRounds    = 100000
+	dbiMtpAuthorization    = 0x4b
+	tdataWideIDsTag        = -1
+	tdataMaxAccounts       = 3
+	tdataKeyFile           = "key_datas"
+	tdataLegacyKeyFile     = "key_data"
+	tdataAccountDataPrefix = "data"
+)
+
+// ImportTData reads every account of a Telegram Desktop tdata folder, passcode is the
+// local passcode of the app, if one is set.
+func ImportTData(path string, passcode ...string) ([]*telegram.Session, error) {
+	data, err := readTDF(path, tdataKeyFile)
+	if os.IsNotExist(errors.Cause(err)) {
+		data, err = readTDF(path, tdataLegacyKeyFile)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "tdata: reading key file")
+	}
+
+	r := bytes.NewReader(data)
+	salt, err := readQByteArray(r)
+	if err != nil {
+		return nil, errors.Wrap(err, "tdata: reading key file")
+	}
+	keyEncrypted, err := readQByteArray(r)
+	if err != nil {
+		return nil, errors.Wrap(err, "tdata: reading key file")
+	}
+	infoEncrypted, err := readQByteArray(r)
+	if err != nil {
+		return nil, errors.Wrap(err, "tdata: reading key file")
+	}
+
+	localKey, err := decryptLocal(keyEncrypted, createLocalKey(salt, getPasscode(passcode)))
+	if err != nil {
+		return nil, errors.Wrap(err, "tdata: decrypting local key (wrong passcode?)")
+	}
+	info, err := decryptLocal(infoEncrypted, localKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "tdata: decrypting accounts info")
+	}
+
+	r = bytes.NewReader(info)
+	var count int32
+	if err := binary.Read(r, binary.BigEndian, &count); err != nil {
+		return nil, errors.Wrap(err, "tdata: reading accounts info")
+	}
+
+	var sessions []*telegram.Session
+	for i := int32(0); i < count; i++ {
+		var index int32
+		if err := binary.Read(r, binary.BigEndian, &index); err != nil {
+			return nil, errors.Wrap(err, "tdata: reading accounts info")
+		}
+
+		s, err := readTDataAccount(path, int(index), localKey)
+		if err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("tdata: account %d", index))
+		}
+		sessions = append(sessions, s)
+	}
+	return sessions, nil
+}
+
+// ExportTData writes sessions as accounts of a Telegram Desktop tdata folder, without a passcode;
+// existing key and account files in path are overwritten.
+func ExportTData(path string, sessions ...*telegram.Session) error {
+	if len(sessions) == 0 || len(sessions) > tdataMaxAccounts {
+		return fmt.Errorf("tdata: between 1 and %d sessions can be exported", tdataMaxAccounts)
+	}
+	for _, s := range sessions {
+		if err := checkSession(s); err != nil {
+			return err
+		}
+	}
+	if err := os.MkdirAll(path, 0700); err != nil {
+		return errors.Wrap(err, "tdata")
+	}
+
+	salt := make([]byte, tdataSaltSize)
+	localKey := make([]byte, tdataLocalKeySize)
+	if _, err := rand.Read(salt); err != nil {
+		return errors.Wrap(err, "tdata")
+	}
+	if _, err := rand.Read(localKey); err != nil {
+		return errors.Wrap(err, "tdata")
+	}
+
+	var info bytes.Buffer
+	binary.Write(&info, binary.BigEndian, int32(len(sessions)))
+	for i := range sessions {
+		binary.Write(&info, binary.BigEndian, int32(i))
+	}
+	binary.Write(&info, binary.BigEndian, int32(0)) // active account
+
+	keyEncrypted, err := encryptLocal(localKey, createLocalKey(salt, ""))
+	if err != nil {
+		return errors.Wrap(err, "tdata")
+	}
+	infoEncrypted, err := encryptLocal(info.Bytes(), localKey)
+	if err != nil {
+		return errors.Wrap(err, "tdata")
+	}
+
+	var keyData bytes.Buffer
+	writeQByteArray(&keyData, salt)
+	writeQByteArray(&keyData, keyEncrypted)
+	writeQByteArray(&keyData, infoEncrypted)
+	if err := writeTDF(path, tdataKeyFile, keyData.Bytes()); err != nil {
+		return errors.Wrap(err, "tdata")
+	}
+
+	for i, s := range sessions {
+		if err := writeTDataAccount(path, i, s, localKey); err != nil {
+			return errors.Wrap(err, fmt.Sprintf("tdata: account %d", i))
+		}
+	}
+	return nil
+}
+
+func getPasscode(passcode []string) string {
+	if len(passcode) > 0 {
+		return passcode[0]
+	}
+	return ""
+}
+
+func readTDataAccount(path string, index int, localKey []byte) (*telegram.Session, error) {
+	name := accountFileName(index)
+	data, err := readTDF(path, name+"s")
+	if os.IsNotExist(errors.Cause(err)) {
+		data, err = readTDF(path, name)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	encrypted, err := readQByteArray(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	decrypted, err := decryptLocal(encrypted, localKey)
+	if err != nil {
+		return nil, err
+	}
+
+	r := bytes.NewReader(decrypted)
+	var blockID uint32
+	if err := binary.Read(r, binary.BigEndian, &blockID); err != nil {
+		return nil, err
+	}
+	if blockID != dbiMtpAuthorization {
+		return nil, fmt.Errorf("unexpected block 0x%x in account data", blockID)
+	}
+	auth, err := readQByteArray(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		userID       int64
+		legacyUserID int32
+		mainDC       int32
+		count        int32
+	)
+	r = bytes.NewReader(auth)
+	binary.Read(r, binary.BigEndian, &legacyUserID)
+	binary.Read(r, binary.BigEndian, &mainDC)
+	userID = int64(legacyUserID)
+	if legacyUserID == tdataWideIDsTag && mainDC == tdataWideIDsTag {
+		binary.Read(r, binary.BigEndian, &userID)
+		binary.Read(r, binary.BigEndian, &mainDC)
+	}
+	if err := binary.Read(r, binary.BigEndian, &count); err != nil {
+		return nil, errors.Wrap(err, "reading authorization")
+	}
+
+	keys := make(map[int][]byte, count)
+	for i := int32(0); i < count; i++ {
+		var dc int32
+		key := make([]byte, authKeySize)
+		if err := binary.Read(r, binary.BigEndian, &dc); err != nil {
+			return nil, errors.Wrap(err, "reading authorization")
+		}
+		if _, err := io.ReadFull(r, key); err != nil {
+			return nil, errors.Wrap(err, "reading authorization")
+		}
+		keys[int(dc)] = key
+	}
+
+	mainKey, ok := keys[int(mainDC)]
+	if !ok {
+		return nil, fmt.Errorf("no auth key for main dc %d", mainDC)
+	}
+	delete(keys, int(mainDC))
+
+	s := newSession(int(mainDC), mainKey, "", false)
+	s.UserID = userID
+	for dc, key := range keys {
+		if s.DCKeys == nil {
+			s.DCKeys = make(map[int]*telegram.DCKey, len(keys))
+		}
+		s.DCKeys[dc] = &telegram.DCKey{Key: key}
+	}
+	return s, nil
+}
+
+func writeTDataAccount(path string, index int, s *telegram.Session, localKey []byte) error {
+	dc := homeDC(s)
+	dcs := []int{dc}
+	for other := range s.DCKeys {
+		if other != dc && s.DCKeys[other] != nil && len(s.DCKeys[other].Key) == authKeySize {
+			dcs = append(dcs, other)
+		}
+	}
+	sort.Ints(dcs[1:])
+
+	var auth bytes.Buffer
+	binary.Write(&auth, binary.BigEndian, int32(tdataWideIDsTag))
+	binary.Write(&auth, binary.BigEndian, int32(tdataWideIDsTag))
+	binary.Write(&auth, binary.BigEndian, uint64(s.UserID))
+	binary.Write(&auth, binary.BigEndian, int32(dc))
+	binary.Write(&auth, binary.BigEndian, int32(len(dcs)))
+	for _, d := range dcs {
+		key := s.Key
+		if d != dc {
+			key = s.DCKeys[d].Key
+		}
+		binary.Write(&auth, binary.BigEndian, int32(d))
+		auth.Write(key)
+	}
+	binary.Write(&auth, binary.BigEndian, int32(0)) // keys to destroy
+
+	var block bytes.Buffer
+	binary.Write(&block, binary.BigEndian, uint32(dbiMtpAuthorization))
+	writeQByteArray(&block, auth.Bytes())
+
+	encrypted, err := encryptLocal(block.Bytes(), localKey)
+	if err != nil {
+		return err
+	}
+
+	var data bytes.Buffer
+	writeQByteArray(&data, encrypted)
+	return writeTDF(path, accountFileName(index)+"s", data.Bytes())
+}
+
+// accountFileName returns the file name of an account's data, the md5 of its data
+// name as hex with the nibbles of every byte swapped.
+func accountFileName(index int) string {
+	name := tdataAccountDataPrefix
+	if index > 0 {
+		name = fmt.Sprintf("%s#%d", tdataAccountDataPrefix, index+1)
+	}
+
+	sum := md5.Sum([]byte(name))
+	var b strings.Builder
+	for _, c := range sum[:8] {
+		fmt.Fprintf(&b, "%X%X", c&0x0f, c>>4)
+	}
+	return b.String()
+}
+
+// readTDF reads a TDF$ container, verifying its checksum.
+func readTDF(dir, name string) ([]byte, error) {
+	raw, err := os.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if len(raw) < len(tdfMagic)+4+md5.Size || string(raw[:len(tdfMagic)]) != tdfMagic {
+		return nil, errors.New("not a tdata file: " + name)
+	}
+
+	version := raw[4:8]
+	data := raw[8 : len(raw)-md5.Size]
+	if !bytes.Equal(tdfChecksum(data, version), raw[len(raw)-md5.Size:]) {
+		return nil, errors.New("checksum mismatch: " + name)
+	}
+	return data, nil
+}
+
+func writeTDF(dir, name string, data []byte) error {
+	version := binary.LittleEndian.AppendUint32(nil, tdfVersion)
+
+	var buf bytes.Buffer
+	buf.WriteString(tdfMagic)
+	buf.Write(version)
+	buf.Write(data)
+	buf.Write(tdfChecksum(data, version))
+	return os.WriteFile(filepath.Join(dir, name), buf.Bytes(), 0600)
+}
+
+func tdfChecksum(data, version []byte) []byte {
+	h := md5.New()
+	h.Write(data)
+	binary.Write(h, binary.LittleEndian, uint32(len(data)))
+	h.Write(version)
+	h.Write([]byte(tdfMagic))
+	return h.Sum(nil)
+}
+
+func readQByteArray(r *bytes.Reader) ([]byte, error) {
+	var size uint32
+	if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+		return nil, err
+	}
+	if size == 0xffffffff { // null
+		return nil, nil
+	}
+	if int64(size) > int64(r.Len()) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	data := make([]byte, size)
+	_, err := io.ReadFull(r, data)
+	return data, err
+}
+
+func writeQByteArray(w *bytes.Buffer, data []byte) {
+	binary.Write(w, binary.BigEndian, uint32(len(data)))
+	w.Write(data)
+}
+
+// createLocalKey derives the key protecting the local key from the passcode.
+func createLocalKey(salt []byte, passcode string) []byte {
+	h := sha512.New()
+	h.Write(salt)
+	h.Write([]byte(passcode))
+	h.Write(salt)
+
+	rounds := 1
+	if passcode != "" {
+		rounds = tdataPasscodeRounds
+	}
+	return utils.PBKDF2(sha512.New, h.Sum(nil), salt, rounds, tdataLocalKeySize)
+}
+
+// decryptLocal decrypts data written by encryptLocal: a 16 byte message key
+// followed by the length prefixed, padded plaintext.
+func decryptLocal(data, localKey []byte) ([]byte, error) {
+	if len(data) <= 16 || (len(data)-16)%16 != 0 {
+		return nil, errors.New("bad encrypted data size")
+	}
+	msgKey := data[:16]
+
+	key, iv := localAESKeys(msgKey, localKey)
+	decrypted, err := ige.DecryptIGE(data[16:], key, iv)
+	if err != nil {
+		return nil, err
+	}
+
+	if sum := sha1.Sum(decrypted); !bytes.Equal(sum[:16], msgKey) {
+		return nil, errors.New("bad decrypt key")
+	}
+	size := binary.LittleEndian.Uint32(decrypted)
+	if size < 4 || int(size) > len(decrypted) {
+		return nil, fmt.Errorf("bad decrypted data size %d", size)
+	}
+	return decrypted[4:size], nil
+}
+
+func encryptLocal(data, localKey []byte) ([]byte, error) {
+	size := 4 + len(data)
+	padded := make([]byte, (size+15)/16*16)
+	binary.LittleEndian.PutUint32(padded, uint32(size))
+	copy(padded[4:], data)
+	if _, err := rand.Read(padded[size:]); err != nil {
+		return nil, err
+	}
+
+	sum := sha1.Sum(padded)
+	msgKey := sum[:16]
+
+	key, iv := localAESKeys(msgKey, localKey)
+	encrypted, err := ige.EncryptIGE(padded, key, iv)
+	if err != nil {
+		return nil, err
+	}
+	return append(bytes.Clone(msgKey), encrypted...), nil
+}
+
+// localAESKeys derives the aes key and iv of local data from its message key (old MTProto v1 scheme).
+func localAESKeys(msgKey, localKey []byte) (key, iv []byte) {
+	const x = 8
+	concat := func(parts ...[]byte) []byte { return bytes.Join(parts, nil) }
+
+	a := sha1.Sum(concat(msgKey, localKey[x:x+32]))
+	b := sha1.Sum(concat(localKey[x+32:x+48], msgKey, localKey[x+48:x+64]))
+	c := sha1.Sum(concat(localKey[x+64:x+96], msgKey))
+	d := sha1.Sum(concat(msgKey, localKey[x+96:x+128]))
+
+	key = concat(a[:8], b[8:20], c[4:16])
+	iv = concat(a[8:20], b[:8], c[16:20], d[:8])
+	return key, iv
+}
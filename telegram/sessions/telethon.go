@@ -0,0 +1,145 @@
+// Copyright (c) 2024 RoseLoverX
+
+package sessions
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"net"
+	"strings"
+
+	"github.com/amarnathcjd/gogram/telegram"
+	"github.com/pkg/errors"
+)
+
+const (
+	telethonStringVersion = "1"
+	telethonSchemaVersion = 7
+)
+
+// ImportTelethonString decodes a Telethon StringSession.
+func ImportTelethonString(encoded string) (*telegram.Session, error) {
+	if !strings.HasPrefix(encoded, telethonStringVersion) {
+		return nil, errors.New("telethon: unsupported string session version")
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(encoded[1:], "="))
+	if err != nil {
+		return nil, errors.Wrap(err, "telethon: decoding string session")
+	}
+
+	// >B{4|16}sH256s
+	var ipLen int
+	switch len(data) {
+	case 1 + 4 + 2 + authKeySize:
+		ipLen = 4
+	case 1 + 16 + 2 + authKeySize:
+		ipLen = 16
+	default:
+		return nil, errors.New("telethon: invalid string session length")
+	}
+
+	dc := int(data[0])
+	ip := net.IP(data[1 : 1+ipLen])
+	port := int(binary.BigEndian.Uint16(data[1+ipLen:]))
+	key := bytes.Clone(data[3+ipLen:])
+
+	return newSession(dc, key, joinHostname(ip.String(), port), false), nil
+}
+
+// ExportTelethonString encodes a session as a Telethon StringSession.
+func ExportTelethonString(s *telegram.Session) (string, error) {
+	if err := checkSession(s); err != nil {
+		return "", err
+	}
+	ip, port, err := splitHostname(s)
+	if err != nil {
+		return "", err
+	}
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	}
+
+	var buf bytes.Buffer
+	buf.WriteByte(byte(homeDC(s)))
+	buf.Write(ip)
+	binary.Write(&buf, binary.BigEndian, uint16(port))
+	buf.Write(s.Key)
+
+	return telethonStringVersion + base64.URLEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+// ImportTelethonFile reads a Telethon SQLite .session file.
+func ImportTelethonFile(path string) (*telegram.Session, error) {
+	db, err := openSQLite(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "telethon")
+	}
+
+	rows, err := db.table("sessions")
+	if err != nil {
+		return nil, errors.Wrap(err, "telethon")
+	}
+	if len(rows) == 0 {
+		return nil, errors.New("telethon: session file holds no session")
+	}
+
+	row := rows[0]
+	key, _ := row["auth_key"].([]byte)
+	if len(key) != authKeySize {
+		return nil, ErrInvalidSession
+	}
+
+	dc, _ := row["dc_id"].(int64)
+	address, _ := row["server_address"].(string)
+	port, _ := row["port"].(int64)
+
+	var hostname string
+	if address != "" && port != 0 {
+		hostname = joinHostname(address, int(port))
+	}
+	return newSession(int(dc), key, hostname, false), nil
+}
+
+// ExportTelethonFile writes a session as a Telethon SQLite .session file,
+// overwriting path if it exists.
+func ExportTelethonFile(path string, s *telegram.Session) error {
+	if err := checkSession(s); err != nil {
+		return err
+	}
+	ip, port, err := splitHostname(s)
+	if err != nil {
+		return err
+	}
+
+	return writeSQLite(path, []sqliteObject{
+		{
+			kind: "table", name: "version", table: "version",
+			sql:     "CREATE TABLE version (version integer primary key)",
+			rowid:   "version",
+			columns: []string{"version"},
+			rows:    [][]any{{int64(telethonSchemaVersion)}},
+		},
+		{
+			kind: "table", name: "sessions", table: "sessions",
+			sql:     "CREATE TABLE sessions (dc_id integer primary key, server_address text, port integer, auth_key blob, takeout_id integer)",
+			rowid:   "dc_id",
+			columns: []string{"dc_id", "server_address", "port", "auth_key", "takeout_id"},
+			rows:    [][]any{{int64(homeDC(s)), ip.String(), int64(port), s.Key, nil}},
+		},
+		{
+			kind: "table", name: "entities", table: "entities",
+			sql: "CREATE TABLE entities (id integer primary key, hash integer not null, username text, phone integer, name text, date integer)",
+		},
+		{
+			kind: "table", name: "sent_files", table: "sent_files",
+			sql: "CREATE TABLE sent_files (md5_digest blob, file_size integer, type integer, id integer, hash integer, primary key(md5_digest, file_size, type))",
+		},
+		{kind: "index", name: "sqlite_autoindex_sent_files_1", table: "sent_files"},
+		{
+			kind: "table", name: "update_state", table: "update_state",
+			sql: "CREATE TABLE update_state (id integer primary key, pts integer, qts integer, date integer, seq integer)",
+		},
+	})
+}
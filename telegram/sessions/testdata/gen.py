@@ -0,0 +1,106 @@
+# Generates the session fixtures the way each library writes them, independently of the Go code.
+# The tdata fixture is written by ExportTData (see TestTDataFixture).
+#
+#	python3 gen.py
+import base64
+import json
+import os
+import socket
+import sqlite3
+import struct
+
+DIR = os.path.dirname(os.path.abspath(__file__))
+KEY = bytes((i * 7 + 3) % 256 for i in range(256))  # has zero bytes, for the MTKruto RLE
+
+
+def write(name, data):
+    with open(os.path.join(DIR, name), "w") as f:
+        f.write(data + "\n")
+
+
+# Telethon StringSession: "1" + urlsafe_b64(>B{4|16}sH256s)
+write("telethon.string", "1" + base64.urlsafe_b64encode(
+    struct.pack(">B4sH256s", 2, socket.inet_aton("149.154.167.51"), 443, KEY)).decode())
+write("telethon_ipv6.string", "1" + base64.urlsafe_b64encode(
+    struct.pack(">B16sH256s", 4, socket.inet_pton(socket.AF_INET6, "2001:67c:4e8:f004::a"), 443, KEY)).decode())
+
+# Telethon SQLiteSession, version 7; enough entities for the tables to span several pages
+path = os.path.join(DIR, "telethon.session")
+if os.path.exists(path):
+    os.remove(path)
+db = sqlite3.connect(path)
+db.executescript("""
+create table version (version integer primary key);
+create table sessions (dc_id integer primary key, server_address text, port integer, auth_key blob, takeout_id integer);
+create table entities (id integer primary key, hash integer not null, username text, phone integer, name text, date integer);
+create table sent_files (md5_digest blob, file_size integer, type integer, id integer, hash integer, primary key(md5_digest, file_size, type));
+create table update_state (id integer primary key, pts integer, qts integer, date integer, seq integer);
+""")
+db.execute("insert into version values (7)")
+db.execute("insert into sessions values (?,?,?,?,?)", (2, "149.154.167.51", 443, KEY, None))
+db.executemany("insert into entities values (?,?,?,?,?,?)",
+               [(i, i * 31, "user%d" % i, None, "User %d" % i, 1700000000) for i in range(1, 2001)])
+db.commit()
+db.close()
+
+# Pyrogram string session, current layout >BI?256sQ? and the legacy >B?256sQ?
+write("pyrogram.string", base64.urlsafe_b64encode(
+    struct.pack(">BI?256sQ?", 5, 123456, False, KEY, 777000, True)).decode().rstrip("="))
+write("pyrogram_legacy.string", base64.urlsafe_b64encode(
+    struct.pack(">B?256sQ?", 1, False, KEY, 5000000000, False)).decode().rstrip("="))
+
+# Pyrogram SQLite session, schema version 3
+path = os.path.join(DIR, "pyrogram.session")
+if os.path.exists(path):
+    os.remove(path)
+db = sqlite3.connect(path)
+db.executescript("""
+CREATE TABLE sessions (dc_id INTEGER PRIMARY KEY, api_id INTEGER, test_mode INTEGER, auth_key BLOB, date INTEGER NOT NULL, user_id INTEGER, is_bot INTEGER);
+CREATE TABLE peers (id INTEGER PRIMARY KEY, access_hash INTEGER, type INTEGER NOT NULL, username TEXT, phone_number TEXT, last_update_on INTEGER NOT NULL DEFAULT (CAST(STRFTIME('%s', 'now') AS INTEGER)));
+CREATE TABLE version (number INTEGER PRIMARY KEY);
+CREATE INDEX idx_peers_id ON peers (id);
+CREATE INDEX idx_peers_username ON peers (username);
+CREATE INDEX idx_peers_phone_number ON peers (phone_number);
+""")
+db.execute("insert into version values (3)")
+db.execute("insert into sessions values (?,?,?,?,?,?,?)", (5, 123456, 0, KEY, 1700000000, 777000, 1))
+db.executemany("insert into peers (id, access_hash, type, username) values (?,?,?,?)",
+               [(-100 - i, i * 17, 1, "chan%d" % i) for i in range(1500)])
+db.commit()
+db.close()
+
+# GramJS StringSession: "1" + b64(dc uint8, address length int16, address, port int16, key)
+address = b"149.154.167.91"
+write("gramjs.string", "1" + base64.b64encode(
+    struct.pack(">BH", 4, len(address)) + address + struct.pack(">H", 443) + KEY).decode())
+
+
+# MTKruto auth string: urlsafe_b64(rle(TL string dc, TL bytes key, int32 api id))
+def tl_bytes(b):
+    head = bytes([len(b)]) if len(b) < 254 else bytes([254]) + len(b).to_bytes(3, "little")
+    out = head + b
+    return out + b"\0" * ((4 - len(out) % 4) % 4)
+
+
+def rle(b):
+    out, zeros = bytearray(), 0
+    for c in b:
+        if c == 0:
+            if zeros == 255:
+                out += bytes([0, zeros])
+                zeros = 0
+            zeros += 1
+            continue
+        if zeros:
+            out += bytes([0, zeros])
+            zeros = 0
+        out.append(c)
+    if zeros:
+        out += bytes([0, zeros])
+    return bytes(out)
+
+
+write("mtkruto.string", base64.urlsafe_b64encode(
+    rle(tl_bytes(b"2-test") + tl_bytes(KEY) + struct.pack("<i", 654321))).decode().rstrip("="))
+
+write("key.b64", base64.b64encode(KEY).decode())
@@ -32,39 +32,19 @@ func (c *Client) StartGroupCallMedia(peer any) (PhoneCall, error) {
 }
 
 func (c *Client) GetGroupCall(chatId any) (*InputGroupCall, error) {
-	resolvedPeer, err := c.ResolvePeer(chatId)
+	fullChatRaw, err := c.GetFullChat(chatId)
 	if err != nil {
 		return nil, err
 	}
 
-	if inPeer, ok := resolvedPeer.(*InputPeerChannel); !ok {
+	fullChat, ok := fullChatRaw.(*ChannelFull)
+	if !ok {
 		return nil, fmt.Errorf("GetGroupCall: chatId is not a channel")
-	} else {
-		fullChatRaw, err := c.ChannelsGetFullChannel(
-			&InputChannelObj{
-				ChannelID:  inPeer.ChannelID,
-				AccessHash: inPeer.AccessHash,
-			},
-		)
-
-		if err != nil {
-			return nil, err
-		}
-
-		if fullChatRaw == nil {
-			return nil, fmt.Errorf("GetGroupCall: fullChatRaw is nil")
-		}
-
-		fullChat, ok := fullChatRaw.FullChat.(*ChannelFull)
-
-		if !ok {
-			return nil, fmt.Errorf("GetGroupCall: fullChatRaw.FullChat is not a ChannelFull")
-		}
-
-		if fullChat.Call == nil {
-			return nil, fmt.Errorf("GetGroupCall: No active group call")
-		}
+	}
 
-		return fullChat.Call, nil
+	if fullChat.Call == nil {
+		return nil, fmt.Errorf("GetGroupCall: No active group call")
 	}
+
+	return fullChat.Call, nil
 }
@@ -0,0 +1,494 @@
+// Copyright (c) 2024 RoseLoverX
+
+package telegram
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var ErrTransferCancelled = errors.New("transfer cancelled")
+
+type TransferKind int
+
+const (
+	TransferUpload TransferKind = iota
+	TransferDownload
+)
+
+type TransferState int
+
+const (
+	TransferQueued TransferState = iota
+	TransferRunning
+	TransferPaused
+	TransferDone
+	TransferFailed
+	TransferCancelled
+)
+
+func (s TransferState) String() string {
+	switch s {
+	case TransferQueued:
+		return "queued"
+	case TransferRunning:
+		return "running"
+	case TransferPaused:
+		return "paused"
+	case TransferDone:
+		return "done"
+	case TransferFailed:
+		return "failed"
+	case TransferCancelled:
+		return "cancelled"
+	}
+	return "unknown"
+}
+
+type TransferConfig struct {
+	MaxConcurrent int // Max transfers running at once (default: 4)
+	MaxPerDC      int // Max transfers running at once against a single DC (default: 2)
+}
+
+// TransferJob is a queued upload or download, managed by a TransferManager.
+type TransferJob struct {
+	ID       int64
+	Kind     TransferKind
+	Priority int // higher runs first
+	DC       int32
+
+	manager *TransferManager
+	mu      sync.Mutex
+	cond    *sync.Cond
+	state   TransferState
+	paused  bool // pause requested while queued or running
+	seq     int64
+	total   int64
+	current int64
+	run     func() (any, error)
+	result  any
+	err     error
+	done    chan struct{}
+}
+
+func newTransferJob(m *TransferManager, kind TransferKind, priority int, dc int32) *TransferJob {
+	j := &TransferJob{manager: m, Kind: kind, Priority: priority, DC: dc, done: make(chan struct{})}
+	j.cond = sync.NewCond(&j.mu)
+	return j
+}
+
+func (j *TransferJob) State() TransferState {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.paused && (j.state == TransferQueued || j.state == TransferRunning) {
+		return TransferPaused
+	}
+	return j.state
+}
+
+// Progress returns the transferred and total bytes of the job.
+func (j *TransferJob) Progress() (current, total int64) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.current, j.total
+}
+
+// Pause holds the job; a running job stops before its next part, keeping its slot.
+func (j *TransferJob) Pause() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.state == TransferQueued || j.state == TransferRunning {
+		j.paused = true
+	}
+}
+
+// Resume lets a paused job go on; a queued job is started when there is a free slot.
+func (j *TransferJob) Resume() {
+	j.mu.Lock()
+	j.paused = false
+	j.cond.Broadcast()
+	j.mu.Unlock()
+	j.manager.schedule()
+}
+
+// Cancel stops the job, Wait then returns ErrTransferCancelled; a job that has already
+// completed keeps its result.
+func (j *TransferJob) Cancel() {
+	j.mu.Lock()
+	if j.state == TransferQueued || j.state == TransferRunning {
+		j.state = TransferCancelled
+		j.paused = false
+		j.cond.Broadcast()
+	}
+	j.mu.Unlock()
+	j.manager.schedule() // a queued job leaves the queue
+}
+
+// Wait blocks until the job finishes, returning the uploaded InputFile
+// or the downloaded file path.
+func (j *TransferJob) Wait() (any, error) {
+	<-j.done
+	return j.result, j.err
+}
+
+// Done is closed once the job has finished.
+func (j *TransferJob) Done() <-chan struct{} {
+	return j.done
+}
+
+// checkpoint blocks while the job is paused, and fails once it is cancelled;
+// transfers call it before every part. It is a no-op for transfers outside of a manager.
+func (j *TransferJob) checkpoint() error {
+	if j == nil {
+		return nil
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for j.paused && j.state == TransferRunning {
+		j.cond.Wait()
+	}
+	if j.state == TransferCancelled {
+		return ErrTransferCancelled
+	}
+	return nil
+}
+
+func (j *TransferJob) cancelled() bool {
+	if j == nil {
+		return false
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.state == TransferCancelled
+}
+
+func (j *TransferJob) finish(result any, err error) {
+	j.mu.Lock()
+	j.result, j.err = result, err
+	switch {
+	case err == nil:
+		j.state = TransferDone // even if cancelled after the transfer went through
+		j.current = j.total
+	case j.state == TransferCancelled || errors.Is(err, ErrTransferCancelled):
+		j.state = TransferCancelled
+		j.err = ErrTransferCancelled
+	default:
+		j.state = TransferFailed
+	}
+	j.mu.Unlock()
+	close(j.done)
+}
+
+// TransferStats is a snapshot of every job known to a TransferManager.
+type TransferStats struct {
+	Queued, Running, Paused, Done, Failed, Cancelled int
+	TotalBytes, DoneBytes                            int64
+}
+
+// TransferManager queues uploads and downloads, running them by priority
+// under global and per-DC concurrency caps, sharing the client's sender pool.
+type TransferManager struct {
+	client *Client
+	config TransferConfig
+
+	mu       sync.Mutex
+	seq      atomic.Int64
+	queue    []*TransferJob
+	jobs     map[int64]*TransferJob
+	running  int
+	perDC    map[int32]int
+	progress *ProgressManager
+	lastEmit time.Time
+}
+
+// NewTransferManager creates a transfer manager for the client.
+func NewTransferManager(c *Client, config ...TransferConfig) *TransferManager {
+	cfg := getVariadic(config, TransferConfig{})
+	cfg.MaxConcurrent = getValue(cfg.MaxConcurrent, 4)
+	cfg.MaxPerDC = getValue(cfg.MaxPerDC, 2)
+
+	return &TransferManager{
+		client: c,
+		config: cfg,
+		jobs:   make(map[int64]*TransferJob),
+		perDC:  make(map[int32]int),
+	}
+}
+
+// Transfers returns the client's transfer manager, creating it on first use.
+func (c *Client) Transfers(config ...TransferConfig) *TransferManager {
+	c.transfersOnce.Do(func() {
+		c.transfers = NewTransferManager(c, config...)
+	})
+	return c.transfers
+}
+
+// WithProgress sets a progress manager receiving the aggregated progress of all unfinished jobs.
+func (m *TransferManager) WithProgress(pm *ProgressManager) *TransferManager {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.progress = pm
+	return m
+}
+
+// Upload queues an upload, the job result is an InputFile.
+func (m *TransferManager) Upload(src any, priority int, opts ...*UploadOptions) *TransferJob {
+	opt := *getVariadic(opts, &UploadOptions{})
+	job := newTransferJob(m, TransferUpload, priority, int32(m.client.GetDC()))
+
+	userProgress := opt.ProgressManager
+	opt.ProgressManager = m.jobProgress(job, userProgress)
+	opt.job = job
+
+	job.run = func() (any, error) {
+		return m.client.UploadFile(src, &opt)
+	}
+	return m.enqueue(job)
+}
+
+// Download queues a download, the job result is the path of the downloaded file.
+func (m *TransferManager) Download(file any, priority int, opts ...*DownloadOptions) *TransferJob {
+	opt := *getVariadic(opts, &DownloadOptions{})
+
+	_, dc, _, _, err := GetFileLocation(file, FileLocationOptions{ThumbOnly: opt.ThumbOnly, ThumbSize: opt.ThumbSize})
+	dc = getValue(dc, opt.DCId)
+	if dc == 0 {
+		dc = int32(m.client.GetDC())
+	}
+
+	job := newTransferJob(m, TransferDownload, priority, dc)
+	if err != nil {
+		m.track(job)
+		job.finish(nil, err)
+		return job
+	}
+
+	userProgress := opt.ProgressManager
+	opt.ProgressManager = m.jobProgress(job, userProgress)
+	opt.job = job
+	opt.DCId = dc
+
+	job.run = func() (any, error) {
+		return m.client.DownloadMedia(file, &opt)
+	}
+	return m.enqueue(job)
+}
+
+// track gives a job its id and makes it known to Job and Stats.
+func (m *TransferManager) track(job *TransferJob) {
+	job.ID = m.seq.Add(1)
+	job.seq = job.ID
+
+	m.mu.Lock()
+	m.jobs[job.ID] = job
+	m.mu.Unlock()
+}
+
+func (m *TransferManager) enqueue(job *TransferJob) *TransferJob {
+	m.track(job)
+
+	m.mu.Lock()
+	m.queue = append(m.queue, job)
+	sort.SliceStable(m.queue, func(i, j int) bool {
+		if m.queue[i].Priority != m.queue[j].Priority {
+			return m.queue[i].Priority > m.queue[j].Priority
+		}
+		return m.queue[i].seq < m.queue[j].seq
+	})
+	m.mu.Unlock()
+
+	m.client.Log.Debug("transfers: queued job ", job.ID, " (priority ", job.Priority, ", dc ", job.DC, ")")
+	m.schedule()
+	return job
+}
+
+// schedule starts queued jobs while there are free slots, skipping paused jobs
+// and jobs whose DC is already at its cap.
+func (m *TransferManager) schedule() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	remaining := m.queue[:0]
+	for _, job := range m.queue {
+		job.mu.Lock()
+		state, paused := job.state, job.paused
+		job.mu.Unlock()
+
+		if state == TransferCancelled {
+			job.finish(nil, ErrTransferCancelled)
+			continue
+		}
+
+		if paused || m.running >= m.config.MaxConcurrent || m.perDC[job.DC] >= m.config.MaxPerDC {
+			remaining = append(remaining, job)
+			continue
+		}
+
+		job.mu.Lock()
+		job.state = TransferRunning
+		job.mu.Unlock()
+
+		m.running++
+		m.perDC[job.DC]++
+		go m.runJob(job)
+	}
+	m.queue = remaining
+}
+
+func (m *TransferManager) runJob(job *TransferJob) {
+	result, err := job.run()
+	job.finish(result, err)
+
+	m.mu.Lock()
+	m.running--
+	m.perDC[job.DC]--
+	m.mu.Unlock()
+
+	m.client.Log.Debug("transfers: job ", job.ID, " finished (", job.State(), ")")
+	m.emitProgress(true)
+	m.schedule()
+}
+
+// jobProgress returns a progress manager recording the progress of a job,
+// forwarding it to the job's own progress manager, on its interval, and to the aggregated one.
+func (m *TransferManager) jobProgress(job *TransferJob, user *ProgressManager) *ProgressManager {
+	pm := NewProgressManager(1)
+	var (
+		mu          sync.Mutex
+		started     bool
+		lastForward time.Time
+	)
+	return pm.WithEdit(func(total, current int64) {
+		job.mu.Lock()
+		job.total, job.current = total, current
+		job.mu.Unlock()
+
+		if user != nil && user.editFunc != nil {
+			mu.Lock()
+			defer mu.Unlock()
+			if !started {
+				// the file name and count are set on pm by the transfer itself
+				started = true
+				user.SetFileName(pm.GetFileName())
+				user.lastPerc = 0
+				user.IncCount()
+			}
+			if total > 0 && current >= total || time.Since(lastForward) >= time.Duration(user.editInterval)*time.Second {
+				lastForward = time.Now()
+				user.SetTotalSize(total)
+				user.editFunc(total, current)
+			}
+		}
+		m.emitProgress(false)
+	})
+}
+
+func (m *TransferManager) emitProgress(force bool) {
+	m.mu.Lock()
+	pm := m.progress
+	if pm == nil || pm.editFunc == nil || (!force && time.Since(m.lastEmit) < time.Duration(pm.editInterval)*time.Second) {
+		m.mu.Unlock()
+		return
+	}
+	m.lastEmit = time.Now()
+	m.mu.Unlock()
+
+	stats := m.Stats()
+	pm.SetTotalSize(stats.TotalBytes)
+	pm.editFunc(stats.TotalBytes, stats.DoneBytes)
+}
+
+// Stats returns counts of jobs by state and the byte totals of unfinished jobs.
+func (m *TransferManager) Stats() TransferStats {
+	m.mu.Lock()
+	jobs := make([]*TransferJob, 0, len(m.jobs))
+	for _, job := range m.jobs {
+		jobs = append(jobs, job)
+	}
+	m.mu.Unlock()
+
+	var stats TransferStats
+	for _, job := range jobs {
+		state := job.State()
+		current, total := job.Progress()
+		switch state {
+		case TransferQueued:
+			stats.Queued++
+		case TransferRunning:
+			stats.Running++
+		case TransferPaused:
+			stats.Paused++
+		case TransferDone:
+			stats.Done++
+		case TransferFailed:
+			stats.Failed++
+		case TransferCancelled:
+			stats.Cancelled++
+		}
+		if state == TransferQueued || state == TransferRunning || state == TransferPaused {
+			stats.TotalBytes += total
+			stats.DoneBytes += current
+		}
+	}
+	return stats
+}
+
+// Job returns a job by its id.
+func (m *TransferManager) Job(id int64) (*TransferJob, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	job, ok := m.jobs[id]
+	return job, ok
+}
+
+// Pause, Resume and Cancel act on a job by its id.
+func (m *TransferManager) Pause(id int64) {
+	if job, ok := m.Job(id); ok {
+		job.Pause()
+	}
+}
+
+func (m *TransferManager) Resume(id int64) {
+	if job, ok := m.Job(id); ok {
+		job.Resume()
+	}
+}
+
+func (m *TransferManager) Cancel(id int64) {
+	if job, ok := m.Job(id); ok {
+		job.Cancel()
+	}
+}
+
+// Prune forgets finished jobs.
+func (m *TransferManager) Prune() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for id, job := range m.jobs {
+		select {
+		case <-job.done:
+			delete(m.jobs, id)
+		default:
+		}
+	}
+}
+
+// Close cancels all jobs.
+func (m *TransferManager) Close() {
+	m.mu.Lock()
+	jobs := make([]*TransferJob, 0, len(m.jobs))
+	for _, job := range m.jobs {
+		jobs = append(jobs, job)
+	}
+	m.mu.Unlock()
+
+	for _, job := range jobs {
+		job.Cancel()
+	}
+}
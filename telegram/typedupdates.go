@@ -0,0 +1,198 @@
+// Copyright (c) 2024 RoseLoverX
+
+package telegram
+
+import (
+	"context"
+	"reflect"
+	"sort"
+)
+
+const maxTrackedUpdates = 1000 // updates waiting for dispatch whose users and chats are kept
+
+// UpdateContext comes with an update to the handlers added with OnUpdate: the users and chats
+// sent along with the update, and the context of the handler (see ClientConfig.HandlerTimeout).
+type UpdateContext struct {
+	Client   *Client
+	Users    map[int64]*UserObj
+	Chats    map[int64]*ChatObj
+	Channels map[int64]*Channel
+	ctx      context.Context
+}
+
+func newUpdateContext(c *Client, users []User, chats []Chat) *UpdateContext {
+	ctx := &UpdateContext{
+		Client:   c,
+		Users:    make(map[int64]*UserObj, len(users)),
+		Chats:    make(map[int64]*ChatObj),
+		Channels: make(map[int64]*Channel),
+	}
+	for _, user := range users {
+		if user, ok := user.(*UserObj); ok {
+			ctx.Users[user.ID] = user
+		}
+	}
+	for _, chat := range chats {
+		switch chat := chat.(type) {
+		case *ChatObj:
+			ctx.Chats[chat.ID] = chat
+		case *Channel:
+			ctx.Channels[chat.ID] = chat
+		}
+	}
+	return ctx
+}
+
+// Context returns the context of the handler handling the update.
+func (u *UpdateContext) Context() context.Context { return handlerContext(u.ctx) }
+
+func (u *UpdateContext) withContext(ctx context.Context) *UpdateContext {
+	return withContext(u, ctx, func(u *UpdateContext, ctx context.Context) { u.ctx = ctx })
+}
+
+// User returns a user sent along with the update, or from the cache.
+func (u *UpdateContext) User(userID int64) *UserObj {
+	if user, ok := u.Users[userID]; ok {
+		return user
+	}
+	user, _ := u.Client.GetUser(userID)
+	return user
+}
+
+// Chat returns a basic group sent along with the update, or from the cache.
+func (u *UpdateContext) Chat(chatID int64) *ChatObj {
+	if chat, ok := u.Chats[chatID]; ok {
+		return chat
+	}
+	chat, _ := u.Client.GetChat(chatID)
+	return chat
+}
+
+// Channel returns a channel (or supergroup) sent along with the update, or from the cache.
+func (u *UpdateContext) Channel(channelID int64) *Channel {
+	if channel, ok := u.Channels[channelID]; ok {
+		return channel
+	}
+	channel, _ := u.Client.GetChannel(channelID)
+	return channel
+}
+
+type updateHandle struct {
+	updateType  reflect.Type // nil for all updates
+	order       uint64
+	Handler     func(update Update, ctx *UpdateContext) error
+	Group       string
+	sortTrigger chan any
+}
+
+func (h *updateHandle) SetGroup(group string) Handle {
+	h.Group = group
+	h.sortTrigger <- h
+	return h
+}
+
+func (h *updateHandle) GetGroup() string {
+	return h.Group
+}
+
+// OnUpdate adds a handler of the updates of type T, such as *UpdateUserTyping; with T being
+// Update itself, of all updates, and with T another interface, of the updates implementing it.
+//
+//	telegram.OnUpdate(client, func(u *telegram.UpdateUserTyping, ctx *telegram.UpdateContext) error {
+//		fmt.Println(ctx.User(u.UserID).FirstName, "is typing")
+//		return nil
+//	})
+func OnUpdate[T Update](c *Client, handler func(update T, ctx *UpdateContext) error) Handle {
+	updateType := reflect.TypeFor[T]()
+	if updateType.Kind() == reflect.Interface {
+		updateType = nil
+	}
+	return c.addUpdateHandle(updateType, func(update Update, ctx *UpdateContext) error {
+		u, ok := update.(T)
+		if !ok {
+			return nil
+		}
+		return handler(u, ctx)
+	})
+}
+
+func (c *Client) addUpdateHandle(updateType reflect.Type, handler func(update Update, ctx *UpdateContext) error) Handle {
+	c.dispatcher.Lock()
+	defer c.dispatcher.Unlock()
+	if c.dispatcher.updateHandles == nil {
+		c.dispatcher.updateHandles = make(map[reflect.Type]map[string][]*updateHandle)
+	}
+	if c.dispatcher.updateHandles[updateType] == nil {
+		c.dispatcher.updateHandles[updateType] = make(map[string][]*updateHandle)
+	}
+
+	c.dispatcher.updateHandleOrder++
+	handle := updateHandle{updateType: updateType, order: c.dispatcher.updateHandleOrder, Handler: handler, sortTrigger: c.dispatcher.sortTrigger}
+	c.dispatcher.updateHandles[updateType]["default"] = append(c.dispatcher.updateHandles[updateType]["default"], &handle)
+	return c.dispatcher.updateHandles[updateType]["default"][len(c.dispatcher.updateHandles[updateType]["default"])-1]
+}
+
+// trackUpdates keeps the users and chats that came with updates until they are dispatched,
+// when there are handlers to pass them to.
+func (d *UpdateDispatcher) trackUpdates(c *Client, updates []Update, users []User, chats []Chat) {
+	d.Lock()
+	defer d.Unlock()
+	if len(d.updateHandles) == 0 || len(updates) == 0 {
+		return
+	}
+	if d.trackedUpdates == nil {
+		d.trackedUpdates = make(map[Update]*UpdateContext)
+	}
+
+	ctx := newUpdateContext(c, users, chats)
+	for _, update := range updates {
+		if len(d.trackedUpdates) >= maxTrackedUpdates {
+			for u := range d.trackedUpdates {
+				delete(d.trackedUpdates, u)
+				break
+			}
+		}
+		d.trackedUpdates[update] = ctx
+	}
+}
+
+// updateContext returns the users and chats that came with an update, forgetting them.
+func (d *UpdateDispatcher) updateContext(update Update) *UpdateContext {
+	d.Lock()
+	defer d.Unlock()
+	ctx, ok := d.trackedUpdates[update]
+	if ok {
+		delete(d.trackedUpdates, update)
+	}
+	return ctx
+}
+
+// handleRawUpdate runs the handlers of the type of an update, and those of all updates.
+func (c *Client) handleRawUpdate(update Update, ctx *UpdateContext) {
+	c.dispatcher.RLock()
+	typed, all := c.dispatcher.updateHandles[reflect.TypeOf(update)], c.dispatcher.updateHandles[nil]
+	if len(typed) == 0 && len(all) == 0 {
+		c.dispatcher.RUnlock()
+		return
+	}
+	handles := make(map[string][]*updateHandle, len(typed)+len(all))
+	for _, byGroup := range []map[string][]*updateHandle{all, typed} {
+		for group, h := range byGroup {
+			handles[group] = append(handles[group], h...)
+		}
+	}
+	c.dispatcher.RUnlock()
+
+	for _, h := range handles {
+		sort.Slice(h, func(i, j int) bool { return h[i].order < h[j].order })
+	}
+	if ctx == nil {
+		ctx = newUpdateContext(c, nil, nil)
+	}
+
+	runGroups(c, "rawUpdate", handles, func(group string, h *updateHandle) error {
+		return c.invokeHandlerContext(group, update, func(u any, hctx context.Context) error {
+			return h.Handler(u.(Update), ctx.withContext(hctx))
+		})
+	})
+}
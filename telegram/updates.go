@@ -3,7 +3,6 @@
 package telegram
 
 import (
-	"context"
 	"reflect"
 	"regexp"
 	"strings"
@@ -30,8 +29,6 @@ type InlineCallbackHandler func(m *InlineCallbackQuery) error
 type ParticipantHandler func(m *ParticipantUpdate) error
 type RawHandler func(m Update, c *Client) error
 
-var EndGroup = errors.New("end-group-trigger")
-
 type messageHandle struct {
 	Pattern     any
 	Handler     MessageHandler
@@ -75,33 +72,11 @@ type albumBox struct {
 func (a *albumBox) WaitAndTrigger(d *UpdateDispatcher, c *Client) {
 	time.Sleep(600 * time.Millisecond)
 
-	for gp, handlers := range d.albumHandles {
-		for _, handler := range handlers {
-			handle := func(h *albumHandle) error {
-				if err := h.Handler(&Album{
-					GroupedID: a.groupedId,
-					Messages:  a.messages,
-					Client:    c,
-				}); err != nil {
-					if errors.Is(err, EndGroup) {
-						return err
-					}
-					c.Log.Error(errors.Wrap(err, "[newAlbum]"))
-				}
-				return nil
-			}
-
-			if strings.EqualFold(gp, "") || strings.EqualFold(strings.TrimSpace(gp), "default") {
-				go handle(handler)
-			} else {
-				if err := handle(handler); err != nil && errors.Is(err, EndGroup) {
-					break
-				}
-			}
-		}
-	}
+	album := &Album{GroupedID: a.groupedId, Messages: a.messages, Client: c}
+	runGroups(c, "newAlbum", d.albumHandles, func(group string, h *albumHandle) error {
+		return c.invokeHandler(group, album, func(u any) error { return h.Handler(u.(*Album)) })
+	})
 
-	// delete(d.activeAlbums, a.groupedId)
 	d.Lock()
 	defer d.Unlock()
 	delete(d.activeAlbums, a.groupedId)
@@ -167,6 +142,7 @@ func (h *messageDeleteHandle) GetGroup() string {
 type inlineHandle struct {
 	Pattern     any
 	Handler     InlineHandler
+	Filters     []Filter
 	Group       string
 	sortTrigger chan any
 }
@@ -234,6 +210,7 @@ func (h *inlineCallbackHandle) GetGroup() string {
 
 type participantHandle struct {
 	Handler     func(p *ParticipantUpdate) error
+	Filters     []Filter
 	Group       string
 	sortTrigger chan any
 }
@@ -248,27 +225,9 @@ func (h *participantHandle) GetGroup() string {
 	return h.Group
 }
 
-type rawHandle struct {
-	updateType  Update
-	Handler     RawHandler
-	Group       string
-	sortTrigger chan any
-}
-
-func (h *rawHandle) SetGroup(group string) Handle {
-	h.Group = group
-	h.sortTrigger <- h
-	return h
-}
-
-func (h *rawHandle) GetGroup() string {
-	return h.Group
-}
-
-type openChat struct { // TODO: Implement this
+type openChat struct {
 	accessHash int64
 	closeChan  chan struct{}
-	lastPts    int32
 }
 
 type UpdateDispatcher struct {
@@ -283,11 +242,20 @@ type UpdateDispatcher struct {
 	actionHandles         map[string][]*chatActionHandle
 	messageDeleteHandles  map[string][]*messageDeleteHandle
 	albumHandles          map[string][]*albumHandle
-	rawHandles            map[string][]*rawHandle
+	updateHandles         map[reflect.Type]map[string][]*updateHandle // by update type, nil for all updates
+	updateHandleOrder     uint64
+	trackedUpdates        map[Update]*UpdateContext
+	eventHandles          map[string]map[string][]*eventHandle // by kind, see events.go
 	activeAlbums          map[int64]*albumBox
 	sortTrigger           chan any
 	logger                *utils.Logger
 	openChats             map[int64]*openChat
+	queue                 *dispatchQueue // nil unless updates are handled by workers, see ClientConfig.DispatchWorkers
+	stats                 dispatchCounters
+	handlerTimeout        time.Duration
+	middleware            []Middleware
+	groupMiddleware       map[string][]Middleware
+	groupPriority         map[string]int
 }
 
 // creates and populates a new UpdateDispatcher
@@ -332,6 +300,8 @@ func (d *UpdateDispatcher) SortTrigger() {
 
 	go func() {
 		for handle := range d.sortTrigger {
+			// sortGeneric rewrites the handler slices in place
+			d.Lock()
 			switch handle.(type) {
 			case *messageHandle:
 				sortGeneric(d.messageHandles)
@@ -351,9 +321,12 @@ func (d *UpdateDispatcher) SortTrigger() {
 				sortGeneric(d.participantHandles)
 			case *messageDeleteHandle:
 				sortGeneric(d.messageDeleteHandles)
-			case *rawHandle:
-				sortGeneric(d.rawHandles)
+			case *updateHandle:
+				sortGeneric(d.updateHandles[handle.(*updateHandle).updateType])
+			case *eventHandle:
+				sortGeneric(d.eventHandles[handle.(*eventHandle).kind])
 			}
+			d.Unlock()
 		}
 	}()
 }
@@ -371,6 +344,9 @@ func (c *Client) RemoveHandle(handle Handle) error {
 }
 
 func (c *Client) removeHandle(handle Handle) error {
+	c.dispatcher.Lock()
+	defer c.dispatcher.Unlock()
+
 	switch h := handle.(type) {
 	case *messageHandle:
 		removeHandleFromMap(h, c.dispatcher.messageHandles)
@@ -390,8 +366,10 @@ func (c *Client) removeHandle(handle Handle) error {
 		removeHandleFromMap(h, c.dispatcher.messageDeleteHandles)
 	case *albumHandle:
 		removeHandleFromMap(h, c.dispatcher.albumHandles)
-	case *rawHandle:
-		removeHandleFromMap(h, c.dispatcher.rawHandles)
+	case *updateHandle:
+		removeHandleFromMap(h, c.dispatcher.updateHandles[h.updateType])
+	case *eventHandle:
+		removeHandleFromMap(h, c.dispatcher.eventHandles[h.kind])
 	default:
 		return errors.New("invalid handle type")
 	}
@@ -420,88 +398,19 @@ func (c *Client) handleMessageUpdate(update Message) {
 			c.handleAlbum(*msg)
 		}
 
-		wg := sync.WaitGroup{}
-		ctx, cancel := context.WithCancel(context.Background())
-
 		packed := packMessage(c, msg)
-		groupFunc := func(group string, handlers []*messageHandle) {
-			defer wg.Done()
-			for _, handler := range handlers {
-				if handler.IsMatch(msg.Message, c) {
-					handle := func(h *messageHandle) error {
-						if handler.runFilterChain(packed, h.Filters) {
-							defer c.NewRecovery()()
-							if err := h.Handler(packed); err != nil {
-								if errors.Is(err, EndGroup) {
-									return err
-								}
-								c.dispatcher.logger.Error(errors.Wrap(err, "[newMessage]"))
-							}
-						}
-						return nil
-					}
-
-					if strings.EqualFold(group, "") || strings.EqualFold(strings.TrimSpace(group), "default") {
-						go handle(handler)
-					} else {
-						if err := handle(handler); err != nil && errors.Is(err, EndGroup) {
-							if strings.EqualFold(group, "conversation") {
-								cancel()
-							}
-							break
-						}
-					}
-				}
-			}
-		}
-
-		if conv, ok := c.dispatcher.messageHandles["conversation"]; ok {
-			wg.Add(1)
-			groupFunc("conversation", conv)
-		}
-
-		for group, handlers := range c.dispatcher.messageHandles {
-			if ctx.Err() != nil {
-				break
-			}
-
-			if strings.EqualFold(group, "conversation") {
-				continue
+		runGroups(c, "newMessage", c.dispatcher.messageHandles, func(group string, h *messageHandle) error {
+			if !h.IsMatch(msg.Message, c) || !h.runFilterChain(packed, h.Filters) {
+				return nil
 			}
-
-			wg.Add(1)
-			go groupFunc(group, handlers)
-		}
-
-		wg.Wait()
-		cancel()
+			return c.invokeHandler(group, packed, func(u any) error { return h.Handler(u.(*NewMessage)) })
+		})
 
 	case *MessageService:
 		packed := packMessage(c, msg)
-
-		for group, handler := range c.dispatcher.actionHandles {
-			for _, h := range handler {
-				handle := func(h *chatActionHandle) error {
-					defer c.NewRecovery()()
-					if err := h.Handler(packed); err != nil {
-						if errors.Is(err, EndGroup) {
-							return err
-						}
-						c.Log.Error(errors.Wrap(err, "[chatAction]"))
-					}
-
-					return nil
-				}
-
-				if strings.EqualFold(group, "") || strings.EqualFold(strings.TrimSpace(group), "default") {
-					go handle(h)
-				} else {
-					if err := handle(h); err != nil && errors.Is(err, EndGroup) {
-						break
-					}
-				}
-			}
-		}
+		runGroups(c, "chatAction", c.dispatcher.actionHandles, func(group string, h *chatActionHandle) error {
+			return c.invokeHandler(group, packed, func(u any) error { return h.Handler(u.(*NewMessage)) })
+		})
 	}
 }
 
@@ -524,7 +433,8 @@ func (c *Client) handleAlbum(message MessageObj) {
 		}
 		c.dispatcher.activeAlbums[message.GroupedID] = albBox
 		c.dispatcher.Unlock()
-		albBox.WaitAndTrigger(c.dispatcher, c)
+		go albBox.WaitAndTrigger(c.dispatcher, c) // the rest of the album arrives meanwhile, don't hold the chat
+
 	}
 }
 
@@ -554,231 +464,67 @@ func (c *Client) handleMessageUpdateWith(m Message, pts int32) {
 func (c *Client) handleEditUpdate(update Message) {
 	if msg, ok := update.(*MessageObj); ok {
 		packed := packMessage(c, msg)
-
-		for group, handlers := range c.dispatcher.messageEditHandles {
-			for _, handler := range handlers {
-				if handler.IsMatch(msg.Message) {
-					handle := func(h *messageEditHandle) error {
-						defer c.NewRecovery()()
-						if handler.runFilterChain(packed, h.Filters) {
-							if err := h.Handler(packed); err != nil {
-								if errors.Is(err, EndGroup) {
-									return err
-								}
-								c.Log.Error(errors.Wrap(err, "[editMessage]"))
-							}
-						}
-						return nil
-					}
-
-					if strings.EqualFold(group, "") || strings.EqualFold(strings.TrimSpace(group), "default") {
-						go handle(handler)
-					} else {
-						if err := handle(handler); err != nil && errors.Is(err, EndGroup) {
-							break
-						}
-					}
-				}
+		runGroups(c, "editMessage", c.dispatcher.messageEditHandles, func(group string, h *messageEditHandle) error {
+			if !h.IsMatch(msg.Message) || !h.runFilterChain(packed, h.Filters) {
+				return nil
 			}
-		}
+			return c.invokeHandler(group, packed, func(u any) error { return h.Handler(u.(*NewMessage)) })
+		})
 	}
 }
 
 func (c *Client) handleCallbackUpdate(update *UpdateBotCallbackQuery) {
 	packed := packCallbackQuery(c, update)
-
-	for group, handlers := range c.dispatcher.callbackHandles {
-		for _, handler := range handlers {
-			if handler.IsMatch(update.Data) {
-				handle := func(h *callbackHandle) error {
-					if handler.runFilterChain(packed, h.Filters) {
-						defer c.NewRecovery()()
-						if err := h.Handler(packed); err != nil {
-							if errors.Is(err, EndGroup) {
-								return err
-							}
-							c.Log.Error(errors.Wrap(err, "[callbackQuery]"))
-						}
-					}
-					return nil
-				}
-
-				if strings.EqualFold(group, "") || strings.EqualFold(strings.TrimSpace(group), "default") {
-					go handle(handler)
-				} else {
-					if err := handle(handler); err != nil && errors.Is(err, EndGroup) {
-						break
-					}
-				}
-			}
+	runGroups(c, "callbackQuery", c.dispatcher.callbackHandles, func(group string, h *callbackHandle) error {
+		if !h.IsMatch(update.Data) || !h.runFilterChain(packed, h.Filters) {
+			return nil
 		}
-	}
+		return c.invokeHandler(group, packed, func(u any) error { return h.Handler(u.(*CallbackQuery)) })
+	})
 }
 
 func (c *Client) handleInlineCallbackUpdate(update *UpdateInlineBotCallbackQuery) {
 	packed := packInlineCallbackQuery(c, update)
-
-	for group, handlers := range c.dispatcher.inlineCallbackHandles {
-		for _, handler := range handlers {
-			if handler.IsMatch(update.Data) {
-				handle := func(h *inlineCallbackHandle) error {
-					defer c.NewRecovery()()
-					if err := h.Handler(packed); err != nil {
-						if errors.Is(err, EndGroup) {
-							return err
-						}
-						c.Log.Error(errors.Wrap(err, "[inlineCallbackQuery]"))
-					}
-					return nil
-				}
-
-				if strings.EqualFold(group, "") || strings.EqualFold(strings.TrimSpace(group), "default") {
-					go handle(handler)
-				} else {
-					if err := handle(handler); err != nil && errors.Is(err, EndGroup) {
-						break
-					}
-				}
-			}
+	runGroups(c, "inlineCallbackQuery", c.dispatcher.inlineCallbackHandles, func(group string, h *inlineCallbackHandle) error {
+		if !h.IsMatch(update.Data) {
+			return nil
 		}
-	}
+		return c.invokeHandler(group, packed, func(u any) error { return h.Handler(u.(*InlineCallbackQuery)) })
+	})
 }
 
 func (c *Client) handleParticipantUpdate(update *UpdateChannelParticipant) {
 	packed := packChannelParticipant(c, update)
-
-	for group, handlers := range c.dispatcher.participantHandles {
-		for _, handler := range handlers {
-			handle := func(h *participantHandle) error {
-				defer c.NewRecovery()()
-				if err := h.Handler(packed); err != nil {
-					if errors.Is(err, EndGroup) {
-						return err
-					}
-					c.Log.Error(errors.Wrap(err, "[participantUpdate]"))
-				}
-				return nil
-			}
-
-			if strings.EqualFold(group, "") || strings.EqualFold(strings.TrimSpace(group), "default") {
-				go handle(handler)
-			} else {
-				if err := handle(handler); err != nil && errors.Is(err, EndGroup) {
-					break
-				}
-			}
+	runGroups(c, "participantUpdate", c.dispatcher.participantHandles, func(group string, h *participantHandle) error {
+		if !runFilters(packed, h.Filters) {
+			return nil
 		}
-	}
+		return c.invokeHandler(group, packed, func(u any) error { return h.Handler(u.(*ParticipantUpdate)) })
+	})
 }
 
 func (c *Client) handleInlineUpdate(update *UpdateBotInlineQuery) {
 	packed := packInlineQuery(c, update)
-
-	for group, handlers := range c.dispatcher.inlineHandles {
-		for _, handler := range handlers {
-			if handler.IsMatch(update.Query) {
-				handle := func(h *inlineHandle) error {
-					defer c.NewRecovery()()
-					if err := h.Handler(packed); err != nil {
-						if errors.Is(err, EndGroup) {
-							return err
-						}
-						c.Log.Error(errors.Wrap(err, "[inlineQuery]"))
-					}
-					return nil
-				}
-
-				if strings.EqualFold(group, "") || strings.EqualFold(strings.TrimSpace(group), "default") {
-					go handle(handler)
-				} else {
-					if err := handle(handler); err != nil && errors.Is(err, EndGroup) {
-						break
-					}
-				}
-			}
+	runGroups(c, "inlineQuery", c.dispatcher.inlineHandles, func(group string, h *inlineHandle) error {
+		if !h.IsMatch(update.Query) || !runFilters(packed, h.Filters) {
+			return nil
 		}
-	}
+		return c.invokeHandler(group, packed, func(u any) error { return h.Handler(u.(*InlineQuery)) })
+	})
 }
 
 func (c *Client) handleInlineSendUpdate(update *UpdateBotInlineSend) {
 	packed := packInlineSend(c, update)
-
-	for group, handlers := range c.dispatcher.inlineSendHandles {
-		for _, handler := range handlers {
-			handle := func(h *inlineSendHandle) error {
-				defer c.NewRecovery()()
-				if err := h.Handler(packed); err != nil {
-					if errors.Is(err, EndGroup) {
-						return err
-					}
-					c.Log.Error(errors.Wrap(err, "[inlineSend]"))
-				}
-				return nil
-			}
-
-			if strings.EqualFold(group, "") || strings.EqualFold(strings.TrimSpace(group), "default") {
-				go handle(handler)
-			} else {
-				if err := handle(handler); err != nil && errors.Is(err, EndGroup) {
-					break
-				}
-			}
-		}
-	}
+	runGroups(c, "inlineSend", c.dispatcher.inlineSendHandles, func(group string, h *inlineSendHandle) error {
+		return c.invokeHandler(group, packed, func(u any) error { return h.Handler(u.(*InlineSend)) })
+	})
 }
 
 func (c *Client) handleDeleteUpdate(update Update) {
 	packed := packDeleteMessage(c, update)
-
-	for group, handlers := range c.dispatcher.messageDeleteHandles {
-		for _, handler := range handlers {
-			handle := func(h *messageDeleteHandle) error {
-				defer c.NewRecovery()()
-				if err := h.Handler(packed); err != nil {
-					if errors.Is(err, EndGroup) {
-						return err
-					}
-					c.Log.Error(errors.Wrap(err, "[deleteMessage]"))
-				}
-				return nil
-			}
-
-			if strings.EqualFold(group, "") || strings.EqualFold(strings.TrimSpace(group), "default") {
-				go handle(handler)
-			} else {
-				if err := handle(handler); err != nil && errors.Is(err, EndGroup) {
-					break
-				}
-			}
-		}
-	}
-}
-
-func (c *Client) handleRawUpdate(update Update) {
-	for group, handlers := range c.dispatcher.rawHandles {
-		for _, handler := range handlers {
-			if reflect.TypeOf(update) == reflect.TypeOf(handler.updateType) || handler.updateType == nil {
-				handle := func(h *rawHandle) error {
-					defer c.NewRecovery()()
-					if err := h.Handler(update, c); err != nil {
-						if errors.Is(err, EndGroup) {
-							return err
-						}
-						c.Log.Error(errors.Wrap(err, "[rawUpdate]"))
-					}
-					return nil
-				}
-
-				if strings.EqualFold(group, "") || strings.EqualFold(strings.TrimSpace(group), "default") {
-					go handle(handler)
-				} else {
-					if err := handle(handler); err != nil && errors.Is(err, EndGroup) {
-						break
-					}
-				}
-			}
-		}
-	}
+	runGroups(c, "deleteMessage", c.dispatcher.messageDeleteHandles, func(group string, h *messageDeleteHandle) error {
+		return c.invokeHandler(group, packed, func(u any) error { return h.Handler(u.(*DeleteMessage)) })
+	})
 }
 
 func (h *inlineHandle) IsMatch(text string) bool {
@@ -872,146 +618,6 @@ func (h *messageHandle) IsMatch(text string, c *Client) bool {
 	return false
 }
 
-func (h *messageHandle) runFilterChain(m *NewMessage, filters []Filter) bool {
-	var (
-		actAsBlacklist      bool
-		actUsers, actGroups []int64
-		inSlice             = func(e int64, s []int64) bool {
-			for _, a := range s {
-				if a == e {
-					return true
-				}
-			}
-			return false
-		}
-	)
-
-	if len(filters) > 0 {
-		for _, filter := range filters {
-			if filter.Private && !m.IsPrivate() || filter.Group && !m.IsGroup() || filter.Channel && !m.IsChannel() {
-				return false
-			}
-			if filter.Media && !m.IsMedia() || filter.Command && !m.IsCommand() || filter.Reply && !m.IsReply() || filter.Forward && !m.IsForward() {
-				return false
-			}
-			if filter.FromBot {
-				if m.Sender == nil || !m.Sender.Bot {
-					return false
-				}
-			}
-			if len(filter.Users) > 0 {
-				actUsers = filter.Users
-			}
-			if len(filter.Chats) > 0 {
-				actGroups = filter.Chats
-			}
-			if filter.Blacklist {
-				actAsBlacklist = true
-			}
-			if filter.Mention && m.Message != nil && !m.Message.Mentioned {
-				return false
-			}
-
-			if filter.Func != nil {
-				if !filter.Func(m) {
-					return false
-				}
-			}
-		}
-	}
-
-	var peerCheckUserPassed bool
-	var peerCheckGroupPassed bool
-
-	if len(actUsers) > 0 && m.SenderID() != 0 {
-		if inSlice(m.SenderID(), actUsers) {
-			if actAsBlacklist {
-				return false
-			}
-			peerCheckUserPassed = true
-		}
-	} else {
-		peerCheckUserPassed = true
-	}
-
-	if len(actGroups) > 0 && m.ChatID() != 0 {
-		if inSlice(m.ChatID(), actGroups) {
-			if actAsBlacklist {
-				return false
-			}
-			peerCheckGroupPassed = true
-		}
-	} else {
-		peerCheckGroupPassed = true
-	}
-
-	if !actAsBlacklist && (len(actUsers) > 0 || len(actGroups) > 0) && !(peerCheckUserPassed && peerCheckGroupPassed) {
-		return false
-	}
-
-	return true
-}
-
-func (h *messageEditHandle) runFilterChain(m *NewMessage, filters []Filter) bool {
-	var message = &messageHandle{}
-	return message.runFilterChain(m, filters)
-}
-
-func (h *callbackHandle) runFilterChain(c *CallbackQuery, filters []Filter) bool {
-	if len(filters) > 0 {
-		for _, filter := range filters {
-			if filter.Private && !c.IsPrivate() || filter.Group && !c.IsGroup() || filter.Channel && !c.IsChannel() {
-				return false
-			}
-			if filter.FromBot {
-				if c.Sender == nil || !c.Sender.Bot {
-					return false
-				}
-			}
-
-			if filter.Func != nil {
-				if !filter.FuncCallback(c) {
-					return false
-				}
-			}
-		}
-	}
-
-	return true
-}
-
-type Filter struct {
-	Private, Group, Channel, Media, Command, Reply, Forward, FromBot, Blacklist, Mention bool
-	Users, Chats                                                                         []int64
-	Func                                                                                 func(m *NewMessage) bool
-	FuncCallback                                                                         func(c *CallbackQuery) bool
-}
-
-var (
-	FilterPrivate   = Filter{Private: true}
-	FilterGroup     = Filter{Group: true}
-	FilterChannel   = Filter{Channel: true}
-	FilterMedia     = Filter{Media: true}
-	FilterCommand   = Filter{Command: true}
-	FilterReply     = Filter{Reply: true}
-	FilterForward   = Filter{Forward: true}
-	FilterFromBot   = Filter{FromBot: true}
-	FilterBlacklist = Filter{Blacklist: true}
-	FilterMention   = Filter{Mention: true}
-	FilterUsers     = func(users ...int64) Filter {
-		return Filter{Users: users}
-	}
-	FilterChats = func(chats ...int64) Filter {
-		return Filter{Chats: chats}
-	}
-	FilterFunc = func(f func(m *NewMessage) bool) Filter {
-		return Filter{Func: f}
-	}
-	FilterFuncCallback = func(f func(c *CallbackQuery) bool) Filter {
-		return Filter{Func: func(m *NewMessage) bool { return true }}
-	}
-)
-
 func (c *Client) AddMessageHandler(pattern any, handler MessageHandler, filters ...Filter) Handle {
 	var messageFilters []Filter
 	if len(filters) > 0 {
@@ -1094,12 +700,12 @@ func (c *Client) AddEditHandler(pattern any, handler MessageHandler, filters ...
 //
 // Included Updates:
 //   - Inline Query
-func (c *Client) AddInlineHandler(pattern any, handler InlineHandler) Handle {
+func (c *Client) AddInlineHandler(pattern any, handler InlineHandler, filters ...Filter) Handle {
 	if c.dispatcher.inlineHandles == nil {
 		c.dispatcher.inlineHandles = make(map[string][]*inlineHandle)
 	}
 
-	handle := inlineHandle{Pattern: pattern, Handler: handler, sortTrigger: c.dispatcher.sortTrigger}
+	handle := inlineHandle{Pattern: pattern, Handler: handler, Filters: filters, sortTrigger: c.dispatcher.sortTrigger}
 	c.dispatcher.inlineHandles["default"] = append(c.dispatcher.inlineHandles["default"], &handle)
 	return c.dispatcher.inlineHandles["default"][len(c.dispatcher.inlineHandles["default"])-1]
 }
@@ -1157,90 +763,146 @@ func (c *Client) AddInlineCallbackHandler(pattern any, handler InlineCallbackHan
 //   - Kicked Channel Participant
 //   - Channel Participant Admin
 //   - Channel Participant Creator
-func (c *Client) AddParticipantHandler(handler ParticipantHandler) Handle {
+func (c *Client) AddParticipantHandler(handler ParticipantHandler, filters ...Filter) Handle {
 	if c.dispatcher.participantHandles == nil {
 		c.dispatcher.participantHandles = make(map[string][]*participantHandle)
 	}
 
-	handle := participantHandle{Handler: handler, sortTrigger: c.dispatcher.sortTrigger}
+	handle := participantHandle{Handler: handler, Filters: filters, sortTrigger: c.dispatcher.sortTrigger}
 	c.dispatcher.participantHandles["default"] = append(c.dispatcher.participantHandles["default"], &handle)
 	return c.dispatcher.participantHandles["default"][len(c.dispatcher.participantHandles["default"])-1]
 }
 
+// Handle updates of the type of updateType (a value of the type, like &UpdateUserTyping{}),
+// or all updates if nil; OnUpdate adds handlers taking the update type itself.
 func (c *Client) AddRawHandler(updateType Update, handler RawHandler) Handle {
-	if c.dispatcher.rawHandles == nil {
-		c.dispatcher.rawHandles = make(map[string][]*rawHandle)
+	var t reflect.Type
+	if updateType != nil {
+		t = reflect.TypeOf(updateType)
 	}
-
-	handle := rawHandle{updateType: updateType, Handler: handler, sortTrigger: c.dispatcher.sortTrigger}
-	c.dispatcher.rawHandles["default"] = append(c.dispatcher.rawHandles["default"], &handle)
-	return c.dispatcher.rawHandles["default"][len(c.dispatcher.rawHandles["default"])-1]
+	return c.addUpdateHandle(t, func(update Update, _ *UpdateContext) error { return handler(update, c) })
 }
 
 // Sort and Handle all the Incoming Updates
 // Many more types to be added
 func HandleIncomingUpdates(u any, c *Client) bool {
-UpdateTypeSwitching:
 	switch upd := u.(type) {
 	case *UpdatesObj:
-		go c.Cache.UpdatePeersToCache(upd.Users, upd.Chats)
-		for _, update := range upd.Updates {
-			switch update := update.(type) {
-			case *UpdateNewMessage:
-				go c.handleMessageUpdate(update.Message)
-			case *UpdateNewChannelMessage:
-				go c.handleMessageUpdate(update.Message)
-			case *UpdateNewScheduledMessage:
-				go c.handleMessageUpdate(update.Message)
-			case *UpdateEditMessage:
-				go c.handleEditUpdate(update.Message)
-			case *UpdateEditChannelMessage:
-				go c.handleEditUpdate(update.Message)
-			case *UpdateBotInlineQuery:
-				go c.handleInlineUpdate(update)
-			case *UpdateBotCallbackQuery:
-				go c.handleCallbackUpdate(update)
-			case *UpdateInlineBotCallbackQuery:
-				go c.handleInlineCallbackUpdate(update)
-			case *UpdateChannelParticipant:
-				go c.handleParticipantUpdate(update)
-			case *UpdateDeleteChannelMessages:
-				go c.handleDeleteUpdate(update)
-			case *UpdateDeleteMessages:
-				go c.handleDeleteUpdate(update)
-			case *UpdateBotInlineSend:
-				go c.handleInlineSendUpdate(update)
-			}
-			go c.handleRawUpdate(update)
+		if !c.updates.acceptSeq(upd, upd.Date, upd.Seq, upd.Seq) {
+			return true
+		}
+		c.handleUpdates(upd.Updates, upd.Users, upd.Chats)
+	case *UpdatesCombined:
+		if !c.updates.acceptSeq(upd, upd.Date, upd.SeqStart, upd.Seq) {
+			return true
 		}
+		c.handleUpdates(upd.Updates, upd.Users, upd.Chats)
 	case *UpdateShort:
-		switch upd := upd.Update.(type) {
-		case *UpdateNewMessage:
-			go c.handleMessageUpdateWith(upd.Message, upd.Pts)
-		case *UpdateNewChannelMessage:
-			go c.handleMessageUpdateWith(upd.Message, upd.Pts)
+		for _, update := range c.updates.accept(upd.Update) {
+			var handle func()
+			if update == upd.Update {
+				switch update := update.(type) {
+				case *UpdateNewMessage:
+					handle = func() { c.handleMessageUpdateWith(update.Message, update.Pts) }
+				case *UpdateNewChannelMessage:
+					handle = func() { c.handleMessageUpdateWith(update.Message, update.Pts) }
+				}
+			}
+			if handle == nil {
+				c.dispatchUpdate(update)
+				continue
+			}
+			c.fullCache.handleUpdate(update)
+			c.dispatcher.run(update, c.dispatchKey(update), handle, func() { c.handleRawUpdate(update, nil) })
 		}
-		go c.handleRawUpdate(upd.Update)
 	case *UpdateShortMessage:
-		go c.handleMessageUpdateWith(&MessageObj{ID: upd.ID, Out: upd.Out, Mentioned: upd.Mentioned, Message: upd.Message, MediaUnread: upd.MediaUnread, FromID: getPeerUser(upd.UserID), PeerID: getPeerUser(upd.UserID), Date: upd.Date, Entities: upd.Entities, FwdFrom: upd.FwdFrom, ReplyTo: upd.ReplyTo, ViaBotID: upd.ViaBotID, TtlPeriod: upd.TtlPeriod, Silent: upd.Silent}, upd.Pts)
+		c.handleShortMessage(&MessageObj{ID: upd.ID, Out: upd.Out, Mentioned: upd.Mentioned, Message: upd.Message, MediaUnread: upd.MediaUnread, FromID: getPeerUser(upd.UserID), PeerID: getPeerUser(upd.UserID), Date: upd.Date, Entities: upd.Entities, FwdFrom: upd.FwdFrom, ReplyTo: upd.ReplyTo, ViaBotID: upd.ViaBotID, TtlPeriod: upd.TtlPeriod, Silent: upd.Silent}, upd.Pts, upd.PtsCount)
 	case *UpdateShortChatMessage:
-		go c.handleMessageUpdateWith(&MessageObj{ID: upd.ID, Out: upd.Out, Mentioned: upd.Mentioned, Message: upd.Message, MediaUnread: upd.MediaUnread, FromID: getPeerUser(upd.FromID), PeerID: &PeerChat{ChatID: upd.ChatID}, Date: upd.Date, Entities: upd.Entities, FwdFrom: upd.FwdFrom, ReplyTo: upd.ReplyTo, ViaBotID: upd.ViaBotID, TtlPeriod: upd.TtlPeriod, Silent: upd.Silent}, upd.Pts)
+		c.handleShortMessage(&MessageObj{ID: upd.ID, Out: upd.Out, Mentioned: upd.Mentioned, Message: upd.Message, MediaUnread: upd.MediaUnread, FromID: getPeerUser(upd.FromID), PeerID: &PeerChat{ChatID: upd.ChatID}, Date: upd.Date, Entities: upd.Entities, FwdFrom: upd.FwdFrom, ReplyTo: upd.ReplyTo, ViaBotID: upd.ViaBotID, TtlPeriod: upd.TtlPeriod, Silent: upd.Silent}, upd.Pts, upd.PtsCount)
 	case *UpdateShortSentMessage:
-		go c.handleMessageUpdateWith(&MessageObj{ID: upd.ID, Out: upd.Out, Date: upd.Date, Media: upd.Media, Entities: upd.Entities, TtlPeriod: upd.TtlPeriod}, upd.Pts)
-	case *UpdatesCombined:
-		u = upd.Updates
-		go c.Cache.UpdatePeersToCache(upd.Users, upd.Chats)
-
-		goto UpdateTypeSwitching
+		c.handleShortMessage(&MessageObj{ID: upd.ID, Out: upd.Out, Date: upd.Date, Media: upd.Media, Entities: upd.Entities, TtlPeriod: upd.TtlPeriod}, upd.Pts, upd.PtsCount)
 	case *UpdatesTooLong:
-		c.Log.Debug("too many updates, forcing getDifference")
-		c.UpdatesGetState() //state, err := c.UpdatesGetState() // TODO: figure out the pts to call here
+		c.Log.Debug("too many updates, fetching difference")
+		go c.updates.getDifference()
 	default:
 		c.Log.Debug("skipping unhanded update type: ", reflect.TypeOf(u), " with value: ", c.JSON(u))
 	}
 	return true
 }
 
+// handleUpdates handles the updates of a container in the order of their sequences.
+func (c *Client) handleUpdates(updates []Update, users []User, chats []Chat) {
+	c.Cache.trackMinPeers(updates, users, chats)
+	c.dispatcher.trackUpdates(c, updates, users, chats)
+	go c.Cache.UpdatePeersToCache(users, chats)
+	for _, update := range updates {
+		for _, ready := range c.updates.accept(update) {
+			c.dispatchUpdate(ready)
+		}
+	}
+}
+
+// handleShortMessage handles a message sent in the short form, checking it against the pts sequence.
+func (c *Client) handleShortMessage(msg *MessageObj, pts, ptsCount int32) {
+	short := &UpdateNewMessage{Message: msg, Pts: pts, PtsCount: ptsCount}
+	for _, update := range c.updates.accept(short) {
+		if update == Update(short) {
+			c.dispatcher.run(short, c.dispatchKey(short), func() { c.handleMessageUpdateWith(msg, pts) })
+		} else {
+			c.dispatchUpdate(update)
+		}
+	}
+}
+
+// dispatchUpdate passes an update to the handlers registered for it.
+func (c *Client) dispatchUpdate(update Update) {
+	c.fullCache.handleUpdate(update)
+
+	var handle func()
+	switch update := update.(type) {
+	case *UpdateNewMessage:
+		handle = func() { c.handleMessageUpdate(update.Message) }
+	case *UpdateNewChannelMessage:
+		handle = func() { c.handleMessageUpdate(update.Message) }
+	case *UpdateNewScheduledMessage:
+		handle = func() { c.handleMessageUpdate(update.Message) }
+	case *UpdateEditMessage:
+		handle = func() { c.handleEditUpdate(update.Message) }
+	case *UpdateEditChannelMessage:
+		handle = func() { c.handleEditUpdate(update.Message) }
+	case *UpdateBotInlineQuery:
+		handle = func() { c.handleInlineUpdate(update) }
+	case *UpdateBotCallbackQuery:
+		handle = func() { c.handleCallbackUpdate(update) }
+	case *UpdateInlineBotCallbackQuery:
+		handle = func() { c.handleInlineCallbackUpdate(update) }
+	case *UpdateChannelParticipant:
+		member := c.dispatchEvent(update)
+		handle = func() {
+			c.handleParticipantUpdate(update)
+			member()
+		}
+	case *UpdateDeleteChannelMessages:
+		handle = func() { c.handleDeleteUpdate(update) }
+	case *UpdateDeleteMessages:
+		handle = func() { c.handleDeleteUpdate(update) }
+	case *UpdateBotInlineSend:
+		handle = func() { c.handleInlineSendUpdate(update) }
+	default:
+		handle = c.dispatchEvent(update)
+	}
+	ctx := c.dispatcher.updateContext(update)
+	c.dispatcher.run(update, c.dispatchKey(update), handle, func() { c.handleRawUpdate(update, ctx) })
+}
+
+// UpdateState returns the current position in the update sequences, nil if updates are not handled.
+func (c *Client) UpdateState() *UpdateState {
+	if c.updates == nil {
+		return nil
+	}
+	return c.updates.State()
+}
+
 func (c *Client) GetDifference(Pts, Limit int32) (Message, error) {
 	c.Log.Debug("getting difference with pts: ", Pts, " and limit: ", Limit)
 
@@ -1279,6 +941,8 @@ func (c *Client) GetDifference(Pts, Limit int32) (Message, error) {
 }
 
 func (c *Client) OpenChat(channel *InputChannelObj) {
+	c.dispatcher.Lock()
+	defer c.dispatcher.Unlock()
 	if c.dispatcher.openChats == nil {
 		c.dispatcher.openChats = make(map[int64]*openChat)
 	}
@@ -1290,11 +954,12 @@ func (c *Client) OpenChat(channel *InputChannelObj) {
 	c.dispatcher.openChats[channel.ChannelID] = &openChat{
 		accessHash: channel.AccessHash,
 		closeChan:  make(chan struct{}),
-		lastPts:    0,
 	}
 }
 
 func (c *Client) CloseChat(channel *InputChannelObj) {
+	c.dispatcher.Lock()
+	defer c.dispatcher.Unlock()
 	if c.dispatcher.openChats == nil {
 		return
 	}
@@ -1307,47 +972,42 @@ func (c *Client) CloseChat(channel *InputChannelObj) {
 	delete(c.dispatcher.openChats, channel.ChannelID)
 }
 
+func (d *UpdateDispatcher) openChatHash(channelID int64) (int64, bool) {
+	d.RLock()
+	defer d.RUnlock()
+	if chat, ok := d.openChats[channelID]; ok {
+		return chat.accessHash, true
+	}
+	return 0, false
+}
+
+func (d *UpdateDispatcher) openChatIDs() []int64 {
+	d.RLock()
+	defer d.RUnlock()
+	ids := make([]int64, 0, len(d.openChats))
+	for id := range d.openChats {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
 const (
 	GET_CHANNEL_DIFF_INTERVAL = 2000 * time.Millisecond
 )
 
-// TODO Implement a better way to fetch channel differences
+// FetchGap polls the difference of the open chats (see OpenChat), for channels whose updates
+// are not pushed to the client.
 func (c *Client) FetchGap() {
 	for {
-		for channelID, chat := range c.dispatcher.openChats {
-			chDiff, _ := c.UpdatesGetChannelDifference(&UpdatesGetChannelDifferenceParams{
-				Force:   false,
-				Channel: &InputChannelObj{ChannelID: channelID, AccessHash: chat.accessHash},
-				Pts:     chat.lastPts,
-				Limit:   100,
-				Filter:  &ChannelMessagesFilterEmpty{},
-			})
-
-			if c.dispatcher.openChats[channelID].lastPts != chat.lastPts {
-				c.Log.Debug("channel pts changed, skipping fetch")
-			}
-
-			if chDiff != nil {
-				switch d := chDiff.(type) {
-				case *UpdatesChannelDifferenceEmpty:
-					c.Log.Info("channel difference is empty")
-				case *UpdatesChannelDifferenceObj:
-					c.Cache.UpdatePeersToCache(d.Users, d.Chats)
-					for _, update := range d.NewMessages {
-						switch u := update.(type) {
-						case *MessageObj:
-							c.handleMessageUpdate(u)
-						}
-					}
-				case *UpdatesChannelDifferenceTooLong:
-					c.Log.Debug("channel difference is too long, requesting getState")
-				default:
-					c.Log.Error("unknown channel difference type: ", reflect.TypeOf(d))
-				}
-			}
+		select {
+		case <-c.stopCh:
+			return
+		case <-time.After(GET_CHANNEL_DIFF_INTERVAL):
 		}
 
-		time.Sleep(GET_CHANNEL_DIFF_INTERVAL)
+		for _, channelID := range c.dispatcher.openChatIDs() {
+			c.updates.pollChannel(channelID)
+		}
 	}
 }
 
@@ -1365,6 +1025,19 @@ var (
 	OnChoosenInline  ev = "choosenInline"
 	OnParticipant    ev = "participant"
 	OnRaw            ev = "raw"
+
+	OnUserStatus      ev = "userStatus"
+	OnTyping          ev = "typing"
+	OnRead            ev = "read"
+	OnReaction        ev = "reaction"
+	OnPollVote        ev = "pollVote"
+	OnPin             ev = "pin"
+	OnJoinRequest     ev = "joinRequest"
+	OnChatParticipant ev = "chatParticipant"
+	OnBotMember       ev = "botMember"
+	OnBoost           ev = "boost"
+	OnStory           ev = "story"
+	OnBusinessMessage ev = "businessMessage"
 )
 
 func (c *Client) On(pattern any, handler any, filters ...Filter) Handle {
@@ -1399,9 +1072,9 @@ func (c *Client) On(pattern any, handler any, filters ...Filter) Handle {
 	case OnEdit, OnEditMessage:
 		if h, ok := handler.(func(m *NewMessage) error); ok {
 			if args != "" {
-				return c.AddEditHandler(args, h)
+				return c.AddEditHandler(args, h, filters...)
 			}
-			return c.AddEditHandler(OnEditMessage, h)
+			return c.AddEditHandler(OnEditMessage, h, filters...)
 		}
 	case OnDelete, OnDeleteMessage:
 		if h, ok := handler.(func(m *DeleteMessage) error); ok {
@@ -1417,9 +1090,9 @@ func (c *Client) On(pattern any, handler any, filters ...Filter) Handle {
 	case OnInline, OnInlineQuery:
 		if h, ok := handler.(func(m *InlineQuery) error); ok {
 			if args != "" {
-				return c.AddInlineHandler(args, h)
+				return c.AddInlineHandler(args, h, filters...)
 			}
-			return c.AddInlineHandler(OnInlineQuery, h)
+			return c.AddInlineHandler(OnInlineQuery, h, filters...)
 		}
 	case OnChoosenInline:
 		if h, ok := handler.(func(m *InlineSend) error); ok {
@@ -1428,9 +1101,9 @@ func (c *Client) On(pattern any, handler any, filters ...Filter) Handle {
 	case OnCallback, OnCallbackQuery:
 		if h, ok := handler.(func(m *CallbackQuery) error); ok {
 			if args != "" {
-				return c.AddCallbackHandler(args, h)
+				return c.AddCallbackHandler(args, h, filters...)
 			}
-			return c.AddCallbackHandler(OnCallbackQuery, h)
+			return c.AddCallbackHandler(OnCallbackQuery, h, filters...)
 		}
 	case OnInlineCallback, OnInlineCallbackQuery:
 		if h, ok := handler.(func(m *InlineCallbackQuery) error); ok {
@@ -1441,7 +1114,55 @@ func (c *Client) On(pattern any, handler any, filters ...Filter) Handle {
 		}
 	case OnParticipant:
 		if h, ok := handler.(func(m *ParticipantUpdate) error); ok {
-			return c.AddParticipantHandler(h)
+			return c.AddParticipantHandler(h, filters...)
+		}
+	case OnUserStatus:
+		if h, ok := handler.(func(u *UserStatusUpdate) error); ok {
+			return c.AddUserStatusHandler(h, filters...)
+		}
+	case OnTyping:
+		if h, ok := handler.(func(t *TypingUpdate) error); ok {
+			return c.AddTypingHandler(h, filters...)
+		}
+	case OnRead:
+		if h, ok := handler.(func(r *ReadUpdate) error); ok {
+			return c.AddReadHandler(h, filters...)
+		}
+	case OnReaction:
+		if h, ok := handler.(func(r *ReactionUpdate) error); ok {
+			return c.AddReactionHandler(h, filters...)
+		}
+	case OnPollVote:
+		if h, ok := handler.(func(p *PollVoteUpdate) error); ok {
+			return c.AddPollVoteHandler(h, filters...)
+		}
+	case OnPin:
+		if h, ok := handler.(func(p *PinUpdate) error); ok {
+			return c.AddPinHandler(h, filters...)
+		}
+	case OnJoinRequest:
+		if h, ok := handler.(func(j *JoinRequestUpdate) error); ok {
+			return c.AddJoinRequestHandler(h, filters...)
+		}
+	case OnChatParticipant:
+		if h, ok := handler.(func(p *ChatParticipantUpdate) error); ok {
+			return c.AddChatParticipantHandler(h, filters...)
+		}
+	case OnBotMember:
+		if h, ok := handler.(func(b *BotMemberUpdate) error); ok {
+			return c.AddBotMemberHandler(h, filters...)
+		}
+	case OnBoost:
+		if h, ok := handler.(func(b *BoostUpdate) error); ok {
+			return c.AddBoostHandler(h, filters...)
+		}
+	case OnStory:
+		if h, ok := handler.(func(s *StoryUpdate) error); ok {
+			return c.AddStoryHandler(h, filters...)
+		}
+	case OnBusinessMessage:
+		if h, ok := handler.(func(b *BusinessMessage) error); ok {
+			return c.AddBusinessMessageHandler(h, filters...)
 		}
 	case OnRaw:
 		if h, ok := handler.(func(m Update, c *Client) error); ok {
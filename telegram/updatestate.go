@@ -0,0 +1,943 @@
+// Copyright (c) 2024 RoseLoverX
+
+package telegram
+
+import (
+	"encoding/json"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/amarnathcjd/gogram/internal/session"
+	"github.com/amarnathcjd/gogram/internal/utils"
+	"github.com/pkg/errors"
+)
+
+const (
+	updateGapTimeout        = 500 * time.Millisecond // wait for missing updates before fetching the difference
+	updateStateSaveInterval = time.Second
+	channelDifferenceLimit  = 100
+	botChannelDiffLimit     = 100000
+)
+
+// UpdateState is the position of the client in the update sequences: the common pts, qts,
+// seq and date, and the pts of each channel.
+type UpdateState struct {
+	Pts      int32           `json:"pts"`
+	Qts      int32           `json:"qts"`
+	Seq      int32           `json:"seq"`
+	Date     int32           `json:"date"`
+	Channels map[int64]int32 `json:"channels,omitempty"`
+}
+
+func (s *UpdateState) clone() *UpdateState {
+	state := *s
+	state.Channels = make(map[int64]int32, len(s.Channels))
+	for id, pts := range s.Channels {
+		state.Channels[id] = pts
+	}
+	return &state
+}
+
+// UpdateStateStore persists the update state, so updates are neither lost nor handled twice
+// across restarts.
+type UpdateStateStore interface {
+	LoadState() (*UpdateState, error) // nil if no state was saved
+	SaveState(state *UpdateState) error
+}
+
+// FileUpdateStateStore keeps the update state in a JSON file, optionally encrypted at rest.
+type FileUpdateStateStore struct {
+	path   string
+	cipher *session.Cipher
+}
+
+func NewFileUpdateStateStore(path string, encryption ...*StorageEncryption) (*FileUpdateStateStore, error) {
+	cipher, err := getVariadic(encryption, nil).getCipher()
+	if err != nil {
+		return nil, err
+	}
+	return &FileUpdateStateStore{path: path, cipher: cipher}, nil
+}
+
+func (s *FileUpdateStateStore) LoadState() (*UpdateState, error) {
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.Wrap(err, "reading update state")
+	}
+
+	data, _, err = decryptStored(data, s.cipher) // a stale file is rewritten by the next save
+	if err != nil {
+		return nil, errors.Wrap(err, "reading update state")
+	}
+
+	state := new(UpdateState)
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, errors.Wrap(err, "decoding update state")
+	}
+	return state, nil
+}
+
+func (s *FileUpdateStateStore) SaveState(state *UpdateState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return errors.Wrap(err, "encoding update state")
+	}
+	if s.cipher != nil {
+		if data, err = s.cipher.Encrypt(data); err != nil {
+			return errors.Wrap(err, "encrypting update state")
+		}
+	}
+
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return errors.Wrap(err, "writing update state")
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// ------------------ Update Manager ------------------
+
+type sequence int
+
+const (
+	seqNone sequence = iota
+	seqPts
+	seqChannelPts
+	seqQts
+)
+
+type sequencedUpdate struct {
+	update Update
+	kind   sequence
+	pts    int32 // pts or qts after the update
+	count  int32
+}
+
+// updateBox is a sequence of updates applied in order: the common one (pts and qts) or a channel.
+type updateBox struct {
+	pending  []sequencedUpdate
+	gapTimer *time.Timer
+	syncing  bool // fetching the difference, incoming updates wait
+}
+
+// updatesAPI is the part of the client the update manager requests differences with.
+type updatesAPI interface {
+	UpdatesGetState() (*UpdatesState, error)
+	UpdatesGetDifference(params *UpdatesGetDifferenceParams) (UpdatesDifference, error)
+	UpdatesGetChannelDifference(params *UpdatesGetChannelDifferenceParams) (UpdatesChannelDifference, error)
+	ChannelsGetFullChannel(channel InputChannel) (*MessagesChatFull, error)
+}
+
+// updateManager applies updates in the order of their sequences, buffering those arriving
+// ahead of a gap, and fetches the difference when a gap is not filled in time.
+type updateManager struct {
+	c        *Client
+	api      updatesAPI   // the client
+	dispatch func(Update) // hands an update to the dispatcher
+	store    UpdateStateStore
+	log      *utils.Logger
+
+	mu         sync.Mutex
+	state      *UpdateState
+	common     *updateBox
+	channels   map[int64]*updateBox
+	pendingSeq []Updates // containers arriving ahead of a seq gap
+	saveTimer  *time.Timer
+
+	catchUp    bool          // resume from the saved state on start
+	maxAge     time.Duration // skip missed updates older than this when catching up
+	started    bool
+	catchingUp bool // live updates wait until the missed ones are handled
+}
+
+// newUpdateManager creates the update manager; the saved state is only loaded when catching up,
+// otherwise the client starts at the current state of the server.
+func newUpdateManager(c *Client, store UpdateStateStore, catchUp bool, maxAge time.Duration) *updateManager {
+	m := &updateManager{
+		c:        c,
+		api:      c,
+		dispatch: c.dispatchUpdate,
+		store:    store,
+		log:      c.Log,
+		state:    &UpdateState{Channels: make(map[int64]int32)},
+		common:   &updateBox{},
+		channels: make(map[int64]*updateBox),
+		catchUp:  catchUp,
+		maxAge:   maxAge,
+	}
+
+	if store != nil && catchUp {
+		state, err := store.LoadState()
+		if err != nil {
+			m.log.Error("error loading update state: ", err)
+		} else if state != nil {
+			if state.Channels == nil {
+				state.Channels = make(map[int64]int32)
+			}
+			m.state = state
+		}
+	}
+	return m
+}
+
+// start is called once the client is authorized: it catches up on the updates missed since
+// the saved state, or starts at the current state of the server.
+func (m *updateManager) start(server *UpdatesState) {
+	if m == nil || server == nil {
+		return
+	}
+
+	m.mu.Lock()
+	if m.started {
+		m.mu.Unlock()
+		return
+	}
+	m.started = true
+
+	if !m.catchUp || m.state.Pts == 0 {
+		m.state = &UpdateState{Pts: server.Pts, Qts: server.Qts, Seq: server.Seq, Date: server.Date, Channels: make(map[int64]int32)}
+		m.markDirty()
+		m.mu.Unlock()
+		return
+	}
+	m.catchingUp = true
+	m.mu.Unlock()
+
+	go m.catchUpMissed()
+}
+
+// catchUpMissed handles the updates missed while offline: those of the common sequences and of
+// the channels with a known pts, then the live updates that arrived meanwhile.
+func (m *updateManager) catchUpMissed() {
+	m.log.Info("catching up on missed updates")
+	m.getDifference()
+
+	m.mu.Lock()
+	channels := make([]int64, 0, len(m.state.Channels))
+	for id := range m.state.Channels {
+		channels = append(channels, id)
+	}
+	m.mu.Unlock()
+
+	for _, id := range channels {
+		m.getChannelDifference(id, 0)
+	}
+
+	m.mu.Lock()
+	m.catchingUp = false
+	boxes := make(map[int64]*updateBox, len(m.channels))
+	for id, box := range m.channels {
+		boxes[id] = box
+	}
+	m.mu.Unlock()
+
+	m.log.Debug("caught up on missed updates")
+	m.finishSync(m.common, 0)
+	for id, box := range boxes {
+		m.finishSync(box, id)
+	}
+}
+
+// replay handles an update of a difference, unless it is older than the max age while catching up.
+func (m *updateManager) replay(update Update) {
+	if m.maxAge > 0 {
+		m.mu.Lock()
+		catchingUp := m.catchingUp
+		m.mu.Unlock()
+
+		if date := updateDate(update); catchingUp && date != 0 && time.Since(time.Unix(int64(date), 0)) > m.maxAge {
+			return
+		}
+	}
+	m.dispatch(update)
+}
+
+func updateDate(update Update) int32 {
+	var message Message
+	switch u := update.(type) {
+	case *UpdateNewMessage:
+		message = u.Message
+	case *UpdateNewChannelMessage:
+		message = u.Message
+	case *UpdateEditMessage:
+		message = u.Message
+	case *UpdateEditChannelMessage:
+		message = u.Message
+	}
+
+	switch msg := message.(type) {
+	case *MessageObj:
+		if msg.EditDate != 0 {
+			return msg.EditDate
+		}
+		return msg.Date
+	case *MessageService:
+		return msg.Date
+	}
+	return 0
+}
+
+// State returns a copy of the current update state.
+func (m *updateManager) State() *UpdateState {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.state.clone()
+}
+
+// markDirty schedules saving the state, the lock must be held.
+func (m *updateManager) markDirty() {
+	if m.store == nil || m.saveTimer != nil {
+		return
+	}
+	m.saveTimer = time.AfterFunc(updateStateSaveInterval, m.save)
+}
+
+// save persists the state now.
+func (m *updateManager) save() {
+	if m == nil || m.store == nil {
+		return
+	}
+
+	m.mu.Lock()
+	if m.saveTimer != nil {
+		m.saveTimer.Stop()
+		m.saveTimer = nil
+	}
+	state := m.state.clone()
+	m.mu.Unlock()
+
+	if err := m.store.SaveState(state); err != nil {
+		m.log.Error("error saving update state: ", err)
+	}
+}
+
+// sequenceOf returns the sequence an update belongs to, with its pts (or qts) and pts count.
+func sequenceOf(update Update) (kind sequence, pts, count int32, channelID int64) {
+	switch u := update.(type) {
+	case *UpdateNewChannelMessage:
+		return seqChannelPts, u.Pts, u.PtsCount, channelOfMessage(u.Message)
+	case *UpdateEditChannelMessage:
+		return seqChannelPts, u.Pts, u.PtsCount, channelOfMessage(u.Message)
+	case *UpdateDeleteChannelMessages:
+		return seqChannelPts, u.Pts, u.PtsCount, u.ChannelID
+	case *UpdatePinnedChannelMessages:
+		return seqChannelPts, u.Pts, u.PtsCount, u.ChannelID
+	case *UpdateChannelWebPage:
+		return seqChannelPts, u.Pts, u.PtsCount, u.ChannelID
+	case *UpdateNewMessage:
+		return seqPts, u.Pts, u.PtsCount, 0
+	case *UpdateEditMessage:
+		return seqPts, u.Pts, u.PtsCount, 0
+	case *UpdateDeleteMessages:
+		return seqPts, u.Pts, u.PtsCount, 0
+	case *UpdateReadHistoryInbox:
+		return seqPts, u.Pts, u.PtsCount, 0
+	case *UpdateReadHistoryOutbox:
+		return seqPts, u.Pts, u.PtsCount, 0
+	case *UpdateReadMessagesContents:
+		return seqPts, u.Pts, u.PtsCount, 0
+	case *UpdateWebPage:
+		return seqPts, u.Pts, u.PtsCount, 0
+	case *UpdatePinnedMessages:
+		return seqPts, u.Pts, u.PtsCount, 0
+	case *UpdateFolderPeers:
+		return seqPts, u.Pts, u.PtsCount, 0
+	case *UpdateNewEncryptedMessage:
+		return seqQts, u.Qts, 1, 0
+	case *UpdateBotStopped:
+		return seqQts, u.Qts, 1, 0
+	case *UpdateChatParticipant:
+		return seqQts, u.Qts, 1, 0
+	case *UpdateChannelParticipant:
+		return seqQts, u.Qts, 1, 0
+	case *UpdateBotChatInviteRequester:
+		return seqQts, u.Qts, 1, 0
+	case *UpdateBotChatBoost:
+		return seqQts, u.Qts, 1, 0
+	case *UpdateBotMessageReaction:
+		return seqQts, u.Qts, 1, 0
+	case *UpdateBotMessageReactions:
+		return seqQts, u.Qts, 1, 0
+	}
+	return seqNone, 0, 0, 0
+}
+
+func channelOfMessage(message Message) int64 {
+	if channel, ok := messagePeer(message).(*PeerChannel); ok {
+		return channel.ChannelID
+	}
+	return 0
+}
+
+func (m *updateManager) box(kind sequence, channelID int64) *updateBox {
+	if kind != seqChannelPts {
+		return m.common
+	}
+	box, ok := m.channels[channelID]
+	if !ok {
+		box = &updateBox{}
+		m.channels[channelID] = box
+	}
+	return box
+}
+
+// position returns the current pts (or qts) of a sequence, the lock must be held.
+func (m *updateManager) position(kind sequence, channelID int64) int32 {
+	switch kind {
+	case seqQts:
+		return m.state.Qts
+	case seqChannelPts:
+		return m.state.Channels[channelID]
+	}
+	return m.state.Pts
+}
+
+func (m *updateManager) setPosition(kind sequence, channelID int64, pts int32) {
+	switch kind {
+	case seqQts:
+		m.state.Qts = pts
+	case seqChannelPts:
+		m.state.Channels[channelID] = pts
+	default:
+		m.state.Pts = pts
+	}
+	m.markDirty()
+}
+
+// accept checks an update against its sequence, returning the updates to handle now, in
+// order: none if it is a duplicate or waits for a gap to be filled, more if it fills one.
+func (m *updateManager) accept(update Update) []Update {
+	if m == nil {
+		return []Update{update}
+	}
+	kind, pts, count, channelID := sequenceOf(update)
+	if kind == seqNone {
+		if tooLong, ok := update.(*UpdateChannelTooLong); ok {
+			go m.getChannelDifference(tooLong.ChannelID, tooLong.Pts)
+		}
+		return []Update{update}
+	}
+	if kind == seqChannelPts && channelID == 0 {
+		return []Update{update}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	box := m.box(kind, channelID)
+	u := sequencedUpdate{update: update, kind: kind, pts: pts, count: count}
+	if box.syncing || m.catchingUp {
+		box.pending = append(box.pending, u)
+		return nil
+	}
+
+	local := m.position(kind, channelID)
+	switch {
+	case local == 0: // position unknown yet, start from here
+		m.setPosition(kind, channelID, pts)
+		return []Update{update}
+	case local+count == pts:
+		m.setPosition(kind, channelID, pts)
+		return append([]Update{update}, m.flush(box, channelID)...)
+	case local+count > pts:
+		return nil // already handled
+	}
+
+	box.pending = append(box.pending, u)
+	if box.gapTimer == nil {
+		box.gapTimer = time.AfterFunc(updateGapTimeout, func() { m.resolveGap(kind, channelID) })
+	}
+	return nil
+}
+
+// flush applies the pending updates of a box that follow its position, dropping those
+// already handled; the lock must be held.
+func (m *updateManager) flush(box *updateBox, channelID int64) []Update {
+	sort.SliceStable(box.pending, func(i, j int) bool { return box.pending[i].pts < box.pending[j].pts })
+
+	var ready []Update
+	for progress := true; progress; {
+		progress = false
+		remaining := box.pending[:0]
+		for _, u := range box.pending {
+			local := m.position(u.kind, channelID)
+			switch {
+			case local+u.count == u.pts:
+				m.setPosition(u.kind, channelID, u.pts)
+				ready = append(ready, u.update)
+				progress = true
+			case local+u.count > u.pts:
+				progress = true // already handled
+			default:
+				remaining = append(remaining, u)
+			}
+		}
+		box.pending = remaining
+	}
+
+	if len(box.pending) == 0 && box.gapTimer != nil {
+		box.gapTimer.Stop()
+		box.gapTimer = nil
+	}
+	return ready
+}
+
+func (m *updateManager) resolveGap(kind sequence, channelID int64) {
+	m.mu.Lock()
+	box := m.box(kind, channelID)
+	box.gapTimer = nil
+	if m.catchingUp || len(box.pending) == 0 && (kind == seqChannelPts || len(m.pendingSeq) == 0) {
+		m.mu.Unlock()
+		return
+	}
+	m.mu.Unlock()
+
+	if kind == seqChannelPts {
+		m.log.Debug("gap in updates of channel ", channelID, ", fetching channel difference")
+		m.getChannelDifference(channelID, 0)
+	} else {
+		m.log.Debug("gap in updates, fetching difference")
+		m.getDifference()
+	}
+}
+
+// acceptSeq checks an update container against the seq sequence, reporting whether to handle
+// it now; containers ahead of a gap are kept until it is filled.
+func (m *updateManager) acceptSeq(container Updates, date, seqStart, seq int32) bool {
+	if m == nil {
+		return true
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if seqStart == 0 {
+		return true
+	}
+	if m.common.syncing || m.catchingUp {
+		m.pendingSeq = append(m.pendingSeq, container)
+		return false
+	}
+
+	switch {
+	case m.state.Seq == 0 || m.state.Seq+1 == seqStart:
+		m.state.Seq = seq
+		if date > m.state.Date {
+			m.state.Date = date
+		}
+		m.markDirty()
+		return true
+	case seqStart <= m.state.Seq:
+		return false // already handled
+	}
+
+	m.pendingSeq = append(m.pendingSeq, container)
+	if m.common.gapTimer == nil {
+		m.common.gapTimer = time.AfterFunc(updateGapTimeout, func() { m.resolveGap(seqPts, 0) })
+	}
+	return false
+}
+
+// nextSeq returns the pending containers that can now be handled (or are duplicates, which
+// acceptSeq drops again).
+func (m *updateManager) nextSeq() []Updates {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var next, remaining []Updates
+	for _, container := range m.pendingSeq {
+		if start, _ := seqRange(container); start <= m.state.Seq+1 {
+			next = append(next, container)
+		} else {
+			remaining = append(remaining, container)
+		}
+	}
+	m.pendingSeq = remaining
+	sort.SliceStable(next, func(i, j int) bool {
+		a, _ := seqRange(next[i])
+		b, _ := seqRange(next[j])
+		return a < b
+	})
+	return next
+}
+
+func seqRange(container Updates) (start, end int32) {
+	switch container := container.(type) {
+	case *UpdatesObj:
+		return container.Seq, container.Seq
+	case *UpdatesCombined:
+		return container.SeqStart, container.Seq
+	}
+	return 0, 0
+}
+
+// observe advances the state past the updates returned by a request (like the message sent by
+// messages.sendMessage), which are not pushed to this session; they are not handled.
+func (m *updateManager) observe(resp any) {
+	if m == nil {
+		return
+	}
+
+	var updates []Update
+	switch resp := resp.(type) {
+	case *UpdatesObj:
+		updates = resp.Updates
+		m.observeSeq(resp.Date, resp.Seq, resp.Seq)
+	case *UpdatesCombined:
+		updates = resp.Updates
+		m.observeSeq(resp.Date, resp.SeqStart, resp.Seq)
+	case *UpdateShort:
+		updates = []Update{resp.Update}
+	case *UpdateShortSentMessage:
+		updates = []Update{&UpdateNewMessage{Pts: resp.Pts, PtsCount: resp.PtsCount}}
+	default:
+		return
+	}
+
+	var ready []Update
+	m.mu.Lock()
+	for _, update := range updates {
+		kind, pts, count, channelID := sequenceOf(update)
+		if kind == seqNone || (kind == seqChannelPts && channelID == 0) {
+			continue
+		}
+		if local := m.position(kind, channelID); local != 0 && local+count == pts {
+			m.setPosition(kind, channelID, pts)
+			box := m.box(kind, channelID)
+			if !box.syncing && !m.catchingUp {
+				ready = append(ready, m.flush(box, channelID)...)
+			}
+		}
+	}
+	m.mu.Unlock()
+
+	for _, update := range ready {
+		m.dispatch(update)
+	}
+}
+
+func (m *updateManager) observeSeq(date, seqStart, seq int32) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if seqStart != 0 && m.state.Seq != 0 && m.state.Seq+1 == seqStart {
+		m.state.Seq = seq
+		if date > m.state.Date {
+			m.state.Date = date
+		}
+		m.markDirty()
+	}
+}
+
+// ------------------ Differences ------------------
+
+// getDifference fetches the updates of the common sequences missed since the current state.
+func (m *updateManager) getDifference() {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	if m.common.syncing {
+		m.mu.Unlock()
+		return
+	}
+	m.common.syncing = true
+	m.mu.Unlock()
+
+	defer m.finishSync(m.common, 0)
+
+	for {
+		m.mu.Lock()
+		state := m.state.clone()
+		m.mu.Unlock()
+
+		if state.Pts == 0 { // nothing to catch up from, start at the current state
+			current, err := m.api.UpdatesGetState()
+			if err != nil {
+				m.log.Error(errors.Wrap(err, "getting update state"))
+				return
+			}
+			m.setState(current)
+			return
+		}
+
+		diff, err := m.api.UpdatesGetDifference(&UpdatesGetDifferenceParams{
+			Pts:  state.Pts,
+			Date: state.Date,
+			Qts:  state.Qts,
+		})
+		if err != nil {
+			m.log.Error(errors.Wrap(err, "getting difference"))
+			m.mu.Lock()
+			m.skipGap(m.common, 0)
+			m.mu.Unlock()
+			return
+		}
+
+		switch d := diff.(type) {
+		case *UpdatesDifferenceEmpty:
+			m.mu.Lock()
+			m.state.Date, m.state.Seq = d.Date, d.Seq
+			m.markDirty()
+			m.mu.Unlock()
+			return
+		case *UpdatesDifferenceObj:
+			m.setState(d.State)
+			m.applyDifference(d.NewMessages, d.OtherUpdates, d.Users, d.Chats)
+			return
+		case *UpdatesDifferenceSlice:
+			m.setState(d.IntermediateState)
+			m.applyDifference(d.NewMessages, d.OtherUpdates, d.Users, d.Chats)
+		case *UpdatesDifferenceTooLong:
+			m.log.Warn("too many updates were missed, skipping to pts ", d.Pts)
+			m.mu.Lock()
+			m.state.Pts = d.Pts
+			m.markDirty()
+			m.mu.Unlock()
+		default:
+			return
+		}
+	}
+}
+
+func (m *updateManager) setState(state *UpdatesState) {
+	if state == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.state.Pts, m.state.Qts, m.state.Seq, m.state.Date = state.Pts, state.Qts, state.Seq, state.Date
+	m.markDirty()
+}
+
+// applyDifference handles the updates of a difference, the state must already be set to it.
+func (m *updateManager) applyDifference(messages []Message, others []Update, users []User, chats []Chat) {
+	m.c.Cache.UpdatePeersToCache(users, chats)
+
+	updates := make([]Update, 0, len(messages)+len(others))
+	for _, message := range messages {
+		updates = append(updates, &UpdateNewMessage{Message: message})
+	}
+	for _, update := range others {
+		if kind, _, _, _ := sequenceOf(update); kind == seqChannelPts {
+			updates = append(updates, m.accept(update)...)
+		} else {
+			if tooLong, ok := update.(*UpdateChannelTooLong); ok {
+				go m.getChannelDifference(tooLong.ChannelID, tooLong.Pts)
+			}
+			updates = append(updates, update)
+		}
+	}
+	m.c.Cache.trackMinPeers(updates, users, chats)
+	m.c.dispatcher.trackUpdates(m.c, updates, users, chats)
+
+	for _, update := range updates {
+		m.replay(update)
+	}
+}
+
+// getChannelDifference fetches the updates of a channel missed since its pts, or since pts
+// if its position is not known yet.
+func (m *updateManager) getChannelDifference(channelID int64, pts int32) {
+	accessHash, ok := m.channelAccessHash(channelID)
+	if !ok {
+		m.log.Debug("no access hash for channel ", channelID, ", cannot fetch its difference")
+		m.mu.Lock()
+		var ready []Update
+		if box := m.box(seqChannelPts, channelID); !m.catchingUp {
+			m.skipGap(box, channelID)
+			ready = m.flush(box, channelID)
+		}
+		m.mu.Unlock()
+
+		for _, update := range ready {
+			m.dispatch(update)
+		}
+		return
+	}
+
+	m.mu.Lock()
+	box := m.box(seqChannelPts, channelID)
+	if box.syncing {
+		m.mu.Unlock()
+		return
+	}
+	box.syncing = true
+	if m.state.Channels[channelID] == 0 && pts != 0 {
+		m.state.Channels[channelID] = pts
+	}
+	m.mu.Unlock()
+
+	defer m.finishSync(box, channelID)
+
+	limit := int32(channelDifferenceLimit)
+	if m.c.clientData.botAcc {
+		limit = botChannelDiffLimit
+	}
+
+	for {
+		m.mu.Lock()
+		local := m.state.Channels[channelID]
+		m.mu.Unlock()
+		if local == 0 {
+			return
+		}
+
+		diff, err := m.api.UpdatesGetChannelDifference(&UpdatesGetChannelDifferenceParams{
+			Channel: &InputChannelObj{ChannelID: channelID, AccessHash: accessHash},
+			Filter:  &ChannelMessagesFilterEmpty{},
+			Pts:     local,
+			Limit:   limit,
+		})
+		if err != nil {
+			m.log.Error(errors.Wrap(err, "getting channel difference"))
+			m.mu.Lock()
+			m.skipGap(box, channelID)
+			m.mu.Unlock()
+			return
+		}
+
+		switch d := diff.(type) {
+		case *UpdatesChannelDifferenceEmpty:
+			m.setChannelPts(channelID, d.Pts)
+			return
+		case *UpdatesChannelDifferenceObj:
+			m.setChannelPts(channelID, d.Pts)
+			m.c.Cache.UpdatePeersToCache(d.Users, d.Chats)
+
+			updates := make([]Update, 0, len(d.NewMessages)+len(d.OtherUpdates))
+			for _, message := range d.NewMessages {
+				updates = append(updates, &UpdateNewChannelMessage{Message: message})
+			}
+			updates = append(updates, d.OtherUpdates...)
+			m.c.Cache.trackMinPeers(updates, d.Users, d.Chats)
+			m.c.dispatcher.trackUpdates(m.c, updates, d.Users, d.Chats)
+			for _, update := range updates {
+				m.replay(update)
+			}
+			if d.Final {
+				return
+			}
+		case *UpdatesChannelDifferenceTooLong:
+			m.c.Cache.UpdatePeersToCache(d.Users, d.Chats)
+			if dialog, ok := d.Dialog.(*DialogObj); ok && dialog.Pts != 0 {
+				m.log.Warn("too many updates were missed in channel ", channelID, ", skipping to pts ", dialog.Pts)
+				m.setChannelPts(channelID, dialog.Pts)
+			}
+			return
+		default:
+			return
+		}
+	}
+}
+
+func (m *updateManager) channelAccessHash(channelID int64) (int64, bool) {
+	if accessHash, ok := m.c.Cache.store.GetInputChannel(channelID); ok {
+		return accessHash, true
+	}
+	return m.c.dispatcher.openChatHash(channelID)
+}
+
+// pollChannel fetches the difference of a channel, starting from its current pts if its
+// position is not known yet.
+func (m *updateManager) pollChannel(channelID int64) {
+	if m == nil {
+		return
+	}
+
+	m.mu.Lock()
+	known := m.state.Channels[channelID] != 0
+	m.mu.Unlock()
+	if known {
+		m.getChannelDifference(channelID, 0)
+		return
+	}
+
+	accessHash, ok := m.channelAccessHash(channelID)
+	if !ok {
+		return
+	}
+	// not GetFullChat, which may serve an outdated pts from the cache
+	full, err := m.api.ChannelsGetFullChannel(&InputChannelObj{ChannelID: channelID, AccessHash: accessHash})
+	if err != nil {
+		m.log.Debug("error getting pts of channel ", channelID, ": ", err)
+		return
+	}
+	m.c.Cache.UpdatePeersToCache(full.Users, full.Chats)
+	if channel, ok := full.FullChat.(*ChannelFull); ok && channel.Pts != 0 {
+		m.setChannelPts(channelID, channel.Pts)
+	}
+}
+
+func (m *updateManager) setChannelPts(channelID int64, pts int32) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.state.Channels[channelID] = pts
+	m.markDirty()
+}
+
+// skipGap gives up on the missing updates of a box when its difference can't be fetched, moving
+// its position up to the first pending update so the rest is handled; the lock must be held.
+func (m *updateManager) skipGap(box *updateBox, channelID int64) {
+	for _, u := range box.pending {
+		if start := u.pts - u.count; start > m.position(u.kind, channelID) {
+			if next := m.nextPending(box, u.kind); next == u.pts {
+				m.setPosition(u.kind, channelID, start)
+			}
+		}
+	}
+	if box != m.common || len(m.pendingSeq) == 0 {
+		return
+	}
+	first, _ := seqRange(m.pendingSeq[0])
+	for _, container := range m.pendingSeq[1:] {
+		if start, _ := seqRange(container); start < first {
+			first = start
+		}
+	}
+	if first-1 > m.state.Seq {
+		m.state.Seq = first - 1
+	}
+}
+
+// nextPending returns the lowest pts of the pending updates of a kind.
+func (m *updateManager) nextPending(box *updateBox, kind sequence) int32 {
+	var next int32
+	for _, u := range box.pending {
+		if u.kind == kind && (next == 0 || u.pts < next) {
+			next = u.pts
+		}
+	}
+	return next
+}
+
+// finishSync handles the updates that arrived while fetching a difference.
+func (m *updateManager) finishSync(box *updateBox, channelID int64) {
+	m.mu.Lock()
+	box.syncing = false
+	if m.catchingUp { // handled once caught up
+		m.mu.Unlock()
+		return
+	}
+	ready := m.flush(box, channelID)
+	if len(box.pending) > 0 && box.gapTimer == nil { // still a gap, try again later
+		kind := seqPts
+		if box != m.common {
+			kind = seqChannelPts
+		}
+		box.gapTimer = time.AfterFunc(updateGapTimeout, func() { m.resolveGap(kind, channelID) })
+	}
+	m.mu.Unlock()
+
+	for _, update := range ready {
+		m.dispatch(update)
+	}
+	if box == m.common {
+		for _, container := range m.nextSeq() {
+			HandleIncomingUpdates(container, m.c)
+		}
+	}
+}
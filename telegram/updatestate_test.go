@@ -0,0 +1,414 @@
+// Copyright (c) 2024 RoseLoverX
+
+package telegram
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/amarnathcjd/gogram/internal/utils"
+)
+
+// fakeUpdatesAPI answers difference requests with queued responses, the last one repeating.
+type fakeUpdatesAPI struct {
+	mu          sync.Mutex
+	differences []any // UpdatesDifference or error
+	requests    []*UpdatesGetDifferenceParams
+}
+
+func (f *fakeUpdatesAPI) UpdatesGetState() (*UpdatesState, error) {
+	return &UpdatesState{Pts: 1, Date: 1}, nil
+}
+
+func (f *fakeUpdatesAPI) UpdatesGetDifference(params *UpdatesGetDifferenceParams) (UpdatesDifference, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests = append(f.requests, params)
+	if len(f.differences) == 0 {
+		return &UpdatesDifferenceEmpty{}, nil
+	}
+	next := f.differences[0]
+	if len(f.differences) > 1 {
+		f.differences = f.differences[1:]
+	}
+	if err, ok := next.(error); ok {
+		return nil, err
+	}
+	return next.(UpdatesDifference), nil
+}
+
+func (f *fakeUpdatesAPI) UpdatesGetChannelDifference(*UpdatesGetChannelDifferenceParams) (UpdatesChannelDifference, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (f *fakeUpdatesAPI) ChannelsGetFullChannel(InputChannel) (*MessagesChatFull, error) {
+	return nil, errors.New("not implemented")
+}
+
+// testManager is an update manager over a fake client, recording the updates it dispatches.
+type testManager struct {
+	*updateManager
+	api *fakeUpdatesAPI
+
+	dispatchedMu sync.Mutex
+	dispatched   []Update
+}
+
+func newTestManager(t *testing.T, state *UpdateState) *testManager {
+	t.Helper()
+	c := &Client{
+		Log:   utils.NewLogger("test").SetLevel(utils.NoLevel),
+		Cache: NewCache("", &CacheConfig{Memory: true, LogLevel: utils.NoLevel}),
+	}
+	c.NewUpdateDispatcher()
+
+	tm := &testManager{updateManager: newUpdateManager(c, nil, false, 0), api: &fakeUpdatesAPI{}}
+	tm.updateManager.api = tm.api
+	tm.updateManager.dispatch = func(update Update) {
+		tm.dispatchedMu.Lock()
+		defer tm.dispatchedMu.Unlock()
+		tm.dispatched = append(tm.dispatched, update)
+	}
+	if state.Channels == nil {
+		state.Channels = make(map[int64]int32)
+	}
+	tm.state = state
+	t.Cleanup(tm.stopTimers)
+	return tm
+}
+
+func (tm *testManager) stopTimers() {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	for _, box := range append([]*updateBox{tm.common}, boxesOf(tm.channels)...) {
+		if box.gapTimer != nil {
+			box.gapTimer.Stop()
+			box.gapTimer = nil
+		}
+	}
+}
+
+func boxesOf(channels map[int64]*updateBox) []*updateBox {
+	boxes := make([]*updateBox, 0, len(channels))
+	for _, box := range channels {
+		boxes = append(boxes, box)
+	}
+	return boxes
+}
+
+// waitDispatched waits until n updates were dispatched, returning them.
+func (tm *testManager) waitDispatched(t *testing.T, n int) []Update {
+	t.Helper()
+	deadline := time.Now().Add(5 * updateGapTimeout)
+	for {
+		tm.dispatchedMu.Lock()
+		dispatched := append([]Update(nil), tm.dispatched...)
+		tm.dispatchedMu.Unlock()
+		if len(dispatched) >= n || time.Now().After(deadline) {
+			return dispatched
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func ptsUpdate(pts, count int32) Update {
+	return &UpdateDeleteMessages{Pts: pts, PtsCount: count}
+}
+
+func channelUpdate(channelID int64, pts, count int32) Update {
+	return &UpdateDeleteChannelMessages{ChannelID: channelID, Pts: pts, PtsCount: count}
+}
+
+func qtsUpdate(qts int32) Update {
+	return &UpdateBotStopped{Qts: qts}
+}
+
+// positions returns the pts (or qts) of updates, or the ids of new messages without one.
+func positions(updates []Update) []int32 {
+	var out []int32
+	for _, update := range updates {
+		if _, pts, _, _ := sequenceOf(update); pts != 0 {
+			out = append(out, pts)
+		} else if msg, ok := update.(*UpdateNewMessage); ok {
+			out = append(out, msg.Message.(*MessageObj).ID)
+		}
+	}
+	return out
+}
+
+func TestUpdateAccept(t *testing.T) {
+	tests := []struct {
+		name    string
+		state   UpdateState
+		updates []Update
+		handled []int32
+		pending int
+		want    UpdateState
+	}{
+		{
+			name:    "in order",
+			state:   UpdateState{Pts: 10},
+			updates: []Update{ptsUpdate(11, 1), ptsUpdate(12, 1), ptsUpdate(14, 2)},
+			handled: []int32{11, 12, 14},
+			want:    UpdateState{Pts: 14},
+		},
+		{
+			name:    "duplicate",
+			state:   UpdateState{Pts: 10},
+			updates: []Update{ptsUpdate(11, 1), ptsUpdate(11, 1), ptsUpdate(10, 1)},
+			handled: []int32{11},
+			want:    UpdateState{Pts: 11},
+		},
+		{
+			name:    "gap filled",
+			state:   UpdateState{Pts: 10},
+			updates: []Update{ptsUpdate(13, 1), ptsUpdate(12, 1), ptsUpdate(11, 1)},
+			handled: []int32{11, 12, 13},
+			want:    UpdateState{Pts: 13},
+		},
+		{
+			name:    "gap open",
+			state:   UpdateState{Pts: 10},
+			updates: []Update{ptsUpdate(11, 1), ptsUpdate(13, 1)},
+			handled: []int32{11},
+			pending: 1,
+			want:    UpdateState{Pts: 11},
+		},
+		{
+			name:    "duplicate while pending",
+			state:   UpdateState{Pts: 10},
+			updates: []Update{ptsUpdate(12, 1), ptsUpdate(12, 1), ptsUpdate(11, 1)},
+			handled: []int32{11, 12},
+			want:    UpdateState{Pts: 12},
+		},
+		{
+			name:    "unknown position",
+			updates: []Update{ptsUpdate(50, 1), ptsUpdate(51, 1)},
+			handled: []int32{50, 51},
+			want:    UpdateState{Pts: 51},
+		},
+		{
+			name:    "qts",
+			state:   UpdateState{Pts: 10, Qts: 7},
+			updates: []Update{qtsUpdate(9), qtsUpdate(8), qtsUpdate(8)},
+			handled: []int32{8, 9},
+			want:    UpdateState{Pts: 10, Qts: 9},
+		},
+		{
+			name:    "channels apart",
+			state:   UpdateState{Pts: 10, Channels: map[int64]int32{5: 100}},
+			updates: []Update{channelUpdate(5, 101, 1), ptsUpdate(12, 1), channelUpdate(5, 103, 1), channelUpdate(5, 102, 1), channelUpdate(6, 7, 1)},
+			handled: []int32{101, 102, 103, 7},
+			pending: 1,
+			want:    UpdateState{Pts: 10, Channels: map[int64]int32{5: 103, 6: 7}},
+		},
+		{
+			name:    "not sequenced",
+			state:   UpdateState{Pts: 10},
+			updates: []Update{&UpdateUserTyping{}, &UpdateNewChannelMessage{Message: &MessageEmpty{}, Pts: 3, PtsCount: 1}},
+			handled: []int32{3}, // a channel message without a channel can't be sequenced
+			want:    UpdateState{Pts: 10},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newTestManager(t, &tt.state)
+
+			var handled []Update
+			for _, update := range tt.updates {
+				handled = append(handled, m.accept(update)...)
+			}
+			if got := positions(handled); !reflect.DeepEqual(got, tt.handled) {
+				t.Errorf("handled %v, want %v", got, tt.handled)
+			}
+
+			pending := len(m.common.pending)
+			for _, box := range m.channels {
+				pending += len(box.pending)
+			}
+			if pending != tt.pending {
+				t.Errorf("%d pending, want %d", pending, tt.pending)
+			}
+			if tt.pending == 0 && m.common.gapTimer != nil {
+				t.Error("gap timer left running")
+			}
+
+			if tt.want.Channels == nil {
+				tt.want.Channels = map[int64]int32{}
+			}
+			if got := m.State(); !reflect.DeepEqual(*got, tt.want) {
+				t.Errorf("state %+v, want %+v", *got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUpdateGapTimeout(t *testing.T) {
+	tests := []struct {
+		name        string
+		differences []any
+		dispatched  []int32
+		want        int32 // pts
+	}{
+		{
+			name: "difference",
+			differences: []any{&UpdatesDifferenceObj{
+				NewMessages: []Message{&MessageObj{ID: 1}},
+				State:       &UpdatesState{Pts: 12, Date: 1},
+			}},
+			dispatched: []int32{1},
+			want:       12,
+		},
+		{
+			name: "slice",
+			differences: []any{
+				&UpdatesDifferenceSlice{NewMessages: []Message{&MessageObj{ID: 1}}, IntermediateState: &UpdatesState{Pts: 11, Date: 1}},
+				&UpdatesDifferenceObj{NewMessages: []Message{&MessageObj{ID: 2}}, State: &UpdatesState{Pts: 12, Date: 2}},
+			},
+			dispatched: []int32{1, 2},
+			want:       12,
+		},
+		{
+			name:        "too long",
+			differences: []any{&UpdatesDifferenceTooLong{Pts: 50}, &UpdatesDifferenceEmpty{Date: 3}},
+			dispatched:  nil,
+			want:        50,
+		},
+		{
+			name:        "empty",
+			differences: []any{&UpdatesDifferenceEmpty{Date: 3}},
+			dispatched:  nil, // the pending update waits for the next try
+			want:        10,
+		},
+		{
+			name:        "error skips the gap",
+			differences: []any{errors.New("INTERNAL_SERVER_ERROR")},
+			dispatched:  []int32{12},
+			want:        12,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newTestManager(t, &UpdateState{Pts: 10})
+			m.api.differences = tt.differences
+
+			if handled := m.accept(ptsUpdate(12, 1)); len(handled) != 0 {
+				t.Fatalf("handled %v ahead of the gap", positions(handled))
+			}
+
+			dispatched := positions(m.waitDispatched(t, len(tt.dispatched)))
+			if len(tt.dispatched) == 0 {
+				time.Sleep(2 * updateGapTimeout)
+				dispatched = positions(m.waitDispatched(t, 0))
+			}
+			if !reflect.DeepEqual(dispatched, tt.dispatched) {
+				t.Errorf("dispatched %v, want %v", dispatched, tt.dispatched)
+			}
+
+			m.api.mu.Lock()
+			if len(m.api.requests) == 0 || m.api.requests[0].Pts != 10 {
+				t.Errorf("difference requested from %v, want pts 10", m.api.requests)
+			}
+			m.api.mu.Unlock()
+
+			if got := m.State().Pts; got != tt.want {
+				t.Errorf("pts %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUpdateSkipGap(t *testing.T) {
+	m := newTestManager(t, &UpdateState{Pts: 10, Seq: 3})
+	m.accept(ptsUpdate(13, 1))
+	m.accept(ptsUpdate(15, 2))
+	m.acceptSeq(&UpdatesObj{Seq: 6}, 0, 6, 6)
+
+	m.mu.Lock()
+	m.skipGap(m.common, 0)
+	ready := m.flush(m.common, 0)
+	seq := m.state.Seq
+	m.mu.Unlock()
+
+	if got := positions(ready); !reflect.DeepEqual(got, []int32{13, 15}) {
+		t.Errorf("handled %v, want [13 15]", got)
+	}
+	if seq != 5 {
+		t.Errorf("seq %d, want 5", seq)
+	}
+	if next := m.nextSeq(); len(next) != 1 {
+		t.Errorf("%d containers ready, want 1", len(next))
+	}
+}
+
+func TestUpdateAcceptSeq(t *testing.T) {
+	tests := []struct {
+		name       string
+		containers []Updates
+		accepted   []bool
+		seq        int32
+		next       []int32 // seq start of the containers nextSeq returns
+	}{
+		{
+			name:       "in order",
+			containers: []Updates{&UpdatesObj{Seq: 6}, &UpdatesObj{Seq: 7}},
+			accepted:   []bool{true, true},
+			seq:        7,
+		},
+		{
+			name:       "duplicate",
+			containers: []Updates{&UpdatesObj{Seq: 5}, &UpdatesObj{Seq: 4}},
+			accepted:   []bool{false, false},
+			seq:        5,
+		},
+		{
+			name:       "no seq",
+			containers: []Updates{&UpdatesObj{}},
+			accepted:   []bool{true},
+			seq:        5,
+		},
+		{
+			name:       "combined",
+			containers: []Updates{&UpdatesCombined{SeqStart: 6, Seq: 8}, &UpdatesObj{Seq: 9}},
+			accepted:   []bool{true, true},
+			seq:        9,
+		},
+		{
+			name:       "gap filled",
+			containers: []Updates{&UpdatesObj{Seq: 8}, &UpdatesObj{Seq: 7}, &UpdatesObj{Seq: 6}},
+			accepted:   []bool{false, false, true},
+			seq:        6,
+			next:       []int32{7},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newTestManager(t, &UpdateState{Pts: 10, Seq: 5})
+
+			for i, container := range tt.containers {
+				start, seq := seqRange(container)
+				if got := m.acceptSeq(container, 0, start, seq); got != tt.accepted[i] {
+					t.Errorf("container %d accepted = %v, want %v", i, got, tt.accepted[i])
+				}
+			}
+			if got := m.State().Seq; got != tt.seq {
+				t.Errorf("seq %d, want %d", got, tt.seq)
+			}
+
+			var next []int32
+			for _, container := range m.nextSeq() {
+				start, _ := seqRange(container)
+				next = append(next, start)
+			}
+			if !reflect.DeepEqual(next, tt.next) {
+				t.Errorf("next %v, want %v", next, tt.next)
+			}
+		})
+	}
+}
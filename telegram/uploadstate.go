@@ -0,0 +1,373 @@
+// Copyright (c) 2024 RoseLoverX
+
+package telegram
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/amarnathcjd/gogram/internal/utils"
+	"github.com/pkg/errors"
+)
+
+// UploadStateTTL is how long uploaded parts are trusted to be kept by telegram;
+// a saved state older than this is discarded and the upload starts over.
+const UploadStateTTL = 24 * time.Hour
+
+// how many FILE_PART_X_MISSING errors are repaired before giving up on a request
+const maxMissingPartRetries = 5
+
+const (
+	uploadStateSaveParts    = 64          // the state is saved after this many new parts
+	uploadStateSaveInterval = time.Second // or when it was last saved this long ago
+)
+
+// UploadState is the persisted progress of a resumable upload.
+type UploadState struct {
+	Fingerprint string  `json:"fingerprint"`
+	FileID      int64   `json:"file_id"`
+	Size        int64   `json:"size"`
+	PartSize    int     `json:"part_size"`
+	TotalParts  int64   `json:"total_parts"`
+	Big         bool    `json:"big"`
+	Parts       []int32 `json:"parts"`   // parts acknowledged by the server
+	Updated     int64   `json:"updated"` // unix time of the last uploaded part
+
+	mu    sync.Mutex
+	parts map[int32]bool
+}
+
+func (s *UploadState) HasPart(part int32) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.parts[part]
+}
+
+func (s *UploadState) AddPart(part int32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.parts == nil {
+		s.parts = make(map[int32]bool)
+	}
+	if !s.parts[part] {
+		s.parts[part] = true
+		s.Parts = append(s.Parts, part)
+	}
+	s.Updated = time.Now().Unix()
+}
+
+// MarshalJSON encodes the state under its lock, so it can be saved while parts are being added.
+func (s *UploadState) MarshalJSON() ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	type state UploadState
+	parts := append([]int32(nil), s.Parts...)
+	sort.Slice(parts, func(i, j int) bool { return parts[i] < parts[j] })
+
+	return json.Marshal(&struct {
+		*state
+		Parts []int32 `json:"parts"`
+	}{(*state)(s), parts})
+}
+
+func (s *UploadState) expired() bool {
+	return time.Since(time.Unix(s.Updated, 0)) > UploadStateTTL
+}
+
+func (s *UploadState) index() {
+	s.parts = make(map[int32]bool, len(s.Parts))
+	for _, p := range s.Parts {
+		s.parts[p] = true
+	}
+}
+
+// UploadStateStore persists upload progress, so that an interrupted upload
+// of the same source can continue with only the missing parts.
+type UploadStateStore interface {
+	Load(fingerprint string) (*UploadState, error) // returns nil, nil if there is no saved state
+	Save(state *UploadState) error
+	Delete(fingerprint string) error
+}
+
+type fileUploadStateStore struct {
+	sync.Mutex
+	path string
+}
+
+// NewUploadStateFile returns an UploadStateStore backed by a single json file,
+// holding the state of every unfinished upload.
+func NewUploadStateFile(path string) UploadStateStore {
+	return &fileUploadStateStore{path: path}
+}
+
+func (f *fileUploadStateStore) read() (map[string]*UploadState, error) {
+	states := make(map[string]*UploadState)
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return states, nil
+		}
+		return nil, err
+	}
+
+	if len(data) == 0 {
+		return states, nil
+	}
+	if err := json.Unmarshal(data, &states); err != nil {
+		return nil, errors.Wrap(err, "parsing upload state file")
+	}
+	return states, nil
+}
+
+func (f *fileUploadStateStore) write(states map[string]*UploadState) error {
+	for fp, state := range states {
+		if state.expired() {
+			delete(states, fp)
+		}
+	}
+
+	data, err := json.Marshal(states)
+	if err != nil {
+		return err
+	}
+
+	tmp := f.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, f.path)
+}
+
+func (f *fileUploadStateStore) Load(fingerprint string) (*UploadState, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	states, err := f.read()
+	if err != nil {
+		return nil, err
+	}
+	return states[fingerprint], nil
+}
+
+func (f *fileUploadStateStore) Save(state *UploadState) error {
+	f.Lock()
+	defer f.Unlock()
+
+	states, err := f.read()
+	if err != nil {
+		return err
+	}
+	states[state.Fingerprint] = state
+	return f.write(states)
+}
+
+func (f *fileUploadStateStore) Delete(fingerprint string) error {
+	f.Lock()
+	defer f.Unlock()
+
+	states, err := f.read()
+	if err != nil {
+		return err
+	}
+	if _, ok := states[fingerprint]; !ok {
+		return nil
+	}
+	delete(states, fingerprint)
+	return f.write(states)
+}
+
+// uploadStateSaver saves the state of an upload in batches rather than on every part, as a
+// file store rewrites every unfinished upload each time; flush saves what is left.
+type uploadStateSaver struct {
+	store UploadStateStore
+	state *UploadState
+	log   *utils.Logger
+
+	mu      sync.Mutex
+	unsaved int
+	saved   time.Time
+}
+
+func newUploadStateSaver(store UploadStateStore, state *UploadState, log *utils.Logger) *uploadStateSaver {
+	return &uploadStateSaver{store: store, state: state, log: log, saved: time.Now()}
+}
+
+// partAdded records an uploaded part, saving the state if enough parts or time went by.
+func (s *uploadStateSaver) partAdded() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.unsaved++
+	if s.unsaved >= uploadStateSaveParts || time.Since(s.saved) >= uploadStateSaveInterval {
+		s.save()
+	}
+}
+
+func (s *uploadStateSaver) flush() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.unsaved > 0 {
+		s.save()
+	}
+}
+
+// save writes the state, the lock must be held.
+func (s *uploadStateSaver) save() {
+	if err := s.store.Save(s.state); err != nil {
+		s.log.Debug(errors.Wrap(err, "saving upload state"))
+	}
+	s.unsaved = 0
+	s.saved = time.Now()
+}
+
+// fingerprint identifies a source across restarts, files by path, size and
+// modification time; in-memory sources by their content hash.
+func (s *Source) fingerprint(size int64) string {
+	switch src := s.Source.(type) {
+	case string:
+		stat, err := os.Stat(src)
+		if err != nil {
+			return ""
+		}
+		abs, _ := filepath.Abs(src)
+		return fmt.Sprintf("file:%s:%d:%d", abs, size, stat.ModTime().UnixNano())
+	case *os.File:
+		stat, err := src.Stat()
+		if err != nil {
+			return ""
+		}
+		abs, _ := filepath.Abs(src.Name())
+		return fmt.Sprintf("file:%s:%d:%d", abs, size, stat.ModTime().UnixNano())
+	case []byte:
+		return fmt.Sprintf("bytes:%x:%d", sha256.Sum256(src), size)
+	}
+	return ""
+}
+
+// loadUploadState returns the saved state of a previous upload of the same source,
+// or a fresh state if there is none or it can no longer be resumed.
+func (c *Client) loadUploadState(store UploadStateStore, source *Source, size int64, partSize int, totalParts int64, big bool) *UploadState {
+	fresh := &UploadState{
+		Fingerprint: source.fingerprint(size),
+		FileID:      GenerateRandomLong(),
+		Size:        size,
+		PartSize:    partSize,
+		TotalParts:  totalParts,
+		Big:         big,
+		Updated:     time.Now().Unix(),
+		parts:       make(map[int32]bool),
+	}
+
+	if fresh.Fingerprint == "" {
+		return fresh
+	}
+
+	state, err := store.Load(fresh.Fingerprint)
+	if err != nil {
+		c.Log.Debug(errors.Wrap(err, "loading upload state"))
+		return fresh
+	}
+
+	if state == nil || state.expired() || state.Size != size || state.PartSize != partSize || state.Big != big {
+		return fresh
+	}
+
+	state.index()
+	c.Log.Info(fmt.Sprintf("file - upload: resuming with %d/%d parts already uploaded", len(state.Parts), totalParts))
+	return state
+}
+
+type trackedUpload struct {
+	source *Source
+	state  *UploadState
+}
+
+// trackUpload remembers the source of a finished resumable upload, so parts
+// reported missing when the file is used can be sent again.
+func (c *Client) trackUpload(fileId int64, source *Source, state *UploadState) {
+	c.uploads.Range(func(key, value any) bool {
+		if value.(*trackedUpload).state.expired() {
+			c.uploads.Delete(key)
+		}
+		return true
+	})
+	c.uploads.Store(fileId, &trackedUpload{source: source, state: state})
+}
+
+func uploadedFileID(media InputMedia) (int64, bool) {
+	var file InputFile
+	switch m := media.(type) {
+	case *InputMediaUploadedPhoto:
+		file = m.File
+	case *InputMediaUploadedDocument:
+		file = m.File
+	}
+
+	switch f := file.(type) {
+	case *InputFileObj:
+		return f.ID, true
+	case *InputFileBig:
+		return f.ID, true
+	}
+	return 0, false
+}
+
+// resendMissingPart re-uploads the part named in a FILE_PART_X_MISSING error,
+// returning true if the failed request can be retried.
+func (c *Client) resendMissingPart(media InputMedia, err error) bool {
+	part := GetMissingFilePart(err)
+	if part < 0 {
+		return false
+	}
+
+	fileId, ok := uploadedFileID(media)
+	if !ok {
+		return false
+	}
+
+	tracked, ok := c.uploads.Load(fileId)
+	if !ok {
+		return false
+	}
+	upload := tracked.(*trackedUpload)
+
+	data, err := upload.source.ReadPart(int64(part)*int64(upload.state.PartSize), upload.state.PartSize)
+	if err != nil {
+		c.Log.Debug(errors.Wrap(err, "reading missing part"))
+		return false
+	}
+
+	c.Log.Debug(fmt.Sprintf("file - upload: re-sending missing part %d", part))
+	if err := c.saveFilePart(int32(c.GetDC()), fileId, int32(part), int32(upload.state.TotalParts), upload.state.Big, data, nil, nil); err != nil {
+		c.Log.Debug(errors.Wrap(err, "re-sending missing part"))
+		return false
+	}
+	return true
+}
+
+// resendMissingParts is resendMissingPart for requests carrying several media, as the
+// error does not tell which file the part is missing from.
+func (c *Client) resendMissingParts(err error, media ...InputMedia) bool {
+	resent := false
+	for _, m := range media {
+		if c.resendMissingPart(m, err) {
+			resent = true
+		}
+	}
+	return resent
+}
+
+// forgetUpload drops a tracked upload once the file has been used successfully.
+func (c *Client) forgetUpload(media ...InputMedia) {
+	for _, m := range media {
+		if fileId, ok := uploadedFileID(m); ok {
+			c.uploads.Delete(fileId)
+		}
+	}
+}
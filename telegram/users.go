@@ -18,6 +18,7 @@ func (c *Client) GetMe() (*UserObj, error) {
 		return nil, errors.New("got wrong response: " + reflect.TypeOf(resp).String())
 	}
 	c.clientData.me = user
+	c.MTProto.SetUser(user.ID, user.Bot)
 
 	return user, nil
 }
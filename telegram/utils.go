@@ -180,6 +180,22 @@ func GetFloodWait(err error) int {
 	return 0
 }
 
+var regexFilePartMissing = regexp.MustCompile(`FILE_PART_(\d+)_MISSING`)
+
+// GetMissingFilePart returns the part number from a FILE_PART_X_MISSING error, or -1
+func GetMissingFilePart(err error) int {
+	if err == nil {
+		return -1
+	}
+
+	if matches := regexFilePartMissing.FindStringSubmatch(err.Error()); len(matches) == 2 {
+		part, _ := strconv.Atoi(matches[1])
+		return part
+	}
+
+	return -1
+}
+
 func MatchError(err error, str string) bool {
 	if err != nil {
 		return strings.Contains(err.Error(), str)